@@ -0,0 +1,400 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// AggregateOp is a function computed over the rows of a group.
+type AggregateOp string
+
+const (
+	AggregateCount         AggregateOp = "count"          // Rows, or rows in which Field is present and not null
+	AggregateCountDistinct AggregateOp = "count_distinct" // Distinct values of Field, nulls left out
+	AggregateSum           AggregateOp = "sum"            // Sum of Field: an int64 while every value is an integer, else a float64
+	AggregateAvg           AggregateOp = "avg"            // Mean of Field as a float64
+	AggregateMin           AggregateOp = "min"            // Least value of Field in key order
+	AggregateMax           AggregateOp = "max"            // Greatest value of Field in key order
+)
+
+// Aggregate is a column computed over the rows of each group. Nulls and missing
+// fields are left out of every function but the count of rows; a function over
+// no values other than a count is null.
+type Aggregate struct {
+	Op    AggregateOp `json:"op"`
+	Field string      `json:"field,omitempty"` // Field aggregated; empty for the count of rows
+	As    string      `json:"as,omitempty"`    // Name of the result column; op_field by default, or count for the count of rows
+}
+
+// name returns the name of the result column of the aggregate.
+func (a Aggregate) name() string {
+	switch {
+	case a.As != "":
+		return a.As
+	case a.Field == "":
+		return string(a.Op)
+	}
+	return string(a.Op) + "_" + a.Field
+}
+
+// Aggregation groups the rows of a collection and computes aggregates over
+// every group:
+//
+//	rows, err := coll.Aggregate(fsdb.Aggregation{
+//		Filter:     fsdb.Gte("created", since),
+//		GroupBy:    []string{"customer"},
+//		Aggregates: []fsdb.Aggregate{{Op: fsdb.AggregateCount}, {Op: fsdb.AggregateSum, Field: "total"}},
+//		Having:     fsdb.Gt("sum_total", 1000),
+//	})
+//
+// Each result row holds the group fields and a column per aggregate. Rows that
+// are null or miss a group field form the group of null.
+type Aggregation struct {
+	Filter     Query    // Rows aggregated; every row when zero
+	GroupBy    []string // Fields rows are grouped by; without any, one group of every row
+	Aggregates []Aggregate
+	Having     Query // Result rows returned; every row when zero
+}
+
+// validate checks the aggregation and its filters.
+func (a Aggregation) validate() error {
+	if err := a.Filter.validate(); err != nil {
+		return err
+	}
+	if err := a.Having.validate(); err != nil {
+		return err
+	}
+	columns := map[string]bool{}
+	for _, f := range a.GroupBy {
+		if f == "" || columns[f] {
+			return fmt.Errorf("aggregate: group by %q more than once or unnamed", f)
+		}
+		columns[f] = true
+	}
+	for _, agg := range a.Aggregates {
+		switch agg.Op {
+		case AggregateCount:
+		case AggregateCountDistinct, AggregateSum, AggregateAvg, AggregateMin, AggregateMax:
+			if agg.Field == "" {
+				return fmt.Errorf("aggregate: %s needs a field", agg.Op)
+			}
+		default:
+			return fmt.Errorf("aggregate: unknown function %q", agg.Op)
+		}
+		if columns[agg.name()] {
+			return fmt.Errorf("aggregate: column %s named more than once", agg.name())
+		}
+		columns[agg.name()] = true
+	}
+	if len(a.Aggregates) == 0 && len(a.GroupBy) == 0 {
+		return errors.New("aggregate: no aggregates or group by fields")
+	}
+	return nil
+}
+
+// accumulator computes one aggregate over the rows of a group.
+type accumulator struct {
+	agg      Aggregate
+	count    int
+	intSum   int64
+	floatSum float64
+	isFloat  bool            // A value of the sum was not an integer
+	best     any             // Least or greatest value so far
+	distinct map[string]bool // Encoded values seen, for AggregateCountDistinct
+}
+
+func (acc *accumulator) add(row map[string]any) error {
+	if acc.agg.Field == "" {
+		acc.count++
+		return nil
+	}
+	v := row[acc.agg.Field]
+	if v == nil {
+		return nil
+	}
+	acc.count++
+	switch acc.agg.Op {
+	case AggregateCountDistinct:
+		if acc.distinct == nil {
+			acc.distinct = map[string]bool{}
+		}
+		acc.distinct[string(keyOrder(nil).encode([]any{v}))] = true
+	case AggregateSum, AggregateAvg:
+		i, f, isInt, ok := numberValue(v)
+		if !ok {
+			return fmt.Errorf("aggregate: %s of %s: %#v is not a number", acc.agg.Op, acc.agg.Field, v)
+		}
+		if isInt && !acc.isFloat {
+			acc.intSum += i
+		} else if !acc.isFloat {
+			acc.isFloat, acc.floatSum = true, float64(acc.intSum)+f
+		} else {
+			acc.floatSum += f
+		}
+	case AggregateMin:
+		if acc.count == 1 || compareValues(v, acc.best) < 0 {
+			acc.best = v
+		}
+	case AggregateMax:
+		if acc.count == 1 || compareValues(v, acc.best) > 0 {
+			acc.best = v
+		}
+	}
+	return nil
+}
+
+func (acc *accumulator) result() any {
+	switch acc.agg.Op {
+	case AggregateCount:
+		return acc.count
+	case AggregateCountDistinct:
+		return len(acc.distinct)
+	}
+	if acc.count == 0 {
+		return nil
+	}
+	sum := any(acc.intSum)
+	if acc.isFloat {
+		sum = acc.floatSum
+	}
+	switch acc.agg.Op {
+	case AggregateSum:
+		return sum
+	case AggregateAvg:
+		if acc.isFloat {
+			return acc.floatSum / float64(acc.count)
+		}
+		return float64(acc.intSum) / float64(acc.count)
+	}
+	return acc.best
+}
+
+// numberValue returns a number as an integer when it has an integer type, and
+// as a float64 otherwise.
+func numberValue(v any) (i int64, f float64, isInt bool, ok bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), float64(n), true, true
+	case int8:
+		return int64(n), float64(n), true, true
+	case int16:
+		return int64(n), float64(n), true, true
+	case int32:
+		return int64(n), float64(n), true, true
+	case int64:
+		return n, float64(n), true, true
+	case uint:
+		return int64(n), float64(n), true, true
+	case uint8:
+		return int64(n), float64(n), true, true
+	case uint16:
+		return int64(n), float64(n), true, true
+	case uint32:
+		return int64(n), float64(n), true, true
+	case uint64:
+		return int64(n), float64(n), true, true
+	case float32:
+		return 0, float64(n), false, true
+	case float64:
+		return 0, n, false, true
+	}
+	return 0, 0, false, false
+}
+
+// aggregateGroup is a group of rows being aggregated.
+type aggregateGroup struct {
+	key  []any
+	accs []*accumulator
+}
+
+func newAggregateGroup(key []any, aggs []Aggregate) *aggregateGroup {
+	g := &aggregateGroup{key: key}
+	for _, agg := range aggs {
+		g.accs = append(g.accs, &accumulator{agg: agg})
+	}
+	return g
+}
+
+// row returns the result row of the group.
+func (g *aggregateGroup) row(groupBy []string) map[string]any {
+	row := make(map[string]any, len(groupBy)+len(g.accs))
+	for i, f := range groupBy {
+		row[f] = g.key[i]
+	}
+	for _, acc := range g.accs {
+		row[acc.agg.name()] = acc.result()
+	}
+	return row
+}
+
+// Aggregate computes an aggregation over the rows of the snapshot.
+func (s *Snapshot) Aggregate(a Aggregation) ([]any, error) {
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	var groups []*aggregateGroup
+	if len(a.GroupBy) == 0 {
+		g, err := s.aggregateByIndex(a)
+		if err != nil {
+			return nil, err
+		}
+		if g != nil {
+			groups = append(groups, g)
+		}
+	}
+	if groups == nil {
+		var err error
+		if groups, err = s.aggregateRows(a); err != nil {
+			return nil, err
+		}
+	}
+	rows := []any{}
+	for _, g := range groups {
+		if row := g.row(a.GroupBy); a.Having.matches(row) {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// aggregateRows reads the rows matching the filter and aggregates them in
+// groups, which it returns in the key order of their group fields.
+func (s *Snapshot) aggregateRows(a Aggregation) ([]*aggregateGroup, error) {
+	// Read only the fields aggregated, so that an index holding them can
+	// stand in for the rows.
+	fields := slices.Clone(a.GroupBy)
+	for _, agg := range a.Aggregates {
+		if agg.Field != "" && !slices.Contains(fields, agg.Field) {
+			fields = append(fields, agg.Field)
+		}
+	}
+	if len(fields) == 0 {
+		for _, k := range s.clustered.index.indexDef.Keys {
+			fields = append(fields, k.Name)
+		}
+	}
+	opts := QueryOptions{Fields: fields}
+	p, err := s.plan(a.Filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	byKey := map[string]*aggregateGroup{}
+	var addErr error
+	err = s.execute(p, opts, func(row map[string]any) bool {
+		key := make([]any, len(a.GroupBy))
+		for i, f := range a.GroupBy {
+			key[i] = row[f]
+		}
+		enc := string(keyOrder(nil).encode(key))
+		g := byKey[enc]
+		if g == nil {
+			g = newAggregateGroup(key, a.Aggregates)
+			byKey[enc] = g
+		}
+		for _, acc := range g.accs {
+			if addErr = acc.add(row); addErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(a.GroupBy) == 0 && len(byKey) == 0 {
+		return []*aggregateGroup{newAggregateGroup(nil, a.Aggregates)}, nil
+	}
+	groups := make([]*aggregateGroup, 0, len(byKey))
+	for _, enc := range slices.Sorted(maps.Keys(byKey)) {
+		groups = append(groups, byKey[enc])
+	}
+	return groups, nil
+}
+
+// aggregateByIndex computes an aggregation without groups from index keys and
+// entry counts alone when it can, and returns nil otherwise. A count is the
+// number of entries of an index range that holds exactly the rows counted; the
+// least or greatest value of a field is read from the first or last entry of
+// an index range that holds exactly the rows with the field, when the field
+// orders the entries of the range.
+func (s *Snapshot) aggregateByIndex(a Aggregation) (*aggregateGroup, error) {
+	conjuncts := a.Filter.conjuncts()
+	g := newAggregateGroup(nil, a.Aggregates)
+	for _, acc := range g.accs {
+		if acc.agg.Op != AggregateCount && acc.agg.Op != AggregateMin && acc.agg.Op != AggregateMax {
+			return nil, nil
+		}
+		required := conjuncts
+		if acc.agg.Field != "" {
+			required = append(slices.Clone(conjuncts), Exists(acc.agg.Field))
+		}
+		p, err := s.exactPlan(required)
+		if err != nil || p == nil {
+			return nil, err
+		}
+		if acc.agg.Op == AggregateCount {
+			acc.count = p.estimate
+			continue
+		}
+		// The range ends in the field: the range of an Exists is on it.
+		def := p.index.index.indexDef
+		i := slices.IndexFunc(def.Keys, func(k IndexField) bool { return k.Name == acc.agg.Field })
+		forward := (acc.agg.Op == AggregateMin) != def.keyOrder()[i].descending
+		cur := p.index.tree.Cursor(p.r)
+		if !forward {
+			cur = p.index.tree.ReverseCursor(p.r)
+		}
+		if cur.Next() {
+			acc.best, acc.count = cur.Key()[i], 1
+		}
+		err = cur.Err()
+		cur.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// exactPlan returns a plan whose index range holds exactly the rows matching the
+// conjuncts, trying the clustered index first, or nil if no index has one.
+func (s *Snapshot) exactPlan(conjuncts []Query) (*queryPlan, error) {
+	candidates := []*indexSnapshot{s.clustered}
+	for _, name := range slices.Sorted(maps.Keys(s.indexes)) {
+		if is := s.indexes[name]; len(is.index.rowKey) > 0 {
+			candidates = append(candidates, is)
+		}
+	}
+	for _, is := range candidates {
+		p, err := planIndex(is, conjuncts, QueryOptions{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil && p.residual.Op == QueryAll {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// Aggregate groups the rows of the collection matching a.Filter by a.GroupBy,
+// computes a.Aggregates over every group and returns the result rows matching
+// a.Having, ordered by their group fields in key order. The rows are read
+// through the index the planner chooses for the filter, or an index holding
+// every field aggregated. Without groups, counts and the least and greatest
+// value of an indexed field come from the index alone when its range holds
+// exactly the rows aggregated: counts from the entry counts of the tree, the
+// least or greatest value from the first or last entry of the range.
+func (c *Collection) Aggregate(a Aggregation) ([]any, error) {
+	snap, err := c.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	return snap.Aggregate(a)
+}
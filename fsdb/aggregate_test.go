@@ -0,0 +1,124 @@
+package fsdb
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestAggregate_ByIndex(t *testing.T) {
+	coll, _ := newQueryCollection(t)
+	snap, err := coll.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	aggregates := []Aggregate{
+		{Op: AggregateCount},
+		{Op: AggregateCount, Field: "total"},
+		{Op: AggregateMin, Field: "total"},
+		{Op: AggregateMax, Field: "total"},
+		{Op: AggregateMin, Field: "id"},
+		{Op: AggregateMax, Field: "id"},
+		{Op: AggregateMax, Field: "status"},
+	}
+	filters := []Query{
+		{},
+		Eq("customer", "bob"),
+		And(Eq("customer", "erin"), Lt("total", 30)),
+		And(Eq("customer", "carol"), Gte("total", 45.5)),
+		Between("id", 20, 80),
+		Eq("status", "open"),
+	}
+	shortcuts := 0
+	for _, filter := range filters {
+		for _, agg := range aggregates {
+			a := Aggregation{Filter: filter, Aggregates: []Aggregate{agg}}
+			g, err := snap.aggregateByIndex(a)
+			if err != nil {
+				t.Fatalf("aggregateByIndex(%v, %+v) failed: %v", filter, agg, err)
+			}
+			if g == nil {
+				continue
+			}
+			shortcuts++
+			groups, err := snap.aggregateRows(a)
+			if err != nil {
+				t.Fatalf("aggregateRows(%v, %+v) failed: %v", filter, agg, err)
+			}
+			if got, want := g.row(nil), groups[0].row(nil); !reflect.DeepEqual(got, want) {
+				t.Errorf("%+v of %v from the index = %v, from the rows %v", agg, filter, got, want)
+			}
+		}
+	}
+	if shortcuts < 20 {
+		t.Errorf("expected most aggregates to be read from an index, got %d", shortcuts)
+	}
+	a := Aggregation{Filter: Eq("customer", "bob"), Aggregates: []Aggregate{{Op: AggregateMin, Field: "total"}, {Op: AggregateSum, Field: "total"}}}
+	if g, _ := snap.aggregateByIndex(a); g != nil {
+		t.Error("expected a sum to need the rows")
+	}
+}
+
+func TestAggregate_Accumulators(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := []any{nil, 3, int64(-2), uint8(7), 2.5, float32(0.5), 3, "x"}
+	for i := 0; i < 200; i++ {
+		var rows []map[string]any
+		for range rng.Intn(6) {
+			rows = append(rows, map[string]any{"v": values[rng.Intn(len(values)-1)]})
+		}
+		var count, intSum int
+		var floatSum float64
+		hasFloat := false
+		distinct := map[float64]bool{}
+		for _, row := range rows {
+			switch v := row["v"].(type) {
+			case int:
+				intSum += v
+				distinct[float64(v)] = true
+			case int64:
+				intSum += int(v)
+				distinct[float64(v)] = true
+			case uint8:
+				intSum += int(v)
+				distinct[float64(v)] = true
+			case float64:
+				floatSum += v
+				hasFloat = true
+				distinct[v] = true
+			case float32:
+				floatSum += float64(v)
+				hasFloat = true
+				distinct[float64(v)] = true
+			default:
+				continue
+			}
+			count++
+		}
+		results := map[AggregateOp]any{}
+		for _, op := range []AggregateOp{AggregateCount, AggregateCountDistinct, AggregateSum, AggregateAvg} {
+			acc := &accumulator{agg: Aggregate{Op: op, Field: "v"}}
+			for _, row := range rows {
+				if err := acc.add(row); err != nil {
+					t.Fatalf("%s failed: %v", op, err)
+				}
+			}
+			results[op] = acc.result()
+		}
+		var wantSum, wantAvg any
+		if count > 0 && hasFloat {
+			wantSum, wantAvg = float64(intSum)+floatSum, (float64(intSum)+floatSum)/float64(count)
+		} else if count > 0 {
+			wantSum, wantAvg = int64(intSum), float64(intSum)/float64(count)
+		}
+		want := map[AggregateOp]any{AggregateCount: count, AggregateCountDistinct: len(distinct), AggregateSum: wantSum, AggregateAvg: wantAvg}
+		if !reflect.DeepEqual(results, want) {
+			t.Fatalf("aggregates of %v = %v, want %v", rows, results, want)
+		}
+	}
+	acc := &accumulator{agg: Aggregate{Op: AggregateSum, Field: "v"}}
+	if err := acc.add(map[string]any{"v": "x"}); err == nil {
+		t.Error("expected the sum of a string to fail")
+	}
+}
@@ -11,11 +11,36 @@ type BTree struct {
 	storage     BTreeNodeStorage
 	rootID      string
 	pageSize    int
-	isUniqueKey bool // true if this is a clustered index
+	pageBytes   int      // Target encoded size of a node; 0 sizes nodes by pageSize keys
+	isUniqueKey bool     // true if this is a clustered index
+	order       keyOrder // per-field sort direction of the composite key
+	shape       treeShape
 }
 
+// treeShape tracks the size of a tree as it is modified, so that index metadata
+// stays current without scans. It starts from the values recorded when the tree
+// was last persisted (see setShape) or from a full recount.
+type treeShape struct {
+	entries int // Number of key-value pairs in the leaves
+	nodes   int // Number of nodes
+	height  int // Number of levels; 0 for an empty tree
+}
+
+// DefaultPageSize is the number of keys per node used when an index does not set PageSize.
+const DefaultPageSize = 32
+
+// minPageSize is the smallest page size for which splits and merges stay balanced.
+const minPageSize = 3
+
 // NewBTree creates a new B+ tree with the given storage provider and page size.
+// A page size of zero selects DefaultPageSize.
 func NewBTree(storage BTreeNodeStorage, rootID string, pageSize int, isUniqueKey bool) *BTree {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize < minPageSize {
+		pageSize = minPageSize
+	}
 	return &BTree{
 		storage:     storage,
 		rootID:      rootID,
@@ -24,41 +49,98 @@ func NewBTree(storage BTreeNodeStorage, rootID string, pageSize int, isUniqueKey
 	}
 }
 
+// SetKeyOrder sets the sort direction of each key field; true marks a descending field.
+// Nulls sort below every value. It must be called before the tree holds any data, as
+// existing entries are not reordered.
+func (bt *BTree) SetKeyOrder(descending []bool) {
+	bt.order = make(keyOrder, len(descending))
+	for i, d := range descending {
+		bt.order[i] = fieldOrder{descending: d, nullsLast: d}
+	}
+}
+
 // RootID returns the current root node ID.
 func (bt *BTree) RootID() string {
 	return bt.rootID
 }
 
+// setShape sets the tracked size of a tree opened on existing nodes.
+func (bt *BTree) setShape(shape treeShape) {
+	bt.shape = shape
+}
+
+// recount walks the whole tree to recompute its tracked size.
+func (bt *BTree) recount() error {
+	var shape treeShape
+	depth := map[string]int{}
+	if bt.rootID != "" {
+		depth[bt.rootID] = 1
+	}
+	err := bt.walkNodes(func(node *BTreeNode) error {
+		shape.nodes++
+		d := depth[node.ID]
+		delete(depth, node.ID)
+		shape.height = max(shape.height, d)
+		if node.IsLeaf() {
+			shape.entries += len(node.Keys)
+			return nil
+		}
+		for _, v := range node.Values {
+			depth[v.(string)] = d + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bt.shape = shape
+	return nil
+}
+
 // Insert inserts a key-value pair into the B+ tree.
 func (bt *BTree) Insert(key []any, value any) error {
 	if bt.isUniqueKey {
 		// Only check for duplicates if the tree is not empty
 		if bt.rootID != "" {
-			results, err := bt.Search(key)
+			leaf, _, err := bt.locate(key)
 			if err != nil {
 				return err
 			}
-			if len(results) > 0 {
+			if leaf != nil {
 				return fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
 			}
 		}
 	}
+	value, err := bt.inline(value)
+	if err != nil {
+		return err
+	}
 	if bt.rootID == "" {
 		// Create root as a new leaf node
-		root := NewBTreeNode(generateNodeID(), LeafNode, bt.pageSize, "")
+		root, err := bt.newNode(LeafNode, "")
+		if err != nil {
+			return err
+		}
 		root.Keys = append(root.Keys, key)
 		root.Values = append(root.Values, value)
 		if err := bt.storage.SaveNode(root); err != nil {
 			return err
 		}
 		bt.rootID = root.ID
+		bt.shape.height = 1
+		bt.shape.entries++
 		return nil
 	}
-	root, err := bt.storage.LoadNode(bt.rootID)
+	root, err := bt.loadNode(bt.rootID)
 	if err != nil {
 		return err
 	}
-	return bt.insertRecursive(root, key, value)
+	if err := bt.insertRecursive(root, key, value); err != nil {
+		bt.release(value)
+		return err
+	}
+	bt.shape.entries++
+	return nil
 }
 
 // insertRecursive handles recursive insert and node splitting.
@@ -66,338 +148,352 @@ func (bt *BTree) insertRecursive(node *BTreeNode, key []any, value any) error {
 	if node.IsLeaf() {
 		// Insert in sorted order
 		pos := 0
-		for pos < len(node.Keys) && compareKeys(key, node.Keys[pos]) > 0 {
+		for pos < len(node.Keys) && bt.order.compare(key, node.Keys[pos]) > 0 {
 			pos++
 		}
 		// Check for duplicate key if clustered (unique key)
-		if bt.isUniqueKey {
-			// Check all keys for duplicate (not just neighbors)
-			for i := 0; i < len(node.Keys); i++ {
-				if compareKeys(key, node.Keys[i]) == 0 {
-					return fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
-				}
-			}
+		if bt.isUniqueKey && pos < len(node.Keys) && bt.order.compare(key, node.Keys[pos]) == 0 {
+			return fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
 		}
 		// For non-clustered, allow duplicates: insert after all existing duplicates
-		for !bt.isUniqueKey && pos < len(node.Keys) && compareKeys(key, node.Keys[pos]) == 0 {
+		for !bt.isUniqueKey && pos < len(node.Keys) && bt.order.compare(key, node.Keys[pos]) == 0 {
 			pos++
 		}
 		node.Keys = append(node.Keys[:pos], append([][]any{key}, node.Keys[pos:]...)...)
 		node.Values = append(node.Values[:pos], append([]any{value}, node.Values[pos:]...)...)
 		node.IsDirty = true
-		if !node.IsFull() {
-			return bt.storage.SaveNode(node)
+		if bt.full(node) {
+			return bt.splitLeaf(node, 1)
 		}
-		return bt.splitLeaf(node)
+		if err := bt.storage.SaveNode(node); err != nil {
+			return err
+		}
+		return bt.addToAncestors(node, 1)
 	}
 	// Internal node: find child
 	pos := 0
-	for pos < len(node.Keys) && compareKeys(key, node.Keys[pos]) > 0 {
+	for pos < len(node.Keys) && bt.order.compare(key, node.Keys[pos]) > 0 {
 		pos++
 	}
-	childID := node.Values[pos].(string)
-	child, err := bt.storage.LoadNode(childID)
+	child, err := bt.loadNode(node.Values[pos].(string))
 	if err != nil {
 		return err
 	}
-	err = bt.insertRecursive(child, key, value)
+	// The entry is counted once the leaf holding it is saved, so a duplicate
+	// or a failed save leaves the counts of the ancestors untouched.
+	return bt.insertRecursive(child, key, value)
+}
+
+// splitLeaf splits a full leaf node and promotes the first key of the new right leaf.
+// added is the number of entries the leaf gained since its ancestors were counted.
+func (bt *BTree) splitLeaf(leaf *BTreeNode, added int) error {
+	mid := bt.splitPoint(leaf)
+	right, err := bt.newNode(LeafNode, leaf.indexPath)
 	if err != nil {
 		return err
 	}
-	if child.IsFull() {
-		// Child was split, handle promotion
-		return bt.handleSplit(node, child)
-	}
-	return bt.storage.SaveNode(node)
-}
-
-// splitLeaf splits a full leaf node and promotes the middle key.
-func (bt *BTree) splitLeaf(leaf *BTreeNode) error {
-	mid := len(leaf.Keys) / 2
-	right := NewBTreeNode(generateNodeID(), LeafNode, bt.pageSize, leaf.indexPath)
 	right.Keys = append(right.Keys, leaf.Keys[mid:]...)
 	right.Values = append(right.Values, leaf.Values[mid:]...)
 	right.Next = leaf.Next
 	right.Previous = leaf.ID
-	// Fix next/previous pointers of the right neighbor if it exists
+	right.Parent = leaf.Parent
+	// Fix the previous pointer of the right neighbor if it exists
 	if leaf.Next != "" {
-		nextNode, err := bt.storage.LoadNode(leaf.Next)
-		if err == nil {
-			nextNode.Previous = right.ID
-			nextNode.IsDirty = true
-			_ = bt.storage.SaveNode(nextNode)
+		nextNode, err := bt.loadNode(leaf.Next)
+		if err != nil {
+			return err
+		}
+		nextNode.Previous = right.ID
+		nextNode.IsDirty = true
+		if err := bt.storage.SaveNode(nextNode); err != nil {
+			return err
 		}
 	}
 	leaf.Keys = leaf.Keys[:mid]
 	leaf.Values = leaf.Values[:mid]
 	leaf.Next = right.ID
 	leaf.IsDirty = true
-	// Set parent pointers for right node
-	right.Parent = leaf.Parent
-	if err := bt.storage.SaveNode(leaf); err != nil {
-		return err
-	}
-	if err := bt.storage.SaveNode(right); err != nil {
-		return err
-	}
-	if leaf.Parent == "" {
-		// Create new root
-		root := NewBTreeNode(generateNodeID(), InternalNode, bt.pageSize, leaf.indexPath)
-		// Gather all leaves in order starting from the leftmost
-		leaves := []*BTreeNode{}
-		current := leaf
-		for current.Previous != "" {
-			prev, err := bt.storage.LoadNode(current.Previous)
-			if err != nil {
-				break
-			}
-			current = prev
+	return bt.promote(leaf, right, right.Keys[0], added)
+}
+
+// promote links a freshly split right sibling into the tree with the given separator,
+// growing a new root when the split node was the root. Both halves are saved, and
+// the ancestors above the last node split count the added entries.
+//
+// The right half is saved before the left, which then loses the entries moved
+// to it, and the parent last: a crash in between leaves every entry in a leaf
+// that a repair from the leaves reaches, through the left leaf or its Next.
+func (bt *BTree) promote(left, right *BTreeNode, separator []any, added int) error {
+	if left.Parent == "" {
+		root, err := bt.newNode(InternalNode, left.indexPath)
+		if err != nil {
+			return err
 		}
-		// Now current is the leftmost leaf
-		for current != nil {
-			leaves = append(leaves, current)
-			if current.Next == "" {
-				break
-			}
-			next, err := bt.storage.LoadNode(current.Next)
-			if err != nil {
-				break
-			}
-			current = next
-		}
-		// Set root keys and values
-		root.Values = make([]any, 0, len(leaves))
-		root.Keys = make([][]any, 0, len(leaves)-1)
-		for i, n := range leaves {
-			root.Values = append(root.Values, n.ID)
-			if i > 0 {
-				root.Keys = append(root.Keys, n.Keys[0])
-			}
-			n.Parent = root.ID
-			_ = bt.storage.SaveNode(n)
+		root.Keys = append(root.Keys, separator)
+		root.Values = append(root.Values, left.ID, right.ID)
+		if err := bt.countChildren(root, left, right); err != nil {
+			return err
 		}
-		if err := bt.storage.SaveNode(root); err != nil {
+		left.Parent = root.ID
+		right.Parent = root.ID
+		left.IsDirty = true
+		right.IsDirty = true
+		if err := bt.saveNodes(right, left, root); err != nil {
 			return err
 		}
 		bt.rootID = root.ID
+		bt.shape.height++
 		return nil
 	}
-	// Promote to parent
-	parent, err := bt.storage.LoadNode(leaf.Parent)
+	if err := bt.saveNodes(right, left); err != nil {
+		return err
+	}
+	parent, err := bt.loadNode(left.Parent)
 	if err != nil {
 		return err
 	}
-	return bt.insertInternalAfterSplit(parent, right.Keys[0], right.ID)
+	return bt.insertInternalAfterSplit(parent, separator, left, right, added)
 }
 
-// insertInternalAfterSplit inserts a promoted key and right child ID into an internal node after a split.
-func (bt *BTree) insertInternalAfterSplit(parent *BTreeNode, key []any, rightID string) error {
-	pos := 0
-	for pos < len(parent.Keys) && compareKeys(key, parent.Keys[pos]) > 0 {
-		pos++
+// insertInternalAfterSplit inserts a promoted key and right child into an internal
+// node after a split, counting the entries below each half afresh.
+func (bt *BTree) insertInternalAfterSplit(parent *BTreeNode, key []any, left, right *BTreeNode, added int) error {
+	pos := parent.childIndex(left.ID)
+	if pos < 0 {
+		return fmt.Errorf("node %s is not a child of %s", left.ID, parent.ID)
+	}
+	if parent.hasCounts() {
+		kept, err := bt.subtreeCount(left)
+		if err != nil {
+			return err
+		}
+		moved, err := bt.subtreeCount(right)
+		if err != nil {
+			return err
+		}
+		parent.Counts[pos] = kept
+		parent.Counts = append(parent.Counts[:pos+1], append([]int{moved}, parent.Counts[pos+1:]...)...)
 	}
 	parent.Keys = append(parent.Keys[:pos], append([][]any{key}, parent.Keys[pos:]...)...)
-	parent.Values = append(parent.Values[:pos+1], append([]any{rightID}, parent.Values[pos+1:]...)...)
+	parent.Values = append(parent.Values[:pos+1], append([]any{right.ID}, parent.Values[pos+1:]...)...)
 	parent.IsDirty = true
-	if !parent.IsFull() {
-		return bt.storage.SaveNode(parent)
+	if bt.full(parent) {
+		return bt.splitInternal(parent, added)
+	}
+	if err := bt.storage.SaveNode(parent); err != nil {
+		return err
 	}
-	return bt.splitInternal(parent)
+	if added == 0 {
+		return nil
+	}
+	return bt.addToAncestors(parent, added)
 }
 
 // splitInternal splits a full internal node and promotes the middle key.
-func (bt *BTree) splitInternal(internal *BTreeNode) error {
-	mid := len(internal.Keys) / 2
-	right := NewBTreeNode(generateNodeID(), InternalNode, bt.pageSize, internal.indexPath)
+func (bt *BTree) splitInternal(internal *BTreeNode, added int) error {
+	mid := bt.splitPoint(internal)
+	right, err := bt.newNode(InternalNode, internal.indexPath)
+	if err != nil {
+		return err
+	}
 	right.Keys = append(right.Keys, internal.Keys[mid+1:]...)
 	right.Values = append(right.Values, internal.Values[mid+1:]...)
+	right.Parent = internal.Parent
+	if internal.hasCounts() {
+		right.Counts = append(right.Counts, internal.Counts[mid+1:]...)
+		internal.Counts = internal.Counts[:mid+1]
+	}
 	promoteKey := internal.Keys[mid]
 	internal.Keys = internal.Keys[:mid]
 	internal.Values = internal.Values[:mid+1]
-	if err := bt.storage.SaveNode(internal); err != nil {
+	internal.IsDirty = true
+	if err := bt.adoptChildren(right, right.Values); err != nil {
 		return err
 	}
-	if err := bt.storage.SaveNode(right); err != nil {
-		return err
-	}
-	if internal.Parent == "" {
-		// New root
-		root := NewBTreeNode(generateNodeID(), InternalNode, bt.pageSize, internal.indexPath)
-		root.Keys = append(root.Keys, promoteKey)
-		root.Values = append(root.Values, internal.ID, right.ID)
-		internal.Parent = root.ID
-		right.Parent = root.ID
-		if err := bt.storage.SaveNode(root); err != nil {
+	return bt.promote(internal, right, promoteKey, added)
+}
+
+// adoptChildren points the Parent of each given child at parent.
+func (bt *BTree) adoptChildren(parent *BTreeNode, childIDs []any) error {
+	for _, id := range childIDs {
+		child, err := bt.loadNode(id.(string))
+		if err != nil {
+			return err
+		}
+		if child.Parent == parent.ID {
+			continue
+		}
+		child.Parent = parent.ID
+		child.IsDirty = true
+		if err := bt.storage.SaveNode(child); err != nil {
 			return err
 		}
-		bt.rootID = root.ID
-		return nil
 	}
-	parent, err := bt.storage.LoadNode(internal.Parent)
+	return nil
+}
+
+// loadNode loads a node for modification. Nodes persisted without a page size
+// (indexes created with PageSize 0) adopt the tree's page size.
+func (bt *BTree) loadNode(nodeID string) (*BTreeNode, error) {
+	node, err := bt.storage.LoadNode(nodeID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if node.PageSize <= 0 {
+		node.PageSize = bt.pageSize
 	}
-	return bt.insertInternalAfterSplit(parent, promoteKey, right.ID)
+	return node, nil
 }
 
-// handleSplit is called after a child node is split.
-func (bt *BTree) handleSplit(parent, child *BTreeNode) error {
-	// No-op: split logic already handled in splitLeaf/splitInternal
+// saveNodes saves each of the given nodes, skipping nil ones.
+func (bt *BTree) saveNodes(nodes ...*BTreeNode) error {
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		if err := bt.storage.SaveNode(n); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// locate finds the leaf and position of the first entry whose key equals key.
+// It returns a nil leaf if the key is not present.
+func (bt *BTree) locate(key []any) (*BTreeNode, int, error) {
+	if bt.rootID == "" {
+		return nil, 0, nil
+	}
+	node, err := bt.findLeaf(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		for i, k := range node.Keys {
+			c := bt.order.compare(k, key)
+			if c == 0 {
+				if node.PageSize <= 0 {
+					node.PageSize = bt.pageSize
+				}
+				return node, i, nil
+			}
+			if c > 0 {
+				return nil, 0, nil
+			}
+		}
+		if node.Next == "" {
+			return nil, 0, nil
+		}
+		if node, err = bt.storage.LoadNode(node.Next); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
 // Search returns all values matching the given key (or all if key is nil).
 func (bt *BTree) Search(key []any) ([]any, error) {
+	if key == nil {
+		return bt.SearchRange(KeyRange{})
+	}
+	return bt.SearchRange(ExactRange(key))
+}
+
+// SearchRange returns all values whose keys fall within r, in key order.
+// It descends to the first leaf that can hold the lower bound and walks the
+// leaf chain only until the upper bound is passed.
+func (bt *BTree) SearchRange(r KeyRange) ([]any, error) {
 	if bt.rootID == "" {
 		return nil, nil
 	}
+	cur := bt.Cursor(r)
+	defer cur.Close()
+	results := []any{}
+	for cur.Next() {
+		results = append(results, cur.Value())
+	}
+	return results, cur.Err()
+}
+
+// findLeaf descends to the leftmost leaf that may contain keys greater than or
+// equal to lower (compared on its prefix). A nil lower selects the leftmost leaf.
+func (bt *BTree) findLeaf(lower []any) (*BTreeNode, error) {
 	node, err := bt.storage.LoadNode(bt.rootID)
 	if err != nil {
 		return nil, err
 	}
-	// Descend to leftmost leaf if key == nil
-	if key == nil {
-		for !node.IsLeaf() {
-			childID := node.Values[0].(string)
-			node, err = bt.storage.LoadNode(childID)
-			if err != nil {
-				return nil, err
-			}
-		}
-		// Traverse all leaves using Next pointers, but also ensure we start from the leftmost leaf
-		results := []any{}
-		visited := map[string]bool{}
-		for node != nil && !visited[node.ID] {
-			visited[node.ID] = true
-			results = append(results, node.Values...)
-			if node.Next == "" {
-				break
-			}
-			nextNode, err := bt.storage.LoadNode(node.Next)
-			if err != nil {
-				break
-			}
-			node = nextNode
-		}
-		return results, nil
-	}
-	// Original search for a specific key
 	for !node.IsLeaf() {
 		pos := 0
-		// Fix: descend to the first child whose separator key is greater than the search key
-		for pos < len(node.Keys) && compareKeys(key, node.Keys[pos]) >= 0 {
-			pos++
+		if lower != nil {
+			// Duplicates of a separator may live on its left, so only skip
+			// children whose separator is strictly below the bound.
+			for pos < len(node.Keys) && bt.order.comparePrefix(node.Keys[pos], lower) < 0 {
+				pos++
+			}
 		}
 		if pos >= len(node.Values) {
 			pos = len(node.Values) - 1
 		}
-		childID := node.Values[pos].(string)
-		node, err = bt.storage.LoadNode(childID)
+		node, err = bt.storage.LoadNode(node.Values[pos].(string))
 		if err != nil {
 			return nil, err
 		}
 	}
-	results := []any{}
-	for i, k := range node.Keys {
-		if compareKeys(key, k) == 0 {
-			results = append(results, node.Values[i])
-		}
-	}
-	return results, nil
+	return node, nil
 }
 
-// Delete removes all records with the given key from the B+ tree.
-func (bt *BTree) Delete(key []any) error {
+// SearchRangeReverse returns the values whose keys fall within r, from the last
+// key to the first, stopping after limit values (0 means no limit).
+func (bt *BTree) SearchRangeReverse(r KeyRange, limit int) ([]any, error) {
 	if bt.rootID == "" {
-		return nil
-	}
-	root, err := bt.storage.LoadNode(bt.rootID)
-	if err != nil {
-		return err
-	}
-	_, shrink, err := bt.deleteRecursive(root, key)
-	if err != nil {
-		return err
+		return nil, nil
 	}
-	if shrink && root.IsLeaf() && len(root.Keys) == 0 {
-		// Tree is now empty
-		bt.rootID = ""
+	cur := bt.ReverseCursor(r)
+	defer cur.Close()
+	results := []any{}
+	for (limit <= 0 || len(results) < limit) && cur.Next() {
+		results = append(results, cur.Value())
 	}
-	return nil
+	return results, cur.Err()
 }
 
-// deleteRecursive recursively deletes all records with the given key and handles underflow.
-// Returns (changed, shrink, error):
-//
-//	changed: true if the node was modified
-//	shrink: true if the subtree height shrank (root merge)
-func (bt *BTree) deleteRecursive(node *BTreeNode, key []any) (bool, bool, error) {
-	if node.IsLeaf() {
-		// Remove all key-value pairs with the matching key
-		deleted := false
-		for {
-			found := false
-			for i := 0; i < len(node.Keys); i++ {
-				if compareKeys(key, node.Keys[i]) == 0 {
-					node.Keys = append(node.Keys[:i], node.Keys[i+1:]...)
-					node.Values = append(node.Values[:i], node.Values[i+1:]...)
-					deleted = true
-					found = true
-					break
-				}
-			}
-			if !found {
-				break
-			}
-		}
-		if deleted {
-			node.IsDirty = true
-			_ = bt.storage.SaveNode(node)
-		}
-		return deleted, len(node.Keys) == 0, nil
-	}
-	// Internal node: find child
-	pos := 0
-	// Fix: descend to the first child whose separator key is greater than the delete key
-	for pos < len(node.Keys) && compareKeys(key, node.Keys[pos]) >= 0 {
-		pos++
-	}
-	if pos >= len(node.Values) {
-		pos = len(node.Values) - 1
+// SearchPage returns at most limit values (0 means no limit) whose keys fall
+// within r, starting at the given offset within the range. The entries before
+// the offset are skipped by their counts rather than visited.
+func (bt *BTree) SearchPage(r KeyRange, offset, limit int) ([]any, error) {
+	if bt.rootID == "" {
+		return nil, nil
 	}
-	childID := node.Values[pos].(string)
-	child, err := bt.storage.LoadNode(childID)
-	if err != nil {
-		return false, false, err
+	cur := bt.Cursor(r)
+	defer cur.Close()
+	cur.SeekToOffset(offset)
+	results := []any{}
+	for (limit <= 0 || len(results) < limit) && cur.Next() {
+		results = append(results, cur.Value())
 	}
-	changed, shrink, err := bt.deleteRecursive(child, key)
+	return results, cur.Err()
+}
+
+// findLastLeaf descends to the rightmost leaf that may contain keys less than or
+// equal to upper (compared on its prefix). A nil upper selects the rightmost leaf.
+func (bt *BTree) findLastLeaf(upper []any) (*BTreeNode, error) {
+	node, err := bt.storage.LoadNode(bt.rootID)
 	if err != nil {
-		return false, false, err
-	}
-	if !changed {
-		return false, false, nil
+		return nil, err
 	}
-	// If child is empty, remove pointer and key
-	if shrink {
-		if child.IsLeaf() || len(child.Keys) == 0 {
-			// Remove child pointer and key (if not leftmost)
-			if pos < len(node.Keys) {
-				node.Keys = append(node.Keys[:pos], node.Keys[pos+1:]...)
-			}
-			node.Values = append(node.Values[:pos], node.Values[pos+1:]...)
-			node.IsDirty = true
-			_ = bt.storage.SaveNode(node)
-			// If root and only one child left, promote child
-			if node.Parent == "" && len(node.Values) == 1 {
-				newRootID := node.Values[0].(string)
-				bt.rootID = newRootID
-				return true, true, nil
+	for !node.IsLeaf() {
+		pos := len(node.Values) - 1
+		if upper != nil {
+			pos = 0
+			for pos < len(node.Keys) && bt.order.comparePrefix(node.Keys[pos], upper) <= 0 {
+				pos++
 			}
-			return true, len(node.Keys) == 0, nil
+		}
+		node, err = bt.storage.LoadNode(node.Values[pos].(string))
+		if err != nil {
+			return nil, err
 		}
 	}
-	_ = bt.storage.SaveNode(node)
-	return true, false, nil
+	return node, nil
 }
 
 // Update replaces the value for a given key in a clustered index. Returns error if not unique key index.
@@ -408,101 +504,93 @@ func (bt *BTree) Update(key []any, newValue any) error {
 	if bt.rootID == "" {
 		return fmt.Errorf("tree is empty")
 	}
-	node, err := bt.storage.LoadNode(bt.rootID)
+	leaf, pos, err := bt.locate(key)
 	if err != nil {
 		return err
 	}
-	// Descend to the leaf node containing the key
-	for !node.IsLeaf() {
-		pos := 0
-		for pos < len(node.Keys) && compareKeys(key, node.Keys[pos]) > 0 {
-			pos++
-		}
-		childID := node.Values[pos].(string)
-		node, err = bt.storage.LoadNode(childID)
-		if err != nil {
-			return err
-		}
+	if leaf == nil {
+		return fmt.Errorf("key not found: %#v", key)
 	}
-	// Find and update the value for the key
-	for i, k := range node.Keys {
-		if compareKeys(key, k) == 0 {
-			node.Values[i] = newValue
-			node.IsDirty = true
-			return bt.storage.SaveNode(node)
-		}
+	if newValue, err = bt.inline(newValue); err != nil {
+		return err
+	}
+	old := leaf.Values[pos]
+	leaf.Values[pos] = newValue
+	leaf.IsDirty = true
+	if bt.full(leaf) {
+		err = bt.splitLeaf(leaf, 0) // A larger value can outgrow a page sized in bytes
+	} else {
+		err = bt.storage.SaveNode(leaf)
 	}
-	return fmt.Errorf("key not found: %#v", key)
+	if err != nil {
+		return err
+	}
+	return bt.release(old)
 }
 
-// Utility: compareKeys compares two composite keys.
+// compareKeys compares two composite keys with every field ascending.
 func compareKeys(a, b []any) int {
-	for i := 0; i < len(a) && i < len(b); i++ {
-		av := a[i]
-		bv := b[i]
-		switch va := av.(type) {
-		case int:
-			switch vb := bv.(type) {
-			case int:
-				if va < vb {
-					return -1
-				} else if va > vb {
-					return 1
-				}
-			case float64:
-				if float64(va) < vb {
-					return -1
-				} else if float64(va) > vb {
-					return 1
-				}
-			}
-		case float64:
-			switch vb := bv.(type) {
-			case int:
-				if va < float64(vb) {
-					return -1
-				} else if va > float64(vb) {
-					return 1
-				}
-			case float64:
-				if va < vb {
-					return -1
-				} else if va > vb {
-					return 1
-				}
-			}
-		case string:
-			vb, ok := bv.(string)
-			if ok {
-				if va < vb {
-					return -1
-				} else if va > vb {
-					return 1
-				}
-			}
-		case time.Time:
-			switch vb := bv.(type) {
-			case time.Time:
-				if va.Before(vb) {
-					return -1
-				} else if va.After(vb) {
-					return 1
-				} else {
-					return 0
+	return keyOrder(nil).compare(a, b)
+}
+
+// walkNodes visits every node reachable from the root, parents before children.
+func (bt *BTree) walkNodes(visit func(node *BTreeNode) error) error {
+	if bt.rootID == "" {
+		return nil
+	}
+	queue := []string{bt.rootID}
+	for len(queue) > 0 {
+		node, err := bt.loadNode(queue[0])
+		if err != nil {
+			return err
+		}
+		queue = queue[1:]
+		if !node.IsLeaf() {
+			for _, v := range node.Values {
+				id, ok := v.(string)
+				if !ok {
+					return fmt.Errorf("internal node %s has a non-string child %#v", node.ID, v)
 				}
+				queue = append(queue, id)
 			}
-		default:
-			// Fallback to string comparison for uncomparable types (e.g., map[string]any)
-			s1 := fmt.Sprintf("%#v", av)
-			s2 := fmt.Sprintf("%#v", bv)
-			if s1 < s2 {
-				return -1
-			} else if s1 > s2 {
-				return 1
-			}
 		}
+		if err := visit(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NodeIDAllocator is implemented by storages that assign the IDs of new nodes
+// themselves, such as page numbers; other storages get random IDs.
+type NodeIDAllocator interface {
+	AllocateNodeID() (string, error)
+}
+
+// newNode creates an empty node with an ID from the storage, if it allocates them.
+func (bt *BTree) newNode(nodeType NodeType, indexPath string) (*BTreeNode, error) {
+	id, err := bt.newNodeID()
+	if err != nil {
+		return nil, err
+	}
+	bt.shape.nodes++
+	return NewBTreeNode(id, nodeType, bt.pageSize, indexPath), nil
+}
+
+// deleteNode removes a node that is no longer part of the tree from storage.
+func (bt *BTree) deleteNode(nodeID string) error {
+	if err := bt.storage.DeleteNode(nodeID); err != nil {
+		return err
+	}
+	bt.shape.nodes--
+	return nil
+}
+
+func (bt *BTree) newNodeID() (string, error) {
+	if a, ok := bt.storage.(NodeIDAllocator); ok {
+		return a.AllocateNodeID()
 	}
-	return len(a) - len(b)
+	return generateNodeID(), nil
 }
 
 // Utility: generateNodeID returns a unique node ID (placeholder).
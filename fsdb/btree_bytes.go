@@ -0,0 +1,121 @@
+package fsdb
+
+// Nodes are sized either by key count (PageSize, the default) or, once
+// SetPageBytes is called, by their encoded size in bytes. With byte sizing a node
+// splits when its encoding outgrows the page, at the entry where the first half
+// of its bytes ends, and it underflows when it shrinks below a quarter of the
+// page. Since values larger than a quarter of the page are moved to overflow
+// nodes, a node that underflows and a sibling that cannot lend it an entry
+// always fit in one page together, unless their keys themselves are very large;
+// such siblings are left as they are rather than merged into an oversized node.
+
+// nodeHeaderBytes approximates the encoded size of a node without its entries:
+// the header and the IDs of the node, its parent and its neighbours.
+const nodeHeaderBytes = 96
+
+// encodedSize returns the size of the typed encoding of a value in a node.
+func encodedSize(v any) int {
+	var buf [64]byte
+	b, err := appendValue(buf[:0], v)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// entryBytes returns the encoded size of the i-th key and value of a node.
+func entryBytes(n *BTreeNode, i int) int {
+	size := encodedSize(n.Values[i])
+	if i < len(n.Keys) {
+		size += encodedSize(n.Keys[i])
+	}
+	return size
+}
+
+// nodeBytes returns the approximate encoded size of a node.
+func nodeBytes(n *BTreeNode) int {
+	size := nodeHeaderBytes
+	for i := range n.Values {
+		size += entryBytes(n, i)
+	}
+	return size
+}
+
+// SetPageBytes sizes the nodes of the tree in bytes: nodes split once their
+// encoding exceeds pageBytes instead of when they hold PageSize keys, and leaf
+// values larger than a quarter of pageBytes are stored in overflow nodes. Zero
+// restores sizing by key count. It must be called before the tree holds any
+// data.
+func (bt *BTree) SetPageBytes(pageBytes int) {
+	bt.pageBytes = max(pageBytes, 0)
+	if bt.pageBytes > 0 {
+		bt.pageBytes = max(bt.pageBytes, minPageBytes)
+	}
+}
+
+// minSplitKeys returns how many keys a node needs before it can split into two
+// valid halves: a leaf half needs one entry, an internal half one key.
+func minSplitKeys(n *BTreeNode) int {
+	if n.IsLeaf() {
+		return 2
+	}
+	return 3
+}
+
+// full reports whether a node has outgrown its page and must split.
+func (bt *BTree) full(n *BTreeNode) bool {
+	if bt.pageBytes <= 0 {
+		return n.IsFull()
+	}
+	return len(n.Keys) >= minSplitKeys(n) && nodeBytes(n) > bt.pageBytes
+}
+
+// underflows reports whether a non-root node holds too little and must borrow
+// from or merge with a sibling.
+func (bt *BTree) underflows(n *BTreeNode) bool {
+	if bt.pageBytes <= 0 {
+		return len(n.Keys) < n.MinKeys()
+	}
+	return len(n.Keys) == 0 || nodeBytes(n) < bt.pageBytes/4
+}
+
+// canLend reports whether a node can give its i-th entry to a sibling without
+// underflowing itself.
+func (bt *BTree) canLend(n *BTreeNode, i int) bool {
+	if bt.pageBytes <= 0 {
+		return n.CanBorrow()
+	}
+	return len(n.Keys) >= 2 && nodeBytes(n)-entryBytes(n, i) >= bt.pageBytes/4
+}
+
+// canMerge reports whether two siblings fit in one node.
+func (bt *BTree) canMerge(left, right *BTreeNode) bool {
+	if bt.pageBytes <= 0 {
+		return true
+	}
+	return nodeBytes(left)+nodeBytes(right)-nodeHeaderBytes <= bt.pageBytes
+}
+
+// splitPoint returns the position at which a full node splits: its middle key,
+// or with byte sizing the entry at which the first half of its bytes ends. A
+// leaf keeps the entries before it; an internal node promotes the key at it.
+func (bt *BTree) splitPoint(n *BTreeNode) int {
+	if bt.pageBytes <= 0 {
+		return len(n.Keys) / 2
+	}
+	lo, hi := 1, len(n.Keys)-1
+	if !n.IsLeaf() {
+		hi--
+	}
+	half := nodeBytes(n) / 2
+	size := nodeHeaderBytes
+	for i := range n.Keys {
+		if size += entryBytes(n, i); size >= half {
+			if n.IsLeaf() {
+				i++ // The left half ends with this entry
+			}
+			return min(max(i, lo), hi)
+		}
+	}
+	return hi
+}
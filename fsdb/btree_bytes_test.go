@@ -0,0 +1,192 @@
+package fsdb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkByteTree verifies a tree sized in bytes: its structure, that no node
+// outgrew its page and that the storage holds no overflow node left behind.
+func checkByteTree(t *testing.T, bt *BTree, storage *memNodeStorage, entries int) {
+	t.Helper()
+	c := bt.check()
+	if len(c.issues) > 0 {
+		t.Fatalf("tree has issues: %v", c.issues)
+	}
+	if c.shape != bt.shape || c.shape.entries != entries {
+		t.Fatalf("tree holds %+v, tracked %+v, want %d entries", c.shape, bt.shape, entries)
+	}
+	if len(storage.nodes) != len(c.reachable) {
+		t.Fatalf("storage holds %d nodes, %d are reachable", len(storage.nodes), len(c.reachable))
+	}
+	for id := range c.reachable {
+		node := storage.nodes[id]
+		if node.Type == OverflowNode {
+			continue
+		}
+		if bt.full(node) {
+			t.Fatalf("node %s is %d bytes with %d keys, page is %d bytes", id, nodeBytes(node), len(node.Keys), bt.pageBytes)
+		}
+		if node.IsLeaf() {
+			for _, v := range node.Values {
+				if _, ok := v.(overflowRef); !ok && encodedSize(v) > bt.maxInlineBytes() {
+					t.Fatalf("leaf %s stores a %d byte value inline", id, encodedSize(v))
+				}
+			}
+		}
+	}
+}
+
+// randomRow returns a row that is mostly small and sometimes larger than a page.
+func randomRow(rng *rand.Rand, pageBytes int) string {
+	if rng.Intn(8) == 0 {
+		return strings.Repeat("y", pageBytes/4+rng.Intn(3*pageBytes))
+	}
+	return strings.Repeat("x", rng.Intn(pageBytes/8))
+}
+
+func TestBTree_PageBytes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	storage := newMemNodeStorage()
+	bt := NewBTree(storage, "", 0, true)
+	bt.SetPageBytes(1024)
+	model := map[int]string{}
+	for step := 0; step < 3000; step++ {
+		k := rng.Intn(300)
+		var err error
+		if rng.Intn(3) > 0 {
+			row := randomRow(rng, 1024)
+			if _, exists := model[k]; exists {
+				err = bt.Update([]any{k}, row)
+			} else {
+				err = bt.Insert([]any{k}, row)
+			}
+			model[k] = row
+		} else {
+			err = bt.Delete([]any{k})
+			delete(model, k)
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", step, err)
+		}
+		if step%100 == 0 {
+			checkByteTree(t, bt, storage, len(model))
+		}
+	}
+
+	var keys []int
+	for k := range model {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	rows, err := bt.Search(nil)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(rows) != len(keys) {
+		t.Fatalf("tree holds %d rows, model %d", len(rows), len(keys))
+	}
+	for i, k := range keys {
+		if rows[i] != model[k] {
+			t.Fatalf("row %d holds %d bytes, want %d", k, len(rows[i].(string)), len(model[k]))
+		}
+	}
+	for _, k := range keys {
+		if err := bt.Delete([]any{k}); err != nil {
+			t.Fatalf("Delete(%d) failed: %v", k, err)
+		}
+	}
+	if bt.RootID() != "" || len(storage.nodes) != 0 {
+		t.Fatalf("empty tree still stores %d nodes", len(storage.nodes))
+	}
+}
+
+func TestBTree_BulkLoadPageBytes(t *testing.T) {
+	for _, fill := range []float64{0.5, 0.9, 1} {
+		for _, n := range []int{1, 2, 5, 100, 2000} {
+			rng := rand.New(rand.NewSource(int64(n)))
+			rows := make([]string, n)
+			for i := range rows {
+				rows[i] = randomRow(rng, 512)
+			}
+			storage := newMemNodeStorage()
+			bt := NewBTree(storage, "", 0, true)
+			bt.SetPageBytes(512)
+			entries := func(yield func([]any, any) bool) {
+				for i, row := range rows {
+					if !yield([]any{i}, row) {
+						return
+					}
+				}
+			}
+			name := fmt.Sprintf("fill %v n %d", fill, n)
+			if err := bt.BulkLoad(entries, n, fill); err != nil {
+				t.Fatalf("%s: BulkLoad failed: %v", name, err)
+			}
+			checkByteTree(t, bt, storage, n)
+			if got, _ := bt.Search([]any{n - 1}); len(got) != 1 || got[0] != rows[n-1] {
+				t.Fatalf("%s: last row not found", name)
+			}
+			if err := bt.Insert([]any{n}, rows[0]); err != nil {
+				t.Fatalf("%s: Insert after bulk load failed: %v", name, err)
+			}
+			if err := bt.Delete([]any{0}); err != nil {
+				t.Fatalf("%s: Delete after bulk load failed: %v", name, err)
+			}
+			checkByteTree(t, bt, storage, n)
+		}
+	}
+}
+
+func TestCollection_PageBytes(t *testing.T) {
+	db, err := NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: NewMemoryFileProvider()})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	defer db.Close()
+	schema := CollectionSchema{
+		Name: "articles",
+		Indexes: []IndexDefinition{
+			{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageBytes: 1024, Storage: StoragePaged},
+			{Name: "ix_title", Keys: []IndexField{{Name: "title"}}, Includes: []string{"id"}, PageBytes: 512},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("articles")
+	rng := rand.New(rand.NewSource(1))
+	bodies := map[int]string{}
+	for i := 0; i < 200; i++ {
+		bodies[i] = randomRow(rng, 1024)
+		if err := coll.Insert(map[string]any{"id": i, "title": fmt.Sprintf("article %03d", i), "body": bodies[i]}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	for i := 0; i < 200; i += 2 {
+		if err := coll.Delete(map[string]any{"id": i, "title": fmt.Sprintf("article %03d", i)}); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	reports, err := db.Verify(VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if !r.OK() {
+			t.Errorf("%s has issues: %v", r.Index, r.Issues)
+		}
+	}
+	for _, i := range []int{1, 99, 199} {
+		rows, err := coll.Find([]any{i})
+		if err != nil || len(rows) != 1 || rows[0].(map[string]any)["body"] != bodies[i] {
+			t.Errorf("Find(%d) did not return the full row: %v", i, err)
+		}
+	}
+	if entries, _ := coll.FindByIndex("ix_title", []any{"article 101"}); len(entries) != 1 {
+		t.Errorf("expected one index entry for article 101, got %d", len(entries))
+	}
+}
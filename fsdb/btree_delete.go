@@ -0,0 +1,305 @@
+package fsdb
+
+import "fmt"
+
+// Delete removes all records with the given key from the B+ tree.
+// Leaves that fall below half capacity borrow from or merge with a sibling,
+// and the rebalancing propagates up to the root, which collapses when it is
+// left with a single child. Nodes freed by merges are deleted from storage.
+func (bt *BTree) Delete(key []any) error {
+	_, err := bt.deleteAll(key)
+	return err
+}
+
+// deleteAll removes all records with the given key and returns how many were removed.
+func (bt *BTree) deleteAll(key []any) (int, error) {
+	removed := 0
+	for bt.rootID != "" {
+		leaf, pos, err := bt.locate(key)
+		if err != nil {
+			return removed, err
+		}
+		if leaf == nil {
+			break
+		}
+		end := pos
+		for end < len(leaf.Keys) && bt.order.compare(leaf.Keys[end], key) == 0 {
+			end++
+		}
+		values := append([]any(nil), leaf.Values[pos:end]...)
+		if err := bt.removeFromLeaf(leaf, pos, end); err != nil {
+			return removed, err
+		}
+		for _, v := range values {
+			if err := bt.release(v); err != nil {
+				return removed, err
+			}
+		}
+		removed += end - pos
+		bt.shape.entries -= end - pos
+	}
+	return removed, nil
+}
+
+// removeFromLeaf removes the entries [from, to) of a leaf and restores the tree invariants.
+func (bt *BTree) removeFromLeaf(leaf *BTreeNode, from, to int) error {
+	leaf.Keys = append(leaf.Keys[:from], leaf.Keys[to:]...)
+	leaf.Values = append(leaf.Values[:from], leaf.Values[to:]...)
+	leaf.IsDirty = true
+	if err := bt.addToAncestors(leaf, from-to); err != nil {
+		return err
+	}
+	if from == 0 && len(leaf.Keys) > 0 {
+		if err := bt.fixSeparator(leaf); err != nil {
+			return err
+		}
+	}
+	return bt.rebalance(leaf)
+}
+
+// rebalance saves a node that just lost entries, fixing an underflow by borrowing
+// from a sibling or merging with it, and recurses into the parent after a merge.
+func (bt *BTree) rebalance(node *BTreeNode) error {
+	if node.Parent == "" {
+		return bt.rebalanceRoot(node)
+	}
+	if !bt.underflows(node) {
+		return bt.storage.SaveNode(node)
+	}
+	parent, err := bt.loadNode(node.Parent)
+	if err != nil {
+		return err
+	}
+	idx := parent.childIndex(node.ID)
+	if idx < 0 {
+		return fmt.Errorf("node %s is not a child of %s", node.ID, parent.ID)
+	}
+	var left, right *BTreeNode
+	if idx > 0 {
+		if left, err = bt.loadNode(parent.Values[idx-1].(string)); err != nil {
+			return err
+		}
+		for bt.underflows(node) && bt.canLend(left, len(left.Keys)-1) {
+			if err := bt.borrowFromLeft(parent, idx, left, node); err != nil {
+				return err
+			}
+		}
+	}
+	if bt.underflows(node) && idx < len(parent.Values)-1 {
+		if right, err = bt.loadNode(parent.Values[idx+1].(string)); err != nil {
+			return err
+		}
+		for bt.underflows(node) && bt.canLend(right, 0) {
+			if err := bt.borrowFromRight(parent, idx, node, right); err != nil {
+				return err
+			}
+		}
+	}
+	if !bt.underflows(node) {
+		return bt.saveNodes(node, left, right, parent)
+	}
+	switch {
+	case left != nil && bt.canMerge(left, node):
+		if err := bt.saveNodes(right); err != nil {
+			return err
+		}
+		err = bt.merge(parent, idx, left, node)
+	case right != nil && bt.canMerge(node, right):
+		if err := bt.saveNodes(left); err != nil {
+			return err
+		}
+		err = bt.merge(parent, idx+1, node, right)
+	default:
+		// Only child of a non-root parent: nothing to merge with until the parent
+		// is fixed. With byte sizing, the siblings may also be too large to merge.
+		err = bt.saveNodes(node, left, right)
+	}
+	if err != nil {
+		return err
+	}
+	return bt.rebalance(parent)
+}
+
+// rebalanceRoot saves the root, dropping it when the tree becomes empty and
+// collapsing it into its only child when an internal root has no keys left.
+func (bt *BTree) rebalanceRoot(root *BTreeNode) error {
+	if root.IsLeaf() && len(root.Keys) == 0 {
+		bt.rootID = ""
+		bt.shape.height = 0
+		return bt.deleteNode(root.ID)
+	}
+	if !root.IsLeaf() && len(root.Values) == 1 {
+		child, err := bt.loadNode(root.Values[0].(string))
+		if err != nil {
+			return err
+		}
+		child.Parent = ""
+		child.IsDirty = true
+		if err := bt.storage.SaveNode(child); err != nil {
+			return err
+		}
+		bt.rootID = child.ID
+		bt.shape.height--
+		return bt.deleteNode(root.ID)
+	}
+	return bt.storage.SaveNode(root)
+}
+
+// borrowFromLeft moves the last entry of the left sibling into node, which sits at idx in parent.
+// The three nodes are modified in memory; the caller saves them.
+func (bt *BTree) borrowFromLeft(parent *BTreeNode, idx int, left, node *BTreeNode) error {
+	last := len(left.Keys) - 1
+	if node.IsLeaf() {
+		node.Keys = append([][]any{left.Keys[last]}, node.Keys...)
+		node.Values = append([]any{left.Values[last]}, node.Values...)
+		left.Keys = left.Keys[:last]
+		left.Values = left.Values[:last]
+		parent.Keys[idx-1] = node.Keys[0]
+		parent.addCount(idx-1, -1)
+		parent.addCount(idx, 1)
+	} else {
+		moved := left.Values[last+1]
+		count, err := bt.childCount(left, last+1)
+		if err != nil {
+			return err
+		}
+		if left.hasCounts() && node.hasCounts() {
+			node.Counts = append([]int{count}, node.Counts...)
+			left.Counts = left.Counts[:last+1]
+		} else {
+			node.Counts, left.Counts = nil, nil
+		}
+		parent.addCount(idx-1, -count)
+		parent.addCount(idx, count)
+		node.Keys = append([][]any{parent.Keys[idx-1]}, node.Keys...)
+		node.Values = append([]any{moved}, node.Values...)
+		parent.Keys[idx-1] = left.Keys[last]
+		left.Keys = left.Keys[:last]
+		left.Values = left.Values[:last+1]
+		if err := bt.adoptChildren(node, []any{moved}); err != nil {
+			return err
+		}
+	}
+	left.IsDirty, node.IsDirty, parent.IsDirty = true, true, true
+	return nil
+}
+
+// borrowFromRight moves the first entry of the right sibling into node, which sits at idx in parent.
+// The three nodes are modified in memory; the caller saves them.
+func (bt *BTree) borrowFromRight(parent *BTreeNode, idx int, node, right *BTreeNode) error {
+	if node.IsLeaf() {
+		node.Keys = append(node.Keys, right.Keys[0])
+		node.Values = append(node.Values, right.Values[0])
+		right.Keys = right.Keys[1:]
+		right.Values = right.Values[1:]
+		parent.Keys[idx] = right.Keys[0]
+		parent.addCount(idx+1, -1)
+		parent.addCount(idx, 1)
+		if len(node.Keys) == 1 {
+			// node was empty, so the separator on its left is now stale
+			if idx > 0 {
+				parent.Keys[idx-1] = node.Keys[0]
+			} else if err := bt.fixSeparator(node); err != nil {
+				return err
+			}
+		}
+	} else {
+		moved := right.Values[0]
+		count, err := bt.childCount(right, 0)
+		if err != nil {
+			return err
+		}
+		if right.hasCounts() && node.hasCounts() {
+			node.Counts = append(node.Counts, count)
+			right.Counts = right.Counts[1:]
+		} else {
+			node.Counts, right.Counts = nil, nil
+		}
+		parent.addCount(idx+1, -count)
+		parent.addCount(idx, count)
+		node.Keys = append(node.Keys, parent.Keys[idx])
+		node.Values = append(node.Values, moved)
+		parent.Keys[idx] = right.Keys[0]
+		right.Keys = right.Keys[1:]
+		right.Values = right.Values[1:]
+		if err := bt.adoptChildren(node, []any{moved}); err != nil {
+			return err
+		}
+	}
+	right.IsDirty, node.IsDirty, parent.IsDirty = true, true, true
+	return nil
+}
+
+// merge folds right into left (right sits at rightIdx in parent), removes right's
+// separator and pointer from parent, and deletes the right node from storage.
+// The parent is modified in memory only; the caller rebalances and saves it.
+func (bt *BTree) merge(parent *BTreeNode, rightIdx int, left, right *BTreeNode) error {
+	if left.IsLeaf() {
+		left.Keys = append(left.Keys, right.Keys...)
+		left.Values = append(left.Values, right.Values...)
+		left.Next = right.Next
+		if right.Next != "" {
+			next, err := bt.loadNode(right.Next)
+			if err != nil {
+				return err
+			}
+			next.Previous = left.ID
+			next.IsDirty = true
+			if err := bt.storage.SaveNode(next); err != nil {
+				return err
+			}
+		}
+	} else {
+		if left.hasCounts() && right.hasCounts() {
+			left.Counts = append(left.Counts, right.Counts...)
+		} else {
+			left.Counts = nil
+		}
+		left.Keys = append(left.Keys, parent.Keys[rightIdx-1])
+		left.Keys = append(left.Keys, right.Keys...)
+		left.Values = append(left.Values, right.Values...)
+		if err := bt.adoptChildren(left, right.Values); err != nil {
+			return err
+		}
+	}
+	if parent.hasCounts() {
+		parent.Counts[rightIdx-1] += parent.Counts[rightIdx]
+		parent.Counts = append(parent.Counts[:rightIdx], parent.Counts[rightIdx+1:]...)
+	}
+	parent.Keys = append(parent.Keys[:rightIdx-1], parent.Keys[rightIdx:]...)
+	parent.Values = append(parent.Values[:rightIdx], parent.Values[rightIdx+1:]...)
+	parent.IsDirty = true
+	left.IsDirty = true
+	if err := bt.storage.SaveNode(left); err != nil {
+		return err
+	}
+	return bt.deleteNode(right.ID)
+}
+
+// fixSeparator updates the separator that bounds a leaf on its left after the
+// leaf's first key changed. The separator lives in the lowest ancestor in which
+// the leaf's subtree is not the leftmost child; the leftmost leaf has none.
+func (bt *BTree) fixSeparator(leaf *BTreeNode) error {
+	first := leaf.Keys[0]
+	childID, parentID := leaf.ID, leaf.Parent
+	for parentID != "" {
+		parent, err := bt.loadNode(parentID)
+		if err != nil {
+			return err
+		}
+		idx := parent.childIndex(childID)
+		if idx < 0 {
+			return fmt.Errorf("node %s is not a child of %s", childID, parent.ID)
+		}
+		if idx > 0 {
+			if bt.order.compare(parent.Keys[idx-1], first) == 0 {
+				return nil
+			}
+			parent.Keys[idx-1] = first
+			parent.IsDirty = true
+			return bt.storage.SaveNode(parent)
+		}
+		childID, parentID = parent.ID, parent.Parent
+	}
+	return nil
+}
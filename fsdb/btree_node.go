@@ -6,21 +6,24 @@ type NodeType string
 const (
 	LeafNode     NodeType = "leaf"
 	InternalNode NodeType = "internal"
+	OverflowNode NodeType = "overflow" // Holds a single leaf value too large to store inline; see BTree.SetPageBytes
 )
 
 // BTreeNode represents a node in the B+ tree.
 // Each node is stored as a separate file on disk.
 type BTreeNode struct {
-	ID        string   `json:"id"`         // Unique identifier for the node (and filename)
-	Type      NodeType `json:"type"`       // LeafNode or InternalNode
-	IsDirty   bool     `json:"-"`          // True if the node has been modified and needs saving (not persisted in JSON)
-	PageSize  int      `json:"pageSize"`   // Maximum number of keys (degree/order related)
-	Parent    string   `json:"parentID"`   // ID of the parent node; empty for root
-	Keys      [][]any  `json:"keys"`       // Keys stored in the node. Each key is a slice of values for composite keys.
-	Values    []any    `json:"values"`     // For Leaf: data records or pointers. For Internal: child node IDs (strings).
-	Next      string   `json:"nextID"`     // For LeafNode: ID of the next leaf node; empty if last
-	Previous  string   `json:"previousID"` // For LeafNode: ID of the previous leaf node; empty if first
-	indexPath string   `json:"-"`          // Path to the index directory (not persisted in JSON)
+	ID        string   `json:"id"`               // Unique identifier for the node (and filename)
+	Type      NodeType `json:"type"`             // LeafNode or InternalNode
+	IsDirty   bool     `json:"-"`                // True if the node has been modified and needs saving (not persisted in JSON)
+	PageSize  int      `json:"pageSize"`         // Maximum number of keys (degree/order related)
+	Parent    string   `json:"parentID"`         // ID of the parent node; empty for root
+	Keys      [][]any  `json:"keys"`             // Keys stored in the node. Each key is a slice of values for composite keys.
+	Values    []any    `json:"values"`           // For Leaf: data records or pointers. For Internal: child node IDs (strings).
+	Counts    []int    `json:"counts,omitempty"` // For Internal: number of leaf entries below each child, parallel to Values
+	Next      string   `json:"nextID"`           // For LeafNode: ID of the next leaf node; empty if last
+	Previous  string   `json:"previousID"`       // For LeafNode: ID of the previous leaf node; empty if first
+	indexPath string   `json:"-"`                // Path to the index directory (not persisted in JSON)
+	fileExt   string   `json:"-"`                // Extension of the file the node was loaded from
 }
 
 // NewBTreeNode creates a new BTreeNode.
@@ -49,13 +52,42 @@ func (n *BTreeNode) IsFull() bool {
 	return len(n.Keys) >= n.PageSize
 }
 
-// CanBorrow returns true if the node has more than the minimum number of keys/values
-// and can lend one to a sibling.
-// Minimum keys for a non-root node is ceil(PageSize/2) - 1 for internal, ceil(PageSize/2) for leaf (simplified to PageSize/2)
+// MinKeys returns the minimum number of keys a non-root node must hold.
+// A full node of PageSize keys splits into halves that both satisfy it, and
+// two siblings that cannot lend to each other always fit in one node.
+func (n *BTreeNode) MinKeys() int {
+	if n.IsLeaf() {
+		return n.PageSize / 2
+	}
+	return (n.PageSize - 1) / 2
+}
+
+// CanBorrow returns true if the node has more than the minimum number of keys
+// and can lend one to a sibling without underflowing itself.
 func (n *BTreeNode) CanBorrow() bool {
-	// Simplified: can borrow if more than half full + 1 (ensuring it doesn't go below min after lending)
-	// A more precise calculation depends on B+ tree rules for min fill factor.
-	// For internal nodes, min keys = ceil(m/2)-1. For leaf, min keys = floor(m/2) or ceil(m/2).
-	// Let's use a simple heuristic: more than half full.
-	return len(n.Keys) > n.PageSize/2
+	return len(n.Keys) > n.MinKeys()
+}
+
+// hasCounts reports whether an internal node records the number of entries
+// below each of its children. Nodes written before counts were kept lack them.
+func (n *BTreeNode) hasCounts() bool {
+	return !n.IsLeaf() && len(n.Counts) == len(n.Values)
+}
+
+// addCount adds delta to the number of entries recorded below the i-th child.
+func (n *BTreeNode) addCount(i, delta int) {
+	if n.hasCounts() {
+		n.Counts[i] += delta
+		n.IsDirty = true
+	}
+}
+
+// childIndex returns the position of a child ID within an internal node's Values, or -1.
+func (n *BTreeNode) childIndex(childID string) int {
+	for i, v := range n.Values {
+		if id, ok := v.(string); ok && id == childID {
+			return i
+		}
+	}
+	return -1
 }
@@ -2,24 +2,45 @@ package fsdb
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // BTreeNodeStorage abstracts node persistence for different file providers.
 type BTreeNodeStorage interface {
 	SaveNode(node *BTreeNode) error
 	LoadNode(nodeID string) (*BTreeNode, error)
+	DeleteNode(nodeID string) error
 }
 
-// FileBTreeNodeStorage implements BTreeNodeStorage using the local filesystem.
+// FileBTreeNodeStorage implements BTreeNodeStorage with one file per node,
+// accessed through an IFileProvider (the local filesystem when Provider is nil).
+// Nodes are written in Format; nodes of either format are read back, so an index
+// written as JSON keeps opening and is converted node by node as it is modified.
 type FileBTreeNodeStorage struct {
 	IndexPath string
+	Format    NodeFormat    // Encoding of saved nodes; binary when empty
+	Provider  IFileProvider // File backend; the local filesystem when nil
+}
+
+const (
+	binaryNodeExt = ".node"
+	jsonNodeExt   = ".json"
+)
+
+func (fs *FileBTreeNodeStorage) files() IFileProvider {
+	if fs.Provider == nil {
+		return &FileProvider{}
+	}
+	return fs.Provider
 }
 
 // Init ensures the index directory exists.
 func (s *FileBTreeNodeStorage) Init() error {
-	return os.MkdirAll(s.IndexPath, 0755)
+	return s.files().CreateDirectory(s.IndexPath)
 }
 
 func (fs *FileBTreeNodeStorage) SaveNode(node *BTreeNode) error {
@@ -29,29 +50,83 @@ func (fs *FileBTreeNodeStorage) SaveNode(node *BTreeNode) error {
 	if fs.IndexPath == "" || node.ID == "" {
 		return os.ErrInvalid
 	}
-	filePath := filepath.Join(fs.IndexPath, node.ID+".json")
-	data, err := json.MarshalIndent(node, "", "  ")
+	ext := binaryNodeExt
+	var data []byte
+	var err error
+	if fs.Format == NodeFormatJSON {
+		ext = jsonNodeExt
+		data, err = json.MarshalIndent(node, "", "  ")
+	} else {
+		data, err = encodeNode(node)
+	}
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(filePath, data, 0644)
-	if err == nil {
-		node.IsDirty = false
+	files := fs.files()
+	if err := files.WriteFile(fs.IndexPath, node.ID+ext, data); err != nil {
+		return err
+	}
+	if node.fileExt != "" && node.fileExt != ext {
+		// The node was stored in the other format; drop the stale copy.
+		if err := files.DeleteFile(fs.IndexPath, node.ID+node.fileExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
-	return err
+	node.fileExt = ext
+	node.IsDirty = false
+	return nil
 }
 
 func (fs *FileBTreeNodeStorage) LoadNode(nodeID string) (*BTreeNode, error) {
-	filePath := filepath.Join(fs.IndexPath, nodeID+".json")
-	data, err := os.ReadFile(filePath)
+	files := fs.files()
+	ext := binaryNodeExt
+	data, err := files.ReadFile(fs.IndexPath, nodeID+ext)
+	if errors.Is(err, os.ErrNotExist) {
+		ext = jsonNodeExt
+		data, err = files.ReadFile(fs.IndexPath, nodeID+ext)
+	}
 	if err != nil {
 		return nil, err
 	}
-	var node BTreeNode
-	if err := json.Unmarshal(data, &node); err != nil {
-		return nil, err
+	node, err := decodeNode(data)
+	if err != nil {
+		return nil, fmt.Errorf("load node %s: %w", nodeID, err)
 	}
 	node.indexPath = fs.IndexPath
+	node.fileExt = ext
 	node.IsDirty = false
-	return &node, nil
+	return node, nil
+}
+
+func (fs *FileBTreeNodeStorage) DeleteNode(nodeID string) error {
+	files := fs.files()
+	for _, ext := range []string{binaryNodeExt, jsonNodeExt} {
+		err := files.DeleteFile(fs.IndexPath, nodeID+ext)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// NodeIDs returns the IDs of the nodes stored in the index directory, in either format.
+func (fs *FileBTreeNodeStorage) NodeIDs() ([]string, error) {
+	entries, err := fs.files().ReadDirectory(fs.IndexPath)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	seen := map[string]bool{}
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || (ext != binaryNodeExt && ext != jsonNodeExt) || name == indexMetaFile {
+			continue
+		}
+		if id := strings.TrimSuffix(name, ext); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
 }
@@ -0,0 +1,94 @@
+package fsdb
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// overflowRef stands in a leaf for a value stored in an overflow node. With byte
+// sizing, values too large to leave room for other entries in a page are moved
+// out of line, so that a leaf stays within its page however large its rows are.
+// Overflow nodes are saved through the tree's storage like any other node (a
+// paged data file continues them over as many pages as they need) but are not
+// part of the tree: they are only reachable from the leaf entry that owns them.
+type overflowRef string
+
+// overflowJSONKey marks a reference in nodes stored in the JSON format.
+const overflowJSONKey = "$overflow"
+
+// MarshalJSON encodes the reference as {"$overflow": id}.
+func (r overflowRef) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{overflowJSONKey: string(r)})
+}
+
+// overflowRefFromJSON recognizes a reference decoded from a JSON node.
+func overflowRefFromJSON(v any) (overflowRef, bool) {
+	m, ok := v.(map[string]any)
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	id, ok := m[overflowJSONKey].(string)
+	return overflowRef(id), ok
+}
+
+// maxInlineBytes returns the largest encoded value kept in a leaf, a quarter of
+// the page, or 0 when nodes are sized by key count and values are never moved.
+func (bt *BTree) maxInlineBytes() int {
+	return bt.pageBytes / 4
+}
+
+// inline returns what a leaf stores for value: the value itself, or a reference
+// to a new overflow node holding it when it is too large.
+func (bt *BTree) inline(value any) (any, error) {
+	if bt.pageBytes <= 0 || encodedSize(value) <= bt.maxInlineBytes() {
+		return value, nil
+	}
+	id, err := bt.newNodeID()
+	if err != nil {
+		return nil, err
+	}
+	node := &BTreeNode{ID: id, Type: OverflowNode, Values: []any{value}, IsDirty: true}
+	if err := bt.storage.SaveNode(node); err != nil {
+		return nil, err
+	}
+	return overflowRef(id), nil
+}
+
+// resolve returns the value a leaf entry stands for, loading it from its
+// overflow node if it was moved out of line.
+func (bt *BTree) resolve(v any) (any, error) {
+	ref, ok := v.(overflowRef)
+	if !ok {
+		return v, nil
+	}
+	node, err := bt.storage.LoadNode(string(ref))
+	if err != nil {
+		return nil, fmt.Errorf("overflow node %s: %w", ref, err)
+	}
+	if node.Type != OverflowNode || len(node.Values) != 1 {
+		return nil, fmt.Errorf("node %s is not an overflow node", ref)
+	}
+	return node.Values[0], nil
+}
+
+// release deletes the overflow node of a value removed from a leaf, if any.
+func (bt *BTree) release(v any) error {
+	if ref, ok := v.(overflowRef); ok {
+		return bt.storage.DeleteNode(string(ref))
+	}
+	return nil
+}
+
+// overflowIDs returns the IDs of the overflow nodes referenced by a leaf.
+func overflowIDs(leaf *BTreeNode) []string {
+	var ids []string
+	if !leaf.IsLeaf() {
+		return nil
+	}
+	for _, v := range leaf.Values {
+		if ref, ok := v.(overflowRef); ok {
+			ids = append(ids, string(ref))
+		}
+	}
+	return ids
+}
@@ -0,0 +1,269 @@
+package fsdb
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Internal nodes record how many leaf entries lie below each of their children
+// (BTreeNode.Counts), which turns counting and positioning by offset into a
+// single descent: the entries before a key are the counts of the children left
+// of the descent path plus the entries before it in the final leaf. Every
+// operation that moves entries between subtrees adjusts the counts of the
+// nodes it touches; inserts and deletes also update each ancestor of the leaf.
+//
+// Nodes written before counts were kept have none. Reads then count the
+// subtree below such a node, and IndexManager fills the counts in when it opens
+// an index of an older format.
+
+// countedEntries returns the number of entries below a leaf or an internal node
+// that has counts.
+func countedEntries(n *BTreeNode) int {
+	if n.IsLeaf() {
+		return len(n.Keys)
+	}
+	total := 0
+	for _, c := range n.Counts {
+		total += c
+	}
+	return total
+}
+
+// subtreeCount returns the number of entries below a node.
+func (bt *BTree) subtreeCount(n *BTreeNode) (int, error) {
+	if n.IsLeaf() || n.hasCounts() {
+		return countedEntries(n), nil
+	}
+	total := 0
+	for i := range n.Values {
+		c, err := bt.childCount(n, i)
+		if err != nil {
+			return 0, err
+		}
+		total += c
+	}
+	return total, nil
+}
+
+// childCount returns the number of entries below the i-th child of an internal node.
+func (bt *BTree) childCount(n *BTreeNode, i int) (int, error) {
+	if n.hasCounts() {
+		return n.Counts[i], nil
+	}
+	child, err := bt.storage.LoadNode(n.Values[i].(string))
+	if err != nil {
+		return 0, err
+	}
+	return bt.subtreeCount(child)
+}
+
+// countChildren sets the counts of a new internal node from its children.
+func (bt *BTree) countChildren(parent *BTreeNode, children ...*BTreeNode) error {
+	parent.Counts = make([]int, len(children))
+	for i, child := range children {
+		c, err := bt.subtreeCount(child)
+		if err != nil {
+			return err
+		}
+		parent.Counts[i] = c
+	}
+	return nil
+}
+
+// addToAncestors adds delta to the count every ancestor keeps for the subtree
+// holding node, after entries were added to or removed from it.
+func (bt *BTree) addToAncestors(node *BTreeNode, delta int) error {
+	childID, parentID := node.ID, node.Parent
+	for parentID != "" {
+		parent, err := bt.loadNode(parentID)
+		if err != nil {
+			return err
+		}
+		idx := parent.childIndex(childID)
+		if idx < 0 {
+			return fmt.Errorf("node %s is not a child of %s", childID, parent.ID)
+		}
+		if parent.hasCounts() {
+			parent.addCount(idx, delta)
+			if err := bt.storage.SaveNode(parent); err != nil {
+				return err
+			}
+		}
+		childID, parentID = parent.ID, parent.Parent
+	}
+	return nil
+}
+
+// rebuildCounts recomputes the counts of every internal node, saving the nodes
+// whose counts were missing or wrong.
+func (bt *BTree) rebuildCounts() error {
+	if bt.rootID == "" {
+		return nil
+	}
+	_, err := bt.rebuildCountsBelow(bt.rootID)
+	return err
+}
+
+func (bt *BTree) rebuildCountsBelow(nodeID string) (int, error) {
+	node, err := bt.loadNode(nodeID)
+	if err != nil {
+		return 0, err
+	}
+	if node.IsLeaf() {
+		return len(node.Keys), nil
+	}
+	counts := make([]int, len(node.Values))
+	total := 0
+	for i, v := range node.Values {
+		id, ok := v.(string)
+		if !ok {
+			return 0, fmt.Errorf("internal node %s has a non-string child %#v", node.ID, v)
+		}
+		if counts[i], err = bt.rebuildCountsBelow(id); err != nil {
+			return 0, err
+		}
+		total += counts[i]
+	}
+	if !slices.Equal(node.Counts, counts) {
+		node.Counts = counts
+		node.IsDirty = true
+		if err := bt.storage.SaveNode(node); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// countBefore returns the number of entries whose keys, compared on the prefix
+// of bound's length, sort before bound, or before or equal to it when orEqual.
+func (bt *BTree) countBefore(bound []any, orEqual bool) (int, error) {
+	if bt.rootID == "" {
+		return 0, nil
+	}
+	before := func(key []any) bool {
+		c := bt.order.comparePrefix(key, bound)
+		return c < 0 || (c == 0 && orEqual)
+	}
+	node, err := bt.storage.LoadNode(bt.rootID)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for !node.IsLeaf() {
+		// Every key below a child is at most its separator, so the children
+		// whose separators sort before the bound are counted whole.
+		pos := 0
+		for pos < len(node.Keys) && before(node.Keys[pos]) {
+			c, err := bt.childCount(node, pos)
+			if err != nil {
+				return 0, err
+			}
+			count += c
+			pos++
+		}
+		if node, err = bt.storage.LoadNode(node.Values[pos].(string)); err != nil {
+			return 0, err
+		}
+	}
+	for _, k := range node.Keys {
+		if !before(k) {
+			break
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Rank returns the number of entries whose keys sort before key, which is the
+// offset of the first entry greater than or equal to it. A key shorter than
+// the index key is compared on its leading fields.
+func (bt *BTree) Rank(key []any) (int, error) {
+	return bt.countBefore(key, false)
+}
+
+// rangeOffsets returns the offsets of the first entry within r and of the
+// first entry past it.
+func (bt *BTree) rangeOffsets(r KeyRange) (int, int, error) {
+	var lo, hi int
+	var err error
+	if r.Lower != nil {
+		if lo, err = bt.countBefore(r.Lower, !r.LowerInclusive); err != nil {
+			return 0, 0, err
+		}
+	}
+	if r.Upper != nil {
+		hi, err = bt.countBefore(r.Upper, r.UpperInclusive)
+	} else if bt.rootID != "" {
+		var root *BTreeNode
+		if root, err = bt.storage.LoadNode(bt.rootID); err == nil {
+			hi, err = bt.subtreeCount(root)
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return lo, max(hi, lo), nil
+}
+
+// CountRange returns the number of entries whose keys fall within r without
+// visiting them: it descends the tree once for each bound.
+func (bt *BTree) CountRange(r KeyRange) (int, error) {
+	lo, hi, err := bt.rangeOffsets(r)
+	return hi - lo, err
+}
+
+// leafAt descends to the leaf holding the entry at the given offset and returns
+// the leaf and the entry's position within it.
+func (bt *BTree) leafAt(offset int) (*BTreeNode, int, error) {
+	node, err := bt.storage.LoadNode(bt.rootID)
+	if err != nil {
+		return nil, 0, err
+	}
+	for !node.IsLeaf() {
+		pos := 0
+		for ; pos < len(node.Values)-1; pos++ {
+			c, err := bt.childCount(node, pos)
+			if err != nil {
+				return nil, 0, err
+			}
+			if offset < c {
+				break
+			}
+			offset -= c
+		}
+		if node, err = bt.storage.LoadNode(node.Values[pos].(string)); err != nil {
+			return nil, 0, err
+		}
+	}
+	if offset >= len(node.Keys) {
+		return nil, 0, fmt.Errorf("entry counts of the tree disagree with leaf %s", node.ID)
+	}
+	return node, offset, nil
+}
+
+// SeekToOffset repositions the cursor so that the next call to Next returns the
+// entry at offset n within the cursor's range, counting from its first entry
+// (from its last for a reverse cursor). The entries skipped are not visited.
+// A cursor positioned past the end of its range returns no more entries.
+func (c *Cursor) SeekToOffset(n int) {
+	if c.closed {
+		return
+	}
+	c.Seek(nil)
+	lo, hi, err := c.tree.rangeOffsets(c.r)
+	if err != nil {
+		c.err = err
+		return
+	}
+	i := lo + n
+	if c.reverse {
+		i = hi - 1 - n
+	}
+	if n < 0 || i < lo || i >= hi {
+		c.finish()
+		return
+	}
+	if c.node, c.pos, err = c.tree.leafAt(i); err != nil {
+		c.err = err
+	}
+}
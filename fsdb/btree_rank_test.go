@@ -0,0 +1,181 @@
+package fsdb
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestBTree_OrderStatistics(t *testing.T) {
+	for _, pageBytes := range []int{0, 256} {
+		rng := rand.New(rand.NewSource(int64(pageBytes)))
+		storage := newMemNodeStorage()
+		bt := NewBTree(storage, "", 4, false)
+		bt.SetPageBytes(pageBytes)
+		var model []int // Keys in tree order; duplicates allowed
+		for step := 0; step < 2000; step++ {
+			k := rng.Intn(100)
+			if rng.Intn(3) > 0 {
+				if err := bt.Insert([]any{k}, k); err != nil {
+					t.Fatalf("bytes %d step %d: Insert(%d) failed: %v", pageBytes, step, k, err)
+				}
+				model = append(model, k)
+			} else {
+				if err := bt.Delete([]any{k}); err != nil {
+					t.Fatalf("bytes %d step %d: Delete(%d) failed: %v", pageBytes, step, k, err)
+				}
+				kept := model[:0]
+				for _, m := range model {
+					if m != k {
+						kept = append(kept, m)
+					}
+				}
+				model = kept
+			}
+			if step%200 != 0 {
+				continue
+			}
+			sort.Ints(model)
+			if c := bt.check(); len(c.issues) > 0 {
+				t.Fatalf("bytes %d step %d: tree has issues: %v", pageBytes, step, c.issues)
+			}
+			checkOrderStatistics(t, bt, model)
+		}
+	}
+}
+
+// checkOrderStatistics compares Rank, CountRange and SeekToOffset with the
+// sorted keys of the tree.
+func checkOrderStatistics(t *testing.T, bt *BTree, keys []int) {
+	t.Helper()
+	for k := -1; k <= 100; k += 7 {
+		want := sort.SearchInts(keys, k)
+		if got, err := bt.Rank([]any{k}); err != nil || got != want {
+			t.Fatalf("Rank(%d) = %d, %v, want %d", k, got, err, want)
+		}
+	}
+	ranges := []KeyRange{
+		{},
+		{Lower: []any{20}, LowerInclusive: true},
+		{Upper: []any{70}},
+		{Lower: []any{30}, Upper: []any{60}, UpperInclusive: true},
+		ExactRange([]any{50}),
+		{Lower: []any{60}, Upper: []any{30}},
+	}
+	for _, r := range ranges {
+		var inRange []int
+		for _, k := range keys {
+			if r.aboveLower(bt.order, []any{k}) && r.belowUpper(bt.order, []any{k}) {
+				inRange = append(inRange, k)
+			}
+		}
+		if got, err := bt.CountRange(r); err != nil || got != len(inRange) {
+			t.Fatalf("CountRange(%+v) = %d, %v, want %d", r, got, err, len(inRange))
+		}
+		for _, offset := range []int{0, 1, len(inRange) / 3, max(len(inRange)-1, 0), len(inRange)} {
+			page, err := bt.SearchPage(r, offset, 3)
+			if err != nil {
+				t.Fatalf("SearchPage(%+v, %d) failed: %v", r, offset, err)
+			}
+			want := inRange[min(offset, len(inRange)):min(offset+3, len(inRange))]
+			if got := intValues(t, page); !equalInts(got, want) {
+				t.Fatalf("SearchPage(%+v, %d) = %v, want %v", r, offset, got, want)
+			}
+			cur := bt.ReverseCursor(r)
+			cur.SeekToOffset(offset)
+			if offset < len(inRange) {
+				if !cur.Next() || cur.Value() != inRange[len(inRange)-1-offset] {
+					t.Fatalf("reverse SeekToOffset(%d) in %+v returned %v, want %d", offset, r, cur.Value(), inRange[len(inRange)-1-offset])
+				}
+			} else if cur.Next() {
+				t.Fatalf("reverse SeekToOffset(%d) past the %d entries of %+v returned %v", offset, len(inRange), r, cur.Value())
+			}
+			cur.Close()
+		}
+	}
+}
+
+func TestBTree_OrderStatisticsBulkLoad(t *testing.T) {
+	for _, pageBytes := range []int{0, 256} {
+		for _, n := range []int{1, 7, 500} {
+			bt := NewBTree(newMemNodeStorage(), "", 5, true)
+			bt.SetPageBytes(pageBytes)
+			keys := make([]int, n)
+			entries := func(yield func([]any, any) bool) {
+				for i := range keys {
+					if !yield([]any{i}, i) {
+						return
+					}
+				}
+			}
+			for i := range keys {
+				keys[i] = i
+			}
+			if err := bt.BulkLoad(entries, n, 0.7); err != nil {
+				t.Fatalf("BulkLoad failed: %v", err)
+			}
+			if c := bt.check(); len(c.issues) > 0 {
+				t.Fatalf("bytes %d n %d: tree has issues: %v", pageBytes, n, c.issues)
+			}
+			t.Run(fmt.Sprintf("bytes %d n %d", pageBytes, n), func(t *testing.T) {
+				checkOrderStatistics(t, bt, keys)
+			})
+		}
+	}
+}
+
+// failingNodeStorage fails every SaveNode of a leaf while fail is set.
+type failingNodeStorage struct {
+	*memNodeStorage
+	fail bool
+}
+
+func (s *failingNodeStorage) SaveNode(node *BTreeNode) error {
+	if s.fail && node.IsLeaf() {
+		return fmt.Errorf("save %s: injected failure", node.ID)
+	}
+	return s.memNodeStorage.SaveNode(node)
+}
+
+func TestBTree_FailedInsertKeepsCounts(t *testing.T) {
+	storage := &failingNodeStorage{memNodeStorage: newMemNodeStorage()}
+	bt := NewBTree(storage, "", 4, true)
+	var keys []int
+	for k := 0; k < 200; k += 2 {
+		if err := bt.Insert([]any{k}, k); err != nil {
+			t.Fatalf("Insert(%d) failed: %v", k, err)
+		}
+		keys = append(keys, k)
+	}
+	if bt.shape.height < 3 {
+		t.Fatalf("tree height = %d, want at least 3", bt.shape.height)
+	}
+	for _, k := range []int{0, 50, 198} {
+		if err := bt.Insert([]any{k}, k); err == nil {
+			t.Fatalf("Insert(%d) of a duplicate succeeded", k)
+		}
+	}
+	storage.fail = true
+	for k := 1; k < 200; k += 2 {
+		if err := bt.Insert([]any{k}, k); err == nil {
+			t.Fatalf("Insert(%d) succeeded with failing saves", k)
+		}
+	}
+	storage.fail = false
+	if c := bt.check(); len(c.issues) > 0 {
+		t.Fatalf("tree has issues after failed inserts: %v", c.issues)
+	}
+	checkOrderStatistics(t, bt, keys)
+	for k := 1; k < 200; k += 2 {
+		if err := bt.Insert([]any{k}, k); err != nil {
+			t.Fatalf("Insert(%d) failed: %v", k, err)
+		}
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	if c := bt.check(); len(c.issues) > 0 {
+		t.Fatalf("tree has issues: %v", c.issues)
+	}
+	checkOrderStatistics(t, bt, keys)
+}
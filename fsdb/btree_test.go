@@ -0,0 +1,310 @@
+package fsdb
+
+import (
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// memNodeStorage is an in-memory BTreeNodeStorage that mimics file semantics:
+// every LoadNode returns a fresh copy, so unsaved changes are never visible.
+type memNodeStorage struct {
+	nodes map[string]*BTreeNode
+}
+
+func newMemNodeStorage() *memNodeStorage {
+	return &memNodeStorage{nodes: make(map[string]*BTreeNode)}
+}
+
+func (s *memNodeStorage) SaveNode(node *BTreeNode) error {
+	if !node.IsDirty {
+		return nil
+	}
+	s.nodes[node.ID] = copyNode(node)
+	node.IsDirty = false
+	return nil
+}
+
+func (s *memNodeStorage) LoadNode(nodeID string) (*BTreeNode, error) {
+	node, ok := s.nodes[nodeID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return copyNode(node), nil
+}
+
+func (s *memNodeStorage) DeleteNode(nodeID string) error {
+	delete(s.nodes, nodeID)
+	return nil
+}
+
+func copyNode(node *BTreeNode) *BTreeNode {
+	c := *node
+	c.Keys = append([][]any(nil), node.Keys...)
+	c.Values = append([]any(nil), node.Values...)
+	c.Counts = append([]int(nil), node.Counts...)
+	c.IsDirty = false
+	return &c
+}
+
+func newTestTree(pageSize int, unique bool, keys ...int) *BTree {
+	bt := NewBTree(newMemNodeStorage(), "", pageSize, unique)
+	for _, k := range keys {
+		if err := bt.Insert([]any{k}, k); err != nil {
+			panic(err)
+		}
+	}
+	return bt
+}
+
+func intValues(t *testing.T, values []any) []int {
+	t.Helper()
+	out := make([]int, len(values))
+	for i, v := range values {
+		out[i] = v.(int)
+	}
+	return out
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBTree_SearchRange(t *testing.T) {
+	var keys []int
+	for i := 40; i >= 1; i-- {
+		keys = append(keys, i)
+	}
+	bt := newTestTree(4, true, keys...)
+
+	tests := []struct {
+		name string
+		r    KeyRange
+		want []int
+	}{
+		{"closed", KeyRange{Lower: []any{10}, Upper: []any{14}, LowerInclusive: true, UpperInclusive: true}, []int{10, 11, 12, 13, 14}},
+		{"open", KeyRange{Lower: []any{10}, Upper: []any{14}}, []int{11, 12, 13}},
+		{"open lower bound", KeyRange{Upper: []any{3}, UpperInclusive: true}, []int{1, 2, 3}},
+		{"open upper bound", KeyRange{Lower: []any{38}}, []int{39, 40}},
+		{"empty", KeyRange{Lower: []any{20}, Upper: []any{20}}, []int{}},
+		{"out of range", KeyRange{Lower: []any{100}, LowerInclusive: true}, []int{}},
+		{"exact", ExactRange([]any{7}), []int{7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := bt.SearchRange(tt.r)
+			if err != nil {
+				t.Fatalf("SearchRange failed: %v", err)
+			}
+			if got := intValues(t, results); !equalInts(got, tt.want) {
+				t.Errorf("SearchRange(%+v) = %v, want %v", tt.r, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBTree_SearchRangeDuplicatesAndPrefix(t *testing.T) {
+	bt := NewBTree(newMemNodeStorage(), "", 3, false)
+	for i := 0; i < 30; i++ {
+		if err := bt.Insert([]any{i % 5, i}, i); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	results, err := bt.Search([]any{2})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{2, 7, 12, 17, 22, 27}) {
+		t.Errorf("prefix search = %v", got)
+	}
+
+	results, err = bt.SearchRange(KeyRange{Lower: []any{3, 10}, Upper: []any{4}, UpperInclusive: true})
+	if err != nil {
+		t.Fatalf("SearchRange failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{13, 18, 23, 28, 4, 9, 14, 19, 24, 29}) {
+		t.Errorf("composite range = %v", got)
+	}
+}
+
+// checkTree asserts the structural invariants of a tree backed by memNodeStorage:
+// sorted keys within separator bounds, minimum fill, parent pointers, a doubly
+// linked leaf chain, uniform leaf depth and no unreachable nodes in storage.
+func checkTree(t *testing.T, bt *BTree, storage *memNodeStorage) int {
+	t.Helper()
+	if bt.rootID == "" {
+		if len(storage.nodes) != 0 {
+			t.Fatalf("empty tree still stores %d nodes", len(storage.nodes))
+		}
+		return 0
+	}
+	reachable := map[string]bool{}
+	var leaves []*BTreeNode
+	leafDepth := -1
+	var walk func(id, parent string, lo, hi []any, depth int) int
+	walk = func(id, parent string, lo, hi []any, depth int) int {
+		node, err := storage.LoadNode(id)
+		if err != nil {
+			t.Fatalf("missing node %s: %v", id, err)
+		}
+		reachable[id] = true
+		if node.Parent != parent {
+			t.Fatalf("node %s has parent %q, want %q", id, node.Parent, parent)
+		}
+		if parent != "" && len(node.Keys) < node.MinKeys() {
+			t.Fatalf("node %s underflows with %d keys", id, len(node.Keys))
+		}
+		if len(node.Keys) >= node.PageSize {
+			t.Fatalf("node %s overflows with %d keys", id, len(node.Keys))
+		}
+		for i, k := range node.Keys {
+			if i > 0 && bt.order.compare(node.Keys[i-1], k) > 0 {
+				t.Fatalf("node %s keys out of order at %d", id, i)
+			}
+			if (lo != nil && bt.order.compare(k, lo) < 0) || (hi != nil && bt.order.compare(k, hi) > 0) {
+				t.Fatalf("node %s key %v outside separator bounds [%v, %v]", id, k, lo, hi)
+			}
+		}
+		if node.IsLeaf() {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				t.Fatalf("leaf %s at depth %d, want %d", id, depth, leafDepth)
+			}
+			leaves = append(leaves, node)
+			return len(node.Keys)
+		}
+		if len(node.Values) != len(node.Keys)+1 || len(node.Counts) != len(node.Values) {
+			t.Fatalf("internal node %s has %d keys, %d children and %d counts", id, len(node.Keys), len(node.Values), len(node.Counts))
+		}
+		entries := 0
+		for i, v := range node.Values {
+			clo, chi := lo, hi
+			if i > 0 {
+				clo = node.Keys[i-1]
+			}
+			if i < len(node.Keys) {
+				chi = node.Keys[i]
+			}
+			n := walk(v.(string), id, clo, chi, depth+1)
+			if node.Counts[i] != n {
+				t.Fatalf("internal node %s counts %d entries below child %d, want %d", id, node.Counts[i], i, n)
+			}
+			entries += n
+		}
+		return entries
+	}
+	walk(bt.rootID, "", nil, nil, 0)
+	count := 0
+	for i, leaf := range leaves {
+		prev, next := "", ""
+		if i > 0 {
+			prev = leaves[i-1].ID
+		}
+		if i < len(leaves)-1 {
+			next = leaves[i+1].ID
+		}
+		if leaf.Previous != prev || leaf.Next != next {
+			t.Fatalf("leaf %s links (%q, %q), want (%q, %q)", leaf.ID, leaf.Previous, leaf.Next, prev, next)
+		}
+		count += len(leaf.Keys)
+	}
+	if len(reachable) != len(storage.nodes) {
+		t.Fatalf("%d nodes stored but only %d reachable", len(storage.nodes), len(reachable))
+	}
+	return count
+}
+
+func TestBTree_DeleteRebalancesAgainstModel(t *testing.T) {
+	for _, pageSize := range []int{3, 4, 5, 8} {
+		rng := rand.New(rand.NewSource(int64(pageSize)))
+		storage := newMemNodeStorage()
+		bt := NewBTree(storage, "", pageSize, true)
+		model := map[int]bool{}
+		for step := 0; step < 3000; step++ {
+			k := rng.Intn(300)
+			if rng.Intn(3) > 0 && !model[k] {
+				if err := bt.Insert([]any{k}, k); err != nil {
+					t.Fatalf("page %d step %d: Insert(%d) failed: %v", pageSize, step, k, err)
+				}
+				model[k] = true
+			} else {
+				if err := bt.Delete([]any{k}); err != nil {
+					t.Fatalf("page %d step %d: Delete(%d) failed: %v", pageSize, step, k, err)
+				}
+				delete(model, k)
+			}
+			if step%50 == 0 {
+				if n := checkTree(t, bt, storage); n != len(model) {
+					t.Fatalf("page %d step %d: tree holds %d entries, model %d", pageSize, step, n, len(model))
+				}
+			}
+		}
+		var want []int
+		for k := range model {
+			want = append(want, k)
+		}
+		sort.Ints(want)
+		results, err := bt.Search(nil)
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if got := intValues(t, results); !equalInts(got, want) {
+			t.Fatalf("page %d: tree contents differ from model", pageSize)
+		}
+		for _, k := range want {
+			if err := bt.Delete([]any{k}); err != nil {
+				t.Fatalf("Delete(%d) failed: %v", k, err)
+			}
+		}
+		checkTree(t, bt, storage)
+		if bt.RootID() != "" {
+			t.Fatalf("page %d: expected empty tree after deleting everything", pageSize)
+		}
+	}
+}
+
+func TestBTree_DeleteDuplicates(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	storage := newMemNodeStorage()
+	bt := NewBTree(storage, "", 4, false)
+	model := map[int]int{}
+	for i := 0; i < 600; i++ {
+		k := rng.Intn(20)
+		if err := bt.Insert([]any{k}, k); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		model[k]++
+	}
+	for k := 0; k < 20; k += 3 {
+		if err := bt.Delete([]any{k}); err != nil {
+			t.Fatalf("Delete(%d) failed: %v", k, err)
+		}
+		delete(model, k)
+		results, err := bt.Search([]any{k})
+		if err != nil || len(results) != 0 {
+			t.Fatalf("Search(%d) after delete = %v, %v", k, results, err)
+		}
+	}
+	total := 0
+	for k, n := range model {
+		results, err := bt.Search([]any{k})
+		if err != nil || len(results) != n {
+			t.Fatalf("Search(%d) = %d entries, want %d (err %v)", k, len(results), n, err)
+		}
+		total += n
+	}
+	if n := checkTree(t, bt, storage); n != total {
+		t.Fatalf("tree holds %d entries, want %d", n, total)
+	}
+}
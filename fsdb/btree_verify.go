@@ -0,0 +1,284 @@
+package fsdb
+
+import (
+	"fmt"
+	"iter"
+)
+
+// VerifyIssueKind classifies a problem found while verifying an index.
+type VerifyIssueKind string
+
+const (
+	IssueKeyOrder    VerifyIssueKind = "key_order"   // Keys of a node are out of order
+	IssueSeparator   VerifyIssueKind = "separator"   // A key lies outside the range set by the parent's separators
+	IssueParentLink  VerifyIssueKind = "parent_link" // A node's Parent does not name the node referencing it
+	IssueLeafChain   VerifyIssueKind = "leaf_chain"  // Next/Previous do not link the leaves in key order
+	IssueOverfull    VerifyIssueKind = "overfull"    // A node holds as many keys as the page size or more, or is twice its page bytes
+	IssueStructure   VerifyIssueKind = "structure"   // Malformed node, leaves at different depths or a node reached twice
+	IssueDangling    VerifyIssueKind = "dangling"    // A reference to a node that cannot be loaded
+	IssueUnreachable VerifyIssueKind = "unreachable" // A stored node that is not reachable from the root
+	IssueMeta        VerifyIssueKind = "meta"        // The index metadata disagrees with the tree
+	IssueCount       VerifyIssueKind = "count"       // An internal node records a wrong number of entries below a child
+)
+
+// VerifyIssue is a single problem found in an index.
+type VerifyIssue struct {
+	Kind    VerifyIssueKind
+	NodeID  string // Node the issue was found in; empty for index-wide issues
+	Message string
+}
+
+func (i VerifyIssue) String() string {
+	if i.NodeID == "" {
+		return fmt.Sprintf("%s: %s", i.Kind, i.Message)
+	}
+	return fmt.Sprintf("%s: node %s: %s", i.Kind, i.NodeID, i.Message)
+}
+
+// VerifyReport is the result of verifying one index.
+type VerifyReport struct {
+	Collection string
+	Index      string
+	Entries    int // Entries found in the leaves reachable from the root
+	Nodes      int // Nodes reachable from the root
+	Height     int
+	Issues     []VerifyIssue
+	Repaired   bool // The index was rebuilt from its leaves
+}
+
+// OK reports whether no issues were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// VerifyOptions controls Verify.
+type VerifyOptions struct {
+	Repair   bool            // Rebuild indexes with issues from the entries of their leaves
+	BulkLoad BulkLoadOptions // Options of the bulk loader used to rebuild
+}
+
+// NodeLister is implemented by storages that can enumerate the nodes they hold,
+// which lets Verify find nodes no longer reachable from the root.
+type NodeLister interface {
+	NodeIDs() ([]string, error)
+}
+
+// treeCheck collects the findings of a structural check of a tree.
+type treeCheck struct {
+	bt        *BTree
+	issues    []VerifyIssue
+	shape     treeShape
+	reachable map[string]bool // Nodes reached from the root, including overflow nodes
+	leaves    []leafLinks     // Leaves in key order
+}
+
+// leafLinks records the chain pointers of a leaf.
+type leafLinks struct {
+	id, next, previous string
+}
+
+func (c *treeCheck) addIssue(kind VerifyIssueKind, nodeID, format string, args ...any) {
+	c.issues = append(c.issues, VerifyIssue{Kind: kind, NodeID: nodeID, Message: fmt.Sprintf(format, args...)})
+}
+
+// check walks the tree depth-first and reports every violation of the B+ tree
+// invariants it finds. Nodes that cannot be loaded are reported as dangling
+// references rather than failing the check.
+func (bt *BTree) check() *treeCheck {
+	c := &treeCheck{bt: bt, reachable: map[string]bool{}}
+	if bt.rootID == "" {
+		return c
+	}
+	c.visit(bt.rootID, "", nil, nil, 1)
+	c.checkLeafChain()
+	return c
+}
+
+// visit checks the subtree of a node whose keys must lie within [lo, hi].
+// nil bounds are open.
+func (c *treeCheck) visit(id, parent string, lo, hi []any, depth int) {
+	if c.reachable[id] {
+		c.addIssue(IssueStructure, id, "node is referenced more than once (again by %s)", parent)
+		return
+	}
+	node, err := c.bt.loadNode(id)
+	if err != nil {
+		from := "the index metadata"
+		if parent != "" {
+			from = "node " + parent
+		}
+		c.addIssue(IssueDangling, id, "referenced by %s but cannot be loaded: %v", from, err)
+		return
+	}
+	c.reachable[id] = true
+	c.shape.nodes++
+	if node.Parent != parent {
+		c.addIssue(IssueParentLink, id, "parent is %q, want %q", node.Parent, parent)
+	}
+	if c.bt.pageBytes > 0 {
+		// Nodes split once they outgrow the page, but separators replaced in place
+		// may grow an internal node a little past it.
+		if size := nodeBytes(node); len(node.Keys) >= minSplitKeys(node) && size > 2*c.bt.pageBytes {
+			c.addIssue(IssueOverfull, id, "is %d bytes, page size is %d bytes", size, c.bt.pageBytes)
+		}
+	} else if len(node.Keys) >= c.bt.pageSize {
+		// Nodes split as soon as they fill up, so at rest they hold fewer keys than the page size.
+		c.addIssue(IssueOverfull, id, "holds %d keys, page size is %d", len(node.Keys), c.bt.pageSize)
+	}
+	c.checkKeys(node, lo, hi)
+
+	if node.IsLeaf() {
+		if len(node.Values) != len(node.Keys) {
+			c.addIssue(IssueStructure, id, "leaf has %d keys but %d values", len(node.Keys), len(node.Values))
+		}
+		if c.shape.height == 0 {
+			c.shape.height = depth
+		} else if depth != c.shape.height {
+			c.addIssue(IssueStructure, id, "leaf at depth %d, other leaves are at depth %d", depth, c.shape.height)
+		}
+		c.shape.entries += len(node.Keys)
+		c.leaves = append(c.leaves, leafLinks{id: node.ID, next: node.Next, previous: node.Previous})
+		c.visitOverflow(node)
+		return
+	}
+	if len(node.Values) != len(node.Keys)+1 {
+		c.addIssue(IssueStructure, id, "internal node has %d keys but %d children", len(node.Keys), len(node.Values))
+	}
+	if !node.hasCounts() {
+		c.addIssue(IssueCount, id, "internal node has %d counts for %d children", len(node.Counts), len(node.Values))
+	}
+	for i, v := range node.Values {
+		childID, ok := v.(string)
+		if !ok || childID == "" {
+			c.addIssue(IssueStructure, id, "child %d is not a node ID: %#v", i, v)
+			continue
+		}
+		childLo, childHi := lo, hi
+		if i > 0 && i-1 < len(node.Keys) {
+			childLo = node.Keys[i-1]
+		}
+		if i < len(node.Keys) {
+			childHi = node.Keys[i]
+		}
+		entries := c.shape.entries
+		c.visit(childID, id, childLo, childHi, depth+1)
+		if found := c.shape.entries - entries; node.hasCounts() && node.Counts[i] != found {
+			c.addIssue(IssueCount, id, "counts %d entries below child %d, found %d", node.Counts[i], i, found)
+		}
+	}
+}
+
+// visitOverflow checks that the overflow nodes referenced by a leaf exist and
+// belong to it alone.
+func (c *treeCheck) visitOverflow(leaf *BTreeNode) {
+	for _, ref := range overflowIDs(leaf) {
+		if c.reachable[ref] {
+			c.addIssue(IssueStructure, ref, "overflow node is referenced more than once (again by %s)", leaf.ID)
+			continue
+		}
+		if _, err := c.bt.resolve(overflowRef(ref)); err != nil {
+			c.addIssue(IssueDangling, ref, "referenced by leaf %s but cannot be loaded: %v", leaf.ID, err)
+			continue
+		}
+		c.reachable[ref] = true
+	}
+}
+
+// checkKeys reports keys out of order within a node and keys outside the range
+// its parent's separators allow. A key equal to a separator may sit on either
+// side of it: duplicates span leaves, and a key reinserted after its deletion
+// goes left of the stale separator.
+func (c *treeCheck) checkKeys(node *BTreeNode, lo, hi []any) {
+	order := c.bt.order
+	for i := 1; i < len(node.Keys); i++ {
+		if cmp := order.compare(node.Keys[i-1], node.Keys[i]); cmp > 0 || cmp == 0 && c.bt.isUniqueKey && node.IsLeaf() {
+			c.addIssue(IssueKeyOrder, node.ID, "key %d %v does not follow %v", i, node.Keys[i], node.Keys[i-1])
+			break
+		}
+	}
+	for _, key := range node.Keys {
+		if lo != nil && order.compare(key, lo) < 0 {
+			c.addIssue(IssueSeparator, node.ID, "key %v is below the separator %v", key, lo)
+			return
+		}
+		if hi != nil && order.compare(key, hi) > 0 {
+			c.addIssue(IssueSeparator, node.ID, "key %v is above the separator %v", key, hi)
+			return
+		}
+	}
+}
+
+// checkLeafChain reports Next and Previous pointers that do not link the
+// leaves in the order the tree holds them.
+func (c *treeCheck) checkLeafChain() {
+	for i, leaf := range c.leaves {
+		var wantPrev, wantNext string
+		if i > 0 {
+			wantPrev = c.leaves[i-1].id
+		}
+		if i+1 < len(c.leaves) {
+			wantNext = c.leaves[i+1].id
+		}
+		if leaf.previous != wantPrev {
+			c.addIssue(IssueLeafChain, leaf.id, "previous leaf is %q, want %q", leaf.previous, wantPrev)
+		}
+		if leaf.next != wantNext {
+			c.addIssue(IssueLeafChain, leaf.id, "next leaf is %q, want %q", leaf.next, wantNext)
+		}
+	}
+}
+
+// salvage adds the entries of every leaf the check reached, and of the leaves
+// linked to them that the tree lost track of, to a sorter. Values stored in
+// overflow nodes are added themselves, and entries whose overflow node is lost
+// are dropped. It returns the IDs of the extra leaves found through the chain.
+func (c *treeCheck) salvage(sorter *entrySorter) ([]string, error) {
+	seen := map[string]bool{}
+	var queue, extra []string
+	for _, leaf := range c.leaves {
+		queue = append(queue, leaf.id)
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		node, err := c.bt.loadNode(id)
+		if err != nil || !node.IsLeaf() {
+			continue
+		}
+		if !c.reachable[id] {
+			extra = append(extra, id)
+		}
+		for i := range min(len(node.Keys), len(node.Values)) {
+			value, err := c.bt.resolve(node.Values[i])
+			if err != nil {
+				continue
+			}
+			if err := sorter.Add(node.Keys[i], value); err != nil {
+				return nil, err
+			}
+		}
+		queue = append(queue, node.Next, node.Previous)
+	}
+	return extra, nil
+}
+
+// distinctEntries drops sorted entries whose key equals the previous one,
+// keeping the first of each key.
+func distinctEntries(sorted iter.Seq2[[]any, any], order keyOrder) iter.Seq2[[]any, any] {
+	return func(yield func([]any, any) bool) {
+		var prev []any
+		for key, value := range sorted {
+			if prev != nil && order.compare(prev, key) == 0 {
+				continue
+			}
+			prev = key
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
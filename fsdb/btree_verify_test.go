@@ -0,0 +1,240 @@
+package fsdb
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func issueKinds(issues []VerifyIssue) map[VerifyIssueKind]bool {
+	kinds := map[VerifyIssueKind]bool{}
+	for _, issue := range issues {
+		kinds[issue.Kind] = true
+	}
+	return kinds
+}
+
+func TestBTree_CheckHealthyTrees(t *testing.T) {
+	for _, unique := range []bool{true, false} {
+		for _, pageSize := range []int{3, 4, 8} {
+			rng := rand.New(rand.NewSource(int64(pageSize)))
+			bt := NewBTree(newMemNodeStorage(), "", pageSize, unique)
+			for step := 0; step < 2000; step++ {
+				k := rng.Intn(200)
+				if !unique {
+					k %= 25
+				}
+				var err error
+				if rng.Intn(3) > 0 {
+					if err = bt.Insert([]any{k}, k); err != nil && unique {
+						err = nil // duplicate
+					}
+				} else {
+					err = bt.Delete([]any{k})
+				}
+				if err != nil {
+					t.Fatalf("step %d failed: %v", step, err)
+				}
+				if step%100 == 0 {
+					c := bt.check()
+					if len(c.issues) > 0 {
+						t.Fatalf("unique=%v page %d step %d: healthy tree reported %v", unique, pageSize, step, c.issues)
+					}
+					if c.shape != bt.shape {
+						t.Fatalf("check measured %+v, tracked %+v", c.shape, bt.shape)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestIndexManager_VerifyAndRepair(t *testing.T) {
+	for _, storage := range []string{StorageFiles, StoragePaged} {
+		t.Run(storage, func(t *testing.T) {
+			dir := t.TempDir()
+			def := IndexDefinition{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4, Storage: storage}
+			im, err := NewIndexManager(dir, def)
+			if err != nil {
+				t.Fatalf("NewIndexManager failed: %v", err)
+			}
+			defer im.Close()
+			for i := 0; i < 200; i++ {
+				if err := im.Insert([]any{i}, map[string]any{"id": i}); err != nil {
+					t.Fatalf("Insert failed: %v", err)
+				}
+			}
+			report, err := im.Verify(VerifyOptions{})
+			if err != nil || !report.OK() || report.Entries != 200 || report.Height != im.Meta().Height {
+				t.Fatalf("healthy index: %+v, %v", report, err)
+			}
+
+			var leaves []*BTreeNode
+			im.bTree.walkNodes(func(node *BTreeNode) error {
+				if node.IsLeaf() {
+					leaves = append(leaves, node)
+				}
+				return nil
+			})
+			save := func(node *BTreeNode) {
+				node.IsDirty = true
+				if err := im.base.SaveNode(node); err != nil {
+					t.Fatalf("SaveNode failed: %v", err)
+				}
+			}
+			leaves[3].Parent = "bogus"
+			save(leaves[3])
+			leaves[10].Next = ""
+			save(leaves[10])
+			last := len(leaves[20].Keys) - 1
+			leaves[20].Keys[last] = []any{1000} // beyond the next leaf's separator
+			save(leaves[20])
+			orphanID, err := im.bTree.newNodeID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			save(NewBTreeNode(orphanID, LeafNode, 4, dir))
+
+			report, err = im.Verify(VerifyOptions{})
+			if err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			kinds := issueKinds(report.Issues)
+			for _, kind := range []VerifyIssueKind{IssueParentLink, IssueLeafChain, IssueSeparator, IssueUnreachable} {
+				if !kinds[kind] {
+					t.Errorf("expected a %s issue, got %v", kind, report.Issues)
+				}
+			}
+			if kinds[IssueMeta] || kinds[IssueDangling] {
+				t.Errorf("unexpected issues %v", report.Issues)
+			}
+
+			report, err = im.Verify(VerifyOptions{Repair: true})
+			if err != nil || !report.Repaired {
+				t.Fatalf("repair failed: %+v, %v", report, err)
+			}
+			if report, err := im.Verify(VerifyOptions{}); err != nil || !report.OK() {
+				t.Fatalf("index still has issues after repair: %v, %v", report.Issues, err)
+			}
+			results, err := im.Search(nil)
+			if err != nil || len(results) != 200 || im.Meta().RowsCount != 200 {
+				t.Fatalf("repaired index holds %d rows (meta %d), %v", len(results), im.Meta().RowsCount, err)
+			}
+			if rows, _ := im.Search([]any{1000}); len(rows) != 1 {
+				t.Errorf("expected the moved key to survive the repair, got %v", rows)
+			}
+
+			// A lost leaf takes its entries with it; the rest is rebuilt.
+			leaves = leaves[:0]
+			im.bTree.walkNodes(func(node *BTreeNode) error {
+				if node.IsLeaf() {
+					leaves = append(leaves, node)
+				}
+				return nil
+			})
+			lost := len(leaves[5].Keys)
+			if err := im.base.DeleteNode(leaves[5].ID); err != nil {
+				t.Fatal(err)
+			}
+			report, err = im.Verify(VerifyOptions{Repair: true})
+			if err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			if kinds := issueKinds(report.Issues); !kinds[IssueDangling] || !kinds[IssueMeta] {
+				t.Errorf("expected dangling and meta issues, got %v", report.Issues)
+			}
+			im.Close()
+			im, err = NewIndexManager(dir, def)
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			if report, err := im.Verify(VerifyOptions{}); err != nil || !report.OK() || report.Entries != 200-lost {
+				t.Fatalf("after repair: %+v, %v; want %d entries", report, err, 200-lost)
+			}
+		})
+	}
+}
+
+func TestIndexManager_VerifyOverfullPages(t *testing.T) {
+	dir := t.TempDir()
+	def := IndexDefinition{Name: "ix", Keys: []IndexField{{Name: "k"}}, PageSize: 8}
+	im, err := NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := im.Insert([]any{i % 10}, map[string]any{"k": i % 10}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	def.PageSize = 4
+	im, err = NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	report, err := im.Verify(VerifyOptions{Repair: true})
+	if err != nil || !issueKinds(report.Issues)[IssueOverfull] {
+		t.Fatalf("expected overfull pages for the smaller page size: %v, %v", report.Issues, err)
+	}
+	report, err = im.Verify(VerifyOptions{})
+	if err != nil || !report.OK() || report.Entries != 100 {
+		t.Fatalf("after repair: %+v, %v", report, err)
+	}
+}
+
+func TestDatabase_VerifySharedDataFile(t *testing.T) {
+	db, err := NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %v", err)
+	}
+	defer db.Close()
+	schema := CollectionSchema{
+		Name: "users",
+		Indexes: []IndexDefinition{
+			{Name: "pk_id", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4, Storage: StorageCollection},
+			{Name: "ix_name", Keys: []IndexField{{Name: "name"}}, PageSize: 4, Storage: StorageCollection},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("users")
+	for i := 0; i < 100; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "name": string(rune('a' + i%26))}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	reports, err := db.Verify(VerifyOptions{})
+	if err != nil || len(reports) != 3 {
+		t.Fatalf("Verify = %d reports, %v", len(reports), err)
+	}
+	for _, r := range reports {
+		if !r.OK() || r.Collection != "users" {
+			t.Errorf("healthy collection reported %+v", r)
+		}
+	}
+
+	storage := coll.clusteredIndex.base.(*PagedNodeStorage)
+	orphanID, err := storage.AllocateNodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := NewBTreeNode(orphanID, LeafNode, 4, "")
+	if err := storage.SaveNode(orphan); err != nil {
+		t.Fatal(err)
+	}
+	reports, err = db.Verify(VerifyOptions{Repair: true})
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	file := reports[len(reports)-1]
+	if file.Index != collectionPagesFile || len(file.Issues) != 1 || file.Issues[0].NodeID != orphanID || !file.Repaired {
+		t.Fatalf("expected the orphaned page to be reported and removed, got %+v", file)
+	}
+	if !slices.ContainsFunc(reports[:2], func(r *VerifyReport) bool { return r.Index == "pk_id" && r.OK() }) {
+		t.Errorf("expected the clustered index to verify cleanly, got %+v", reports)
+	}
+	if reports, err := db.Verify(VerifyOptions{}); err != nil || !reports[len(reports)-1].OK() {
+		t.Errorf("orphaned page still present after repair: %v", err)
+	}
+}
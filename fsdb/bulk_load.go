@@ -0,0 +1,725 @@
+package fsdb
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"sort"
+)
+
+const (
+	// DefaultFillFactor leaves some free space in bulk loaded pages for later inserts.
+	DefaultFillFactor = 0.9
+	// DefaultBulkLoadMemory is the approximate number of bytes of entries sorted in
+	// memory before a sorted run is spilled to a temporary file.
+	DefaultBulkLoadMemory = 64 << 20
+)
+
+// BulkLoadOptions tunes how indexes are bulk loaded.
+type BulkLoadOptions struct {
+	FillFactor   float64 // Fraction of each page filled by the loader, in (0, 1]
+	MemoryBudget int     // Approximate bytes of entries kept in memory while sorting
+	TempDir      string  // Directory of the file provider for spilled sort runs; defaults to os.TempDir()
+}
+
+func (o BulkLoadOptions) withDefaults() BulkLoadOptions {
+	if o.FillFactor <= 0 || o.FillFactor > 1 {
+		o.FillFactor = DefaultFillFactor
+	}
+	if o.MemoryBudget <= 0 {
+		o.MemoryBudget = DefaultBulkLoadMemory
+	}
+	if o.TempDir == "" {
+		o.TempDir = os.TempDir()
+	}
+	return o
+}
+
+// sortEntry is a key-value pair flowing through the bulk loader.
+type sortEntry struct {
+	Key   []any
+	Value any
+}
+
+// entrySorter sorts an arbitrary number of entries by key. Entries are buffered
+// in memory up to a budget, then sorted and spilled to a temporary run file in
+// opts.TempDir of the file provider; the runs are merged when the entries are
+// read back. Equal keys keep their input order.
+type entrySorter struct {
+	order    keyOrder
+	files    IFileProvider
+	opts     BulkLoadOptions
+	buf      []sortEntry
+	bufBytes int
+	runs     []string // File names of the spilled runs within opts.TempDir
+	count    int
+	err      error
+}
+
+func newEntrySorter(order keyOrder, files IFileProvider, opts BulkLoadOptions) *entrySorter {
+	if files == nil {
+		files = &FileProvider{}
+	}
+	return &entrySorter{order: order, files: files, opts: opts.withDefaults()}
+}
+
+// Add adds an entry to the sorter.
+func (s *entrySorter) Add(key []any, value any) error {
+	s.buf = append(s.buf, sortEntry{Key: key, Value: value})
+	s.bufBytes += estimateSize(key) + estimateSize(value)
+	s.count++
+	if s.bufBytes >= s.opts.MemoryBudget {
+		return s.spill()
+	}
+	return nil
+}
+
+// Len returns the number of entries added.
+func (s *entrySorter) Len() int {
+	return s.count
+}
+
+// Err returns the first error encountered while reading entries back.
+func (s *entrySorter) Err() error {
+	return s.err
+}
+
+// Close removes any spilled run files.
+func (s *entrySorter) Close() error {
+	for _, run := range s.runs {
+		s.files.DeleteFile(s.opts.TempDir, run)
+	}
+	s.runs = nil
+	s.buf = nil
+	return nil
+}
+
+func (s *entrySorter) sortBuffer() {
+	sort.SliceStable(s.buf, func(i, j int) bool {
+		return s.order.compare(s.buf[i].Key, s.buf[j].Key) < 0
+	})
+}
+
+// spill sorts the buffered entries and writes them to a new run file.
+func (s *entrySorter) spill() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	ra, ok := s.files.(IRandomAccessFileProvider)
+	if !ok {
+		return errors.New("spilling sorted runs requires a file provider implementing IRandomAccessFileProvider")
+	}
+	s.sortBuffer()
+	if err := s.files.CreateDirectory(s.opts.TempDir); err != nil {
+		return err
+	}
+	name := "fsdb-sort-" + RandString(16) + ".run"
+	f, err := ra.OpenFile(s.opts.TempDir, name)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, name)
+	w := bufio.NewWriter(io.NewOffsetWriter(f, 0))
+	var rec, lenBuf []byte
+	for _, e := range s.buf {
+		rec, err = appendValue(rec[:0], e.Key)
+		if err == nil {
+			rec, err = appendValue(rec, e.Value)
+		}
+		if err == nil {
+			lenBuf = binary.AppendUvarint(lenBuf[:0], uint64(len(rec)))
+			if _, err = w.Write(lenBuf); err == nil {
+				_, err = w.Write(rec)
+			}
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	s.bufBytes = 0
+	return nil
+}
+
+// All returns the entries in key order. Errors stop the iteration and are reported by Err.
+func (s *entrySorter) All() iter.Seq2[[]any, any] {
+	return func(yield func([]any, any) bool) {
+		if len(s.runs) == 0 {
+			s.sortBuffer()
+			for _, e := range s.buf {
+				if !yield(e.Key, e.Value) {
+					return
+				}
+			}
+			return
+		}
+		if err := s.spill(); err != nil {
+			s.err = err
+			return
+		}
+		s.merge(yield)
+	}
+}
+
+// runReader streams the entries of one spilled run. Each entry is a
+// length-prefixed record holding the key and the value in the typed value
+// encoding of the binary node format, so values keep their Go types.
+type runReader struct {
+	file  RandomAccessFile
+	r     *bufio.Reader
+	buf   []byte
+	head  sortEntry
+	index int
+}
+
+func (r *runReader) advance() (bool, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	if uint64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return false, err
+	}
+	vr := &valueReader{data: r.buf}
+	key, err := vr.value()
+	if err != nil {
+		return false, err
+	}
+	value, err := vr.value()
+	if err != nil {
+		return false, err
+	}
+	k, ok := key.([]any)
+	if !ok {
+		return false, errCorruptNode
+	}
+	r.head = sortEntry{Key: k, Value: value}
+	return true, nil
+}
+
+// runHeap orders run readers by their head entry, breaking ties by run index
+// so that the merge is stable.
+type runHeap struct {
+	order   keyOrder
+	readers []*runReader
+}
+
+func (h *runHeap) Len() int { return len(h.readers) }
+func (h *runHeap) Less(i, j int) bool {
+	c := h.order.compare(h.readers[i].head.Key, h.readers[j].head.Key)
+	if c != 0 {
+		return c < 0
+	}
+	return h.readers[i].index < h.readers[j].index
+}
+func (h *runHeap) Swap(i, j int) { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *runHeap) Push(x any)    { h.readers = append(h.readers, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
+
+// merge performs a k-way merge of the spilled runs.
+func (s *entrySorter) merge(yield func([]any, any) bool) {
+	h := &runHeap{order: s.order}
+	defer func() {
+		for _, r := range h.readers {
+			r.file.Close()
+		}
+	}()
+	ra := s.files.(IRandomAccessFileProvider)
+	for i, name := range s.runs {
+		f, err := ra.OpenFile(s.opts.TempDir, name)
+		if err != nil {
+			s.err = err
+			return
+		}
+		size, err := f.Size()
+		if err != nil {
+			f.Close()
+			s.err = err
+			return
+		}
+		r := &runReader{file: f, r: bufio.NewReader(io.NewSectionReader(f, 0, size)), index: i}
+		ok, err := r.advance()
+		if err != nil {
+			f.Close()
+			s.err = err
+			return
+		}
+		if !ok {
+			f.Close()
+			continue
+		}
+		h.readers = append(h.readers, r)
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		r := h.readers[0]
+		if !yield(r.head.Key, r.head.Value) {
+			return
+		}
+		ok, err := r.advance()
+		if err != nil {
+			s.err = err
+			return
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			r.file.Close()
+			heap.Pop(h)
+		}
+	}
+}
+
+// BulkLoad builds the tree bottom-up from entries already sorted in key order.
+// count must be the number of entries. Leaves and internal nodes are packed to
+// fillFactor of their capacity and each node is written exactly once, instead of
+// splitting pages on every insert. Trees sized in bytes (see SetPageBytes) are
+// packed to fillFactor of their page bytes. The tree must be empty.
+func (bt *BTree) BulkLoad(sorted iter.Seq2[[]any, any], count int, fillFactor float64) error {
+	if bt.rootID != "" {
+		return errors.New("bulk load requires an empty tree")
+	}
+	if count <= 0 {
+		return nil
+	}
+	if fillFactor <= 0 || fillFactor > 1 {
+		fillFactor = DefaultFillFactor
+	}
+	var b bulkBuilder
+	if bt.pageBytes > 0 {
+		b = newByteTreeBuilder(bt, count, fillFactor)
+	} else {
+		b = newTreeBuilder(bt, count, fillFactor)
+	}
+	for key, value := range sorted {
+		if err := b.add(key, value); err != nil {
+			b.discard()
+			return err
+		}
+	}
+	if err := b.finish(); err != nil {
+		b.discard()
+		return err
+	}
+	bt.shape = b.shape()
+	return nil
+}
+
+// bulkBuilder builds a tree bottom-up from sorted entries.
+type bulkBuilder interface {
+	add(key []any, value any) error
+	finish() error
+	discard() // Deletes the nodes written so far and leaves the tree empty
+	shape() treeShape
+}
+
+// buildLevel tracks the node being filled on one level of a bulk loaded tree.
+// The number of nodes per level is planned up front, so every node knows how many
+// items it will hold and its parent can be assigned before it is written.
+type buildLevel struct {
+	groups int        // Number of nodes on this level
+	total  int        // Number of items (entries or children) on this level
+	index  int        // Index of the open node within the level
+	node   *BTreeNode // Open node, nil between nodes
+	first  []any      // Smallest key below the open node
+	nextID string     // Pre-assigned ID of the next leaf
+	lastID string     // ID of the previous leaf
+}
+
+// size returns the number of items planned for the i-th node of the level.
+func (l *buildLevel) size(i int) int {
+	n := l.total / l.groups
+	if i < l.total%l.groups {
+		n++
+	}
+	return n
+}
+
+type treeBuilder struct {
+	bt      *BTree
+	levels  []*buildLevel
+	count   int
+	added   int
+	prevKey []any
+	nodeIDs []string // IDs of every node created, to clean up after a failure
+}
+
+func newTreeBuilder(bt *BTree, count int, fillFactor float64) *treeBuilder {
+	p := bt.pageSize
+	leafMin, leafMax := max(p/2, 1), p-1
+	intMin, intMax := (p-1)/2+1, p
+	leafTarget := min(max(int(math.Round(fillFactor*float64(leafMax))), leafMin), leafMax)
+	intTarget := min(max(int(math.Round(fillFactor*float64(intMax))), intMin), intMax)
+
+	b := &treeBuilder{bt: bt, count: count}
+	level := &buildLevel{groups: planGroups(count, leafTarget, leafMin, leafMax), total: count}
+	b.levels = append(b.levels, level)
+	for level.groups > 1 {
+		level = &buildLevel{groups: planGroups(level.groups, intTarget, intMin, intMax), total: level.groups}
+		b.levels = append(b.levels, level)
+	}
+	return b
+}
+
+// planGroups returns how many nodes n items are spread over so that every node
+// holds about target items and stays within [lo, hi]. A single node (the root)
+// may hold fewer than lo.
+func planGroups(n, target, lo, hi int) int {
+	if n <= hi {
+		return 1
+	}
+	groups := (n + target - 1) / target
+	for groups > 1 && n/groups < lo {
+		groups--
+	}
+	for (n+groups-1)/groups > hi {
+		groups++
+	}
+	return groups
+}
+
+// checkSorted fails unless key may follow prev in the input of a bulk load.
+func (bt *BTree) checkSorted(prev, key []any) error {
+	if prev == nil {
+		return nil
+	}
+	c := bt.order.compare(prev, key)
+	if c > 0 {
+		return fmt.Errorf("bulk load entries are not sorted: %#v after %#v", key, prev)
+	}
+	if c == 0 && bt.isUniqueKey {
+		return fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
+	}
+	return nil
+}
+
+func (b *treeBuilder) add(key []any, value any) error {
+	if err := b.bt.checkSorted(b.prevKey, key); err != nil {
+		return err
+	}
+	if b.added >= b.count {
+		return fmt.Errorf("bulk load received more than the expected %d entries", b.count)
+	}
+	b.prevKey = key
+	b.added++
+
+	leaves := b.levels[0]
+	if leaves.node == nil {
+		id := leaves.nextID
+		if id == "" {
+			var err error
+			if id, err = b.newNodeID(); err != nil {
+				return err
+			}
+		}
+		leaves.node = NewBTreeNode(id, LeafNode, b.bt.pageSize, "")
+		leaves.node.Previous = leaves.lastID
+		leaves.first = key
+	}
+	leaf := leaves.node
+	leaf.Keys = append(leaf.Keys, key)
+	leaf.Values = append(leaf.Values, value)
+	if len(leaf.Keys) < leaves.size(leaves.index) {
+		return nil
+	}
+	if leaves.index < leaves.groups-1 {
+		id, err := b.newNodeID()
+		if err != nil {
+			return err
+		}
+		leaves.nextID = id
+		leaf.Next = id
+	}
+	leaves.lastID = leaf.ID
+	leaves.node = nil
+	leaves.index++
+	return b.complete(0, leaf, leaves.first)
+}
+
+// complete hands a finished node of the given level to its parent and writes it.
+func (b *treeBuilder) complete(level int, node *BTreeNode, first []any) error {
+	if level == len(b.levels)-1 {
+		node.Parent = ""
+		if err := b.bt.storage.SaveNode(node); err != nil {
+			return err
+		}
+		b.bt.rootID = node.ID
+		return nil
+	}
+	up := b.levels[level+1]
+	if up.node == nil {
+		id, err := b.newNodeID()
+		if err != nil {
+			return err
+		}
+		up.node = NewBTreeNode(id, InternalNode, b.bt.pageSize, "")
+		up.first = first
+	}
+	parent := up.node
+	node.Parent = parent.ID
+	if err := b.bt.storage.SaveNode(node); err != nil {
+		return err
+	}
+	if len(parent.Values) > 0 {
+		parent.Keys = append(parent.Keys, first)
+	}
+	parent.Values = append(parent.Values, node.ID)
+	parent.Counts = append(parent.Counts, countedEntries(node))
+	if len(parent.Values) < up.size(up.index) {
+		return nil
+	}
+	up.node = nil
+	up.index++
+	return b.complete(level+1, parent, up.first)
+}
+
+func (b *treeBuilder) newNodeID() (string, error) {
+	id, err := b.bt.newNodeID()
+	if err == nil {
+		b.nodeIDs = append(b.nodeIDs, id)
+	}
+	return id, err
+}
+
+// discard deletes the nodes written so far and leaves the tree empty.
+func (b *treeBuilder) discard() {
+	for _, id := range b.nodeIDs {
+		b.bt.storage.DeleteNode(id)
+	}
+	b.bt.rootID = ""
+	b.bt.shape = treeShape{}
+}
+
+func (b *treeBuilder) finish() error {
+	if b.added != b.count {
+		return fmt.Errorf("bulk load received %d of the expected %d entries", b.added, b.count)
+	}
+	return nil
+}
+
+func (b *treeBuilder) shape() treeShape {
+	return treeShape{entries: b.count, nodes: len(b.nodeIDs), height: len(b.levels)}
+}
+
+// byteTreeBuilder bulk loads a tree sized in bytes. How many entries fit in a
+// node is only known as they arrive, so the nodes of each level are filled to
+// the target size one after another and levels are added as needed. The last
+// completed node of a level is held back until the next one completes: only
+// then is it known to need a parent, and otherwise it becomes the root.
+type byteTreeBuilder struct {
+	bt      *BTree
+	target  int // Encoded size nodes are filled to
+	count   int
+	added   int
+	prevKey []any
+	levels  []*byteLevel
+	nodes   int      // Number of tree nodes written
+	nodeIDs []string // IDs of every node created, overflow nodes included, to clean up after a failure
+}
+
+// byteLevel tracks the nodes being filled on one level of a byte sized tree.
+type byteLevel struct {
+	node      *BTreeNode // Open node, nil between nodes
+	first     []any      // Smallest key below the open node
+	bytes     int        // Encoded size of the open node
+	done      *BTreeNode // Completed node not yet handed to a parent
+	doneFirst []any      // Smallest key below the completed node
+}
+
+func newByteTreeBuilder(bt *BTree, count int, fillFactor float64) *byteTreeBuilder {
+	target := max(int(fillFactor*float64(bt.pageBytes)), bt.pageBytes/2)
+	return &byteTreeBuilder{bt: bt, target: target, count: count}
+}
+
+func (b *byteTreeBuilder) add(key []any, value any) error {
+	if err := b.bt.checkSorted(b.prevKey, key); err != nil {
+		return err
+	}
+	if b.added >= b.count {
+		return fmt.Errorf("bulk load received more than the expected %d entries", b.count)
+	}
+	b.prevKey = key
+	b.added++
+	value, err := b.bt.inline(value)
+	if err != nil {
+		return err
+	}
+	if ref, ok := value.(overflowRef); ok {
+		b.nodeIDs = append(b.nodeIDs, string(ref))
+	}
+	return b.push(0, key, value)
+}
+
+// push appends an entry to the open node of a level: a key and value to a leaf,
+// or the smallest key below a child and the child's ID to an internal node. A
+// node that would outgrow the target is completed first, once it holds at least
+// one entry (two children for an internal node).
+func (b *byteTreeBuilder) push(level int, key []any, value any) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, &byteLevel{})
+	}
+	l := b.levels[level]
+	size := encodedSize(key) + encodedSize(value)
+	if l.node != nil && l.bytes+size > b.target && len(l.node.Values) >= min(level+1, 2) {
+		if err := b.complete(level); err != nil {
+			return err
+		}
+	}
+	if l.node == nil {
+		if err := b.open(level, key); err != nil {
+			return err
+		}
+	}
+	if level == 0 || len(l.node.Values) > 0 {
+		l.node.Keys = append(l.node.Keys, key)
+	}
+	l.node.Values = append(l.node.Values, value)
+	l.bytes += size
+	return nil
+}
+
+// open starts a new node on a level and links a leaf to the previous one.
+func (b *byteTreeBuilder) open(level int, first []any) error {
+	id, err := b.newNodeID()
+	if err != nil {
+		return err
+	}
+	l := b.levels[level]
+	if level == 0 {
+		l.node = NewBTreeNode(id, LeafNode, b.bt.pageSize, "")
+		if l.done != nil {
+			l.done.Next = id
+			l.node.Previous = l.done.ID
+		}
+	} else {
+		l.node = NewBTreeNode(id, InternalNode, b.bt.pageSize, "")
+	}
+	l.first = first
+	l.bytes = nodeHeaderBytes
+	return nil
+}
+
+// complete closes the open node of a level. The node completed before it now
+// has a sibling, so it is handed to a parent.
+func (b *byteTreeBuilder) complete(level int) error {
+	l := b.levels[level]
+	if l.done != nil {
+		if err := b.handUp(level, l.done, l.doneFirst); err != nil {
+			return err
+		}
+	}
+	l.done, l.doneFirst, l.node = l.node, l.first, nil
+	return nil
+}
+
+// handUp adds a completed node to the open node of the level above and writes it.
+func (b *byteTreeBuilder) handUp(level int, node *BTreeNode, first []any) error {
+	if err := b.push(level+1, first, node.ID); err != nil {
+		return err
+	}
+	parent := b.levels[level+1].node
+	parent.Counts = append(parent.Counts, countedEntries(node))
+	node.Parent = parent.ID
+	b.nodes++
+	return b.bt.storage.SaveNode(node)
+}
+
+// adoptLast moves the only child of the open internal node of a level to the
+// node completed before it, which leaves no internal node with a single child.
+func (b *byteTreeBuilder) adoptLast(level int) error {
+	l := b.levels[level]
+	childID := l.node.Values[0].(string)
+	l.done.Keys = append(l.done.Keys, l.first)
+	l.done.Values = append(l.done.Values, childID)
+	l.done.Counts = append(l.done.Counts, l.node.Counts[0])
+	child, err := b.bt.storage.LoadNode(childID)
+	if err != nil {
+		return err
+	}
+	child.Parent = l.done.ID
+	child.IsDirty = true
+	if err := b.bt.storage.SaveNode(child); err != nil {
+		return err
+	}
+	unused := l.node.ID
+	l.node = nil
+	return b.bt.storage.DeleteNode(unused)
+}
+
+func (b *byteTreeBuilder) finish() error {
+	if b.added != b.count {
+		return fmt.Errorf("bulk load received %d of the expected %d entries", b.added, b.count)
+	}
+	for level := 0; level < len(b.levels); level++ {
+		l := b.levels[level]
+		var err error
+		switch {
+		case l.node == nil:
+		case level > 0 && len(l.node.Values) == 1 && l.done != nil:
+			err = b.adoptLast(level)
+		default:
+			err = b.complete(level)
+		}
+		if err != nil {
+			return err
+		}
+		if level == len(b.levels)-1 {
+			l.done.Parent = ""
+			b.nodes++
+			if err := b.bt.storage.SaveNode(l.done); err != nil {
+				return err
+			}
+			b.bt.rootID = l.done.ID
+			return nil
+		}
+		if err := b.handUp(level, l.done, l.doneFirst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *byteTreeBuilder) newNodeID() (string, error) {
+	id, err := b.bt.newNodeID()
+	if err == nil {
+		b.nodeIDs = append(b.nodeIDs, id)
+	}
+	return id, err
+}
+
+func (b *byteTreeBuilder) discard() {
+	for _, id := range b.nodeIDs {
+		b.bt.storage.DeleteNode(id)
+	}
+	b.bt.rootID = ""
+	b.bt.shape = treeShape{}
+}
+
+func (b *byteTreeBuilder) shape() treeShape {
+	return treeShape{entries: b.count, nodes: b.nodes, height: len(b.levels)}
+}
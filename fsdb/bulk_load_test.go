@@ -0,0 +1,129 @@
+package fsdb
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEntrySorter_SpillsAndMerges(t *testing.T) {
+	dir := t.TempDir()
+	sorter := newEntrySorter(nil, nil, BulkLoadOptions{MemoryBudget: 2000, TempDir: dir})
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if err := sorter.Add([]any{rng.Intn(100)}, i); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if len(sorter.runs) < 2 {
+		t.Fatalf("expected the sorter to spill several runs, got %d", len(sorter.runs))
+	}
+	count := 0
+	var prev []any
+	lastValue := map[int]int{}
+	for key, value := range sorter.All() {
+		if prev != nil && compareKeys(prev, key) > 0 {
+			t.Fatalf("entries out of order: %v after %v", key, prev)
+		}
+		// Equal keys must keep their insertion order.
+		k, v := key[0].(int), value.(int)
+		if last, ok := lastValue[k]; ok && last > v {
+			t.Fatalf("merge is not stable for key %v", k)
+		}
+		lastValue[k] = v
+		prev = key
+		count++
+	}
+	if err := sorter.Err(); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if count != 1000 {
+		t.Fatalf("expected 1000 entries, got %d", count)
+	}
+	sorter.Close()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected spilled runs to be removed, found %d files", len(files))
+	}
+}
+
+func TestBTree_BulkLoad(t *testing.T) {
+	for _, pageSize := range []int{3, 4, 7, 32} {
+		for _, fill := range []float64{0.5, 0.9, 1} {
+			for _, n := range []int{1, 2, 5, 31, 32, 100, 1000} {
+				storage := newMemNodeStorage()
+				bt := NewBTree(storage, "", pageSize, true)
+				entries := func(yield func([]any, any) bool) {
+					for i := 0; i < n; i++ {
+						if !yield([]any{i}, i) {
+							return
+						}
+					}
+				}
+				if err := bt.BulkLoad(entries, n, fill); err != nil {
+					t.Fatalf("page %d fill %v n %d: BulkLoad failed: %v", pageSize, fill, n, err)
+				}
+				if got := checkTree(t, bt, storage); got != n {
+					t.Fatalf("page %d fill %v n %d: tree holds %d entries", pageSize, fill, n, got)
+				}
+				// The tree must keep working after a bulk load.
+				if err := bt.Insert([]any{n}, n); err != nil {
+					t.Fatalf("Insert after bulk load failed: %v", err)
+				}
+				if err := bt.Delete([]any{0}); err != nil {
+					t.Fatalf("Delete after bulk load failed: %v", err)
+				}
+				if got := checkTree(t, bt, storage); got != n {
+					t.Fatalf("page %d fill %v n %d: tree holds %d entries after update", pageSize, fill, n, got)
+				}
+			}
+		}
+	}
+}
+
+func TestBTree_BulkLoadRejectsDuplicates(t *testing.T) {
+	bt := NewBTree(newMemNodeStorage(), "", 4, true)
+	entries := func(yield func([]any, any) bool) {
+		for _, k := range []int{1, 2, 2, 3} {
+			if !yield([]any{k}, k) {
+				return
+			}
+		}
+	}
+	if err := bt.BulkLoad(entries, 4, 1); err == nil {
+		t.Fatal("expected duplicate key error")
+	}
+}
+
+func TestIndexManager_BuildPacksPages(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "idx")
+	im, err := NewIndexManager(dir, IndexDefinition{Name: "pk", IsClustered: true, PageSize: 10, Keys: []IndexField{{Name: "id"}}})
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	var rows []map[string]any
+	for i := 999; i >= 0; i-- {
+		rows = append(rows, map[string]any{"id": i})
+	}
+	if err := im.BuildFrom(func(yield func(map[string]any) bool) {
+		for _, r := range rows {
+			if !yield(r) {
+				return
+			}
+		}
+	}, BulkLoadOptions{FillFactor: 1, MemoryBudget: 10000, TempDir: t.TempDir()}); err != nil {
+		t.Fatalf("BuildFrom failed: %v", err)
+	}
+	files, _ := os.ReadDir(dir)
+	// 1000 rows in full leaves of 9 keys need 112 leaves plus 13 internal nodes and the root.
+	if nodes := len(files) - 1; nodes > 130 {
+		t.Errorf("expected densely packed pages, got %d nodes", nodes)
+	}
+	results, err := im.SearchRange(KeyRange{Lower: []any{500}, Upper: []any{505}, LowerInclusive: true})
+	if err != nil {
+		t.Fatalf("SearchRange failed: %v", err)
+	}
+	if len(results) != 5 {
+		t.Errorf("expected 5 rows, got %d", len(results))
+	}
+}
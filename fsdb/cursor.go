@@ -0,0 +1,205 @@
+package fsdb
+
+import "iter"
+
+// Cursor streams the entries of a B+ tree in key order without materializing them.
+// Leaves are loaded lazily, one at a time, by following their Next pointers, so a
+// full scan uses constant memory regardless of the tree size.
+//
+// A cursor starts positioned before the first entry of its range:
+//
+//	cur := tree.Cursor(KeyRange{})
+//	defer cur.Close()
+//	for cur.Next() {
+//		fmt.Println(cur.Key(), cur.Value())
+//	}
+//	if err := cur.Err(); err != nil { ... }
+//
+// A reverse cursor walks the same range from the last entry to the first using
+// the leaves' Previous pointers.
+//
+// A cursor over a BTree does not pin a snapshot of the tree; writes made while
+// it is open may or may not be observed. Cursors returned by IndexManager and
+// Collection read a snapshot, which they hold until closed.
+type Cursor struct {
+	tree    *BTree
+	r       KeyRange
+	reverse bool
+	release func()     // Releases the snapshot the cursor reads, if any
+	node    *BTreeNode // Current leaf; nil until the cursor is positioned
+	pos     int        // Index of the next entry to return within node
+	seek    []any      // Pending seek key; entries before it are skipped
+	key     []any
+	value   any
+	err     error
+	done    bool
+	closed  bool
+}
+
+// Cursor returns a cursor over the entries whose keys fall within r.
+func (bt *BTree) Cursor(r KeyRange) *Cursor {
+	return &Cursor{tree: bt, r: r}
+}
+
+// ReverseCursor returns a cursor over the entries within r, from the last to the first.
+func (bt *BTree) ReverseCursor(r KeyRange) *Cursor {
+	return &Cursor{tree: bt, r: r, reverse: true}
+}
+
+// Seek repositions the cursor so that the next call to Next returns the first
+// entry whose key is greater than or equal to key (and within the cursor's range).
+// For a reverse cursor it is the last entry whose key is less than or equal to key.
+func (c *Cursor) Seek(key []any) {
+	if c.closed {
+		return
+	}
+	c.node = nil
+	c.pos = 0
+	c.seek = key
+	c.key = nil
+	c.value = nil
+	c.done = false
+}
+
+// Next advances the cursor to the next entry and reports whether one exists.
+func (c *Cursor) Next() bool {
+	if c.closed || c.done || c.err != nil {
+		return false
+	}
+	if c.node == nil && !c.start() {
+		return false
+	}
+	order := c.tree.order
+	for {
+		if c.pos < 0 || c.pos >= len(c.node.Keys) {
+			nextID := c.node.Next
+			if c.reverse {
+				nextID = c.node.Previous
+			}
+			if nextID == "" {
+				c.finish()
+				return false
+			}
+			next, err := c.load(nextID)
+			if err != nil {
+				c.err = err
+				return false
+			}
+			c.node, c.pos = next, 0
+			if c.reverse {
+				c.pos = len(next.Keys) - 1
+			}
+			continue
+		}
+		k, v := c.node.Keys[c.pos], c.node.Values[c.pos]
+		if c.reverse {
+			c.pos--
+			if !c.r.belowUpper(order, k) || (c.seek != nil && order.comparePrefix(k, c.seek) > 0) {
+				continue
+			}
+			if !c.r.aboveLower(order, k) {
+				c.finish()
+				return false
+			}
+		} else {
+			c.pos++
+			if !c.r.aboveLower(order, k) || (c.seek != nil && order.comparePrefix(k, c.seek) < 0) {
+				continue
+			}
+			if !c.r.belowUpper(order, k) {
+				c.finish()
+				return false
+			}
+		}
+		v, err := c.tree.resolve(v)
+		if err != nil {
+			c.err = err
+			return false
+		}
+		c.key, c.value = k, v
+		return true
+	}
+}
+
+// Key returns the key of the current entry.
+func (c *Cursor) Key() []any {
+	return c.key
+}
+
+// Value returns the value of the current entry.
+func (c *Cursor) Value() any {
+	return c.value
+}
+
+// Err returns the first error encountered while iterating.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the cursor. It is safe to call Close more than once.
+func (c *Cursor) Close() error {
+	c.closed = true
+	c.finish()
+	if c.release != nil {
+		c.release()
+	}
+	return nil
+}
+
+// All returns an iterator over the remaining entries as (key, value) pairs.
+// The cursor is closed when the iteration ends or the loop breaks early;
+// check Err afterwards to distinguish the end of the range from a failure.
+func (c *Cursor) All() iter.Seq2[[]any, any] {
+	return func(yield func([]any, any) bool) {
+		defer c.Close()
+		for c.Next() {
+			if !yield(c.key, c.value) {
+				return
+			}
+		}
+	}
+}
+
+// start descends to the leaf holding the seek key (or the range's bound).
+func (c *Cursor) start() bool {
+	if c.tree.rootID == "" {
+		c.done = true
+		return false
+	}
+	order := c.tree.order
+	var node *BTreeNode
+	var err error
+	if c.reverse {
+		upper := c.r.Upper
+		if c.seek != nil && (upper == nil || order.comparePrefix(c.seek, upper) < 0) {
+			upper = c.seek
+		}
+		node, err = c.tree.findLastLeaf(upper)
+	} else {
+		lower := c.r.Lower
+		if c.seek != nil && (lower == nil || order.comparePrefix(c.seek, lower) > 0) {
+			lower = c.seek
+		}
+		node, err = c.tree.findLeaf(lower)
+	}
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.node, c.pos = node, 0
+	if c.reverse {
+		c.pos = len(node.Keys) - 1
+	}
+	return true
+}
+
+func (c *Cursor) load(nodeID string) (*BTreeNode, error) {
+	return c.tree.storage.LoadNode(nodeID)
+}
+
+func (c *Cursor) finish() {
+	c.done = true
+	c.node = nil
+	c.key = nil
+	c.value = nil
+}
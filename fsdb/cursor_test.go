@@ -0,0 +1,218 @@
+package fsdb
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestCursor_NextAndSeek(t *testing.T) {
+	var keys []int
+	for i := 1; i <= 50; i++ {
+		keys = append(keys, (i*7)%50+1)
+	}
+	bt := newTestTree(4, true, keys...)
+
+	cur := bt.Cursor(KeyRange{})
+	var got []int
+	for cur.Next() {
+		got = append(got, cur.Value().(int))
+	}
+	if err := cur.Err(); err != nil {
+		t.Fatalf("cursor failed: %v", err)
+	}
+	if len(got) != 50 {
+		t.Fatalf("expected 50 entries, got %d", len(got))
+	}
+	for i, v := range got {
+		if v != i+1 {
+			t.Fatalf("entry %d = %d, want %d", i, v, i+1)
+		}
+	}
+
+	cur.Seek([]any{45})
+	got = got[:0]
+	for cur.Next() {
+		got = append(got, cur.Value().(int))
+	}
+	if !equalInts(got, []int{45, 46, 47, 48, 49, 50}) {
+		t.Errorf("after Seek(45) = %v", got)
+	}
+
+	cur.Close()
+	if cur.Next() {
+		t.Error("expected Next to return false after Close")
+	}
+}
+
+func TestCursor_RangeAndEarlyBreak(t *testing.T) {
+	bt := newTestTree(3, true, 5, 1, 9, 3, 7, 2, 8, 4, 6, 10)
+
+	cur := bt.Cursor(KeyRange{Lower: []any{3}, Upper: []any{8}, LowerInclusive: true})
+	cur.Seek([]any{1}) // seeking before the range must not escape it
+	var got []int
+	for key, value := range cur.All() {
+		if key[0].(int) != value.(int) {
+			t.Fatalf("key %v does not match value %v", key, value)
+		}
+		got = append(got, value.(int))
+		if len(got) == 3 {
+			break
+		}
+	}
+	if !equalInts(got, []int{3, 4, 5}) {
+		t.Errorf("range iteration = %v", got)
+	}
+	if cur.Next() {
+		t.Error("expected cursor to be closed after breaking out of All")
+	}
+
+	empty := NewBTree(newMemNodeStorage(), "", 3, true).Cursor(KeyRange{})
+	if empty.Next() || empty.Err() != nil {
+		t.Error("expected an empty tree cursor to yield nothing")
+	}
+}
+
+func TestCursor_Reverse(t *testing.T) {
+	var keys []int
+	for i := 1; i <= 30; i++ {
+		keys = append(keys, (i*11)%30+1)
+	}
+	bt := newTestTree(4, true, keys...)
+
+	results, err := bt.SearchRangeReverse(KeyRange{Upper: []any{20}}, 5)
+	if err != nil {
+		t.Fatalf("SearchRangeReverse failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{19, 18, 17, 16, 15}) {
+		t.Errorf("reverse range = %v", got)
+	}
+
+	cur := bt.ReverseCursor(KeyRange{Lower: []any{3}, LowerInclusive: true})
+	var got []int
+	for cur.Next() {
+		got = append(got, cur.Value().(int))
+	}
+	if len(got) != 28 || got[0] != 30 || got[27] != 3 {
+		t.Errorf("reverse scan = %v", got)
+	}
+
+	cur.Seek([]any{5})
+	got = got[:0]
+	for cur.Next() {
+		got = append(got, cur.Value().(int))
+	}
+	if !equalInts(got, []int{5, 4, 3}) {
+		t.Errorf("reverse scan after Seek(5) = %v", got)
+	}
+}
+
+func TestBTree_DescendingField(t *testing.T) {
+	// (user asc, ts desc): the newest events of a user come first.
+	def := IndexDefinition{Keys: []IndexField{{Name: "user"}, {Name: "ts", Descending: true}}}
+	bt := NewBTree(newMemNodeStorage(), "", 3, true)
+	bt.SetKeyOrder(def.descendingFields())
+	for i := 0; i < 40; i++ {
+		if err := bt.Insert([]any{i % 4, i}, i); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	results, err := bt.SearchRange(ExactRange([]any{1}))
+	if err != nil {
+		t.Fatalf("SearchRange failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{37, 33, 29, 25, 21, 17, 13, 9, 5, 1}) {
+		t.Errorf("descending ts for user 1 = %v", got)
+	}
+
+	results, err = bt.SearchRange(KeyRange{Lower: []any{2, 30}, Upper: []any{2, 10}, LowerInclusive: true, UpperInclusive: true})
+	if err != nil {
+		t.Fatalf("SearchRange failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{30, 26, 22, 18, 14, 10}) {
+		t.Errorf("descending range = %v", got)
+	}
+
+	results, err = bt.SearchRangeReverse(ExactRange([]any{3}), 3)
+	if err != nil {
+		t.Fatalf("SearchRangeReverse failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{3, 7, 11}) {
+		t.Errorf("oldest events of user 3 = %v", got)
+	}
+
+	if (IndexDefinition{Keys: []IndexField{{Name: "id"}}}).descendingFields() != nil {
+		t.Error("an index without Descending fields must stay ascending")
+	}
+}
+
+func TestIndexManager_SingleDescendingField(t *testing.T) {
+	def := IndexDefinition{Name: "ix_score", IsClustered: true, Keys: []IndexField{{Name: "score", Descending: true}}, PageSize: 3}
+	im, err := NewIndexManager(t.TempDir(), def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	for _, i := range []int{4, 9, 1, 7, 3, 8, 2, 6, 5} {
+		if err := im.Insert([]any{i}, i); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	results, err := im.bTree.Search(nil)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{9, 8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Errorf("descending scan = %v", got)
+	}
+	results, err = im.bTree.SearchRange(KeyRange{Lower: []any{6}, Upper: []any{3}, LowerInclusive: true})
+	if err != nil {
+		t.Fatalf("SearchRange failed: %v", err)
+	}
+	if got := intValues(t, results); !equalInts(got, []int{6, 5, 4}) {
+		t.Errorf("descending range = %v", got)
+	}
+}
+
+func TestIndexDefinition_LegacyAscending(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   []bool
+	}{
+		// Schemas written before directions were honoured set ascending false on every field.
+		{`{"name":"ix","keys":[{"name":"id","ascending":false}]}`, nil},
+		{`{"name":"ix","keys":[{"name":"a","ascending":false},{"name":"b","ascending":false}]}`, nil},
+		// Once a field is ascending, the fields that are not are descending.
+		{`{"name":"ix","keys":[{"name":"user","ascending":true},{"name":"ts","ascending":false}]}`, []bool{false, true}},
+		{`{"name":"ix","keys":[{"name":"user","ascending":true},{"name":"ts"}]}`, []bool{false, true}},
+		{`{"name":"ix","keys":[{"name":"user"},{"name":"ts","descending":true}]}`, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		var def IndexDefinition
+		if err := json.Unmarshal([]byte(tt.schema), &def); err != nil {
+			t.Fatal(err)
+		}
+		if err := def.validate(); err != nil {
+			t.Errorf("%s: validate = %v", tt.schema, err)
+		}
+		if got := def.descendingFields(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: descending fields = %v, want %v", tt.schema, got, tt.want)
+		}
+		data, _ := json.Marshal(def)
+		var again IndexDefinition
+		if err := json.Unmarshal(data, &again); err != nil || !slices.Equal(again.descendingFields(), tt.want) {
+			t.Errorf("%s: descending fields after a round trip through %s = %v, %v", tt.schema, data, again.descendingFields(), err)
+		}
+	}
+
+	var def IndexDefinition
+	if err := json.Unmarshal([]byte(`{"name":"ix","keys":[{"name":"a","ascending":true},{"name":"b","descending":true}]}`), &def); err != nil {
+		t.Fatal(err)
+	}
+	if err := def.validate(); err == nil {
+		t.Error("validate accepted an index setting both ascending and descending")
+	}
+	if _, err := NewIndexManager(t.TempDir(), def); err == nil {
+		t.Error("NewIndexManager accepted an index setting both ascending and descending")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"iter"
+	"maps"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +19,7 @@ var (
 	errCollectionExists   = errors.New("collection already exists")
 	errCollectionNotExist = errors.New("collection does not exist")
 	errInvalidCollection  = errors.New("invalid collection")
+	errCollectionNotEmpty = errors.New("collection is not empty")
 )
 
 // Database manages collections (schemas and their associated indexes).
@@ -25,6 +29,20 @@ type Database struct {
 	basePath     string                 // Base path where all collections are stored (e.g., /data/mydb)
 	collections  map[string]*Collection // Map of collection name to Collection object
 	fileProvider IFileProvider          // Injected file provider
+	nodeCache    *NodeCache             // B+ tree node cache shared by all indexes
+	wal          *writeAheadLog         // Log of mutations not yet checkpointed; nil when disabled
+}
+
+// DatabaseOptions configures a Database opened with NewDatabaseWithOptions.
+type DatabaseOptions struct {
+	FileProvider IFileProvider     // Backend for all file I/O; the local filesystem when nil
+	NodeCache    *NodeCacheOptions // Node cache limits; DefaultNodeCacheOptions when nil
+	WAL          *WALOptions       // Write-ahead log settings; enabled with the defaults when nil
+}
+
+// env returns the resources shared with the database's collections.
+func (db *Database) env() storageEnv {
+	return storageEnv{files: db.fileProvider, nodeCache: db.nodeCache, wal: db.wal}
 }
 
 func (db *Database) loadExistingCollections() error {
@@ -51,7 +69,7 @@ func (db *Database) loadExistingCollections() error {
 			if err := json.Unmarshal(data, &schema); err != nil {
 				return err
 			}
-			collection, err := NewCollection(collectionPath, schema)
+			collection, err := newCollection(collectionPath, schema, db.env())
 			if err != nil {
 				return err
 			}
@@ -64,21 +82,116 @@ func (db *Database) loadExistingCollections() error {
 // NewDatabase creates a new CollectionManager.
 // basePath is the root directory where all database data will be stored.
 func NewDatabase(basePath string) (*Database, error) {
-	fileProvider := &FileProvider{}
+	return NewDatabaseWithOptions(basePath, DatabaseOptions{})
+}
+
+// NewDatabaseWithOptions opens a database whose catalog, index nodes, index
+// metadata and full-text postings are all stored through opts.FileProvider.
+// Paged index storage additionally requires the provider to implement
+// IRandomAccessFileProvider, as does the write-ahead log: with a provider that
+// lacks it, the database runs without a log.
+//
+// Mutations are logged before they are applied, so that those interrupted by a
+// crash are redone when the database is next opened. Should a logged mutation
+// fail to apply, e.g. on an I/O error, the database refuses further reads,
+// writes and checkpoints until it is reopened, which redoes it.
+func NewDatabaseWithOptions(basePath string, opts DatabaseOptions) (*Database, error) {
+	fileProvider := opts.FileProvider
+	if fileProvider == nil {
+		fileProvider = &FileProvider{}
+	}
+	cacheOpts := DefaultNodeCacheOptions
+	if opts.NodeCache != nil {
+		cacheOpts = *opts.NodeCache
+	}
+	var walOpts WALOptions
+	if opts.WAL != nil {
+		walOpts = *opts.WAL
+	}
 	if err := fileProvider.CreateDirectory(basePath); err != nil {
 		return nil, err
 	}
+	if tf, ok := fileProvider.(ITempFileProvider); ok {
+		if err := tf.RemoveTempFiles(basePath); err != nil {
+			return nil, err
+		}
+	}
 	db := &Database{
 		basePath:     basePath,
 		collections:  make(map[string]*Collection),
 		fileProvider: fileProvider,
+		nodeCache:    NewNodeCache(cacheOpts),
+	}
+	if _, ok := fileProvider.(IRandomAccessFileProvider); ok && !walOpts.Disabled {
+		wal, err := openWAL(fileProvider, basePath, walOpts)
+		if err != nil {
+			return nil, err
+		}
+		wal.requestCheckpoint = db.checkpoint
+		db.wal = wal
 	}
 	if err := db.loadExistingCollections(); err != nil {
+		db.wal.Close()
 		return nil, err
 	}
+	if err := db.recover(); err != nil {
+		db.wal.Close()
+		return nil, fmt.Errorf("failed to recover from the write-ahead log: %w", err)
+	}
 	return db, nil
 }
 
+// recover redoes the operations logged since the last checkpoint, collection by
+// collection, and checkpoints them. Operations on collections that no longer
+// exist are skipped.
+func (db *Database) recover() error {
+	if db.wal == nil || len(db.wal.recovery) == 0 {
+		return nil
+	}
+	var names []string
+	ops := map[string][]walOp{}
+	for _, rec := range db.wal.recovery {
+		for _, op := range rec.Ops {
+			if _, ok := ops[op.Collection]; !ok {
+				names = append(names, op.Collection)
+			}
+			ops[op.Collection] = append(ops[op.Collection], op)
+		}
+	}
+	for _, name := range names {
+		coll, ok := db.collections[name]
+		if !ok {
+			continue
+		}
+		if err := coll.replay(ops[name]); err != nil {
+			return fmt.Errorf("failed to replay collection %s: %w", name, err)
+		}
+	}
+	return db.checkpointLocked()
+}
+
+// checkpoint makes every applied mutation durable and empties the write-ahead log.
+func (db *Database) checkpoint() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.checkpointLocked()
+}
+
+// checkpointLocked is checkpoint for callers holding db.mu.
+func (db *Database) checkpointLocked() error {
+	return db.wal.checkpoint(func() error {
+		if err := db.nodeCache.Flush(); err != nil {
+			return err
+		}
+		for _, coll := range db.collections {
+			if err := coll.syncStorage(); err != nil {
+				return err
+			}
+		}
+		return syncFiles(db.fileProvider)
+	})
+}
+
 func (db *Database) EnsureCreatedCollection(schema CollectionSchema) error {
 	err := db.CreateCollection(schema)
 	if err != nil && !errors.Is(err, errCollectionExists) {
@@ -122,19 +235,23 @@ func (db *Database) CreateCollection(schema CollectionSchema) error {
 		db.fileProvider.DeleteDirectory(collectionPath)
 		return err
 	}
-	collection, err := NewCollection(collectionPath, schema)
+	collection, err := newCollection(collectionPath, schema, db.env())
 	if err != nil {
 		return err
 	}
 	db.collections[schema.Name] = collection
-	return nil
+	return syncFiles(db.fileProvider)
 }
 
 // GetCollectionSchema retrieves the schema for a given collection name.
 func (db *Database) GetCollectionSchema(collectionName string) (*CollectionSchema, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	return db.readCollectionSchema(collectionName)
+}
 
+// readCollectionSchema reads a collection's schema file. The caller holds db.mu.
+func (db *Database) readCollectionSchema(collectionName string) (*CollectionSchema, error) {
 	collectionPath := filepath.Join(db.basePath, collectionName)
 	exists, err := db.fileProvider.FileExists(collectionPath, "schema.json")
 	if err != nil {
@@ -161,20 +278,42 @@ func (db *Database) UpdateCollectionSchema(collectionName string, updatedSchema
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	currentSchema, err := db.GetCollectionSchema(collectionName)
+	currentSchema, err := db.readCollectionSchema(collectionName)
 	if err != nil {
 		return err
 	}
 	if currentSchema.Name != updatedSchema.Name || currentSchema.ID != updatedSchema.ID {
 		return errInvalidCollection
 	}
+	// Logged operations are replayed against the schema in place when they
+	// were logged, so none may outlive it.
+	if err := db.checkpointLocked(); err != nil {
+		return err
+	}
 	updatedSchema.UpdatedAt = time.Now()
 	collectionPath := filepath.Join(db.basePath, collectionName)
 	data, err := json.MarshalIndent(updatedSchema, "", "  ")
 	if err != nil {
 		return err
 	}
-	return db.fileProvider.WriteFile(collectionPath, "schema.json", data)
+	if old, ok := db.collections[collectionName]; ok {
+		if err := old.flush(); err != nil {
+			return err
+		}
+		old.invalidateCache()
+	}
+	if err := db.fileProvider.WriteFile(collectionPath, "schema.json", data); err != nil {
+		return err
+	}
+	collection, err := newCollection(collectionPath, updatedSchema, db.env())
+	if err != nil {
+		return err
+	}
+	if old, ok := db.collections[collectionName]; ok {
+		old.Close()
+	}
+	db.collections[collectionName] = collection
+	return syncFiles(db.fileProvider)
 }
 
 // DeleteCollection removes a collection and all its data.
@@ -190,19 +329,121 @@ func (db *Database) DeleteCollection(collectionName string) error {
 	if !dirExists {
 		return errCollectionNotExist
 	}
-	return db.fileProvider.DeleteDirectory(collectionPath)
+	if err := db.checkpointLocked(); err != nil {
+		return err
+	}
+	if coll, ok := db.collections[collectionName]; ok {
+		coll.invalidateCache()
+		coll.Close()
+		delete(db.collections, collectionName)
+	}
+	if err := db.fileProvider.DeleteDirectory(collectionPath); err != nil {
+		return err
+	}
+	return syncFiles(db.fileProvider)
 }
 
-// GetCollection loads a collection and its indexes by name.
+// GetCollection returns a collection and its indexes by name. All callers share
+// the same Collection instance, so they see each other's cached writes.
 func (db *Database) GetCollection(collectionName string) (*Collection, error) {
 	db.mu.RLock()
-	defer db.mu.RUnlock()
-	collectionPath := filepath.Join(db.basePath, collectionName)
-	schema, err := db.GetCollectionSchema(collectionName)
+	coll, ok := db.collections[collectionName]
+	db.mu.RUnlock()
+	if ok {
+		return coll, nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if coll, ok := db.collections[collectionName]; ok {
+		return coll, nil
+	}
+	schema, err := db.readCollectionSchema(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	coll, err = newCollection(filepath.Join(db.basePath, collectionName), *schema, db.env())
 	if err != nil {
 		return nil, err
 	}
-	return NewCollection(collectionPath, *schema)
+	db.collections[collectionName] = coll
+	return coll, nil
+}
+
+// Flush writes every dirty node held by the node cache to disk, makes all
+// writes durable and empties the write-ahead log.
+func (db *Database) Flush() error {
+	return db.checkpoint()
+}
+
+// syncFiles makes the writes so far durable when the file provider defers it,
+// as FileProvider does with DurabilityBatch. Collections call it after every
+// mutation.
+func syncFiles(files IFileProvider) error {
+	if s, ok := files.(ISyncFileProvider); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close checkpoints the database and releases the storage of every collection
+// and the write-ahead log. A database that failed to apply logged operations is
+// closed as if it had crashed: the log is kept and cached changes are dropped,
+// and the next open replays the log. Close then returns the failure.
+func (db *Database) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.checkpointLocked()
+	failed := errors.Is(err, errWALFailed)
+	for _, coll := range db.collections {
+		if failed {
+			coll.invalidateCache()
+		}
+		if cerr := coll.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if serr := syncFiles(db.fileProvider); err == nil {
+		err = serr
+	}
+	if werr := db.wal.Close(); err == nil {
+		err = werr
+	}
+	db.wal = nil
+	return err
+}
+
+// MigrateFormat rewrites the indexes of every collection in the current node format.
+func (db *Database) MigrateFormat() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for name, coll := range db.collections {
+		if err := coll.MigrateFormat(); err != nil {
+			return fmt.Errorf("failed to migrate collection %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Verify checks the indexes of every collection, in the order of their names;
+// see Collection.Verify.
+func (db *Database) Verify(opts VerifyOptions) ([]*VerifyReport, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var reports []*VerifyReport
+	for _, name := range slices.Sorted(maps.Keys(db.collections)) {
+		collReports, err := db.collections[name].Verify(opts)
+		reports = append(reports, collReports...)
+		if err != nil {
+			return reports, fmt.Errorf("failed to verify collection %s: %w", name, err)
+		}
+	}
+	return reports, nil
+}
+
+// NodeCacheStats returns the hit, miss and eviction counters of the node cache.
+func (db *Database) NodeCacheStats() NodeCacheStats {
+	return db.nodeCache.Stats()
 }
 
 // validateSchema performs basic validation on a CollectionSchema.
@@ -244,17 +485,33 @@ type Collection struct {
 	clusteredIndex      *IndexManager
 	nonClusteredIndexes map[string]*IndexManager
 	fullTextIndex       *InvertedIndex // Optional full-text index for the collection
+	files               IFileProvider
+	wal                 *writeAheadLog // Log of the owning database; nil for standalone collections
 }
 
 // NewCollection loads a collection and initializes its indexes.
 func NewCollection(collectionPath string, schema CollectionSchema) (*Collection, error) {
+	return newCollection(collectionPath, schema, storageEnv{})
+}
+
+func newCollection(collectionPath string, schema CollectionSchema, env storageEnv) (*Collection, error) {
 	coll := &Collection{
 		Schema:              schema,
 		collectionPath:      collectionPath,
 		nonClusteredIndexes: make(map[string]*IndexManager),
+		files:               env.fileProvider(),
+		wal:                 env.wal,
+	}
+	var rowKey []string
+	for _, idx := range schema.Indexes {
+		if idx.IsClustered {
+			for _, k := range idx.Keys {
+				rowKey = append(rowKey, k.Name)
+			}
+		}
 	}
 	for _, idx := range schema.Indexes {
-		im, err := NewIndexManager(filepath.Join(collectionPath, idx.Name), idx)
+		im, err := newIndexManager(filepath.Join(collectionPath, idx.Name), idx, rowKey, env)
 		if err != nil {
 			return nil, err
 		}
@@ -264,8 +521,11 @@ func NewCollection(collectionPath string, schema CollectionSchema) (*Collection,
 			coll.nonClusteredIndexes[idx.Name] = im
 		}
 	}
+	if err := coll.migrateIndexes(); err != nil {
+		return nil, err
+	}
 	if schema.EnableFullText {
-		ftIndex, err := NewInvertedIndex(filepath.Join(collectionPath, "fulltext"), 3, &FileProvider{})
+		ftIndex, err := NewInvertedIndex(filepath.Join(collectionPath, "fulltext"), 3, env.fileProvider())
 		if err != nil {
 			return nil, err
 		}
@@ -276,18 +536,25 @@ func NewCollection(collectionPath string, schema CollectionSchema) (*Collection,
 
 // Insert inserts a row into the collection (and all indexes).
 func (c *Collection) Insert(row map[string]any) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.clusteredIndex == nil {
-		return errInvalidCollection
-	}
+	return c.mutate(walOp{Kind: walInsert, Row: row}, func() error {
+		key := extractIndexKey(row, c.clusteredIndex.indexDef)
+		if err := c.clusteredIndex.checkKey(key); err != nil {
+			return err
+		}
+		return c.checkAbsent(key)
+	}, func() error {
+		return c.insert(row)
+	})
+}
+
+// insert applies an insert to every index.
+func (c *Collection) insert(row map[string]any) error {
 	key := extractIndexKey(row, c.clusteredIndex.indexDef)
 	if err := c.clusteredIndex.Insert(key, row); err != nil {
 		return err
 	}
 	for _, im := range c.nonClusteredIndexes {
-		idxKey := extractIndexKey(row, im.indexDef)
-		if err := im.Insert(idxKey, row); err != nil {
+		if err := im.Insert(im.entryKey(row), row); err != nil {
 			return err
 		}
 	}
@@ -303,25 +570,109 @@ func (c *Collection) Insert(row map[string]any) error {
 		}
 	}
 
-	return nil
+	return syncFiles(c.files)
+}
+
+// BulkLoad imports rows into an empty collection. Every index is built bottom-up
+// from sorted input in a single pass over rows, which is much faster than inserting
+// them one by one and yields densely packed pages. If loading fails the indexes are
+// left empty. The rows are not written to the write-ahead log: a load interrupted
+// by a crash is undone on recovery, and a completed one is checkpointed at once.
+func (c *Collection) BulkLoad(rows iter.Seq[map[string]any], opts BulkLoadOptions) error {
+	err := c.mutate(walOp{Kind: walBulkLoad}, func() error {
+		if !c.clusteredIndex.isEmpty() {
+			return errCollectionNotEmpty
+		}
+		return nil
+	}, func() error {
+		return c.bulkLoad(rows, opts)
+	})
+	if err != nil {
+		return err
+	}
+	return c.wal.checkpointDatabase()
+}
+
+func (c *Collection) bulkLoad(rows iter.Seq[map[string]any], opts BulkLoadOptions) error {
+	indexes := c.indexes()
+	sorters := make([]*entrySorter, len(indexes))
+	for i, im := range indexes {
+		sorters[i] = im.newSorter(opts)
+		defer sorters[i].Close()
+	}
+	for row := range rows {
+		for i, im := range indexes {
+			if err := im.addToSorter(sorters[i], row); err != nil {
+				return err
+			}
+		}
+	}
+	for i, im := range indexes {
+		if err := im.loadSorted(sorters[i], opts); err != nil {
+			for _, loaded := range indexes[:i] {
+				loaded.mu.Lock()
+				loaded.clear()
+				loaded.mu.Unlock()
+			}
+			return err
+		}
+	}
+	if err := c.indexFullText(); err != nil {
+		return err
+	}
+	return syncFiles(c.files)
+}
+
+// indexFullText adds every row of the clustered index to the full-text index.
+func (c *Collection) indexFullText() error {
+	if c.fullTextIndex == nil {
+		return nil
+	}
+	cur, err := c.clusteredIndex.Cursor(KeyRange{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	for key, value := range cur.All() {
+		row, ok := value.(map[string]any)
+		if !ok {
+			continue
+		}
+		if content := c.extractFullTextContent(row); content != "" {
+			if err := c.fullTextIndex.AddDocument(DocumentID(c.generateDocumentID(key)), content); err != nil {
+				return err
+			}
+		}
+	}
+	return cur.Err()
 }
 
 // Update updates a row in the collection (and all indexes).
 func (c *Collection) Update(oldRow, newRow map[string]any) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.clusteredIndex == nil {
-		return errInvalidCollection
-	}
+	return c.mutate(walOp{Kind: walUpdate, Row: newRow, OldRow: oldRow}, func() error {
+		def := c.clusteredIndex.indexDef
+		oldKey, newKey := extractIndexKey(oldRow, def), extractIndexKey(newRow, def)
+		if err := c.clusteredIndex.checkKey(newKey); err != nil {
+			return err
+		}
+		if compareKeys(oldKey, newKey) != 0 {
+			return c.checkAbsent(newKey)
+		}
+		return c.checkPresent(oldKey)
+	}, func() error {
+		return c.update(oldRow, newRow)
+	})
+}
+
+// update applies an update to every index.
+func (c *Collection) update(oldRow, newRow map[string]any) error {
 	oldKey := extractIndexKey(oldRow, c.clusteredIndex.indexDef)
 	newKey := extractIndexKey(newRow, c.clusteredIndex.indexDef)
 	if err := c.clusteredIndex.Update(oldKey, oldRow, newKey, newRow); err != nil {
 		return err
 	}
 	for _, im := range c.nonClusteredIndexes {
-		oldIdxKey := extractIndexKey(oldRow, im.indexDef)
-		newIdxKey := extractIndexKey(newRow, im.indexDef)
-		if err := im.Update(oldIdxKey, oldRow, newIdxKey, newRow); err != nil {
+		if err := im.Update(im.entryKey(oldRow), oldRow, im.entryKey(newRow), newRow); err != nil {
 			return err
 		}
 	}
@@ -345,23 +696,24 @@ func (c *Collection) Update(oldRow, newRow map[string]any) error {
 		}
 	}
 
-	return nil
+	return syncFiles(c.files)
 }
 
 // Delete deletes a row from the collection (and all indexes).
 func (c *Collection) Delete(row map[string]any) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.clusteredIndex == nil {
-		return errInvalidCollection
-	}
+	return c.mutate(walOp{Kind: walDelete, Row: row}, nil, func() error {
+		return c.delete(row)
+	})
+}
+
+// delete applies a delete to every index.
+func (c *Collection) delete(row map[string]any) error {
 	key := extractIndexKey(row, c.clusteredIndex.indexDef)
 	if err := c.clusteredIndex.Delete(key); err != nil {
 		return err
 	}
 	for _, im := range c.nonClusteredIndexes {
-		idxKey := extractIndexKey(row, im.indexDef)
-		if err := im.Delete(idxKey); err != nil {
+		if err := im.Delete(im.entryKey(row)); err != nil {
 			return err
 		}
 	}
@@ -374,33 +726,439 @@ func (c *Collection) Delete(row map[string]any) error {
 		}
 	}
 
+	return syncFiles(c.files)
+}
+
+// mutate runs a mutation under the collection lock: check validates it, so that
+// rejected operations are never logged, then op is written to the write-ahead
+// log and apply carries it out. Once the lock is released the database may
+// checkpoint the log.
+func (c *Collection) mutate(op walOp, check, apply func() error) error {
+	c.mu.Lock()
+	err := c.mutateLocked(op, check, apply)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.wal.checkpointIfFull()
+}
+
+func (c *Collection) mutateLocked(op walOp, check, apply func() error) error {
+	if c.clusteredIndex == nil {
+		return errInvalidCollection
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	op.Collection = c.Schema.Name
+	return c.wal.apply([]walOp{op}, apply)
+}
+
+// checkAbsent fails if the clustered index holds key.
+func (c *Collection) checkAbsent(key []any) error {
+	rows, err := c.clusteredIndex.Search(key)
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 {
+		return fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
+	}
+	return nil
+}
+
+// checkPresent fails unless the clustered index holds key.
+func (c *Collection) checkPresent(key []any) error {
+	rows, err := c.clusteredIndex.Search(key)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("key not found: %#v", key)
+	}
 	return nil
 }
 
-// Search finds rows in the collection by key (clustered index).
+// Find returns the rows whose clustered keys equal (or are prefixed by) key.
+// Like the other reads of a collection, it reads a snapshot and does not block
+// writers while it runs; see Snapshot.
 func (c *Collection) Find(key []any) ([]any, error) {
+	snap, err := c.pin("")
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	return snap.tree.Search(key)
+}
+
+// Count returns the number of rows in the collection, read from the clustered
+// index's metadata without scanning it.
+func (c *Collection) Count() (int64, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	if c.clusteredIndex == nil {
-		return nil, errInvalidCollection
+		return 0, errInvalidCollection
+	}
+	if err := c.wal.failure(); err != nil {
+		return 0, err
 	}
-	return c.clusteredIndex.Search(key)
+	return c.clusteredIndex.Meta().RowsCount, nil
 }
 
+// FindByIndex finds the entries of an index whose keys start with key. The keys
+// of a non-clustered index end with the row key, so key may give the indexed
+// fields alone, matching every row with those values in row key order, or be
+// followed by the row key to match a single row. Each entry holds the indexed,
+// included and row key fields of its row.
 func (c *Collection) FindByIndex(indexName string, key []any) ([]any, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	im, exists := c.nonClusteredIndexes[indexName]
-	if !exists {
-		return nil, fmt.Errorf("index %s does not exist", indexName)
+	snap, err := c.pin(indexName)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	return snap.tree.Search(key)
+}
+
+// FindRange finds rows whose clustered keys fall within the given range, in key order.
+func (c *Collection) FindRange(r KeyRange) ([]any, error) {
+	snap, err := c.pin("")
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	return snap.tree.SearchRange(r)
+}
+
+// FindByIndexRange finds entries of a non-clustered index whose keys fall within the given range.
+func (c *Collection) FindByIndexRange(indexName string, r KeyRange) ([]any, error) {
+	snap, err := c.pin(indexName)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	return snap.tree.SearchRange(r)
+}
+
+// CountRange returns the number of rows whose clustered keys fall within r.
+// It descends the index once per bound instead of reading the rows.
+func (c *Collection) CountRange(r KeyRange) (int64, error) {
+	return c.countRange("", r)
+}
+
+// CountByIndexRange returns the number of entries of a non-clustered index within r.
+func (c *Collection) CountByIndexRange(indexName string, r KeyRange) (int64, error) {
+	return c.countRange(indexName, r)
+}
+
+func (c *Collection) countRange(indexName string, r KeyRange) (int64, error) {
+	snap, err := c.pin(indexName)
+	if err != nil {
+		return 0, err
+	}
+	defer snap.release()
+	n, err := snap.tree.CountRange(r)
+	return int64(n), err
+}
+
+// FindPage returns up to limit rows (0 means no limit) whose clustered keys fall
+// within r, skipping the first offset rows of the range without reading them.
+func (c *Collection) FindPage(r KeyRange, offset, limit int) ([]any, error) {
+	snap, err := c.pin("")
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	return snap.tree.SearchPage(r, offset, limit)
+}
+
+// FindPageByIndex returns up to limit entries of a non-clustered index within r,
+// skipping the first offset entries of the range without reading them.
+func (c *Collection) FindPageByIndex(indexName string, r KeyRange, offset, limit int) ([]any, error) {
+	snap, err := c.pin(indexName)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.release()
+	return snap.tree.SearchPage(r, offset, limit)
+}
+
+// Cursor returns a cursor streaming the rows whose clustered keys fall within r.
+// Callers must Close the cursor (or fully drain Cursor.All) when done.
+func (c *Collection) Cursor(r KeyRange) (*Cursor, error) {
+	return c.cursor("", r, false)
+}
+
+// IndexCursor returns a cursor streaming the entries of a non-clustered index within r.
+func (c *Collection) IndexCursor(indexName string, r KeyRange) (*Cursor, error) {
+	return c.cursor(indexName, r, false)
+}
+
+// ReverseCursor returns a cursor streaming rows within r from the last clustered key to the first.
+func (c *Collection) ReverseCursor(r KeyRange) (*Cursor, error) {
+	return c.cursor("", r, true)
+}
+
+// IndexReverseCursor returns a cursor streaming the entries of a non-clustered index
+// within r from the last key to the first, e.g. the latest events of a user.
+func (c *Collection) IndexReverseCursor(indexName string, r KeyRange) (*Cursor, error) {
+	return c.cursor(indexName, r, true)
+}
+
+// cursor opens a cursor over a snapshot of an index; "" selects the clustered
+// index. The snapshot is released when the cursor is closed.
+func (c *Collection) cursor(indexName string, r KeyRange, reverse bool) (*Cursor, error) {
+	snap, err := c.pin(indexName)
+	if err != nil {
+		return nil, err
+	}
+	cur := snap.tree.Cursor(r)
+	if reverse {
+		cur = snap.tree.ReverseCursor(r)
+	}
+	cur.release = snap.release
+	return cur, nil
+}
+
+// indexes returns the clustered index followed by the non-clustered indexes.
+func (c *Collection) indexes() []*IndexManager {
+	var indexes []*IndexManager
+	if c.clusteredIndex != nil {
+		indexes = append(indexes, c.clusteredIndex)
+	}
+	for _, im := range c.nonClusteredIndexes {
+		indexes = append(indexes, im)
+	}
+	return indexes
+}
+
+// MigrateFormat rewrites the nodes of every index in the current node format.
+func (c *Collection) MigrateFormat() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, im := range c.indexes() {
+		if err := im.MigrateFormat(); err != nil {
+			return fmt.Errorf("failed to migrate index %s: %w", im.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// Close releases the storage engines of the collection's indexes.
+func (c *Collection) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for _, im := range c.indexes() {
+		if cerr := im.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Verify checks every index of the collection; see IndexManager.Verify. The
+// nodes of the collection's shared data file that no index reaches are reported
+// (and removed on repair) in a separate report named after the file.
+func (c *Collection) Verify(opts VerifyOptions) ([]*VerifyReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var reports []*VerifyReport
+	var shared *IndexManager
+	sharedReachable := map[string]bool{}
+	for _, im := range c.indexes() {
+		isShared := im.indexDef.Storage == StorageCollection
+		im.mu.Lock()
+		report, reachable, err := im.verify(opts, !isShared)
+		im.mu.Unlock()
+		if err != nil {
+			return reports, fmt.Errorf("failed to verify index %s: %w", im.GetName(), err)
+		}
+		report.Collection = c.Schema.Name
+		reports = append(reports, report)
+		if isShared {
+			shared = im
+			maps.Copy(sharedReachable, reachable)
+		}
+	}
+	if shared == nil {
+		return reports, nil
+	}
+	lister, ok := shared.base.(NodeLister)
+	if !ok {
+		return reports, nil
+	}
+	ids, err := lister.NodeIDs()
+	if err != nil {
+		return reports, err
+	}
+	report := &VerifyReport{Collection: c.Schema.Name, Index: collectionPagesFile}
+	for _, id := range ids {
+		if sharedReachable[id] {
+			continue
+		}
+		report.Issues = append(report.Issues, VerifyIssue{Kind: IssueUnreachable, NodeID: id, Message: "node is stored but not reachable from any index"})
+		if opts.Repair {
+			if err := shared.Storage.DeleteNode(id); err != nil {
+				return reports, err
+			}
+			report.Repaired = true
+		}
+	}
+	return append(reports, report), nil
+}
+
+// flush writes the cached dirty nodes of every index to disk.
+func (c *Collection) flush() error {
+	for _, im := range c.indexes() {
+		if err := im.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncStorage commits the paged data files of the collection's indexes to stable storage.
+func (c *Collection) syncStorage() error {
+	for _, im := range c.indexes() {
+		if paged, ok := im.base.(*PagedNodeStorage); ok {
+			if err := paged.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay redoes operations logged before a crash. The clustered index is
+// repaired first; every operation is then redone so that the result is the
+// same whether or not it reached the index before the crash. The other indexes
+// and the full-text index are rebuilt from the clustered index.
+func (c *Collection) replay(ops []walOp) error {
+	if c.clusteredIndex == nil {
+		return nil
+	}
+	if _, err := c.Verify(VerifyOptions{Repair: true}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ci := c.clusteredIndex
+	def := ci.indexDef
+	for _, op := range ops {
+		var err error
+		switch op.Kind {
+		case walInsert:
+			key := extractIndexKey(op.Row, def)
+			if err = ci.Delete(key); err == nil {
+				err = ci.Insert(key, op.Row)
+			}
+		case walUpdate:
+			oldKey, newKey := extractIndexKey(op.OldRow, def), extractIndexKey(op.Row, def)
+			if err = ci.Delete(oldKey); err == nil {
+				if err = ci.Delete(newKey); err == nil {
+					err = ci.Insert(newKey, op.Row)
+				}
+			}
+		case walDelete:
+			err = ci.Delete(extractIndexKey(op.Row, def))
+		case walBulkLoad:
+			// A load still in the log never completed; its rows are dropped.
+			ci.mu.Lock()
+			ci.clear()
+			err = ci.saveMeta()
+			ci.mu.Unlock()
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Kind)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to redo %s: %w", op.Kind, err)
+		}
+	}
+	return c.rebuildDerived()
+}
+
+// rebuildDerived rebuilds the non-clustered indexes and the full-text index
+// from the rows of the clustered index.
+func (c *Collection) rebuildDerived() error {
+	for _, im := range c.nonClusteredIndexes {
+		if err := c.rebuildIndex(im); err != nil {
+			return err
+		}
+	}
+	if c.fullTextIndex == nil {
+		return nil
+	}
+	path := filepath.Join(c.collectionPath, "fulltext")
+	if err := c.files.DeleteDirectory(path); err != nil {
+		return err
+	}
+	ftIndex, err := NewInvertedIndex(path, 3, c.files)
+	if err != nil {
+		return err
+	}
+	c.fullTextIndex = ftIndex
+	return c.indexFullText()
+}
+
+// rebuildIndex rebuilds a non-clustered index from the rows of the clustered index.
+func (c *Collection) rebuildIndex(im *IndexManager) error {
+	cur, err := c.clusteredIndex.Cursor(KeyRange{})
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+	err = im.BuildFrom(cursorRows(cur), BulkLoadOptions{})
+	if err == nil {
+		err = cur.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rebuild index %s: %w", im.GetName(), err)
+	}
+	return nil
+}
+
+// migrateIndexes rebuilds the non-clustered indexes written before format 3,
+// whose keys do not end with the row key.
+func (c *Collection) migrateIndexes() error {
+	if c.clusteredIndex == nil {
+		return nil
+	}
+	for _, im := range c.nonClusteredIndexes {
+		if im.format < 3 {
+			if err := c.rebuildIndex(im); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cursorRows yields the rows held by a cursor over a clustered index.
+func cursorRows(cur *Cursor) iter.Seq[map[string]any] {
+	return func(yield func(map[string]any) bool) {
+		for _, value := range cur.All() {
+			if row, ok := value.(map[string]any); ok && !yield(row) {
+				return
+			}
+		}
+	}
+}
+
+// invalidateCache drops the nodes of every index from the shared cache.
+func (c *Collection) invalidateCache() {
+	for _, im := range c.indexes() {
+		im.invalidateCache()
 	}
-	return im.Search(key)
 }
 
 func (c *Collection) SearchFullText(query string) ([]DocumentID, error) {
 	if c.fullTextIndex == nil {
 		return nil, errInvalidCollection
 	}
+	if err := c.wal.failure(); err != nil {
+		return nil, err
+	}
 	return c.fullTextIndex.Search(query)
 }
 
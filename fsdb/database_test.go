@@ -1,8 +1,10 @@
 package fsdb_test
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/dannyswat/fsdb"
@@ -449,3 +451,722 @@ func TestDatabase_FullTextWithEmptyContent(t *testing.T) {
 		t.Errorf("expected at least 1 result for 'Content', got %d", len(results))
 	}
 }
+
+func TestCollection_FindRange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := fsdb.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Columns: []fsdb.ColumnDefinition{
+			{FieldName: "id", DataType: datatype.Integer},
+			{FieldName: "customer", DataType: datatype.String},
+		},
+		Indexes: []fsdb.IndexDefinition{
+			{
+				Name:        "pk_orders",
+				IsClustered: true,
+				Keys:        []fsdb.IndexField{{Name: "id"}},
+				PageSize:    4,
+			},
+			{
+				Name:     "ix_customer",
+				Keys:     []fsdb.IndexField{{Name: "customer"}},
+				PageSize: 4,
+			},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := db.GetCollection("orders")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	customers := []string{"alice", "bob", "carol"}
+	for i := 1; i <= 20; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "customer": customers[i%3]}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	results, err := coll.FindRange(fsdb.KeyRange{Lower: []any{5}, Upper: []any{9}, LowerInclusive: true})
+	if err != nil {
+		t.Fatalf("find range failed: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 rows in [5, 9), got %d", len(results))
+	}
+	for i, r := range results {
+		if id := r.(map[string]any)["id"]; fmt.Sprint(id) != fmt.Sprint(5+i) {
+			t.Errorf("expected id %d at position %d, got %v", 5+i, i, id)
+		}
+	}
+
+	results, err = coll.FindByIndexRange("ix_customer", fsdb.KeyRange{Lower: []any{"b"}, Upper: []any{"c"}})
+	if err != nil {
+		t.Fatalf("find by index range failed: %v", err)
+	}
+	if len(results) != 7 {
+		t.Errorf("expected 7 entries for customer in (b, c), got %d", len(results))
+	}
+
+	if _, err := coll.FindByIndexRange("missing", fsdb.KeyRange{}); err == nil {
+		t.Error("expected error for unknown index")
+	}
+}
+
+func TestCollection_Cursor(t *testing.T) {
+	dir := t.TempDir()
+	db, err := fsdb.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	schema := fsdb.CollectionSchema{
+		Name: "events",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_events", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := db.GetCollection("events")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	for i := 1; i <= 25; i++ {
+		if err := coll.Insert(map[string]any{"id": i}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	cur, err := coll.Cursor(fsdb.KeyRange{Lower: []any{10}, LowerInclusive: true})
+	if err != nil {
+		t.Fatalf("cursor failed: %v", err)
+	}
+	count := 0
+	for range cur.All() {
+		count++
+	}
+	if err := cur.Err(); err != nil {
+		t.Fatalf("cursor iteration failed: %v", err)
+	}
+	if count != 16 {
+		t.Errorf("expected 16 rows from id 10, got %d", count)
+	}
+}
+
+func TestCollection_FindPage(t *testing.T) {
+	dir := t.TempDir()
+	db, err := fsdb.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_orders", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_customer", Keys: []fsdb.IndexField{{Name: "customer"}}, PageSize: 4},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := db.GetCollection("orders")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	customers := []string{"alice", "bob", "carol"}
+	for i := 1; i <= 60; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "customer": customers[i%3]}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	if n, err := coll.CountByIndexRange("ix_customer", fsdb.KeyRange{Lower: []any{"b"}}); err != nil || n != 40 {
+		t.Errorf("expected 40 orders of bob and carol, got %d: %v", n, err)
+	}
+	entries, err := coll.FindPageByIndex("ix_customer", fsdb.ExactRange([]any{"bob"}), 18, 0)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("expected the last 2 of 20 orders of bob, got %d: %v", len(entries), err)
+	}
+
+	for i := 3; i <= 60; i += 6 {
+		if err := coll.Delete(map[string]any{"id": i, "customer": customers[i%3]}); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+	}
+
+	r := fsdb.KeyRange{Lower: []any{10}, Upper: []any{40}, LowerInclusive: true}
+	if n, err := coll.CountRange(r); err != nil || n != 25 {
+		t.Errorf("expected 25 rows in [10, 40), got %d: %v", n, err)
+	}
+	page, err := coll.FindPage(r, 20, 10)
+	if err != nil {
+		t.Fatalf("find page failed: %v", err)
+	}
+	var ids []any
+	for _, row := range page {
+		ids = append(ids, row.(map[string]any)["id"])
+	}
+	if got := fmt.Sprint(ids); got != "[34 35 36 37 38]" {
+		t.Errorf("expected rows 34 to 38 at offset 20, got %s", got)
+	}
+}
+
+func TestCollection_Query(t *testing.T) {
+	db, err := fsdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_orders", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_customer", Keys: []fsdb.IndexField{{Name: "customer"}}, PageSize: 4},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("orders")
+	customers := []string{"alice", "bob", "carol", "dave"}
+	for i := 1; i <= 40; i++ {
+		row := map[string]any{"id": i, "customer": customers[i%4], "total": i * 10}
+		if i%5 == 0 {
+			delete(row, "total")
+		}
+		if err := coll.Insert(row); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	if err := coll.Delete(map[string]any{"id": 2, "customer": "carol"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	ids := func(q fsdb.Query) string {
+		t.Helper()
+		rows, err := coll.Query(q)
+		if err != nil {
+			t.Fatalf("query %+v failed: %v", q, err)
+		}
+		var got []any
+		for _, row := range rows {
+			got = append(got, row.(map[string]any)["id"])
+		}
+		return fmt.Sprint(got)
+	}
+	if got := ids(fsdb.Eq("customer", "carol")); got != "[6 10 14 18 22 26 30 34 38]" {
+		t.Errorf("expected the remaining orders of carol, got %s", got)
+	}
+	if got := ids(fsdb.And(fsdb.Eq("customer", "bob"), fsdb.Gt("total", 200))); got != "[21 29 33 37]" {
+		t.Errorf("expected the orders of bob over 200, got %s", got)
+	}
+	if got := ids(fsdb.Or(fsdb.Lte("id", 3), fsdb.Not(fsdb.Exists("total")))); got != "[1 3 5 10 15 20 25 30 35 40]" {
+		t.Errorf("expected the first orders and those without a total, got %s", got)
+	}
+	if got := ids(fsdb.And(fsdb.In("customer", "alice", "dave"), fsdb.Between("total", 50, 120))); got != "[7 8 11 12]" {
+		t.Errorf("expected the orders of alice and dave between 50 and 120, got %s", got)
+	}
+	if _, err := coll.Query(fsdb.Query{Op: "like", Field: "customer"}); err == nil {
+		t.Error("expected an unknown operator to be rejected")
+	}
+}
+
+func TestCollection_Explain(t *testing.T) {
+	db, err := fsdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_orders", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 8},
+			{Name: "ix_customer", Keys: []fsdb.IndexField{{Name: "customer"}}, PageSize: 8},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("orders")
+	for i := 0; i < 100; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "customer": fmt.Sprintf("c%d", i%10), "total": i}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	e, err := coll.Explain(fsdb.And(fsdb.Eq("customer", "c3"), fsdb.Gt("total", 50)))
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	if e.Index != "ix_customer" || !e.BookmarkLookup || e.EstimatedRows != 10 || e.ExaminedRows != 10 || e.ReturnedRows != 5 {
+		t.Errorf("expected a lookup of 10 entries of ix_customer returning 5 rows, got %+v", e)
+	}
+	want := `scan ix_customer forward from ("c3") inclusive to ("c3") inclusive, bookmark lookup into pk_orders
+rows: estimated 10, examined 10, returned 5
+filter: total > 50
+sort: index order`
+	if got := e.String(); got != want {
+		t.Errorf("unexpected explain text:\n%s\nwant:\n%s", got, want)
+	}
+
+	e, err = coll.Explain(fsdb.And(fsdb.Between("id", 10, 19), fsdb.Ne("customer", "c5")))
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	want = `scan pk_orders forward from (10) inclusive to (19) inclusive
+rows: estimated 10, examined 10, returned 9
+filter: customer != "c5"
+sort: index order`
+	if got := e.String(); got != want || e.BookmarkLookup {
+		t.Errorf("unexpected explain text:\n%s\nwant:\n%s", got, want)
+	}
+
+	e, err = coll.ExplainWithOptions(fsdb.Query{}, fsdb.QueryOptions{
+		OrderBy: []fsdb.SortField{{Field: "id", Descending: true}}, Skip: 10, Limit: 5,
+	})
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	want = `scan pk_orders reverse over all keys
+rows: skipped 10 by offset, estimated 5, examined 5, returned 5
+filter: none
+sort: index order`
+	if got := e.String(); got != want {
+		t.Errorf("unexpected explain text:\n%s\nwant:\n%s", got, want)
+	}
+	e, err = coll.ExplainWithOptions(fsdb.Gte("total", 50), fsdb.QueryOptions{
+		OrderBy: []fsdb.SortField{{Field: "customer"}}, SortMemory: 256,
+	})
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	if e.Sort != fsdb.SortExternal || e.ReturnedRows != 50 {
+		t.Errorf("expected an external sort of 50 rows, got %+v", e)
+	}
+	e, err = coll.ExplainWithOptions(fsdb.Eq("customer", "c3"), fsdb.QueryOptions{Fields: []string{"id"}})
+	if err != nil {
+		t.Fatalf("explain failed: %v", err)
+	}
+	if e.Index != "ix_customer" || !e.Covering || e.BookmarkLookup {
+		t.Errorf("expected ix_customer to cover the query, got %+v", e)
+	}
+}
+
+func TestCollection_QueryWithOptions(t *testing.T) {
+	db, err := fsdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_orders", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_customer", Keys: []fsdb.IndexField{{Name: "customer"}}, Includes: []string{"total"}, PageSize: 4},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("orders")
+	customers := []string{"alice", "bob", "carol"}
+	for i := 1; i <= 30; i++ {
+		row := map[string]any{"id": i, "customer": customers[i%3], "total": (i * 7) % 20, "note": "x"}
+		if err := coll.Insert(row); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	rows, err := coll.QueryWithOptions(fsdb.Eq("customer", "bob"), fsdb.QueryOptions{
+		OrderBy: []fsdb.SortField{{Field: "total", Descending: true}, {Field: "id"}},
+		Skip:    2,
+		Limit:   4,
+		Fields:  []string{"id", "total"},
+	})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if got := fmt.Sprint(rows); got != "[map[id:22 total:14] map[id:19 total:13] map[id:16 total:12] map[id:13 total:11]]" {
+		t.Errorf("expected the 3rd to 6th largest orders of bob, got %s", got)
+	}
+
+	rows, err = coll.QueryWithOptions(fsdb.Query{}, fsdb.QueryOptions{OrderBy: []fsdb.SortField{{Field: "customer", Descending: true}}, Limit: 3, Fields: []string{"customer"}})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if got := fmt.Sprint(rows); got != "[map[customer:carol] map[customer:carol] map[customer:carol]]" {
+		t.Errorf("expected the first 3 orders of carol, got %s", got)
+	}
+	if _, err := coll.QueryWithOptions(fsdb.Query{}, fsdb.QueryOptions{Limit: -1}); err == nil {
+		t.Error("expected a negative limit to be rejected")
+	}
+}
+
+func TestCollection_QueryPage(t *testing.T) {
+	db, err := fsdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_orders", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_customer", Keys: []fsdb.IndexField{{Name: "customer"}}, PageSize: 4},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("orders")
+	customers := []string{"alice", "bob", "carol", "dave", "erin"}
+	for i := 1; i <= 20; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "customer": customers[i%5]}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	ids := func(page *fsdb.QueryPage) string {
+		var got []any
+		for _, row := range page.Rows {
+			got = append(got, row.(map[string]any)["id"])
+		}
+		return fmt.Sprint(got)
+	}
+
+	opts := fsdb.QueryOptions{Limit: 7}
+	page, err := coll.QueryPage(fsdb.Query{}, opts)
+	if err != nil || ids(page) != "[1 2 3 4 5 6 7]" || page.NextToken == "" {
+		t.Fatalf("expected the first 7 orders and a token, got %s %q: %v", ids(page), page.NextToken, err)
+	}
+	if strings.Trim(page.NextToken, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		t.Errorf("expected a URL-safe token, got %q", page.NextToken)
+	}
+	// Rows inserted before the position of the token do not shift the pages.
+	for _, id := range []int{0, 21} {
+		if err := coll.Insert(map[string]any{"id": id, "customer": "bob"}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	for _, want := range []string{"[8 9 10 11 12 13 14]", "[15 16 17 18 19 20 21]"} {
+		opts.PageToken = page.NextToken
+		if page, err = coll.QueryPage(fsdb.Query{}, opts); err != nil || ids(page) != want {
+			t.Fatalf("expected orders %s, got %s: %v", want, ids(page), err)
+		}
+	}
+	if page.NextToken != "" {
+		t.Errorf("expected no token after the last page, got %q", page.NextToken)
+	}
+
+	q := fsdb.Eq("customer", "bob")
+	opts = fsdb.QueryOptions{Limit: 2, OrderBy: []fsdb.SortField{{Field: "id", Descending: true}}}
+	page, err = coll.QueryPage(q, opts)
+	if err != nil || ids(page) != "[21 16]" {
+		t.Fatalf("expected the last 2 orders of bob, got %s: %v", ids(page), err)
+	}
+	opts.PageToken = page.NextToken
+	e, err := coll.ExplainWithOptions(q, opts)
+	if err != nil || e.Index != "ix_customer" || e.Direction != fsdb.ScanReverse || e.ExaminedRows != 2 {
+		t.Errorf("expected the next page to read 2 entries of ix_customer in reverse, got %+v: %v", e, err)
+	}
+	if page, err = coll.QueryPage(q, opts); err != nil || ids(page) != "[11 6]" {
+		t.Fatalf("expected the next 2 orders of bob, got %s: %v", ids(page), err)
+	}
+
+	if _, err := coll.QueryPage(fsdb.Eq("customer", "carol"), opts); err == nil {
+		t.Error("expected a token of another query to be rejected")
+	}
+	opts.PageToken = "not a token"
+	if _, err := coll.QueryPage(q, opts); err == nil {
+		t.Error("expected a malformed token to be rejected")
+	}
+}
+
+func TestCollection_Aggregate(t *testing.T) {
+	db, err := fsdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	schema := fsdb.CollectionSchema{
+		Name: "orders",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_orders", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_customer_total", Keys: []fsdb.IndexField{{Name: "customer"}, {Name: "total"}}, PageSize: 4},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("orders")
+	rows := []map[string]any{
+		{"id": 1, "customer": "alice", "total": 10, "region": "east"},
+		{"id": 2, "customer": "bob", "total": 25.5, "region": "west"},
+		{"id": 3, "customer": "alice", "total": 30, "region": "west"},
+		{"id": 4, "customer": "carol", "region": "east"},
+		{"id": 5, "customer": "bob", "total": 4, "region": "west"},
+		{"id": 6, "customer": "alice", "total": 10, "region": "east"},
+	}
+	for _, row := range rows {
+		if err := coll.Insert(row); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	got, err := coll.Aggregate(fsdb.Aggregation{
+		GroupBy: []string{"customer"},
+		Aggregates: []fsdb.Aggregate{
+			{Op: fsdb.AggregateCount},
+			{Op: fsdb.AggregateSum, Field: "total"},
+			{Op: fsdb.AggregateAvg, Field: "total", As: "mean"},
+			{Op: fsdb.AggregateCountDistinct, Field: "total"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	want := "[map[count:3 count_distinct_total:2 customer:alice mean:16.666666666666668 sum_total:50] " +
+		"map[count:2 count_distinct_total:2 customer:bob mean:14.75 sum_total:29.5] " +
+		"map[count:1 count_distinct_total:0 customer:carol mean:<nil> sum_total:<nil>]]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("unexpected groups:\n%v\nwant:\n%s", got, want)
+	}
+
+	got, err = coll.Aggregate(fsdb.Aggregation{
+		Filter:     fsdb.Exists("total"),
+		GroupBy:    []string{"region", "customer"},
+		Aggregates: []fsdb.Aggregate{{Op: fsdb.AggregateMax, Field: "total"}},
+		Having:     fsdb.Gt("max_total", 10),
+	})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if want := "[map[customer:alice max_total:30 region:west] map[customer:bob max_total:25.5 region:west]]"; fmt.Sprint(got) != want {
+		t.Errorf("expected the groups with an order over 10, got %v, want %s", got, want)
+	}
+
+	got, err = coll.Aggregate(fsdb.Aggregation{
+		Filter: fsdb.Eq("customer", "alice"),
+		Aggregates: []fsdb.Aggregate{
+			{Op: fsdb.AggregateCount},
+			{Op: fsdb.AggregateMin, Field: "total"},
+			{Op: fsdb.AggregateMax, Field: "total"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("aggregate failed: %v", err)
+	}
+	if want := "[map[count:3 max_total:30 min_total:10]]"; fmt.Sprint(got) != want {
+		t.Errorf("expected the count and range of alice's orders, got %v", got)
+	}
+	got, err = coll.Aggregate(fsdb.Aggregation{Filter: fsdb.Eq("customer", "dave"), Aggregates: []fsdb.Aggregate{{Op: fsdb.AggregateCount}, {Op: fsdb.AggregateSum, Field: "total"}}})
+	if err != nil || fmt.Sprint(got) != "[map[count:0 sum_total:<nil>]]" {
+		t.Errorf("expected an empty total for dave, got %v: %v", got, err)
+	}
+	if _, err := coll.Aggregate(fsdb.Aggregation{Aggregates: []fsdb.Aggregate{{Op: fsdb.AggregateSum, Field: "region"}}}); err == nil {
+		t.Error("expected the sum of strings to fail")
+	}
+	if _, err := coll.Aggregate(fsdb.Aggregation{Aggregates: []fsdb.Aggregate{{Op: "median", Field: "total"}}}); err == nil {
+		t.Error("expected an unknown function to be rejected")
+	}
+}
+
+func TestCollection_BulkLoad(t *testing.T) {
+	dir := t.TempDir()
+	db, err := fsdb.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	schema := fsdb.CollectionSchema{
+		Name:           "products",
+		EnableFullText: true,
+		Columns: []fsdb.ColumnDefinition{
+			{FieldName: "id", DataType: datatype.Integer},
+			{FieldName: "category", DataType: datatype.String},
+			{FieldName: "title", DataType: datatype.String, FullText: true},
+		},
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_products", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 8},
+			{Name: "ix_category", Keys: []fsdb.IndexField{{Name: "category"}}, PageSize: 8},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, err := db.GetCollection("products")
+	if err != nil {
+		t.Fatalf("failed to get collection: %v", err)
+	}
+	categories := []string{"books", "games", "tools"}
+	rows := func(yield func(map[string]any) bool) {
+		for i := 300; i > 0; i-- {
+			row := map[string]any{"id": i, "category": categories[i%3], "title": "item"}
+			if i == 42 {
+				row["title"] = "special gadget"
+			}
+			if !yield(row) {
+				return
+			}
+		}
+	}
+	if err := coll.BulkLoad(rows, fsdb.BulkLoadOptions{MemoryBudget: 4096, TempDir: t.TempDir()}); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+
+	all, err := coll.Find(nil)
+	if err != nil {
+		t.Fatalf("find failed: %v", err)
+	}
+	if len(all) != 300 {
+		t.Fatalf("expected 300 rows, got %d", len(all))
+	}
+	games, err := coll.FindByIndex("ix_category", []any{"games"})
+	if err != nil {
+		t.Fatalf("find by index failed: %v", err)
+	}
+	if len(games) != 100 {
+		t.Errorf("expected 100 games, got %d", len(games))
+	}
+	hits, err := coll.SearchFullText("gadget")
+	if err != nil || len(hits) != 1 || hits[0] != "42" {
+		t.Errorf("expected full-text hit for row 42, got %v (err %v)", hits, err)
+	}
+
+	if err := coll.BulkLoad(rows, fsdb.BulkLoadOptions{}); err == nil {
+		t.Error("expected bulk load into a non-empty collection to fail")
+	}
+	if err := coll.Insert(map[string]any{"id": 301, "category": "books"}); err != nil {
+		t.Errorf("insert after bulk load failed: %v", err)
+	}
+	if n, err := coll.Count(); err != nil || n != 301 {
+		t.Errorf("Count = %d, %v, want 301", n, err)
+	}
+}
+
+func TestDatabase_SharedNodeCache(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := fsdb.NewDatabase(tempDir)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	schema := fsdb.CollectionSchema{
+		Name:    "items",
+		Indexes: []fsdb.IndexDefinition{{Name: "pk_id", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4}},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	first, _ := db.GetCollection("items")
+	second, _ := db.GetCollection("items")
+	if first != second {
+		t.Fatal("expected GetCollection to return the shared collection instance")
+	}
+	for i := 0; i < 50; i++ {
+		if err := first.Insert(map[string]any{"id": i}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if rows, err := second.Find([]any{i}); err != nil || len(rows) != 1 {
+			t.Fatalf("Find(%d) = %v, %v", i, rows, err)
+		}
+	}
+	if stats := db.NodeCacheStats(); stats.Hits == 0 || stats.Entries == 0 {
+		t.Errorf("expected the node cache to serve reads, got %+v", stats)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := db.DeleteCollection("items"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if stats := db.NodeCacheStats(); stats.Entries != 0 {
+		t.Errorf("expected deleted collection's nodes to leave the cache, %d remain", stats.Entries)
+	}
+}
+
+func TestCollection_NullKeys(t *testing.T) {
+	db, err := fsdb.NewDatabase(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+	schema := fsdb.CollectionSchema{
+		Name: "players",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_players", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_score", Keys: []fsdb.IndexField{{Name: "score", Nulls: fsdb.NullsLast}}, Includes: []string{"id"}, PageSize: 4},
+			{Name: "ix_team", Keys: []fsdb.IndexField{{Name: "team"}}, Includes: []string{"id"}, PageSize: 4, Sparse: true},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("players")
+	rows := []map[string]any{
+		{"id": 1, "score": 5, "team": "red"},
+		{"id": 2, "team": nil},
+		{"id": 3, "score": 1},
+		{"id": 4, "score": 3, "team": "blue"},
+	}
+	for _, row := range rows {
+		if err := coll.Insert(row); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	ids := func(index string) []string {
+		entries, err := coll.FindByIndexRange(index, fsdb.KeyRange{})
+		if err != nil {
+			t.Fatalf("find by index range failed: %v", err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, fmt.Sprint(e.(map[string]any)["id"]))
+		}
+		return got
+	}
+	if got := fmt.Sprint(ids("ix_score")); got != "[3 4 1 2]" {
+		t.Errorf("expected the missing score last, got ids %s", got)
+	}
+	if got := fmt.Sprint(ids("ix_team")); got != "[4 1]" {
+		t.Errorf("expected the sparse index to skip null teams, got ids %s", got)
+	}
+	if err := coll.Update(rows[1], map[string]any{"id": 2, "score": 7, "team": "green"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := coll.Update(rows[0], map[string]any{"id": 1, "score": 6}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := coll.Delete(rows[2]); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if got := fmt.Sprint(ids("ix_team")); got != "[4 2]" {
+		t.Errorf("expected the sparse index to follow updates, got ids %s", got)
+	}
+
+	if err := coll.Insert(map[string]any{"score": 9}); err == nil {
+		t.Error("expected a row without an id to be rejected")
+	}
+	if err := coll.Update(rows[3], map[string]any{"id": nil, "score": 3}); err == nil {
+		t.Error("expected an update to a null id to be rejected")
+	}
+	if count, _ := coll.Count(); count != 3 {
+		t.Errorf("expected 3 rows, got %d", count)
+	}
+
+	for _, idx := range []fsdb.IndexDefinition{
+		{Name: "pk", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, Sparse: true},
+		{Name: "pk", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id", Nulls: "middle"}}},
+	} {
+		if err := db.CreateCollection(fsdb.CollectionSchema{Name: "invalid", Indexes: []fsdb.IndexDefinition{idx}}); err == nil {
+			t.Errorf("expected index %+v to be rejected", idx)
+			db.DeleteCollection("invalid")
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package fsdb
 
-import "os"
+import (
+	"io"
+	"os"
+)
 
 // IFileProvider abstracts file and directory operations for the database.
 type IFileProvider interface {
@@ -13,3 +16,22 @@ type IFileProvider interface {
 	DeleteFile(path string, fileName string) error
 	ReadDirectory(path string) ([]os.DirEntry, error)
 }
+
+// IRandomAccessFileProvider is implemented by file providers that can open a
+// file for positioned reads and writes. Paged index storage and the spill files
+// of the bulk loader require it.
+type IRandomAccessFileProvider interface {
+	// OpenFile opens a file for reading and writing, creating it if it does not exist.
+	OpenFile(path string, fileName string) (RandomAccessFile, error)
+}
+
+// RandomAccessFile is an open file supporting positioned reads and writes.
+type RandomAccessFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Size() (int64, error)
+	Truncate(size int64) error
+	// Sync commits the contents of the file to stable storage.
+	Sync() error
+}
@@ -1,14 +1,159 @@
 package fsdb
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 )
 
-type FileProvider struct{}
+// Durability selects when FileProvider forces written files to stable storage.
+// Every write replaces its file by renaming a temporary file over it, so a
+// process crash leaves either the old or the new contents. DurabilityOp and
+// DurabilityBatch also fsync the temporary file before the rename, which keeps
+// that true across power loss; DurabilityNone does not, and a power loss may
+// leave a renamed file with missing data.
+type Durability string
+
+const (
+	DurabilityOp    Durability = "op"    // fsync each file and its directory on every write (the default)
+	DurabilityBatch Durability = "batch" // fsync each file before its rename, and the directories written since the last Sync on Sync
+	DurabilityNone  Durability = "none"  // Never fsync: survives process crashes but may lose or tear recent writes on power loss
+)
+
+const tempFileSuffix = ".tmp"
+
+// FileProvider is the IFileProvider of the local filesystem. WriteFile writes
+// to a temporary file in the target directory and renames it over the target;
+// the temporary files of interrupted writes are hidden from ReadDirectory and
+// removed by RemoveTempFiles.
+type FileProvider struct {
+	Durability Durability // When writes are made durable; DurabilityOp when empty
+
+	mu       sync.Mutex
+	pending  map[string]bool // DurabilityBatch: directories to fsync on Sync
+	failStep func(step writeStep, tmpPath string) error
+}
+
+// writeStep names the stages of an atomic write, for fault injection in tests.
+type writeStep int
+
+const (
+	stepWritten writeStep = iota // Data written to the temporary file
+	stepSynced                   // Temporary file synced, about to be renamed
+	stepRenamed                  // Renamed over the target, directory not yet synced
+)
+
+// errCrashed is returned by a fault injected into a write to simulate the
+// process dying at that step; the write stops without cleaning up.
+var errCrashed = errors.New("simulated crash")
+
+// ISyncFileProvider is implemented by file providers that can defer making
+// writes durable. Sync makes every write so far durable; the database calls it
+// after each collection mutation and on Flush.
+type ISyncFileProvider interface {
+	Sync() error
+}
+
+// ITempFileProvider is implemented by file providers whose writes leave
+// temporary files behind when a crash interrupts them. RemoveTempFiles deletes
+// those below a directory; the database calls it on its directory when opened.
+type ITempFileProvider interface {
+	RemoveTempFiles(path string) error
+}
+
+func (fp *FileProvider) durability() Durability {
+	if fp.Durability == "" {
+		return DurabilityOp
+	}
+	return fp.Durability
+}
+
+func (fp *FileProvider) fault(step writeStep, tmpPath string) error {
+	if fp.failStep == nil {
+		return nil
+	}
+	return fp.failStep(step, tmpPath)
+}
+
+// syncPath opens a file or directory and fsyncs it.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// synced makes a change to path durable per the durability level: immediately
+// for DurabilityOp, on the next Sync for DurabilityBatch.
+func (fp *FileProvider) synced(paths ...string) error {
+	switch fp.durability() {
+	case DurabilityOp:
+		for _, path := range paths {
+			if err := syncPath(path); err != nil {
+				return err
+			}
+		}
+	case DurabilityBatch:
+		fp.mu.Lock()
+		defer fp.mu.Unlock()
+		if fp.pending == nil {
+			fp.pending = make(map[string]bool)
+		}
+		for _, path := range paths {
+			fp.pending[path] = true
+		}
+	}
+	return nil
+}
+
+// Sync fsyncs the directories changed since the last Sync when the durability
+// level is DurabilityBatch, making the renames, creations and deletions in them
+// durable. The files written were synced before their rename.
+func (fp *FileProvider) Sync() error {
+	fp.mu.Lock()
+	pending := fp.pending
+	fp.pending = nil
+	fp.mu.Unlock()
+	for dir := range pending {
+		err := syncPath(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Deleted since it was changed
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 func (fp *FileProvider) CreateDirectory(path string) error {
-	return os.MkdirAll(path, 0755)
+	// Find the directories to create, so that their parents can be synced.
+	var created []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		created = append(created, dir)
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	parents := make([]string, len(created))
+	for i, dir := range created {
+		parents[i] = filepath.Dir(dir)
+	}
+	return fp.synced(parents...)
 }
 
 func (fp *FileProvider) DirectoryExists(path string) (bool, error) {
@@ -23,7 +168,10 @@ func (fp *FileProvider) DirectoryExists(path string) (bool, error) {
 }
 
 func (fp *FileProvider) DeleteDirectory(path string) error {
-	return os.RemoveAll(path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return fp.synced(filepath.Dir(filepath.Clean(path)))
 }
 
 func (fp *FileProvider) FileExists(path string, fileName string) (bool, error) {
@@ -43,16 +191,117 @@ func (fp *FileProvider) ReadFile(path string, fileName string) ([]byte, error) {
 	return os.ReadFile(fullPath)
 }
 
+// WriteFile atomically replaces the contents of a file: the data is written to
+// a temporary file in the same directory, which is synced and renamed over the
+// target, and the directory is synced, as the durability level requires.
 func (fp *FileProvider) WriteFile(path string, fileName string, data []byte) error {
 	fullPath := filepath.Join(path, fileName)
-	return os.WriteFile(fullPath, data, 0644)
+	tmp, err := os.CreateTemp(path, "."+fileName+".*"+tempFileSuffix)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		if !errors.Is(err, errCrashed) {
+			os.Remove(tmpPath)
+		}
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := fp.fault(stepWritten, tmpPath); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return fail(err)
+	}
+	if fp.durability() != DurabilityNone {
+		if err := tmp.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := fp.fault(stepSynced, tmpPath); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, fullPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := fp.fault(stepRenamed, tmpPath); err != nil {
+		return err
+	}
+	return fp.synced(path)
 }
 
 func (fp *FileProvider) DeleteFile(path string, fileName string) error {
 	fullPath := filepath.Join(path, fileName)
-	return os.Remove(fullPath)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	return fp.synced(path)
 }
 
+// ReadDirectory lists a directory, leaving out the temporary files of writes in
+// progress or interrupted by a crash.
 func (fp *FileProvider) ReadDirectory(path string) ([]os.DirEntry, error) {
-	return os.ReadDir(path)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(entries, func(e os.DirEntry) bool { return isTempFile(e.Name()) }), nil
+}
+
+// RemoveTempFiles deletes the temporary files of writes interrupted by a crash
+// from path and the directories below it. No write may be in progress there.
+func (fp *FileProvider) RemoveTempFiles(path string) error {
+	var dirs []string
+	err := filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		dirs = append(dirs, filepath.Dir(p))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fp.synced(slices.Compact(dirs)...)
+}
+
+// isTempFile reports whether a file name is that of a temporary file of WriteFile.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
+
+func (fp *FileProvider) OpenFile(path string, fileName string) (RandomAccessFile, error) {
+	f, err := os.OpenFile(filepath.Join(path, fileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return osFile{f}, nil
+}
+
+// osFile adapts *os.File to RandomAccessFile.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
@@ -0,0 +1,189 @@
+package fsdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashAt returns a fault that kills the n-th write at step, after tearing its
+// temporary file in half when the data has not been renamed yet.
+func crashAt(n int, step writeStep) func(writeStep, string) error {
+	count := 0
+	return func(s writeStep, tmpPath string) error {
+		if s != step {
+			return nil
+		}
+		if count++; count != n {
+			return nil
+		}
+		if step != stepRenamed {
+			if info, err := os.Stat(tmpPath); err == nil {
+				os.Truncate(tmpPath, info.Size()/2)
+			}
+		}
+		return errCrashed
+	}
+}
+
+func TestFileProvider_AtomicWrite(t *testing.T) {
+	for _, step := range []writeStep{stepWritten, stepSynced, stepRenamed} {
+		dir := t.TempDir()
+		fp := &FileProvider{}
+		if err := fp.WriteFile(dir, "a.json", []byte(`{"version":"old"}`)); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		fp.failStep = crashAt(1, step)
+		if err := fp.WriteFile(dir, "a.json", []byte(`{"version":"new"}`)); !errors.Is(err, errCrashed) {
+			t.Fatalf("expected the injected crash, got %v", err)
+		}
+
+		want := `{"version":"old"}`
+		if step == stepRenamed {
+			want = `{"version":"new"}`
+		}
+		fp = &FileProvider{}
+		if data, err := fp.ReadFile(dir, "a.json"); err != nil || string(data) != want {
+			t.Errorf("step %d: file holds %q, %v; want %q", step, data, err, want)
+		}
+		entries, err := fp.ReadDirectory(dir)
+		if err != nil || len(entries) != 1 || entries[0].Name() != "a.json" {
+			t.Errorf("step %d: ReadDirectory = %v, %v; want only a.json", step, entries, err)
+		}
+		raw, _ := os.ReadDir(dir)
+		if debris := len(raw) - 1; step != stepRenamed && debris != 1 {
+			t.Errorf("step %d: expected the interrupted temporary file on disk, found %d", step, debris)
+		}
+		if err := fp.RemoveTempFiles(dir); err != nil {
+			t.Fatalf("RemoveTempFiles failed: %v", err)
+		}
+		if raw, _ := os.ReadDir(dir); len(raw) != 1 {
+			t.Errorf("step %d: %d files left after RemoveTempFiles, want only a.json", step, len(raw))
+		}
+	}
+}
+
+func TestFileProvider_TempFilesRemovedOnOpen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	fp := &FileProvider{}
+	db, err := NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: fp})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	if err := db.CreateCollection(walTestSchema()); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("notes")
+	fp.failStep = crashAt(1, stepSynced)
+	if err := coll.Insert(map[string]any{"id": 1, "title": "one"}); !errors.Is(err, errCrashed) {
+		t.Fatalf("expected the injected crash, got %v", err)
+	}
+	countTemp := func() int {
+		n := 0
+		filepath.WalkDir(dir, func(_ string, d os.DirEntry, _ error) error {
+			if d != nil && isTempFile(d.Name()) {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	if n := countTemp(); n != 1 {
+		t.Fatalf("found %d temporary files after the crash, want 1", n)
+	}
+
+	db, err = NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: &FileProvider{}})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer db.Close()
+	if n := countTemp(); n != 0 {
+		t.Errorf("found %d temporary files after reopening, want none", n)
+	}
+}
+
+func TestFileProvider_CrashDuringIndexWrites(t *testing.T) {
+	def := IndexDefinition{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4}
+	for n := 1; n <= 12; n++ {
+		dir := t.TempDir()
+		fp := &FileProvider{Durability: DurabilityNone}
+		im, err := newIndexManager(dir, def, nil, storageEnv{files: fp})
+		if err != nil {
+			t.Fatalf("newIndexManager failed: %v", err)
+		}
+		for i := 0; i < 30; i++ {
+			if err := im.Insert([]any{i}, map[string]any{"id": i}); err != nil {
+				t.Fatalf("Insert failed: %v", err)
+			}
+		}
+		fp.failStep = crashAt(n, stepWritten)
+		crashed := false
+		for i := 30; i < 60 && !crashed; i++ {
+			err := im.Insert([]any{i}, map[string]any{"id": i})
+			if err != nil && !errors.Is(err, errCrashed) {
+				t.Fatalf("Insert failed: %v", err)
+			}
+			crashed = err != nil
+		}
+		if !crashed {
+			t.Fatalf("write %d: expected a crash", n)
+		}
+
+		// Restart: every file that was written is whole, and repair restores the index.
+		im, err = NewIndexManager(dir, def)
+		if err != nil {
+			t.Fatalf("write %d: reopening after the crash failed: %v", n, err)
+		}
+		ids, err := im.base.(NodeLister).NodeIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if _, err := im.base.LoadNode(id); err != nil {
+				t.Fatalf("write %d: node %s is unreadable after the crash: %v", n, id, err)
+			}
+		}
+		if _, err := im.Verify(VerifyOptions{Repair: true}); err != nil {
+			t.Fatalf("write %d: repair failed: %v", n, err)
+		}
+		if report, err := im.Verify(VerifyOptions{}); err != nil || !report.OK() || report.Entries < 30 {
+			t.Fatalf("write %d: after repair %+v, %v", n, report, err)
+		}
+	}
+}
+
+func TestFileProvider_BatchDurability(t *testing.T) {
+	fp := &FileProvider{Durability: DurabilityBatch}
+	db, err := NewDatabaseWithOptions(filepath.Join(t.TempDir(), "db"), DatabaseOptions{FileProvider: fp})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	defer db.Close()
+	schema := CollectionSchema{
+		Name:    "items",
+		Indexes: []IndexDefinition{{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4}},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	if len(fp.pending) != 0 {
+		t.Errorf("expected creating a collection to sync its batch, %d paths pending", len(fp.pending))
+	}
+	coll, _ := db.GetCollection("items")
+	if err := fp.WriteFile(coll.collectionPath, "extra", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if len(fp.pending) != 1 || !fp.pending[coll.collectionPath] {
+		t.Fatalf("expected the directory of the file, synced before its rename, waiting for a batch sync, got %v", fp.pending)
+	}
+	if err := coll.Insert(map[string]any{"id": 1}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if len(fp.pending) != 0 {
+		t.Errorf("expected the insert to sync its batch, %d paths pending", len(fp.pending))
+	}
+	if rows, err := coll.Find([]any{1}); err != nil || len(rows) != 1 {
+		t.Errorf("Find = %v, %v", rows, err)
+	}
+}
@@ -0,0 +1,392 @@
+package fsdb
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryFileProvider is a thread-safe in-memory IFileProvider, for tests and
+// ephemeral databases. It follows the semantics of FileProvider: files can only
+// be created in existing directories, missing files report fs.ErrNotExist, and
+// DeleteDirectory removes a whole subtree. Its contents can be copied to a real
+// directory with SnapshotTo and loaded back with RestoreFrom.
+type MemoryFileProvider struct {
+	mu    sync.RWMutex
+	dirs  map[string]time.Time // Cleaned directory path -> modification time
+	files map[string]*memFile  // Cleaned file path -> contents
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryFileProvider creates an empty in-memory file provider.
+func NewMemoryFileProvider() *MemoryFileProvider {
+	return &MemoryFileProvider{
+		dirs:  make(map[string]time.Time),
+		files: make(map[string]*memFile),
+	}
+}
+
+// isRoot reports whether a cleaned path is a filesystem root, which always exists.
+func isRoot(path string) bool {
+	return path == "." || path == string(filepath.Separator) || filepath.Dir(path) == path
+}
+
+func (p *MemoryFileProvider) dirExists(path string) bool {
+	if isRoot(path) {
+		return true
+	}
+	_, ok := p.dirs[path]
+	return ok
+}
+
+func (p *MemoryFileProvider) CreateDirectory(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mkdirAll(filepath.Clean(path))
+}
+
+func (p *MemoryFileProvider) mkdirAll(path string) error {
+	now := time.Now()
+	for dir := path; !isRoot(dir); dir = filepath.Dir(dir) {
+		if _, ok := p.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+		}
+		if _, ok := p.dirs[dir]; ok {
+			break
+		}
+		p.dirs[dir] = now
+	}
+	return nil
+}
+
+func (p *MemoryFileProvider) DirectoryExists(path string) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dirExists(filepath.Clean(path)), nil
+}
+
+func (p *MemoryFileProvider) DeleteDirectory(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	for dir := range p.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(p.dirs, dir)
+		}
+	}
+	for file := range p.files {
+		if file == path || strings.HasPrefix(file, prefix) {
+			delete(p.files, file)
+		}
+	}
+	return nil
+}
+
+func (p *MemoryFileProvider) FileExists(path string, fileName string) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.files[filepath.Join(path, fileName)]
+	return ok, nil
+}
+
+func (p *MemoryFileProvider) ReadFile(path string, fileName string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	fullPath := filepath.Join(path, fileName)
+	f, ok := p.files[fullPath]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (p *MemoryFileProvider) WriteFile(path string, fileName string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := p.openLocked(filepath.Join(path, fileName))
+	if err != nil {
+		return err
+	}
+	f.data = append(f.data[:0:0], data...)
+	f.modTime = time.Now()
+	return nil
+}
+
+// openLocked returns the file at fullPath, creating it in an existing directory.
+func (p *MemoryFileProvider) openLocked(fullPath string) (*memFile, error) {
+	if f, ok := p.files[fullPath]; ok {
+		return f, nil
+	}
+	if _, ok := p.dirs[fullPath]; ok {
+		return nil, &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrInvalid}
+	}
+	if !p.dirExists(filepath.Dir(fullPath)) {
+		return nil, &fs.PathError{Op: "open", Path: fullPath, Err: fs.ErrNotExist}
+	}
+	f := &memFile{modTime: time.Now()}
+	p.files[fullPath] = f
+	return f, nil
+}
+
+func (p *MemoryFileProvider) DeleteFile(path string, fileName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fullPath := filepath.Join(path, fileName)
+	if _, ok := p.files[fullPath]; !ok {
+		return &fs.PathError{Op: "remove", Path: fullPath, Err: fs.ErrNotExist}
+	}
+	delete(p.files, fullPath)
+	return nil
+}
+
+// ReadDirectory returns the entries of a directory sorted by name.
+func (p *MemoryFileProvider) ReadDirectory(path string) ([]os.DirEntry, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	path = filepath.Clean(path)
+	if !p.dirExists(path) {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for dir, modTime := range p.dirs {
+		if filepath.Dir(dir) == path && dir != path {
+			entries = append(entries, memFileInfo{name: filepath.Base(dir), modTime: modTime, dir: true})
+		}
+	}
+	for file, f := range p.files {
+		if filepath.Dir(file) == path {
+			entries = append(entries, memFileInfo{name: filepath.Base(file), size: int64(len(f.data)), modTime: f.modTime})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// OpenFile opens a file for positioned reads and writes, creating it if needed.
+// The handle stays usable after the file is deleted, as on Unix.
+func (p *MemoryFileProvider) OpenFile(path string, fileName string) (RandomAccessFile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := p.openLocked(filepath.Join(path, fileName))
+	if err != nil {
+		return nil, err
+	}
+	return &memHandle{p: p, f: f, name: fileName}, nil
+}
+
+// SnapshotTo copies the subtree at root into the real directory dir, creating
+// it if needed. The copy is a consistent point in time; flush a write-back node
+// cache first so that it contains every change.
+func (p *MemoryFileProvider) SnapshotTo(root, dir string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	root = filepath.Clean(root)
+	if !p.dirExists(root) {
+		return &fs.PathError{Op: "snapshot", Path: root, Err: fs.ErrNotExist}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for path := range p.dirs {
+		if rel, ok := relativeTo(root, path); ok {
+			if err := os.MkdirAll(filepath.Join(dir, rel), 0755); err != nil {
+				return err
+			}
+		}
+	}
+	for path, f := range p.files {
+		if rel, ok := relativeTo(root, path); ok {
+			if err := os.WriteFile(filepath.Join(dir, rel), f.data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RestoreFrom loads the contents of the real directory dir into the provider at
+// root, replacing anything stored there before.
+func (p *MemoryFileProvider) RestoreFrom(dir, root string) error {
+	root = filepath.Clean(root)
+	dirs := map[string]time.Time{}
+	files := map[string]*memFile{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(root, rel)
+		if d.IsDir() {
+			dirs[target] = info.ModTime()
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[target] = &memFile{data: data, modTime: info.ModTime()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.DeleteDirectory(root); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.mkdirAll(root); err != nil {
+		return err
+	}
+	for path, modTime := range dirs {
+		p.dirs[path] = modTime
+	}
+	for path, f := range files {
+		p.files[path] = f
+	}
+	return nil
+}
+
+// relativeTo returns path relative to root if it lies strictly below it.
+func relativeTo(root, path string) (string, bool) {
+	if root == "." {
+		return path, !filepath.IsAbs(path) && path != "."
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// memFileInfo describes a file or directory of a MemoryFileProvider. It serves
+// as both fs.FileInfo and fs.DirEntry.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() any           { return nil }
+func (i memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+func (i memFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i memFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+func (i memFileInfo) String() string             { return fs.FormatDirEntry(i) }
+
+// memHandle is an open RandomAccessFile of a MemoryFileProvider.
+type memHandle struct {
+	p      *MemoryFileProvider
+	f      *memFile
+	name   string
+	closed bool
+}
+
+func (h *memHandle) ReadAt(b []byte, off int64) (int, error) {
+	h.p.mu.RLock()
+	defer h.p.mu.RUnlock()
+	if h.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if off >= int64(len(h.f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, h.f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memHandle) WriteAt(b []byte, off int64) (int, error) {
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	if h.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if end := off + int64(len(b)); end > int64(len(h.f.data)) {
+		h.f.data = append(h.f.data, make([]byte, end-int64(len(h.f.data)))...)
+	}
+	copy(h.f.data[off:], b)
+	h.f.modTime = time.Now()
+	return len(b), nil
+}
+
+func (h *memHandle) Size() (int64, error) {
+	h.p.mu.RLock()
+	defer h.p.mu.RUnlock()
+	if h.closed {
+		return 0, fs.ErrClosed
+	}
+	return int64(len(h.f.data)), nil
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	if h.closed {
+		return fs.ErrClosed
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if size <= int64(len(h.f.data)) {
+		h.f.data = h.f.data[:size]
+	} else {
+		h.f.data = append(h.f.data, make([]byte, size-int64(len(h.f.data)))...)
+	}
+	h.f.modTime = time.Now()
+	return nil
+}
+
+// Sync does nothing: memory files have no stable storage to commit to.
+func (h *memHandle) Sync() error {
+	h.p.mu.RLock()
+	defer h.p.mu.RUnlock()
+	if h.closed {
+		return fs.ErrClosed
+	}
+	return nil
+}
+
+func (h *memHandle) Close() error {
+	h.p.mu.Lock()
+	defer h.p.mu.Unlock()
+	if h.closed {
+		return fs.ErrClosed
+	}
+	h.closed = true
+	return nil
+}
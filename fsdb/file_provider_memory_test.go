@@ -0,0 +1,171 @@
+package fsdb_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dannyswat/fsdb"
+)
+
+func TestMemoryFileProvider_Operations(t *testing.T) {
+	p := fsdb.NewMemoryFileProvider()
+	if err := p.WriteFile("/data/db", "a.txt", []byte("x")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("writing into a missing directory: got %v, want ErrNotExist", err)
+	}
+	if err := p.CreateDirectory("/data/db/sub"); err != nil {
+		t.Fatalf("CreateDirectory failed: %v", err)
+	}
+	for _, dir := range []string{"/data", "/data/db", "/data/db/sub"} {
+		if ok, _ := p.DirectoryExists(dir); !ok {
+			t.Errorf("expected %s to exist", dir)
+		}
+	}
+	if err := p.WriteFile("/data/db", "b.txt", []byte("hello")); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	data, err := p.ReadFile("/data/db", "b.txt")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	data[0] = 'j' // callers get a private copy
+	if data, _ := p.ReadFile("/data/db", "b.txt"); string(data) != "hello" {
+		t.Errorf("file modified through a returned slice: %q", data)
+	}
+	if _, err := p.ReadFile("/data/db", "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading a missing file: got %v, want ErrNotExist", err)
+	}
+
+	entries, err := p.ReadDirectory("/data/db")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ReadDirectory = %v, %v", entries, err)
+	}
+	if entries[0].Name() != "b.txt" || entries[0].IsDir() || entries[1].Name() != "sub" || !entries[1].IsDir() {
+		t.Errorf("unexpected entries %v", entries)
+	}
+	if info, err := entries[0].Info(); err != nil || info.Size() != 5 || info.Mode().IsDir() {
+		t.Errorf("unexpected file info %v, %v", info, err)
+	}
+
+	f, err := p.OpenFile("/data/db", "c.bin")
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("world"), 3); err != nil {
+		t.Fatalf("WriteAt failed: %v", err)
+	}
+	buf := make([]byte, 10)
+	if n, err := f.ReadAt(buf, 0); n != 8 || err != io.EOF || string(buf[3:8]) != "world" {
+		t.Errorf("ReadAt = %d, %v, %q", n, err, buf[:n])
+	}
+	if err := f.Truncate(4); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if size, _ := f.Size(); size != 4 {
+		t.Errorf("size after truncate = %d", size)
+	}
+	f.Close()
+
+	if err := p.DeleteFile("/data/db", "b.txt"); err != nil {
+		t.Fatalf("DeleteFile failed: %v", err)
+	}
+	if err := p.DeleteFile("/data/db", "b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleting a missing file: got %v, want ErrNotExist", err)
+	}
+	if err := p.DeleteDirectory("/data/db"); err != nil {
+		t.Fatalf("DeleteDirectory failed: %v", err)
+	}
+	if ok, _ := p.DirectoryExists("/data/db/sub"); ok {
+		t.Error("expected DeleteDirectory to remove the subtree")
+	}
+	if ok, _ := p.FileExists("/data/db", "c.bin"); ok {
+		t.Error("expected DeleteDirectory to remove files")
+	}
+}
+
+func TestMemoryFileProvider_Concurrent(t *testing.T) {
+	p := fsdb.NewMemoryFileProvider()
+	p.CreateDirectory("/d")
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				name := fmt.Sprintf("%d-%d", g, i)
+				p.WriteFile("/d", name, []byte(name))
+				if data, err := p.ReadFile("/d", name); err != nil || string(data) != name {
+					t.Errorf("ReadFile(%s) = %q, %v", name, data, err)
+				}
+				p.ReadDirectory("/d")
+			}
+		}(g)
+	}
+	wg.Wait()
+	if entries, _ := p.ReadDirectory("/d"); len(entries) != 800 {
+		t.Errorf("expected 800 files, got %d", len(entries))
+	}
+}
+
+func TestMemoryFileProvider_DatabaseSnapshotAndRestore(t *testing.T) {
+	p := fsdb.NewMemoryFileProvider()
+	db, err := fsdb.NewDatabaseWithOptions("db", fsdb.DatabaseOptions{FileProvider: p})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	schema := fsdb.CollectionSchema{
+		Name: "items",
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_id", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_kind", Keys: []fsdb.IndexField{{Name: "kind"}}, PageSize: 4, Storage: fsdb.StorageCollection},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("items")
+	for i := 0; i < 60; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "kind": i % 3}); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "snapshot")
+	if err := p.SnapshotTo("db", dir); err != nil {
+		t.Fatalf("SnapshotTo failed: %v", err)
+	}
+	// The snapshot is a regular database directory.
+	disk, err := fsdb.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+	coll, _ = disk.GetCollection("items")
+	if rows, err := coll.FindByIndex("ix_kind", []any{1}); err != nil || len(rows) != 20 {
+		t.Fatalf("FindByIndex on snapshot = %d rows, %v", len(rows), err)
+	}
+	disk.Close()
+
+	restored := fsdb.NewMemoryFileProvider()
+	if err := restored.RestoreFrom(dir, "/restored/db"); err != nil {
+		t.Fatalf("RestoreFrom failed: %v", err)
+	}
+	db, err = fsdb.NewDatabaseWithOptions("/restored/db", fsdb.DatabaseOptions{FileProvider: restored})
+	if err != nil {
+		t.Fatalf("failed to open restored database: %v", err)
+	}
+	defer db.Close()
+	coll, err = db.GetCollection("items")
+	if err != nil {
+		t.Fatalf("restored collection missing: %v", err)
+	}
+	if rows, err := coll.Find(nil); err != nil || len(rows) != 60 {
+		t.Fatalf("restored collection holds %d rows, %v", len(rows), err)
+	}
+}
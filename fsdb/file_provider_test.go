@@ -0,0 +1,124 @@
+package fsdb_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dannyswat/fsdb"
+	"github.com/dannyswat/fsdb/datatype"
+)
+
+// remappedProvider serves a virtual directory tree from a real directory. The
+// virtual root sits below a regular file, so any code bypassing the provider
+// and touching the virtual paths directly fails.
+type remappedProvider struct {
+	fsdb.FileProvider
+	virtual, real string
+}
+
+func (p *remappedProvider) path(path string) string {
+	if rel, err := filepath.Rel(p.virtual, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.Join(p.real, rel)
+	}
+	return path
+}
+
+func (p *remappedProvider) CreateDirectory(path string) error {
+	return p.FileProvider.CreateDirectory(p.path(path))
+}
+func (p *remappedProvider) DirectoryExists(path string) (bool, error) {
+	return p.FileProvider.DirectoryExists(p.path(path))
+}
+func (p *remappedProvider) DeleteDirectory(path string) error {
+	return p.FileProvider.DeleteDirectory(p.path(path))
+}
+func (p *remappedProvider) FileExists(path, fileName string) (bool, error) {
+	return p.FileProvider.FileExists(p.path(path), fileName)
+}
+func (p *remappedProvider) ReadFile(path, fileName string) ([]byte, error) {
+	return p.FileProvider.ReadFile(p.path(path), fileName)
+}
+func (p *remappedProvider) WriteFile(path, fileName string, data []byte) error {
+	return p.FileProvider.WriteFile(p.path(path), fileName, data)
+}
+func (p *remappedProvider) DeleteFile(path, fileName string) error {
+	return p.FileProvider.DeleteFile(p.path(path), fileName)
+}
+func (p *remappedProvider) ReadDirectory(path string) ([]os.DirEntry, error) {
+	return p.FileProvider.ReadDirectory(p.path(path))
+}
+func (p *remappedProvider) OpenFile(path, fileName string) (fsdb.RandomAccessFile, error) {
+	return p.FileProvider.OpenFile(p.path(path), fileName)
+}
+func (p *remappedProvider) RemoveTempFiles(path string) error {
+	return p.FileProvider.RemoveTempFiles(p.path(path))
+}
+
+func TestDatabase_AllIOThroughFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	provider := &remappedProvider{virtual: filepath.Join(blocker, "db"), real: filepath.Join(dir, "real")}
+	open := func() *fsdb.Database {
+		db, err := fsdb.NewDatabaseWithOptions(provider.virtual, fsdb.DatabaseOptions{FileProvider: provider})
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		return db
+	}
+
+	db := open()
+	schema := fsdb.CollectionSchema{
+		Name:           "notes",
+		EnableFullText: true,
+		Columns: []fsdb.ColumnDefinition{
+			{FieldName: "id", DataType: datatype.Integer},
+			{FieldName: "body", DataType: datatype.String, FullText: true},
+		},
+		Indexes: []fsdb.IndexDefinition{
+			{Name: "pk_id", IsClustered: true, Keys: []fsdb.IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_body", Keys: []fsdb.IndexField{{Name: "body"}}, PageSize: 4, Storage: fsdb.StoragePaged},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("failed to create collection: %v", err)
+	}
+	coll, _ := db.GetCollection("notes")
+	rows := func(yield func(map[string]any) bool) {
+		for i := 0; i < 200; i++ {
+			if !yield(map[string]any{"id": i, "body": "note number " + strings.Repeat("z", i%7)}) {
+				return
+			}
+		}
+	}
+	opts := fsdb.BulkLoadOptions{MemoryBudget: 2048, TempDir: filepath.Join(provider.virtual, "tmp")}
+	if err := coll.BulkLoad(rows, opts); err != nil {
+		t.Fatalf("bulk load failed: %v", err)
+	}
+	if err := coll.Insert(map[string]any{"id": 500, "body": "unique words here"}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	db = open()
+	defer db.Close()
+	coll, err := db.GetCollection("notes")
+	if err != nil {
+		t.Fatalf("failed to reopen collection: %v", err)
+	}
+	if found, err := coll.Find([]any{123}); err != nil || len(found) != 1 {
+		t.Fatalf("Find(123) = %v, %v", found, err)
+	}
+	if docs, err := coll.SearchFullText("unique"); err != nil || len(docs) != 1 {
+		t.Fatalf("full-text search = %v, %v", docs, err)
+	}
+	if _, err := os.Stat(filepath.Join(provider.real, "notes", "ix_body", "nodes.pages")); err != nil {
+		t.Errorf("expected the paged data file inside the provider's tree: %v", err)
+	}
+}
@@ -1,5 +1,10 @@
 package fsdb
 
+import (
+	"fmt"
+	"slices"
+)
+
 type IndexDefinition struct {
 	Name          string                 `json:"name"`
 	Keys          []IndexField           `json:"keys"`
@@ -7,5 +12,65 @@ type IndexDefinition struct {
 	Includes      []string               `json:"includes"`
 	PartialFilter []EqualFilterCondition `json:"partial_filter"`
 	PageSize      int                    `json:"page_size"`
+	PageBytes     int                    `json:"page_bytes"` // Target node size in bytes; when set, nodes split by size instead of PageSize keys and large values move to overflow nodes
 	IsClustered   bool                   `json:"is_clustered"`
+	Storage       string                 `json:"storage"` // Node storage engine: StorageFiles (default), StoragePaged or StorageCollection
+	Sparse        bool                   `json:"sparse"`  // Non-clustered only: rows with a null or missing key field are left out of the index
+}
+
+// validate checks the sort direction and null handling options of the definition.
+func (def IndexDefinition) validate() error {
+	if def.Sparse && def.IsClustered {
+		return fmt.Errorf("clustered index %s cannot be sparse", def.Name)
+	}
+	legacy := slices.ContainsFunc(def.Keys, func(k IndexField) bool { return k.Ascending })
+	for _, k := range def.Keys {
+		if legacy && k.Descending {
+			return fmt.Errorf("index %s sets both ascending and descending on its fields; set only descending, on the descending fields", def.Name)
+		}
+		switch k.Nulls {
+		case "", NullsFirst, NullsLast:
+		default:
+			return fmt.Errorf("unknown null placement %q for field %s of index %s", k.Nulls, k.Name, def.Name)
+		}
+	}
+	return nil
+}
+
+// descendingFields returns the sort direction of each key field (true = descending),
+// or nil when every field is ascending. Fields are descending when Descending is
+// set. Definitions written before Descending existed use Ascending instead: once
+// any field sets it, every field without it is descending. Ascending was written
+// as false on every field of older schemas, which then sort all ascending, as
+// they always have.
+func (def IndexDefinition) descendingFields() []bool {
+	legacy := slices.ContainsFunc(def.Keys, func(k IndexField) bool { return k.Ascending })
+	if !legacy && !slices.ContainsFunc(def.Keys, func(k IndexField) bool { return k.Descending }) {
+		return nil
+	}
+	desc := make([]bool, len(def.Keys))
+	for i, k := range def.Keys {
+		desc[i] = k.Descending || (legacy && !k.Ascending)
+	}
+	return desc
+}
+
+// keyOrder returns the sort order of the index key: the direction of each field
+// (see descendingFields) and where its nulls sort.
+func (def IndexDefinition) keyOrder() keyOrder {
+	desc := def.descendingFields()
+	order := make(keyOrder, len(def.Keys))
+	for i, k := range def.Keys {
+		f := fieldOrder{descending: desc != nil && desc[i]}
+		switch k.Nulls {
+		case NullsFirst:
+			f.nullsLast = false
+		case NullsLast:
+			f.nullsLast = true
+		default:
+			f.nullsLast = f.descending
+		}
+		order[i] = f
+	}
+	return order
 }
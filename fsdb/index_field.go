@@ -1,6 +1,14 @@
 package fsdb
 
+// Placement of null key fields in an index; see IndexField.Nulls.
+const (
+	NullsFirst = "first"
+	NullsLast  = "last"
+)
+
 type IndexField struct {
-	Name      string `json:"name"`
-	Ascending bool   `json:"ascending"`
+	Name       string `json:"name"`
+	Ascending  bool   `json:"ascending,omitempty"`  // Legacy direction flag; see IndexDefinition.descendingFields. Prefer Descending
+	Descending bool   `json:"descending,omitempty"` // Sort the field in descending order
+	Nulls      string `json:"nulls,omitempty"`      // Where null or missing values sort in scan order: NullsFirst or NullsLast. By default nulls sort below every value, i.e. first in an ascending field and last in a descending one
 }
@@ -2,63 +2,190 @@ package fsdb
 
 import (
 	"errors"
-	"os"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
 	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 )
 
 // IndexManager manages a single index (either clustered or non-clustered).
-// Each B+ tree node is stored as a file within the index's directory.
+// Its B+ tree nodes live in the index's directory, one file per node or in a
+// paged data file, depending on IndexDefinition.Storage.
 type IndexManager struct {
 	mu         sync.RWMutex
 	indexDef   IndexDefinition
-	indexPath  string // Path to this specific index's data (e.g., /basePath/indexes/indexName)
-	rootNodeID string // ID of the root node of the B+ tree
+	indexPath  string    // Path to this specific index's data (e.g., /basePath/indexes/indexName)
+	rootNodeID string    // ID of the root node of the B+ tree
+	meta       IndexMeta // Persisted state of the index, rewritten after every mutation
 	bTree      *BTree
 	Storage    BTreeNodeStorage
-	// nodeCache    map[string]*BTreeNode // TODO: Implement node caching
+	base       BTreeNodeStorage      // Storage engine below the node cache
+	versions   *versionedNodeStorage // Storage of the tree, keeping the versions open snapshots read
+	files      IFileProvider         // Backend for the index's files
+	rowKey     []string              // Clustered key fields appended to the keys of a collection's non-clustered index; see entryKey
+	format     int                   // Format version of the index when it was opened
 	// nextNodeID   int64                 // TODO: Implement node ID generation
 }
 
+// storageEnv carries the resources a Database shares with its collections and indexes.
+type storageEnv struct {
+	files     IFileProvider  // Backend for all file I/O; the local filesystem when nil
+	nodeCache *NodeCache     // Node cache shared by all indexes; nil disables caching
+	wal       *writeAheadLog // Log of the database's mutations; nil disables logging
+}
+
+// fileProvider returns the environment's file provider.
+func (env storageEnv) fileProvider() IFileProvider {
+	if env.files == nil {
+		return &FileProvider{}
+	}
+	return env.files
+}
+
 // NewIndexManager creates a new IndexManager.
 // basePath is the root directory for the collection.
 // indexDef is the definition of the index to manage.
 // schema is the schema of the collection.
 func NewIndexManager(indexPath string, indexDef IndexDefinition) (*IndexManager, error) {
-	storage := &FileBTreeNodeStorage{IndexPath: indexPath}
-	if err := storage.Init(); err != nil {
+	return newIndexManager(indexPath, indexDef, nil, storageEnv{})
+}
+
+// newIndexManager opens an index. rowKey names the clustered key fields of the
+// collection for a non-clustered index; see entryKey.
+func newIndexManager(indexPath string, indexDef IndexDefinition, rowKey []string, env storageEnv) (*IndexManager, error) {
+	if err := indexDef.validate(); err != nil {
 		return nil, err
 	}
+	files := env.fileProvider()
+	base, err := openNodeStorage(files, indexPath, indexDef)
+	if err != nil {
+		return nil, err
+	}
+	storage := base
+	if env.nodeCache != nil {
+		storage = NewCachedNodeStorage(env.nodeCache, base, indexPath)
+	}
 	im := &IndexManager{
 		indexDef:  indexDef,
 		indexPath: indexPath,
 		Storage:   storage,
+		base:      base,
+		files:     files,
 	}
-	// Load root node ID from meta file if exists
-	rootID, err := loadRootNodeID(indexPath)
-	if err == nil && rootID != "" {
-		im.rootNodeID = rootID
-		im.bTree = NewBTree(storage, rootID, indexDef.PageSize, indexDef.IsClustered)
-	} else {
-		im.bTree = NewBTree(storage, "", indexDef.PageSize, indexDef.IsClustered)
+	if !indexDef.IsClustered {
+		im.rowKey = rowKey
+	}
+	meta, legacy, err := loadIndexMeta(files, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	im.rootNodeID = meta.RootPageName
+	im.format = meta.FormatVersion
+	if meta.RootPageName == "" {
+		im.format = IndexFormatVersion // Nothing written in an older format
+	}
+	im.bTree = im.newBTree(meta.RootPageName)
+	if !legacy {
+		im.meta = meta
+		im.bTree.setShape(meta.shape())
+		if meta.FormatVersion >= 2 || meta.RootPageName == "" {
+			return im, nil
+		}
+		if err := im.migrateCounts(); err != nil {
+			return nil, err
+		}
+		return im, nil
+	}
+	// Migrate a root.meta file: count the tree once and persist full metadata.
+	if err := im.bTree.recount(); err != nil {
+		return nil, err
+	}
+	if err := im.migrateCounts(); err != nil {
+		return nil, err
+	}
+	if err := files.DeleteFile(indexPath, legacyRootFile); err != nil {
+		return nil, err
 	}
 	return im, nil
 }
 
-// Helper to persist root node ID to a file
-func saveRootNodeID(indexPath, rootID string) error {
-	metaPath := filepath.Join(indexPath, "root.meta")
-	return os.WriteFile(metaPath, []byte(rootID), 0644)
+// migrateCounts fills in the subtree counts of an index written before format
+// 2, writes the nodes through and records the current format in the metadata.
+func (im *IndexManager) migrateCounts() error {
+	if err := im.bTree.rebuildCounts(); err != nil {
+		return err
+	}
+	if cached, ok := im.Storage.(*CachedNodeStorage); ok {
+		if err := cached.Flush(); err != nil {
+			return err
+		}
+	}
+	return im.saveMeta()
 }
 
-// Helper to load root node ID from a file
-func loadRootNodeID(indexPath string) (string, error) {
-	metaPath := filepath.Join(indexPath, "root.meta")
-	data, err := os.ReadFile(metaPath)
-	if err != nil {
-		return "", err
+// openNodeStorage opens the storage engine selected by the index definition.
+func openNodeStorage(files IFileProvider, indexPath string, indexDef IndexDefinition) (BTreeNodeStorage, error) {
+	fileStorage := &FileBTreeNodeStorage{IndexPath: indexPath, Provider: files}
+	if err := fileStorage.Init(); err != nil {
+		return nil, err
 	}
-	return string(data), nil
+	switch indexDef.Storage {
+	case "", StorageFiles:
+		return fileStorage, nil
+	case StoragePaged:
+		return openPagedNodeStorage(files, indexPath, indexPagesFile, 0)
+	case StorageCollection:
+		return openPagedNodeStorage(files, filepath.Dir(indexPath), collectionPagesFile, 0)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q for index %s", indexDef.Storage, indexDef.Name)
+	}
+}
+
+// newBTree creates a B+ tree over the index storage, ordered per the index definition.
+func (im *IndexManager) newBTree(rootID string) *BTree {
+	if im.versions == nil || im.versions.BTreeNodeStorage != im.Storage {
+		im.versions = newVersionedNodeStorage(im.Storage)
+	}
+	bt := NewBTree(im.versions, rootID, im.indexDef.PageSize, im.unique())
+	bt.order = im.indexDef.keyOrder()
+	bt.SetPageBytes(im.indexDef.PageBytes)
+	return bt
+}
+
+// unique reports whether the keys of the index's tree are unique: those of a
+// clustered index, and those of a non-clustered index that end with the row key.
+func (im *IndexManager) unique() bool {
+	return im.indexDef.IsClustered || len(im.rowKey) > 0
+}
+
+// saveMeta records the current root and size of the tree in the index metadata.
+// It ends every mutation, so it also commits the version the mutation wrote.
+func (im *IndexManager) saveMeta() error {
+	im.versions.commit()
+	shape := im.bTree.shape
+	im.rootNodeID = im.bTree.RootID()
+	im.meta = IndexMeta{
+		IndexName:     im.indexDef.Name,
+		RootPageName:  im.rootNodeID,
+		RowsCount:     int64(shape.entries),
+		PagesCount:    int64(shape.nodes),
+		Height:        shape.height,
+		LastModified:  time.Now().UTC(),
+		FormatVersion: IndexFormatVersion,
+	}
+	return saveIndexMeta(im.files, im.indexPath, im.meta)
+}
+
+// Meta returns the persisted metadata of the index: its root, row and page
+// counts and tree height.
+func (im *IndexManager) Meta() IndexMeta {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	return im.meta
 }
 
 // GetName returns the name of the index.
@@ -78,40 +205,287 @@ func (im *IndexManager) GetType() string {
 // For a clustered index, 'data' contains full rows.
 // For a non-clustered index, 'data' might contain only key values and pointers to the clustered index.
 func (im *IndexManager) Build(data []map[string]any) error {
+	return im.BuildFrom(slices.Values(data), BulkLoadOptions{})
+}
+
+// BuildFrom rebuilds the index from a stream of rows with the bulk loader: the
+// entries are sorted (spilling to temporary files beyond the memory budget) and
+// the tree is built bottom-up with pages packed to the configured fill factor.
+func (im *IndexManager) BuildFrom(rows iter.Seq[map[string]any], opts BulkLoadOptions) error {
+	sorter := im.newSorter(opts)
+	defer sorter.Close()
+	for row := range rows {
+		if err := im.addToSorter(sorter, row); err != nil {
+			return err
+		}
+	}
+	return im.loadSorted(sorter, opts)
+}
+
+// newSorter creates a sorter ordering entries by this index's key.
+func (im *IndexManager) newSorter(opts BulkLoadOptions) *entrySorter {
+	return newEntrySorter(im.indexDef.keyOrder(), im.files, opts)
+}
+
+// addToSorter adds the index entry for a row to a sorter.
+func (im *IndexManager) addToSorter(sorter *entrySorter, row map[string]any) error {
+	key := im.entryKey(row)
+	if err := im.checkKey(key); err != nil {
+		return err
+	}
+	if im.skips(key) {
+		return nil
+	}
+	if im.indexDef.IsClustered {
+		return sorter.Add(key, row)
+	}
+	return sorter.Add(key, im.entryValue(row))
+}
+
+// loadSorted replaces the index contents with the sorted entries of a sorter.
+// On failure the index is left empty.
+func (im *IndexManager) loadSorted(sorter *entrySorter, opts BulkLoadOptions) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
-	// Clear existing index files
-	d, err := os.ReadDir(im.indexPath)
+	im.clear()
+	err := im.bTree.BulkLoad(sorter.All(), sorter.Len(), opts.FillFactor)
 	if err == nil {
-		for _, f := range d {
-			os.RemoveAll(filepath.Join(im.indexPath, f.Name()))
-		}
+		err = sorter.Err()
 	}
-	im.bTree = NewBTree(im.Storage, "", im.indexDef.PageSize, im.indexDef.IsClustered)
+	if err != nil {
+		im.clear()
+		return err
+	}
+	return im.saveMeta()
+}
 
-	// Sort data by index keys if needed (not implemented here)
-	for _, row := range data {
-		var key []any
-		var value any
-		if im.indexDef.IsClustered {
-			key = extractIndexKey(row, im.indexDef)
-			value = row
-		} else {
-			key = extractIndexKey(row, im.indexDef)
-			value = extractNonClusteredValue(row, im.indexDef)
+// MigrateFormat rewrites every node of the index in the storage's current format,
+// e.g. to convert an index created with JSON nodes to the binary format. Files
+// in the previous format are removed as their nodes are rewritten.
+func (im *IndexManager) MigrateFormat() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.bTree == nil {
+		return errors.New("BTree not initialized")
+	}
+	return im.bTree.walkNodes(func(node *BTreeNode) error {
+		for _, id := range overflowIDs(node) {
+			overflow, err := im.Storage.LoadNode(id)
+			if err != nil {
+				return err
+			}
+			overflow.IsDirty = true
+			if err := im.Storage.SaveNode(overflow); err != nil {
+				return err
+			}
 		}
-		if err := im.bTree.Insert(key, value); err != nil {
-			return err
+		node.IsDirty = true
+		return im.Storage.SaveNode(node)
+	})
+}
+
+// Verify checks the structure of the index: key order within nodes and against
+// the parent's separators, parent and leaf chain links, page fill, references to
+// missing nodes, stored nodes no longer reachable from the root, and the index
+// metadata. With opts.Repair, an index with issues is rebuilt from the entries
+// of its leaves and the nodes of the old tree are removed.
+func (im *IndexManager) Verify(opts VerifyOptions) (*VerifyReport, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	report, _, err := im.verify(opts, im.indexDef.Storage != StorageCollection)
+	return report, err
+}
+
+// verify implements Verify and returns the nodes reachable from the root
+// afterwards. Unreachable nodes are only looked for when the index owns its
+// storage; the collection checks a shared data file as a whole.
+func (im *IndexManager) verify(opts VerifyOptions, ownsStorage bool) (*VerifyReport, map[string]bool, error) {
+	if im.bTree == nil {
+		return nil, nil, errors.New("BTree not initialized")
+	}
+	// Check what is stored, not what only lives in the cache.
+	if cached, ok := im.Storage.(*CachedNodeStorage); ok {
+		if err := cached.Flush(); err != nil {
+			return nil, nil, err
 		}
 	}
-	im.rootNodeID = im.bTree.RootID()
-	if err := saveRootNodeID(im.indexPath, im.rootNodeID); err != nil {
+	check := im.bTree.check()
+	var orphans []string
+	if lister, ok := im.base.(NodeLister); ok && ownsStorage {
+		ids, err := lister.NodeIDs()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range ids {
+			if !check.reachable[id] {
+				orphans = append(orphans, id)
+				check.addIssue(IssueUnreachable, id, "node is stored but not reachable from the root")
+			}
+		}
+	}
+	if im.meta.RootPageName != im.bTree.RootID() {
+		check.addIssue(IssueMeta, "", "metadata names root %q, the index uses %q", im.meta.RootPageName, im.bTree.RootID())
+	}
+	if shape := im.meta.shape(); shape != check.shape {
+		check.addIssue(IssueMeta, "", "metadata records %d rows in %d nodes of height %d, the tree has %d rows in %d nodes of height %d",
+			shape.entries, shape.nodes, shape.height, check.shape.entries, check.shape.nodes, check.shape.height)
+	}
+	report := &VerifyReport{
+		Index:   im.indexDef.Name,
+		Entries: check.shape.entries,
+		Nodes:   check.shape.nodes,
+		Height:  check.shape.height,
+		Issues:  check.issues,
+	}
+	if !opts.Repair || report.OK() {
+		return report, check.reachable, nil
+	}
+	rebuild := slices.ContainsFunc(report.Issues, func(i VerifyIssue) bool { return i.Kind != IssueUnreachable })
+	if !rebuild {
+		for _, id := range orphans {
+			if err := im.Storage.DeleteNode(id); err != nil {
+				return report, nil, err
+			}
+		}
+		report.Repaired = true
+		return report, check.reachable, nil
+	}
+	if err := im.rebuildFromLeaves(check, orphans, opts.BulkLoad); err != nil {
+		return report, nil, err
+	}
+	report.Repaired = true
+	return report, im.bTree.check().reachable, nil
+}
+
+// rebuildFromLeaves replaces the tree with one bulk loaded from the entries of
+// its leaves, keeping the first entry of a duplicated key of a clustered index.
+// The new tree is written and recorded in the metadata before the nodes of the
+// old tree and the given orphans are removed.
+func (im *IndexManager) rebuildFromLeaves(check *treeCheck, orphans []string, opts BulkLoadOptions) error {
+	sorter := im.newSorter(opts)
+	defer sorter.Close()
+	extra, err := check.salvage(sorter)
+	if err != nil {
 		return err
 	}
+	entries := sorter.All()
+	if im.indexDef.IsClustered {
+		entries = distinctEntries(entries, im.bTree.order)
+	}
+	count := 0
+	for range entries {
+		count++
+	}
+	if err := sorter.Err(); err != nil {
+		return err
+	}
+	bt := im.newBTree("")
+	err = bt.BulkLoad(entries, count, opts.FillFactor)
+	if err == nil {
+		err = sorter.Err()
+	}
+	if err != nil {
+		return err
+	}
+	im.bTree = bt
+	if err := im.saveMeta(); err != nil {
+		return err
+	}
+	old := slices.Concat(slices.Collect(maps.Keys(check.reachable)), extra, orphans)
+	for _, id := range old {
+		if err := im.versions.DeleteNode(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the index's cached dirty nodes to disk.
+func (im *IndexManager) Flush() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if cached, ok := im.Storage.(*CachedNodeStorage); ok {
+		return cached.Flush()
+	}
 	return nil
 }
 
+// invalidateCache drops the index's nodes from the shared cache without writing them.
+func (im *IndexManager) invalidateCache() {
+	if cached, ok := im.Storage.(*CachedNodeStorage); ok {
+		cached.Invalidate()
+	}
+}
+
+// Close writes the index's cached dirty nodes and releases its storage engine,
+// e.g. its paged data file.
+func (im *IndexManager) Close() error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	var err error
+	if cached, ok := im.Storage.(*CachedNodeStorage); ok {
+		err = cached.Flush()
+		cached.Invalidate()
+	}
+	if closer, ok := im.base.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// clear removes every node of the index and resets it to an empty tree.
+func (im *IndexManager) clear() {
+	var ids []string
+	if im.bTree != nil && (im.versions.pinned() || !isFileStorage(im.base)) {
+		im.bTree.walkNodes(func(node *BTreeNode) error {
+			ids = append(ids, node.ID)
+			ids = append(ids, overflowIDs(node)...)
+			return nil
+		})
+	}
+	if isFileStorage(im.base) {
+		for _, id := range ids {
+			im.versions.capture(id)
+		}
+		im.invalidateCache()
+		d, err := im.files.ReadDirectory(im.indexPath)
+		if err == nil {
+			for _, f := range d {
+				if f.IsDir() {
+					im.files.DeleteDirectory(filepath.Join(im.indexPath, f.Name()))
+				} else {
+					im.files.DeleteFile(im.indexPath, f.Name())
+				}
+			}
+		}
+	} else {
+		// Paged data files may be shared with other indexes, so free the pages one by one.
+		for _, id := range ids {
+			im.versions.DeleteNode(id)
+		}
+		im.invalidateCache()
+		im.files.DeleteFile(im.indexPath, indexMetaFile)
+	}
+	im.bTree = im.newBTree("")
+	im.rootNodeID = ""
+	im.meta = IndexMeta{}
+}
+
+func isFileStorage(storage BTreeNodeStorage) bool {
+	_, ok := storage.(*FileBTreeNodeStorage)
+	return ok
+}
+
+// isEmpty reports whether the index holds no entries.
+func (im *IndexManager) isEmpty() bool {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	return im.bTree == nil || im.bTree.RootID() == ""
+}
+
 // Insert inserts a new entry into the index.
 // For a clustered index, 'value' is the full row. 'key' is extracted from the value.
 // For a non-clustered index, 'key' is the indexed fields, and 'value' is the pointer/reference
@@ -122,6 +496,12 @@ func (im *IndexManager) Insert(key []any, value any) error {
 	if im.bTree == nil {
 		return errors.New("BTree not initialized")
 	}
+	if err := im.checkKey(key); err != nil {
+		return err
+	}
+	if im.skips(key) {
+		return nil
+	}
 	var err error
 	if im.indexDef.IsClustered {
 		err = im.bTree.Insert(key, value)
@@ -130,24 +510,27 @@ func (im *IndexManager) Insert(key []any, value any) error {
 		if !ok {
 			return errors.New("value must be a map for non-clustered index")
 		}
-		err = im.bTree.Insert(key, extractNonClusteredValue(row, im.indexDef))
+		err = im.bTree.Insert(key, im.entryValue(row))
 	}
-	if err == nil {
-		im.rootNodeID = im.bTree.RootID()
-		saveRootNodeID(im.indexPath, im.rootNodeID)
+	if err != nil {
+		return err
 	}
-	return err
+	return im.saveMeta()
 }
 
 // Update updates an existing entry in the index.
 // For clustered index: updates the value for the key in-place.
-// For non-clustered index: returns an error (not supported).
+// For non-clustered index: moves the entry to the new key, adding or removing it
+// when a sparse index leaves out the old or the new key.
 func (im *IndexManager) Update(oldKey []any, oldValue any, newKey []any, newValue any) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 	if im.bTree == nil {
 		return errors.New("BTree not initialized")
 	}
+	if err := im.checkKey(newKey); err != nil {
+		return err
+	}
 	var err error
 	if im.indexDef.IsClustered {
 		if compareKeys(oldKey, newKey) != 0 {
@@ -163,45 +546,78 @@ func (im *IndexManager) Update(oldKey []any, oldValue any, newKey []any, newValu
 		if !ok1 || !ok2 {
 			return errors.New("values must be maps for non-clustered index")
 		}
-		if compareKeys(oldKey, newKey) != 0 {
+		switch {
+		case im.skips(oldKey) && im.skips(newKey):
+			return nil
+		case im.skips(oldKey):
+			err = im.bTree.Insert(newKey, im.entryValue(newRow))
+		case im.skips(newKey):
+			err = im.bTree.Delete(oldKey)
+		case compareKeys(oldKey, newKey) != 0 || !im.bTree.isUniqueKey:
 			if err = im.bTree.Delete(oldKey); err == nil {
-				err = im.bTree.Insert(newKey, extractNonClusteredValue(newRow, im.indexDef))
+				err = im.bTree.Insert(newKey, im.entryValue(newRow))
 			}
-		} else {
-			err = im.bTree.Update(oldKey, extractNonClusteredValue(newRow, im.indexDef))
+		default:
+			err = im.bTree.Update(oldKey, im.entryValue(newRow))
 		}
 	}
-	if err == nil {
-		im.rootNodeID = im.bTree.RootID()
-		saveRootNodeID(im.indexPath, im.rootNodeID)
+	if err != nil {
+		return err
 	}
-	return err
+	return im.saveMeta()
 }
 
 // Delete removes an entry from the index.
 // For both clustered and non-clustered indexes: deletes all entries with the given key.
+// The keys of a collection's non-clustered index end with the row key (see
+// entryKey), so there it deletes the entry of a single row.
 func (im *IndexManager) Delete(key []any) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 	if im.bTree == nil {
 		return errors.New("BTree not initialized")
 	}
+	if im.skips(key) {
+		return nil
+	}
 	err := im.bTree.Delete(key)
-	if err == nil {
-		im.rootNodeID = im.bTree.RootID()
-		saveRootNodeID(im.indexPath, im.rootNodeID)
+	if err != nil {
+		return err
 	}
-	return err
+	return im.saveMeta()
 }
 
-// Search finds entries in the index based on a key or a range of keys.
+// Search finds entries in the index based on a key or a range of keys. It
+// reads a snapshot of the index, so writers are not blocked while it runs.
 func (im *IndexManager) Search(searchKey []any) ([]any, error) {
-	im.mu.RLock()
-	defer im.mu.RUnlock()
-	if im.bTree == nil {
-		return nil, errors.New("BTree not initialized")
-	}
-	return im.bTree.Search(searchKey)
+	snap := im.snapshot()
+	defer snap.release()
+	return snap.tree.Search(searchKey)
+}
+
+// SearchRange finds entries whose keys fall within the given range, in key order.
+func (im *IndexManager) SearchRange(r KeyRange) ([]any, error) {
+	snap := im.snapshot()
+	defer snap.release()
+	return snap.tree.SearchRange(r)
+}
+
+// Cursor returns a cursor over the entries whose keys fall within r, as of the
+// moment it was opened. Writers are not blocked while it is open; Close it to
+// release the snapshot it reads.
+func (im *IndexManager) Cursor(r KeyRange) (*Cursor, error) {
+	snap := im.snapshot()
+	cur := snap.tree.Cursor(r)
+	cur.release = snap.release
+	return cur, nil
+}
+
+// ReverseCursor returns a cursor over the entries within r, from the last key to the first.
+func (im *IndexManager) ReverseCursor(r KeyRange) (*Cursor, error) {
+	snap := im.snapshot()
+	cur := snap.tree.ReverseCursor(r)
+	cur.release = snap.release
+	return cur, nil
 }
 
 // Helper to extract index key from a row
@@ -213,6 +629,67 @@ func extractIndexKey(row map[string]any, def IndexDefinition) []any {
 	return key
 }
 
+// entryKey returns the key of a row's entry in the index. A non-clustered index
+// of a collection appends the row's clustered key to the indexed fields, which
+// makes every entry unique and points it at its row: entries with equal indexed
+// fields are ordered by row key, each can be removed on its own, and lookups by
+// the indexed fields alone match the entries as a prefix.
+func (im *IndexManager) entryKey(row map[string]any) []any {
+	key := extractIndexKey(row, im.indexDef)
+	for _, name := range im.rowKey {
+		key = append(key, row[name])
+	}
+	return key
+}
+
+// entryValue returns the value stored for a row in the index: the row itself in
+// a clustered index, otherwise its indexed, row key and included fields.
+func (im *IndexManager) entryValue(row map[string]any) any {
+	if im.indexDef.IsClustered {
+		return row
+	}
+	value := extractNonClusteredValue(row, im.indexDef)
+	for _, name := range im.rowKey {
+		if v, ok := row[name]; ok {
+			value[name] = v
+		}
+	}
+	return value
+}
+
+// nullKeyField returns the name of the first field that is null or missing in
+// a key of the index.
+func nullKeyField(key []any, def IndexDefinition) (string, bool) {
+	for i, v := range key {
+		if v == nil && i < len(def.Keys) {
+			return def.Keys[i].Name, true
+		}
+	}
+	return "", false
+}
+
+// checkKey rejects a key with a null field in a clustered index, where keys
+// identify rows.
+func (im *IndexManager) checkKey(key []any) error {
+	if !im.indexDef.IsClustered {
+		return nil
+	}
+	if name, null := nullKeyField(key, im.indexDef); null {
+		return fmt.Errorf("clustered index %s: key field %s is null or missing", im.indexDef.Name, name)
+	}
+	return nil
+}
+
+// skips reports whether the index leaves out the entry with the given key,
+// which a sparse index does when a key field is null.
+func (im *IndexManager) skips(key []any) bool {
+	if !im.indexDef.Sparse {
+		return false
+	}
+	_, null := nullKeyField(key, im.indexDef)
+	return null
+}
+
 // Helper to extract only the primary key and included fields for non-clustered index
 func extractNonClusteredValue(row map[string]any, def IndexDefinition) map[string]any {
 	result := make(map[string]any)
@@ -136,3 +136,209 @@ func TestIndexManager_BuildInsertSearch(t *testing.T) {
 		t.Errorf("Expected 3 rows, got %d", len(results))
 	}
 }
+
+func TestIndexManager_Meta(t *testing.T) {
+	dir := t.TempDir()
+	def := IndexDefinition{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4}
+	im, err := NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := im.Insert([]any{i}, map[string]any{"id": i}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	for i := 0; i < 50; i += 5 {
+		if err := im.Delete([]any{i}); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	checkMeta := func(im *IndexManager, rows int64) {
+		t.Helper()
+		meta := im.Meta()
+		if meta.IndexName != "pk" || meta.FormatVersion != IndexFormatVersion || meta.LastModified.IsZero() {
+			t.Errorf("unexpected meta %+v", meta)
+		}
+		if meta.RootPageName != im.bTree.RootID() || meta.RowsCount != rows {
+			t.Errorf("meta root %s with %d rows, want %s with %d", meta.RootPageName, meta.RowsCount, im.bTree.RootID(), rows)
+		}
+		want := im.bTree.shape
+		if err := im.bTree.recount(); err != nil {
+			t.Fatalf("recount failed: %v", err)
+		}
+		if im.bTree.shape != want || meta.shape() != want {
+			t.Errorf("tracked shape %+v and meta %+v differ from the tree %+v", want, meta.shape(), im.bTree.shape)
+		}
+	}
+	checkMeta(im, 40)
+
+	im, err = NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	checkMeta(im, 40)
+
+	// An index written before meta.json existed only has root.meta.
+	if err := os.Remove(filepath.Join(dir, indexMetaFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, legacyRootFile), []byte(im.bTree.RootID()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	im, err = NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("opening a legacy index failed: %v", err)
+	}
+	checkMeta(im, 40)
+	if _, err := os.Stat(filepath.Join(dir, legacyRootFile)); !os.IsNotExist(err) {
+		t.Errorf("expected root.meta to be removed after migration: %v", err)
+	}
+
+	rebuilt, err := NewIndexManager(t.TempDir(), def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	rows := make([]map[string]any, 100)
+	for i := range rows {
+		rows[i] = map[string]any{"id": i}
+	}
+	if err := rebuilt.Build(rows); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	checkMeta(rebuilt, 100)
+}
+
+func TestIndexManager_MigrateCounts(t *testing.T) {
+	dir := t.TempDir()
+	def := IndexDefinition{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4}
+	im, err := NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	for i := 0; i < 60; i++ {
+		if err := im.Insert([]any{i}, map[string]any{"id": i}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	// Rewrite the index as format 1 wrote it: internal nodes without counts.
+	err = im.bTree.walkNodes(func(node *BTreeNode) error {
+		if node.IsLeaf() {
+			return nil
+		}
+		node.Counts = nil
+		node.IsDirty = true
+		return im.Storage.SaveNode(node)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := im.Meta()
+	meta.FormatVersion = 1
+	if err := saveIndexMeta(im.files, dir, meta); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := im.bTree.CountRange(KeyRange{Lower: []any{10}, LowerInclusive: true}); err != nil || n != 50 {
+		t.Errorf("CountRange without counts = %d, %v, want 50", n, err)
+	}
+
+	im, err = NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if v := im.Meta().FormatVersion; v != IndexFormatVersion {
+		t.Errorf("format version %d after opening, want %d", v, IndexFormatVersion)
+	}
+	report, err := im.Verify(VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("migrated index has issues: %v", report.Issues)
+	}
+	if n, err := im.bTree.Rank([]any{25}); err != nil || n != 25 {
+		t.Errorf("Rank(25) = %d, %v, want 25", n, err)
+	}
+}
+
+func TestCollection_MigrateRowKeys(t *testing.T) {
+	files := NewMemoryFileProvider()
+	db, err := NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: files})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	byColor := IndexDefinition{Name: "ix_color", Keys: []IndexField{{Name: "color"}}, PageSize: 4}
+	schema := CollectionSchema{
+		Name: "items",
+		Indexes: []IndexDefinition{
+			{Name: "pk_id", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4},
+			byColor,
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("items")
+	var rows []map[string]any
+	for i := 0; i < 30; i++ {
+		row := map[string]any{"id": i, "color": []string{"red", "green", "blue"}[i%3]}
+		rows = append(rows, row)
+		if err := coll.Insert(row); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	db.Close()
+
+	// Rewrite the index as format 2 wrote it: keyed by the indexed fields alone.
+	dir := filepath.Join("/db", "items", "ix_color")
+	im, err := newIndexManager(dir, byColor, nil, storageEnv{files: files})
+	if err != nil {
+		t.Fatalf("newIndexManager failed: %v", err)
+	}
+	if err := im.Build(rows); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	meta := im.Meta()
+	meta.FormatVersion = 2
+	if err := saveIndexMeta(files, dir, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: files})
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer db.Close()
+	coll, _ = db.GetCollection("items")
+	ix := coll.nonClusteredIndexes["ix_color"]
+	if v := ix.Meta().FormatVersion; v != IndexFormatVersion {
+		t.Errorf("format version %d after opening, want %d", v, IndexFormatVersion)
+	}
+	report, err := ix.Verify(VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("migrated index has issues: %v", report.Issues)
+	}
+	// Entries with equal indexed fields come in row key order and carry the row key.
+	found, err := coll.FindByIndex("ix_color", []any{"green"})
+	if err != nil || len(found) != 10 {
+		t.Fatalf("FindByIndex(green) = %d entries, %v, want 10", len(found), err)
+	}
+	for i, entry := range found {
+		if id := entry.(map[string]any)["id"]; fmt.Sprint(id) != fmt.Sprint(3*i+1) {
+			t.Errorf("entry %d has id %v, want %d", i, id, 3*i+1)
+		}
+	}
+	// Deleting a row removes its entry alone.
+	if err := coll.Delete(rows[4]); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if found, _ := coll.FindByIndex("ix_color", []any{"green"}); len(found) != 9 {
+		t.Errorf("FindByIndex(green) after delete = %d entries, want 9", len(found))
+	}
+	if found, _ := coll.FindByIndex("ix_color", []any{"green", 7}); len(found) != 1 {
+		t.Errorf("FindByIndex(green, 7) = %d entries, want 1", len(found))
+	}
+}
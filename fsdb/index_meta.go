@@ -1,8 +1,69 @@
 package fsdb
 
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// IndexFormatVersion is the on-disk format version recorded in new index metadata.
+// Version 2 records the number of entries below each child in internal nodes;
+// indexes of version 1 get their counts filled in when they are opened.
+// Version 3 appends the row key to the keys of a collection's non-clustered
+// indexes; older ones are rebuilt when their collection is opened.
+const IndexFormatVersion = 3
+
+const (
+	indexMetaFile  = "meta.json"
+	legacyRootFile = "root.meta" // Root node ID only, written before IndexMeta was persisted
+)
+
+// IndexMeta describes the persisted state of an index. It is rewritten after
+// every mutation, so row counts and tree statistics are available without a scan.
 type IndexMeta struct {
-	IndexName    string `json:"index_name"`
-	RootPageName string `json:"root_page_name"`
-	RowsCount    int64  `json:"rows_count"`
-	PagesCount   int64  `json:"pages_count"`
+	IndexName     string    `json:"index_name"`
+	RootPageName  string    `json:"root_page_name"`
+	RowsCount     int64     `json:"rows_count"`
+	PagesCount    int64     `json:"pages_count"`
+	Height        int       `json:"height"`
+	LastModified  time.Time `json:"last_modified"`
+	FormatVersion int       `json:"format_version"`
+}
+
+// shape returns the tree statistics recorded in the metadata.
+func (m IndexMeta) shape() treeShape {
+	return treeShape{entries: int(m.RowsCount), nodes: int(m.PagesCount), height: m.Height}
+}
+
+// saveIndexMeta writes the metadata of an index in a single file write.
+func saveIndexMeta(files IFileProvider, indexPath string, meta IndexMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return files.WriteFile(indexPath, indexMetaFile, data)
+}
+
+// loadIndexMeta reads the metadata of an index; a new index has empty metadata.
+// An index written before IndexMeta was persisted only has a root.meta file; its
+// metadata is returned with legacy set so that the caller can recount the tree
+// and migrate it.
+func loadIndexMeta(files IFileProvider, indexPath string) (meta IndexMeta, legacy bool, err error) {
+	data, err := files.ReadFile(indexPath, indexMetaFile)
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+		return meta, false, err
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return IndexMeta{}, false, err
+	}
+	data, err = files.ReadFile(indexPath, legacyRootFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return IndexMeta{}, false, nil
+	}
+	if err != nil {
+		return IndexMeta{}, false, err
+	}
+	return IndexMeta{RootPageName: string(data)}, true, nil
 }
@@ -0,0 +1,171 @@
+package fsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Keys are compared through an order-preserving ("memcomparable") binary
+// encoding: two keys compare like their encodings compared as byte strings.
+// Each field is encoded as a type tag followed by its value, so that values of
+// different types never compare equal and sort by the rank of their tags:
+//
+//	null < false < true < numbers < strings < times < byte slices < other values
+//
+// All integer and floating point types share one numeric encoding and compare
+// by value, e.g. int 1 equals float64 1. Strings compare bytewise. Times
+// compare as instants. Values of other types (maps, slices, structs) are
+// encoded by their Go syntax representation, which at least orders them
+// consistently.
+//
+// A null field sorts below every value, unless its order places nulls on the
+// other side of the values, in which case it is encoded with keyTagNullHigh.
+//
+// The encoding of every field is prefix-free, so the bytes of a descending
+// field are simply inverted, and the encoding of a composite key is the
+// concatenation of its fields'. A key that is a prefix of another sorts first.
+const (
+	keyTagNull   byte = 0x05
+	keyTagFalse  byte = 0x10
+	keyTagTrue   byte = 0x11
+	keyTagNumber byte = 0x20
+	keyTagString byte = 0x30
+	keyTagTime   byte = 0x40
+	keyTagBytes  byte = 0x50
+	keyTagOther  byte = 0x60
+
+	keyTagNullHigh byte = 0xF0
+)
+
+// encode returns the binary encoding of key under the order.
+func (o keyOrder) encode(key []any) []byte {
+	return o.appendKey(nil, key)
+}
+
+// appendKey appends the binary encoding of key under the order to dst.
+func (o keyOrder) appendKey(dst []byte, key []any) []byte {
+	for i, v := range key {
+		var f fieldOrder
+		if i < len(o) {
+			f = o[i]
+		}
+		start := len(dst)
+		if v == nil && f.nullsLast != f.descending {
+			dst = append(dst, keyTagNullHigh) // Low again once a descending field is inverted
+		} else {
+			dst = appendKeyValue(dst, v)
+		}
+		if f.descending {
+			for j := start; j < len(dst); j++ {
+				dst[j] = ^dst[j]
+			}
+		}
+	}
+	return dst
+}
+
+// appendKeyValue appends the encoding of a single key field.
+func appendKeyValue(dst []byte, v any) []byte {
+	switch val := v.(type) {
+	case nil:
+		return append(dst, keyTagNull)
+	case bool:
+		if val {
+			return append(dst, keyTagTrue)
+		}
+		return append(dst, keyTagFalse)
+	case int:
+		return appendKeyInt(dst, int64(val))
+	case int8:
+		return appendKeyInt(dst, int64(val))
+	case int16:
+		return appendKeyInt(dst, int64(val))
+	case int32:
+		return appendKeyInt(dst, int64(val))
+	case int64:
+		return appendKeyInt(dst, val)
+	case uint:
+		return appendKeyUint(dst, uint64(val))
+	case uint8:
+		return appendKeyInt(dst, int64(val))
+	case uint16:
+		return appendKeyInt(dst, int64(val))
+	case uint32:
+		return appendKeyInt(dst, int64(val))
+	case uint64:
+		return appendKeyUint(dst, val)
+	case float32:
+		return appendKeyNumber(dst, float64(val), 0)
+	case float64:
+		return appendKeyNumber(dst, val, 0)
+	case string:
+		return appendKeyBytes(append(dst, keyTagString), val)
+	case time.Time:
+		dst = append(dst, keyTagTime)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(val.Unix())^(1<<63))
+		return binary.BigEndian.AppendUint32(dst, uint32(val.Nanosecond()))
+	case []byte:
+		return appendKeyBytes(append(dst, keyTagBytes), string(val))
+	default:
+		return appendKeyBytes(append(dst, keyTagOther), fmt.Sprintf("%#v", v))
+	}
+}
+
+// appendKeyInt encodes an integer as the nearest float64 followed by the
+// integer's distance from it, so that integers beyond the float64 precision
+// stay distinct and still compare correctly with floats.
+func appendKeyInt(dst []byte, i int64) []byte {
+	f := float64(i)
+	if f >= 0x1p63 { // Rounded up past math.MaxInt64
+		return appendKeyNumber(dst, f, i-math.MaxInt64-1)
+	}
+	return appendKeyNumber(dst, f, i-int64(f))
+}
+
+func appendKeyUint(dst []byte, u uint64) []byte {
+	if u <= math.MaxInt64 {
+		return appendKeyInt(dst, int64(u))
+	}
+	f := float64(u)
+	if f >= 0x1p64 { // Rounded up past math.MaxUint64
+		return appendKeyNumber(dst, f, -int64(^u)-1)
+	}
+	return appendKeyNumber(dst, f, int64(u-uint64(f)))
+}
+
+// appendKeyNumber encodes a number as its float64 approximation f, with the
+// bits flipped so that they sort as unsigned integers, and the signed
+// remainder of an integer that f does not represent exactly.
+func appendKeyNumber(dst []byte, f float64, remainder int64) []byte {
+	if f == 0 {
+		f = 0 // Negative zero equals zero
+	}
+	if math.IsNaN(f) {
+		f = math.NaN() // One NaN, above +Inf
+	}
+	bits := math.Float64bits(f)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	dst = append(dst, keyTagNumber)
+	dst = binary.BigEndian.AppendUint64(dst, bits)
+	return binary.BigEndian.AppendUint64(dst, uint64(remainder)^(1<<63))
+}
+
+// appendKeyBytes appends s with its zero bytes escaped as 0x00 0xFF and
+// terminated by 0x00 0x01, which preserves the bytewise order of strings and
+// keeps the encoding prefix-free.
+func appendKeyBytes(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			dst = append(dst, 0, 0xFF)
+		} else {
+			dst = append(dst, s[i])
+		}
+	}
+	return append(dst, 0, 1)
+}
@@ -0,0 +1,155 @@
+package fsdb
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeyEncoding_Order(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ascending := []any{
+		nil,
+		false,
+		true,
+		math.Inf(-1),
+		int64(math.MinInt64),
+		-1.5,
+		-1,
+		0,
+		0.5,
+		1,
+		1 << 53,
+		1<<53 + 1,
+		float64(1<<53 + 2),
+		int64(math.MaxInt64),
+		uint64(math.MaxUint64),
+		math.Inf(1),
+		math.NaN(),
+		"",
+		"a",
+		"a\x00",
+		"a\x00b",
+		"ab",
+		"b",
+		t0.Add(-time.Second),
+		t0,
+		t0.Add(time.Nanosecond),
+		[]byte{},
+		[]byte{0},
+		map[string]any{"a": 1},
+	}
+	for i := 1; i < len(ascending); i++ {
+		a, b := []any{ascending[i-1]}, []any{ascending[i]}
+		if c := compareKeys(a, b); c >= 0 {
+			t.Errorf("%#v should sort before %#v, compare = %d", ascending[i-1], ascending[i], c)
+		}
+		desc := keyOrder{{descending: true, nullsLast: true}}
+		if c := desc.compare(a, b); c <= 0 {
+			t.Errorf("descending: %#v should sort after %#v, compare = %d", ascending[i-1], ascending[i], c)
+		}
+	}
+
+	equal := [][2]any{
+		{1, int64(1)},
+		{1, 1.0},
+		{uint8(7), int32(7)},
+		{float32(0.5), 0.5},
+		{0.0, math.Copysign(0, -1)},
+		{uint64(1 << 63), float64(1 << 63)},
+		{t0, t0.In(time.FixedZone("X", 3600))},
+	}
+	for _, pair := range equal {
+		if !bytes.Equal(keyOrder(nil).encode([]any{pair[0]}), keyOrder(nil).encode([]any{pair[1]})) {
+			t.Errorf("%#v and %#v should encode alike", pair[0], pair[1])
+		}
+	}
+	for _, pair := range [][2]any{{1, "1"}, {0, false}, {nil, ""}, {"", []byte{}}} {
+		if compareKeys([]any{pair[0]}, []any{pair[1]}) == 0 {
+			t.Errorf("%#v and %#v of different types compare equal", pair[0], pair[1])
+		}
+	}
+}
+
+func TestKeyEncoding_Composite(t *testing.T) {
+	order := keyOrder{{}, {descending: true, nullsLast: true}}
+	ascending := [][]any{
+		{"a"},
+		{"a", 9},
+		{"a", 2},
+		{"a", 1},
+		{"a", nil},
+		{"ab", 5},
+		{"b", "x"},
+		{"b", "w"},
+	}
+	for i := 1; i < len(ascending); i++ {
+		if c := order.compare(ascending[i-1], ascending[i]); c >= 0 {
+			t.Errorf("%v should sort before %v, compare = %d", ascending[i-1], ascending[i], c)
+		}
+	}
+	if order.comparePrefix([]any{"a", 1}, []any{"a"}) != 0 {
+		t.Error("a key should match a prefix of its fields")
+	}
+	if c := (keyOrder{{descending: true}}).compare([]any{"a"}, []any{"ab"}); c <= 0 {
+		t.Errorf("descending strings: %q should sort after %q", "a", "ab")
+	}
+}
+
+func TestKeyEncoding_Nulls(t *testing.T) {
+	for _, f := range []fieldOrder{{}, {nullsLast: true}, {descending: true}, {descending: true, nullsLast: true}} {
+		order := keyOrder{f}
+		lo, hi := []any{-1}, []any{"z"}
+		if f.descending {
+			lo, hi = hi, lo
+		}
+		if order.compare(lo, hi) >= 0 {
+			t.Fatalf("%+v: %v should sort before %v", f, lo, hi)
+		}
+		null := []any{nil}
+		if f.nullsLast {
+			if order.compare(hi, null) >= 0 {
+				t.Errorf("%+v: null should sort after %v", f, hi)
+			}
+		} else if order.compare(null, lo) >= 0 {
+			t.Errorf("%+v: null should sort before %v", f, lo)
+		}
+	}
+
+	def := IndexDefinition{Keys: []IndexField{{Name: "a"}, {Name: "b", Descending: true}, {Name: "c", Nulls: NullsLast}}}
+	want := keyOrder{{}, {descending: true, nullsLast: true}, {nullsLast: true}}
+	if got := def.keyOrder(); !slices.Equal(got, want) {
+		t.Errorf("keyOrder() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBTree_MixedTypeKeys(t *testing.T) {
+	bt := NewBTree(newMemNodeStorage(), "", 4, true)
+	keys := []any{"1", 1, true, nil, 2.5, "x", false, 0}
+	for _, k := range keys {
+		if err := bt.Insert([]any{k}, k); err != nil {
+			t.Fatalf("Insert(%#v) failed: %v", k, err)
+		}
+	}
+	if err := bt.Insert([]any{1.0}, 1.0); err == nil {
+		t.Error("expected 1.0 to collide with the integer key 1")
+	}
+	got, err := bt.Search(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{nil, false, true, 0, 1, 2.5, "1", "x"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	if rows, _ := bt.Search([]any{"1"}); len(rows) != 1 || rows[0] != "1" {
+		t.Errorf("Search(\"1\") = %v", rows)
+	}
+}
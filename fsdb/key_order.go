@@ -0,0 +1,28 @@
+package fsdb
+
+import "bytes"
+
+// keyOrder holds the sort order of each field of a composite key. Fields beyond
+// its length (and a nil keyOrder) sort ascending with nulls first.
+type keyOrder []fieldOrder
+
+// fieldOrder is the sort order of one key field.
+type fieldOrder struct {
+	descending bool
+	nullsLast  bool // Nulls sort after every value in the field's direction
+}
+
+// compare compares two composite keys, honouring the direction of each field,
+// by comparing their binary encodings (see appendKey).
+func (o keyOrder) compare(a, b []any) int {
+	var bufA, bufB [64]byte
+	return bytes.Compare(o.appendKey(bufA[:0], a), o.appendKey(bufB[:0], b))
+}
+
+// comparePrefix compares key against bound using only the first len(bound) fields of key.
+func (o keyOrder) comparePrefix(key, bound []any) int {
+	if len(key) > len(bound) {
+		key = key[:len(bound)]
+	}
+	return o.compare(key, bound)
+}
@@ -0,0 +1,37 @@
+package fsdb
+
+// KeyRange describes a contiguous range of index keys.
+// A nil bound leaves that side of the range open. A bound may be shorter than
+// the index key, in which case only the leading fields are compared (prefix match),
+// e.g. Lower: []any{42}, Upper: []any{42} on a (user_id, created_at) index selects
+// every entry for user 42. Bounds follow the index order: on a descending field
+// Lower is the bound visited first, i.e. the larger value.
+type KeyRange struct {
+	Lower          []any `json:"lower"`
+	Upper          []any `json:"upper"`
+	LowerInclusive bool  `json:"lower_inclusive"`
+	UpperInclusive bool  `json:"upper_inclusive"`
+}
+
+// ExactRange returns a range that matches every key equal to (or prefixed by) key.
+func ExactRange(key []any) KeyRange {
+	return KeyRange{Lower: key, Upper: key, LowerInclusive: true, UpperInclusive: true}
+}
+
+// aboveLower reports whether key satisfies the lower bound of the range under the given order.
+func (r KeyRange) aboveLower(o keyOrder, key []any) bool {
+	if r.Lower == nil {
+		return true
+	}
+	c := o.comparePrefix(key, r.Lower)
+	return c > 0 || (c == 0 && r.LowerInclusive)
+}
+
+// belowUpper reports whether key satisfies the upper bound of the range under the given order.
+func (r KeyRange) belowUpper(o keyOrder, key []any) bool {
+	if r.Upper == nil {
+		return true
+	}
+	c := o.comparePrefix(key, r.Upper)
+	return c < 0 || (c == 0 && r.UpperInclusive)
+}
@@ -0,0 +1,351 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errReadOnlySnapshot = errors.New("snapshots are read-only")
+
+// versionedNodeStorage gives an index multi-version reads. Every mutation of
+// the index commits a new version. Writers save and delete nodes through it as
+// usual; while snapshots of earlier versions are open, the content a node had
+// before it was first overwritten or deleted in a version is copied into
+// memory. A snapshot reads each node as of its version: the oldest copy
+// replaced after that version, or the stored node when it has not changed
+// since. Copies are dropped as soon as no open snapshot can read them, so an
+// index without open snapshots keeps none.
+type versionedNodeStorage struct {
+	BTreeNodeStorage // Current nodes
+
+	mu       sync.Mutex
+	version  uint64                   // Last committed version
+	pins     map[uint64]int           // Number of open snapshots by version
+	previous map[string][]nodeVersion // Replaced contents by node ID, oldest first
+}
+
+// nodeVersion is the content a node had until version replacedAt.
+type nodeVersion struct {
+	node       *BTreeNode // nil when the node did not exist
+	replacedAt uint64
+}
+
+func newVersionedNodeStorage(inner BTreeNodeStorage) *versionedNodeStorage {
+	return &versionedNodeStorage{
+		BTreeNodeStorage: inner,
+		pins:             map[uint64]int{},
+		previous:         map[string][]nodeVersion{},
+	}
+}
+
+// SaveNode keeps the node's previous content for open snapshots, then saves it.
+func (v *versionedNodeStorage) SaveNode(node *BTreeNode) error {
+	if node.IsDirty {
+		v.capture(node.ID)
+	}
+	return v.BTreeNodeStorage.SaveNode(node)
+}
+
+// DeleteNode keeps the node's content for open snapshots, then deletes it.
+func (v *versionedNodeStorage) DeleteNode(nodeID string) error {
+	v.capture(nodeID)
+	return v.BTreeNodeStorage.DeleteNode(nodeID)
+}
+
+// AllocateNodeID lets the wrapped storage assign node IDs when it allocates them.
+func (v *versionedNodeStorage) AllocateNodeID() (string, error) {
+	if a, ok := v.BTreeNodeStorage.(NodeIDAllocator); ok {
+		return a.AllocateNodeID()
+	}
+	return generateNodeID(), nil
+}
+
+// capture copies the current content of a node before the version being
+// written first changes it, if an open snapshot may read it.
+func (v *versionedNodeStorage) capture(nodeID string) {
+	v.mu.Lock()
+	writing := v.version + 1
+	versions := v.previous[nodeID]
+	captured := len(versions) > 0 && versions[len(versions)-1].replacedAt == writing
+	pinned := len(v.pins) > 0
+	v.mu.Unlock()
+	if !pinned || captured {
+		return
+	}
+	node, err := v.BTreeNodeStorage.LoadNode(nodeID)
+	if err != nil {
+		node = nil // A node allocated in this version did not exist before
+	}
+	v.mu.Lock()
+	v.previous[nodeID] = append(v.previous[nodeID], nodeVersion{node: node, replacedAt: writing})
+	v.mu.Unlock()
+}
+
+// pinned reports whether a snapshot is open.
+func (v *versionedNodeStorage) pinned() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.pins) > 0
+}
+
+// commit ends the version being written.
+func (v *versionedNodeStorage) commit() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.version++
+}
+
+// pin opens a snapshot of the last committed version. The caller must hold off
+// writers, e.g. with the index lock, so that no version is half written.
+func (v *versionedNodeStorage) pin() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.pins[v.version]++
+	return v.version
+}
+
+// unpin closes a snapshot and drops the copies no other snapshot can read.
+func (v *versionedNodeStorage) unpin(version uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pins[version]--; v.pins[version] <= 0 {
+		delete(v.pins, version)
+	}
+	if len(v.pins) == 0 {
+		clear(v.previous)
+		return
+	}
+	oldest := version
+	for pinned := range v.pins {
+		oldest = min(oldest, pinned)
+	}
+	// A copy replaced at r is read by snapshots of versions below r.
+	for id, versions := range v.previous {
+		keep := versions[:0]
+		for _, nv := range versions {
+			if nv.replacedAt > oldest {
+				keep = append(keep, nv)
+			}
+		}
+		if len(keep) == 0 {
+			delete(v.previous, id)
+		} else {
+			v.previous[id] = keep
+		}
+	}
+}
+
+// loadAt returns a node as of a committed version. The stored node is read
+// first: a writer keeps the previous content before it stores a change, so
+// any change the read may have observed is found among the copies.
+func (v *versionedNodeStorage) loadAt(nodeID string, version uint64) (*BTreeNode, error) {
+	node, err := v.BTreeNodeStorage.LoadNode(nodeID)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, nv := range v.previous[nodeID] {
+		if nv.replacedAt > version {
+			if nv.node == nil {
+				return nil, fmt.Errorf("node %s does not exist in version %d", nodeID, version)
+			}
+			return cloneNode(nv.node), nil
+		}
+	}
+	return node, err
+}
+
+// snapshotNodeStorage reads the nodes of an index as of a pinned version.
+type snapshotNodeStorage struct {
+	versions *versionedNodeStorage
+	version  uint64
+}
+
+func (s snapshotNodeStorage) LoadNode(nodeID string) (*BTreeNode, error) {
+	return s.versions.loadAt(nodeID, s.version)
+}
+
+func (s snapshotNodeStorage) SaveNode(*BTreeNode) error { return errReadOnlySnapshot }
+func (s snapshotNodeStorage) DeleteNode(string) error   { return errReadOnlySnapshot }
+
+// indexSnapshot is a read-only tree over a pinned version of an index.
+type indexSnapshot struct {
+	tree    *BTree
+	index   *IndexManager // Index the snapshot was taken of
+	release func()
+}
+
+// snapshot pins the current version of the index.
+func (im *IndexManager) snapshot() *indexSnapshot {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	version := im.versions.pin()
+	tree := NewBTree(snapshotNodeStorage{versions: im.versions, version: version}, im.bTree.RootID(), im.indexDef.PageSize, im.unique())
+	tree.order = im.indexDef.keyOrder()
+	tree.setShape(im.bTree.shape)
+	var once sync.Once
+	return &indexSnapshot{tree: tree, index: im, release: func() {
+		once.Do(func() { im.versions.unpin(version) })
+	}}
+}
+
+// Snapshot is a consistent, read-only view of a collection as of the moment it
+// was taken: all of its indexes are read at the same version, and writes made
+// afterwards are not visible through it. Readers of a snapshot never block
+// writers, nor wait for them. Close releases the snapshot; until then, the
+// previous content of nodes that writers change is kept in memory.
+type Snapshot struct {
+	clustered *indexSnapshot
+	indexes   map[string]*indexSnapshot // Non-clustered indexes by name
+}
+
+// Snapshot takes a snapshot of the collection. It fails once the database has
+// logged operations it failed to apply, whose changes may be partly visible.
+func (c *Collection) Snapshot() (*Snapshot, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.clusteredIndex == nil {
+		return nil, errInvalidCollection
+	}
+	if err := c.wal.failure(); err != nil {
+		return nil, err
+	}
+	s := &Snapshot{clustered: c.clusteredIndex.snapshot(), indexes: map[string]*indexSnapshot{}}
+	for name, im := range c.nonClusteredIndexes {
+		s.indexes[name] = im.snapshot()
+	}
+	return s, nil
+}
+
+// pin takes a snapshot of one index of the collection; "" selects the
+// clustered index. Like Snapshot, it fails once the database has failed to
+// apply logged operations.
+func (c *Collection) pin(indexName string) (*indexSnapshot, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.wal.failure(); err != nil {
+		return nil, err
+	}
+	if indexName == "" {
+		if c.clusteredIndex == nil {
+			return nil, errInvalidCollection
+		}
+		return c.clusteredIndex.snapshot(), nil
+	}
+	im, exists := c.nonClusteredIndexes[indexName]
+	if !exists {
+		return nil, fmt.Errorf("index %s does not exist", indexName)
+	}
+	return im.snapshot(), nil
+}
+
+func (s *Snapshot) index(indexName string) (*indexSnapshot, error) {
+	is, exists := s.indexes[indexName]
+	if !exists {
+		return nil, fmt.Errorf("index %s does not exist", indexName)
+	}
+	return is, nil
+}
+
+// Find returns the rows whose clustered keys equal (or are prefixed by) key.
+func (s *Snapshot) Find(key []any) ([]any, error) {
+	return s.clustered.tree.Search(key)
+}
+
+// FindRange returns the rows whose clustered keys fall within r, in key order.
+func (s *Snapshot) FindRange(r KeyRange) ([]any, error) {
+	return s.clustered.tree.SearchRange(r)
+}
+
+// FindByIndex returns the entries of a non-clustered index matching key.
+func (s *Snapshot) FindByIndex(indexName string, key []any) ([]any, error) {
+	is, err := s.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+	return is.tree.Search(key)
+}
+
+// FindByIndexRange returns the entries of a non-clustered index within r.
+func (s *Snapshot) FindByIndexRange(indexName string, r KeyRange) ([]any, error) {
+	is, err := s.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+	return is.tree.SearchRange(r)
+}
+
+// Count returns the number of rows in the snapshot.
+func (s *Snapshot) Count() int64 {
+	return int64(s.clustered.tree.shape.entries)
+}
+
+// CountRange returns the number of rows whose clustered keys fall within r.
+func (s *Snapshot) CountRange(r KeyRange) (int64, error) {
+	n, err := s.clustered.tree.CountRange(r)
+	return int64(n), err
+}
+
+// CountByIndexRange returns the number of entries of a non-clustered index within r.
+func (s *Snapshot) CountByIndexRange(indexName string, r KeyRange) (int64, error) {
+	is, err := s.index(indexName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := is.tree.CountRange(r)
+	return int64(n), err
+}
+
+// FindPage returns up to limit rows (0 means no limit) within r, starting at the
+// given offset within the range.
+func (s *Snapshot) FindPage(r KeyRange, offset, limit int) ([]any, error) {
+	return s.clustered.tree.SearchPage(r, offset, limit)
+}
+
+// FindPageByIndex returns up to limit entries of a non-clustered index within r,
+// starting at the given offset within the range.
+func (s *Snapshot) FindPageByIndex(indexName string, r KeyRange, offset, limit int) ([]any, error) {
+	is, err := s.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+	return is.tree.SearchPage(r, offset, limit)
+}
+
+// Cursor returns a cursor over the rows whose clustered keys fall within r.
+// It must not be used after the snapshot is closed.
+func (s *Snapshot) Cursor(r KeyRange) *Cursor {
+	return s.clustered.tree.Cursor(r)
+}
+
+// ReverseCursor returns a cursor over the rows within r, from the last key to the first.
+func (s *Snapshot) ReverseCursor(r KeyRange) *Cursor {
+	return s.clustered.tree.ReverseCursor(r)
+}
+
+// IndexCursor returns a cursor over the entries of a non-clustered index within r.
+func (s *Snapshot) IndexCursor(indexName string, r KeyRange) (*Cursor, error) {
+	is, err := s.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+	return is.tree.Cursor(r), nil
+}
+
+// IndexReverseCursor returns a cursor over the entries of a non-clustered index
+// within r, from the last key to the first.
+func (s *Snapshot) IndexReverseCursor(indexName string, r KeyRange) (*Cursor, error) {
+	is, err := s.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+	return is.tree.ReverseCursor(r), nil
+}
+
+// Close releases the snapshot. It is safe to call Close more than once.
+func (s *Snapshot) Close() error {
+	s.clustered.release()
+	for _, is := range s.indexes {
+		is.release()
+	}
+	return nil
+}
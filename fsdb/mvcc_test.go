@@ -0,0 +1,285 @@
+package fsdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func snapshotTestCollection(t *testing.T, storage string) (*Database, *Collection) {
+	t.Helper()
+	db, err := NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: NewMemoryFileProvider()})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	schema := CollectionSchema{
+		Name: "events",
+		Indexes: []IndexDefinition{
+			{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4, Storage: storage},
+			{Name: "ix_kind", Keys: []IndexField{{Name: "kind"}}, PageSize: 4, Storage: storage},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("events")
+	return db, coll
+}
+
+func TestSnapshot_StableView(t *testing.T) {
+	for _, storage := range []string{StorageFiles, StorageCollection} {
+		t.Run(storage, func(t *testing.T) {
+			db, coll := snapshotTestCollection(t, storage)
+			defer db.Close()
+			for i := 0; i < 100; i++ {
+				if err := coll.Insert(map[string]any{"id": i, "kind": "old"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			snap, err := coll.Snapshot()
+			if err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+			cur := snap.Cursor(KeyRange{})
+			if !cur.Next() || cur.Key()[0] != 0 {
+				t.Fatalf("expected the cursor to start at id 0, got %v", cur.Key())
+			}
+
+			// Rewrite the whole collection while the snapshot is open.
+			for i := 0; i < 100; i++ {
+				row := map[string]any{"id": i, "kind": "old"}
+				if i%2 == 0 {
+					err = coll.Delete(row)
+				} else {
+					err = coll.Update(row, map[string]any{"id": i, "kind": "new"})
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 100; i < 200; i++ {
+				if err := coll.Insert(map[string]any{"id": i, "kind": "new"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rows, err := snap.Find(nil)
+			if err != nil || len(rows) != 100 || snap.Count() != 100 {
+				t.Fatalf("snapshot holds %d rows (count %d), %v; want 100", len(rows), snap.Count(), err)
+			}
+			for i, row := range rows {
+				if r := row.(map[string]any); r["id"] != i || r["kind"] != "old" {
+					t.Fatalf("row %d of the snapshot is %v", i, r)
+				}
+			}
+			for want := 1; cur.Next(); want++ {
+				if cur.Key()[0] != want {
+					t.Fatalf("cursor returned id %v, want %d", cur.Key()[0], want)
+				}
+			}
+			if err := cur.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if entries, _ := snap.FindByIndex("ix_kind", []any{"new"}); len(entries) != 0 {
+				t.Errorf("snapshot sees %d entries written after it was taken", len(entries))
+			}
+			if current, _ := coll.FindByIndex("ix_kind", []any{"new"}); len(current) != 150 {
+				t.Errorf("expected 150 new entries outside the snapshot, got %d", len(current))
+			}
+
+			snap.Close()
+			for _, im := range coll.indexes() {
+				if n := len(im.versions.previous); n != 0 {
+					t.Errorf("index %s keeps %d node versions after the snapshot closed", im.GetName(), n)
+				}
+			}
+			if reports, err := db.Verify(VerifyOptions{}); err != nil || !reports[0].OK() {
+				t.Errorf("Verify after the snapshot closed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSnapshot_ConcurrentReadersAndWriters(t *testing.T) {
+	db, coll := snapshotTestCollection(t, StorageCollection)
+	defer db.Close()
+
+	// The writer slides a window of 20 consecutive ids, so every committed
+	// version of the collection holds a contiguous run of ids.
+	const writes = 400
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < writes; i++ {
+			if err := coll.Insert(map[string]any{"id": i, "kind": "k"}); err != nil {
+				errs <- err
+				return
+			}
+			if i >= 20 {
+				if err := coll.Delete(map[string]any{"id": i - 20, "kind": "k"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				rows, err := coll.Find(nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for i := 1; i < len(rows); i++ {
+					prev, cur := rows[i-1].(map[string]any)["id"].(int), rows[i].(map[string]any)["id"].(int)
+					if cur != prev+1 {
+						errs <- fmt.Errorf("scan %d saw id %d after %d", n, cur, prev)
+						return
+					}
+				}
+				if len(rows) > 21 {
+					errs <- fmt.Errorf("scan %d saw %d rows", n, len(rows))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSnapshot_ConcurrentReadersWithNodeCache(t *testing.T) {
+	for _, writeBack := range []bool{false, true} {
+		t.Run(fmt.Sprintf("write_back=%v", writeBack), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "db")
+			files := &FileProvider{Durability: DurabilityNone}
+			open := func() (*Database, *Collection) {
+				// A cache this small makes readers miss and refill the nodes the
+				// writer keeps changing.
+				cache := NodeCacheOptions{MaxEntries: 4, WriteBack: writeBack}
+				db, err := NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: files, NodeCache: &cache})
+				if err != nil {
+					t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+				}
+				schema := CollectionSchema{
+					Name: "events",
+					Indexes: []IndexDefinition{
+						{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4},
+						{Name: "ix_kind", Keys: []IndexField{{Name: "kind"}}, PageSize: 4},
+					},
+				}
+				if err := db.EnsureCreatedCollection(schema); err != nil {
+					t.Fatal(err)
+				}
+				coll, _ := db.GetCollection("events")
+				return db, coll
+			}
+			db, coll := open()
+
+			// Every insert changes the rightmost leaves, so a writer building on
+			// a stale node loses rows for good.
+			const rows = 300
+			kinds := []string{"a", "b", "c"}
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			errs := make(chan error, 4)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer close(done)
+				for i := 0; i < rows; i++ {
+					if err := coll.Insert(map[string]any{"id": i, "kind": kinds[i%3]}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+			for r := 0; r < 3; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						snap, err := coll.Snapshot()
+						if err != nil {
+							errs <- err
+							return
+						}
+						// The snapshot's indexes agree with each other and with its count.
+						all, err := snap.Find(nil)
+						indexed := 0
+						for _, kind := range kinds {
+							if err != nil {
+								break
+							}
+							var found []any
+							found, err = snap.Query(Eq("kind", kind))
+							indexed += len(found)
+						}
+						count := snap.Count()
+						snap.Close()
+						if err == nil && (len(all) != indexed || int64(len(all)) != count) {
+							err = fmt.Errorf("snapshot holds %d rows, %d indexed by kind, count %d", len(all), indexed, count)
+						}
+						if err == nil {
+							_, err = coll.FindRange(KeyRange{Lower: []any{len(all) - 8}, LowerInclusive: true})
+						}
+						if err == nil {
+							_, err = coll.Count()
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			check := func(when string) {
+				found, err := coll.Find(nil)
+				if err != nil || len(found) != rows {
+					t.Fatalf("%s: Find = %d rows, %v; want %d", when, len(found), err, rows)
+				}
+				for _, kind := range kinds {
+					if entries, err := coll.FindByIndex("ix_kind", []any{kind}); err != nil || len(entries) != rows/3 {
+						t.Fatalf("%s: %d %s entries, %v; want %d", when, len(entries), kind, err, rows/3)
+					}
+				}
+				reports, err := coll.Verify(VerifyOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range reports {
+					if !r.OK() {
+						t.Fatalf("%s: %s has issues: %v", when, r.Index, r.Issues)
+					}
+				}
+			}
+			check("after the writer")
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, coll = open()
+			defer db.Close()
+			check("after reopening")
+		})
+	}
+}
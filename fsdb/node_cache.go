@@ -0,0 +1,366 @@
+package fsdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// NodeCacheOptions bounds a NodeCache. A zero limit leaves that dimension unbounded.
+type NodeCacheOptions struct {
+	MaxEntries int  `json:"max_entries"` // Maximum number of cached nodes
+	MaxBytes   int  `json:"max_bytes"`   // Approximate maximum size of the cached nodes in bytes
+	WriteBack  bool `json:"write_back"`  // Defer writing modified nodes until Flush or eviction
+}
+
+// DefaultNodeCacheOptions is the cache configuration used by NewDatabase.
+var DefaultNodeCacheOptions = NodeCacheOptions{MaxEntries: 4096, MaxBytes: 32 << 20}
+
+// NodeCacheStats reports the activity of a NodeCache.
+type NodeCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int   `json:"bytes"`
+	Dirty     int   `json:"dirty"`
+}
+
+// NodeCache is a bounded LRU cache of decoded B+ tree nodes. One cache is shared
+// by every index of a Database; each index addresses its own namespace through a
+// CachedNodeStorage. In write-back mode modified nodes stay dirty in the cache
+// until they are flushed or evicted.
+//
+// Snapshot readers load nodes while the index's writer changes them, so a node
+// a reader loaded on a miss may be older than the one the writer has cached,
+// or than what it has since deleted. Such fills never replace an entry and are
+// dropped when the namespace was written during the load: the writer wins.
+type NodeCache struct {
+	mu        sync.Mutex
+	opts      NodeCacheOptions
+	lru       *list.List // Front is the most recently used entry
+	items     map[nodeCacheKey]*list.Element
+	writes    map[string]uint64 // Number of nodes saved or deleted by namespace, to detect writes racing a fill
+	bytes     int
+	dirty     int
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type nodeCacheKey struct {
+	space  string
+	nodeID string
+}
+
+type nodeCacheEntry struct {
+	key     nodeCacheKey
+	node    *BTreeNode
+	size    int
+	dirty   bool
+	storage BTreeNodeStorage // Backing storage a dirty node is written to
+}
+
+// NewNodeCache creates an empty cache with the given limits.
+func NewNodeCache(opts NodeCacheOptions) *NodeCache {
+	return &NodeCache{
+		opts:   opts,
+		lru:    list.New(),
+		items:  make(map[nodeCacheKey]*list.Element),
+		writes: make(map[string]uint64),
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *NodeCache) Stats() NodeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return NodeCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.lru.Len(),
+		Bytes:     c.bytes,
+		Dirty:     c.dirty,
+	}
+}
+
+// Flush writes every dirty node to its backing storage.
+func (c *NodeCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked(func(nodeCacheKey) bool { return true })
+}
+
+func (c *NodeCache) get(key nodeCacheKey) (*BTreeNode, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return cloneNode(el.Value.(*nodeCacheEntry).node), true
+}
+
+// generation returns the number of writes to a namespace so far; see fill.
+func (c *NodeCache) generation(space string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes[space]
+}
+
+// fill caches a node loaded from storage after a miss, unless the node has been
+// cached meanwhile or its namespace written since generation gen, in which case
+// the loaded node may be stale.
+func (c *NodeCache) fill(key nodeCacheKey, node *BTreeNode, gen uint64, storage BTreeNodeStorage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok || c.writes[key.space] != gen {
+		return nil
+	}
+	return c.storeLocked(key, node, false, storage)
+}
+
+// put stores a private copy of a node a writer saved, replacing any cached
+// entry. A dirty entry is written to storage on eviction or flush; an error
+// from writing an evicted node is returned.
+func (c *NodeCache) put(key nodeCacheKey, node *BTreeNode, dirty bool, storage BTreeNodeStorage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes[key.space]++
+	return c.storeLocked(key, node, dirty, storage)
+}
+
+func (c *NodeCache) storeLocked(key nodeCacheKey, node *BTreeNode, dirty bool, storage BTreeNodeStorage) error {
+	entry := &nodeCacheEntry{
+		key:     key,
+		node:    cloneNode(node),
+		size:    nodeSize(node),
+		dirty:   dirty,
+		storage: storage,
+	}
+	if el, ok := c.items[key]; ok {
+		old := el.Value.(*nodeCacheEntry)
+		c.bytes -= old.size
+		if old.dirty {
+			c.dirty--
+		}
+		el.Value = entry
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[key] = c.lru.PushFront(entry)
+	}
+	c.bytes += entry.size
+	if dirty {
+		c.dirty++
+	}
+	return c.evictLocked()
+}
+
+// remove drops a node from the cache without writing it.
+func (c *NodeCache) remove(key nodeCacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes[key.space]++
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// flushSpace writes the dirty nodes of one namespace.
+func (c *NodeCache) flushSpace(space string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked(func(k nodeCacheKey) bool { return k.space == space })
+}
+
+// dropSpace discards every node of a namespace, dirty or not.
+func (c *NodeCache) dropSpace(space string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes[space]++
+	for key, el := range c.items {
+		if key.space == space {
+			c.removeLocked(el)
+		}
+	}
+}
+
+func (c *NodeCache) flushLocked(match func(nodeCacheKey) bool) error {
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*nodeCacheEntry)
+		if !entry.dirty || !match(entry.key) {
+			continue
+		}
+		if err := c.writeLocked(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *NodeCache) writeLocked(entry *nodeCacheEntry) error {
+	node := cloneNode(entry.node)
+	node.IsDirty = true
+	if err := entry.storage.SaveNode(node); err != nil {
+		return err
+	}
+	entry.dirty = false
+	c.dirty--
+	return nil
+}
+
+// evictLocked evicts least recently used entries until the cache fits its limits.
+func (c *NodeCache) evictLocked() error {
+	for c.lru.Len() > 1 && c.overBudget() {
+		el := c.lru.Back()
+		entry := el.Value.(*nodeCacheEntry)
+		if entry.dirty {
+			if err := c.writeLocked(entry); err != nil {
+				return err
+			}
+		}
+		c.removeLocked(el)
+		c.evictions++
+	}
+	return nil
+}
+
+func (c *NodeCache) overBudget() bool {
+	return (c.opts.MaxEntries > 0 && c.lru.Len() > c.opts.MaxEntries) ||
+		(c.opts.MaxBytes > 0 && c.bytes > c.opts.MaxBytes)
+}
+
+func (c *NodeCache) removeLocked(el *list.Element) {
+	entry := el.Value.(*nodeCacheEntry)
+	c.lru.Remove(el)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+	if entry.dirty {
+		c.dirty--
+	}
+}
+
+// CachedNodeStorage is a BTreeNodeStorage decorator that serves nodes from a
+// shared NodeCache, loading from the wrapped storage only on a miss. Callers
+// always receive private copies, so unsaved changes never leak into the cache.
+type CachedNodeStorage struct {
+	cache *NodeCache
+	inner BTreeNodeStorage
+	space string // Namespace of this storage's nodes within the shared cache
+}
+
+// NewCachedNodeStorage wraps inner with cache. space must be unique per index,
+// e.g. the index path.
+func NewCachedNodeStorage(cache *NodeCache, inner BTreeNodeStorage, space string) *CachedNodeStorage {
+	return &CachedNodeStorage{cache: cache, inner: inner, space: space}
+}
+
+func (s *CachedNodeStorage) SaveNode(node *BTreeNode) error {
+	if !node.IsDirty {
+		return nil
+	}
+	key := nodeCacheKey{space: s.space, nodeID: node.ID}
+	if s.cache.opts.WriteBack {
+		if err := s.cache.put(key, node, true, s.inner); err != nil {
+			return err
+		}
+		node.IsDirty = false
+		return nil
+	}
+	if err := s.inner.SaveNode(node); err != nil {
+		return err
+	}
+	return s.cache.put(key, node, false, s.inner)
+}
+
+func (s *CachedNodeStorage) LoadNode(nodeID string) (*BTreeNode, error) {
+	key := nodeCacheKey{space: s.space, nodeID: nodeID}
+	if node, ok := s.cache.get(key); ok {
+		return node, nil
+	}
+	gen := s.cache.generation(s.space)
+	node, err := s.inner.LoadNode(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.fill(key, node, gen, s.inner); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// DeleteNode deletes the stored node before dropping it from the cache, so that
+// a reader that loaded it meanwhile cannot cache it again.
+func (s *CachedNodeStorage) DeleteNode(nodeID string) error {
+	err := s.inner.DeleteNode(nodeID)
+	s.cache.remove(nodeCacheKey{space: s.space, nodeID: nodeID})
+	return err
+}
+
+// AllocateNodeID lets the wrapped storage assign node IDs when it allocates them.
+func (s *CachedNodeStorage) AllocateNodeID() (string, error) {
+	if a, ok := s.inner.(NodeIDAllocator); ok {
+		return a.AllocateNodeID()
+	}
+	return generateNodeID(), nil
+}
+
+// Flush writes this storage's dirty nodes to the wrapped storage.
+func (s *CachedNodeStorage) Flush() error {
+	return s.cache.flushSpace(s.space)
+}
+
+// Invalidate discards this storage's cached nodes without writing them, e.g.
+// after the underlying files were removed.
+func (s *CachedNodeStorage) Invalidate() {
+	s.cache.dropSpace(s.space)
+}
+
+// cloneNode returns a deep copy of a node's keys and values.
+func cloneNode(node *BTreeNode) *BTreeNode {
+	c := *node
+	c.Keys = make([][]any, len(node.Keys), cap(node.Keys))
+	for i, k := range node.Keys {
+		c.Keys[i] = cloneValue(k).([]any)
+	}
+	c.Values = make([]any, len(node.Values), cap(node.Values))
+	for i, v := range node.Values {
+		c.Values[i] = cloneValue(v)
+	}
+	c.Counts = append([]int(nil), node.Counts...)
+	c.IsDirty = false
+	return &c
+}
+
+// cloneValue deep copies the container types a node can hold; other values are immutable.
+func cloneValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(val))
+		for k, e := range val {
+			m[k] = cloneValue(e)
+		}
+		return m
+	case []any:
+		if val == nil {
+			return []any(nil)
+		}
+		s := make([]any, len(val))
+		for i, e := range val {
+			s[i] = cloneValue(e)
+		}
+		return s
+	case []byte:
+		return append([]byte(nil), val...)
+	default:
+		return v
+	}
+}
+
+// nodeSize estimates the memory held by a cached node.
+func nodeSize(node *BTreeNode) int {
+	return 128 + len(node.ID) + estimateSize(node.Keys) + estimateSize(node.Values)
+}
@@ -0,0 +1,160 @@
+package fsdb
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// countingStorage counts the calls that reach the wrapped storage.
+type countingStorage struct {
+	*memNodeStorage
+	loads, saves int
+}
+
+func (s *countingStorage) LoadNode(nodeID string) (*BTreeNode, error) {
+	s.loads++
+	return s.memNodeStorage.LoadNode(nodeID)
+}
+
+func (s *countingStorage) SaveNode(node *BTreeNode) error {
+	if node.IsDirty {
+		s.saves++
+	}
+	return s.memNodeStorage.SaveNode(node)
+}
+
+func TestNodeCache_HitsAndIsolation(t *testing.T) {
+	inner := &countingStorage{memNodeStorage: newMemNodeStorage()}
+	cache := NewNodeCache(NodeCacheOptions{MaxEntries: 1000})
+	bt := NewBTree(NewCachedNodeStorage(cache, inner, "idx"), "", 4, true)
+	for i := 0; i < 200; i++ {
+		if err := bt.Insert([]any{i}, map[string]any{"id": i}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	inner.loads = 0
+	for i := 0; i < 200; i++ {
+		results, err := bt.Search([]any{i})
+		if err != nil || len(results) != 1 {
+			t.Fatalf("Search(%d) = %v, %v", i, results, err)
+		}
+		// Mutating a returned row must not corrupt the cached copy.
+		results[0].(map[string]any)["id"] = -1
+	}
+	if inner.loads != 0 {
+		t.Errorf("expected every load to be served from the cache, got %d storage loads", inner.loads)
+	}
+	results, _ := bt.Search([]any{7})
+	if got := results[0].(map[string]any)["id"]; got != 7 {
+		t.Errorf("cached row was modified through a search result: id = %v", got)
+	}
+	if stats := cache.Stats(); stats.Hits == 0 || stats.Misses != 0 || stats.Dirty != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestNodeCache_EvictionAndWriteBack(t *testing.T) {
+	inner := &countingStorage{memNodeStorage: newMemNodeStorage()}
+	cache := NewNodeCache(NodeCacheOptions{MaxEntries: 8, WriteBack: true})
+	storage := NewCachedNodeStorage(cache, inner, "idx")
+	bt := NewBTree(storage, "", 4, true)
+
+	rng := rand.New(rand.NewSource(1))
+	keys := rng.Perm(300)
+	for _, k := range keys {
+		if err := bt.Insert([]any{k}, k); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	for _, k := range keys[:100] {
+		if err := bt.Delete([]any{k}); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Entries > 8 || stats.Evictions == 0 {
+		t.Fatalf("cache exceeded its budget: %+v", stats)
+	}
+	if stats.Dirty == 0 {
+		t.Fatal("expected dirty nodes to be held back in write-back mode")
+	}
+
+	if err := storage.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if stats := cache.Stats(); stats.Dirty != 0 {
+		t.Fatalf("expected no dirty nodes after Flush, got %d", stats.Dirty)
+	}
+	// The backing storage alone must now hold a consistent tree.
+	cold := NewBTree(inner.memNodeStorage, bt.RootID(), 4, true)
+	if n := checkTree(t, cold, inner.memNodeStorage); n != 200 {
+		t.Fatalf("flushed tree holds %d entries, want 200", n)
+	}
+}
+
+// racingStorage runs a hook between reading a node and returning it, standing
+// in for a writer that changes the node while a reader's miss is in flight.
+type racingStorage struct {
+	*memNodeStorage
+	afterLoad func()
+}
+
+func (s *racingStorage) LoadNode(nodeID string) (*BTreeNode, error) {
+	node, err := s.memNodeStorage.LoadNode(nodeID)
+	if hook := s.afterLoad; hook != nil {
+		s.afterLoad = nil
+		hook()
+	}
+	return node, err
+}
+
+func TestNodeCache_WriterWinsOverRacingFill(t *testing.T) {
+	leaf := func(value string) *BTreeNode {
+		node := NewBTreeNode("n1", LeafNode, 4, "")
+		node.Keys = [][]any{{1}}
+		node.Values = []any{value}
+		node.IsDirty = true
+		return node
+	}
+	for _, writeBack := range []bool{false, true} {
+		inner := &racingStorage{memNodeStorage: newMemNodeStorage()}
+		cache := NewNodeCache(NodeCacheOptions{MaxEntries: 10, WriteBack: writeBack})
+		storage := NewCachedNodeStorage(cache, inner, "idx")
+		if err := inner.SaveNode(leaf("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		// A reader misses and loads the old node; the writer saves a new one
+		// before the reader caches what it read.
+		inner.afterLoad = func() {
+			if err := storage.SaveNode(leaf("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if node, err := storage.LoadNode("n1"); err != nil || node.Values[0] != "old" {
+			t.Fatalf("write back %v: racing load = %v, %v", writeBack, node, err)
+		}
+		if node, err := storage.LoadNode("n1"); err != nil || node.Values[0] != "new" {
+			t.Errorf("write back %v: load after the save = %v, %v; want the new node", writeBack, node, err)
+		}
+		if err := storage.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if node, _ := inner.memNodeStorage.LoadNode("n1"); node == nil || node.Values[0] != "new" {
+			t.Errorf("write back %v: stored node after Flush = %v; want the new node", writeBack, node)
+		}
+
+		// A reader that loaded a node the writer then deletes must not cache it.
+		storage.Invalidate()
+		inner.afterLoad = func() {
+			if err := storage.DeleteNode("n1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		storage.LoadNode("n1")
+		if node, err := storage.LoadNode("n1"); err == nil {
+			t.Errorf("write back %v: deleted node served from the cache: %v", writeBack, node)
+		}
+	}
+}
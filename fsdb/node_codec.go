@@ -0,0 +1,483 @@
+package fsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// NodeFormat selects how FileBTreeNodeStorage encodes nodes on disk.
+type NodeFormat string
+
+const (
+	NodeFormatBinary NodeFormat = "binary" // Compact typed encoding; the default
+	NodeFormatJSON   NodeFormat = "json"   // Indented JSON, the original format
+)
+
+// A binary node starts with a magic string and a format version, which lets
+// LoadNode tell it apart from a legacy JSON node:
+//
+//	"FSDBN" version:byte type:byte pageSize:uvarint
+//	id parent next previous:string
+//	keyCount:uvarint key:list...
+//	valueCount:uvarint value...
+//	countCount:uvarint count:uvarint...
+//
+// The subtree counts of internal nodes were added in version 2; version 1
+// nodes are read without them.
+// Strings and byte slices are a uvarint length followed by the bytes.
+const (
+	nodeFormatMagic   = "FSDBN"
+	nodeFormatVersion = 2
+)
+
+// Value tags of the typed value encoding.
+const (
+	tagNil byte = iota
+	tagFalse
+	tagTrue
+	tagInt     // Go int, zigzag varint
+	tagInt64   // Go int64, zigzag varint
+	tagFloat64 // IEEE 754 bits, 8 bytes big endian
+	tagString
+	tagTime  // time.Time.MarshalBinary, length prefixed
+	tagBytes // []byte, length prefixed
+	tagList  // []any: count:uvarint value...
+	tagMap   // map[string]any: count:uvarint (key:string value)... sorted by key
+	tagJSON  // Any other type, as length prefixed JSON
+
+	tagOverflow // overflowRef, the ID of an overflow node as a string
+
+	tagInt8    // Go int8, zigzag varint
+	tagInt16   // Go int16, zigzag varint
+	tagInt32   // Go int32, zigzag varint
+	tagUint    // Go uint, uvarint
+	tagUint8   // Go uint8, uvarint
+	tagUint16  // Go uint16, uvarint
+	tagUint32  // Go uint32, uvarint
+	tagUint64  // Go uint64, uvarint
+	tagFloat32 // IEEE 754 bits, 4 bytes big endian
+)
+
+var errCorruptNode = errors.New("corrupt node data")
+
+// isBinaryNode reports whether data starts with the binary node header.
+func isBinaryNode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(nodeFormatMagic))
+}
+
+// encodeNode encodes a node in the binary format.
+func encodeNode(node *BTreeNode) ([]byte, error) {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, nodeFormatMagic...)
+	buf = append(buf, nodeFormatVersion)
+	switch node.Type {
+	case InternalNode:
+		buf = append(buf, 1)
+	case OverflowNode:
+		buf = append(buf, 2)
+	default:
+		buf = append(buf, 0)
+	}
+	buf = binary.AppendUvarint(buf, uint64(max(node.PageSize, 0)))
+	for _, s := range []string{node.ID, node.Parent, node.Next, node.Previous} {
+		buf = appendString(buf, s)
+	}
+	var err error
+	buf = binary.AppendUvarint(buf, uint64(len(node.Keys)))
+	for _, k := range node.Keys {
+		if buf, err = appendValue(buf, k); err != nil {
+			return nil, err
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(node.Values)))
+	for _, v := range node.Values {
+		if buf, err = appendValue(buf, v); err != nil {
+			return nil, err
+		}
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(node.Counts)))
+	for _, c := range node.Counts {
+		buf = binary.AppendUvarint(buf, uint64(c))
+	}
+	return buf, nil
+}
+
+// decodeNode decodes a node in either the binary or the legacy JSON format.
+func decodeNode(data []byte) (*BTreeNode, error) {
+	if !isBinaryNode(data) {
+		var node BTreeNode
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		if node.IsLeaf() {
+			for i, v := range node.Values {
+				if ref, ok := overflowRefFromJSON(v); ok {
+					node.Values[i] = ref
+				}
+			}
+		}
+		return &node, nil
+	}
+	r := &valueReader{data: data, pos: len(nodeFormatMagic)}
+	version, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if version < 1 || version > nodeFormatVersion {
+		return nil, fmt.Errorf("unsupported node format version %d", version)
+	}
+	var node BTreeNode
+	typ, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case 1:
+		node.Type = InternalNode
+	case 2:
+		node.Type = OverflowNode
+	default:
+		node.Type = LeafNode
+	}
+	pageSize, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	node.PageSize = int(pageSize)
+	for _, s := range []*string{&node.ID, &node.Parent, &node.Next, &node.Previous} {
+		if *s, err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	node.Keys = make([][]any, n)
+	for i := range node.Keys {
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := v.([]any)
+		if !ok {
+			return nil, errCorruptNode
+		}
+		node.Keys[i] = key
+	}
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	node.Values = make([]any, n)
+	for i := range node.Values {
+		if node.Values[i], err = r.value(); err != nil {
+			return nil, err
+		}
+	}
+	if version < 2 {
+		return &node, nil
+	}
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		node.Counts = make([]int, n)
+	}
+	for i := range node.Counts {
+		c, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		node.Counts[i] = int(c)
+	}
+	return &node, nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendValue appends the typed encoding of v to buf.
+func appendValue(buf []byte, v any) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, tagNil), nil
+	case bool:
+		if val {
+			return append(buf, tagTrue), nil
+		}
+		return append(buf, tagFalse), nil
+	case int:
+		return binary.AppendVarint(append(buf, tagInt), int64(val)), nil
+	case int64:
+		return binary.AppendVarint(append(buf, tagInt64), val), nil
+	case int8:
+		return binary.AppendVarint(append(buf, tagInt8), int64(val)), nil
+	case int16:
+		return binary.AppendVarint(append(buf, tagInt16), int64(val)), nil
+	case int32:
+		return binary.AppendVarint(append(buf, tagInt32), int64(val)), nil
+	case uint:
+		return binary.AppendUvarint(append(buf, tagUint), uint64(val)), nil
+	case uint8:
+		return binary.AppendUvarint(append(buf, tagUint8), uint64(val)), nil
+	case uint16:
+		return binary.AppendUvarint(append(buf, tagUint16), uint64(val)), nil
+	case uint32:
+		return binary.AppendUvarint(append(buf, tagUint32), uint64(val)), nil
+	case uint64:
+		return binary.AppendUvarint(append(buf, tagUint64), val), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(buf, tagFloat64), math.Float64bits(val)), nil
+	case float32:
+		return binary.BigEndian.AppendUint32(append(buf, tagFloat32), math.Float32bits(val)), nil
+	case string:
+		return appendString(append(buf, tagString), val), nil
+	case overflowRef:
+		return appendString(append(buf, tagOverflow), string(val)), nil
+	case time.Time:
+		data, err := val.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendString(append(buf, tagTime), string(data)), nil
+	case []byte:
+		buf = binary.AppendUvarint(append(buf, tagBytes), uint64(len(val)))
+		return append(buf, val...), nil
+	case []any:
+		buf = binary.AppendUvarint(append(buf, tagList), uint64(len(val)))
+		var err error
+		for _, e := range val {
+			if buf, err = appendValue(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf = binary.AppendUvarint(append(buf, tagMap), uint64(len(keys)))
+		var err error
+		for _, k := range keys {
+			buf = appendString(buf, k)
+			if buf, err = appendValue(buf, val[k]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		data, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		return appendString(append(buf, tagJSON), string(data)), nil
+	}
+}
+
+// valueReader decodes the typed value encoding from a byte slice.
+type valueReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *valueReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errCorruptNode
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *valueReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errCorruptNode
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *valueReader) varint() (int64, error) {
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, errCorruptNode
+	}
+	r.pos += n
+	return v, nil
+}
+
+// sized reads an integer of the given bit width, signed (zigzag varint) or
+// unsigned (uvarint), and checks that it fits. The result holds the bits of
+// the value, to be converted to the integer type of that width.
+func (r *valueReader) sized(bits int, signed bool) (uint64, error) {
+	if signed {
+		v, err := r.varint()
+		if err == nil && v>>(bits-1) != 0 && v>>(bits-1) != -1 {
+			err = errCorruptNode
+		}
+		return uint64(v), err
+	}
+	v, err := r.uvarint()
+	if err == nil && v>>bits != 0 {
+		err = errCorruptNode
+	}
+	return v, err
+}
+
+// count reads a length and checks it against the remaining data, so that a
+// corrupt length cannot trigger a huge allocation.
+func (r *valueReader) count() (int, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		return 0, errCorruptNode
+	}
+	return int(n), nil
+}
+
+func (r *valueReader) bytes() ([]byte, error) {
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *valueReader) string() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+// value decodes one typed value.
+func (r *valueReader) value() (any, error) {
+	tag, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case tagNil:
+		return nil, nil
+	case tagFalse:
+		return false, nil
+	case tagTrue:
+		return true, nil
+	case tagInt:
+		v, err := r.varint()
+		return int(v), err
+	case tagInt64:
+		return r.varint()
+	case tagInt8:
+		v, err := r.sized(8, true)
+		return int8(v), err
+	case tagInt16:
+		v, err := r.sized(16, true)
+		return int16(v), err
+	case tagInt32:
+		v, err := r.sized(32, true)
+		return int32(v), err
+	case tagUint:
+		v, err := r.uvarint()
+		return uint(v), err
+	case tagUint8:
+		v, err := r.sized(8, false)
+		return uint8(v), err
+	case tagUint16:
+		v, err := r.sized(16, false)
+		return uint16(v), err
+	case tagUint32:
+		v, err := r.sized(32, false)
+		return uint32(v), err
+	case tagUint64:
+		return r.uvarint()
+	case tagFloat32:
+		if len(r.data)-r.pos < 4 {
+			return nil, errCorruptNode
+		}
+		bits := binary.BigEndian.Uint32(r.data[r.pos:])
+		r.pos += 4
+		return math.Float32frombits(bits), nil
+	case tagFloat64:
+		if len(r.data)-r.pos < 8 {
+			return nil, errCorruptNode
+		}
+		bits := binary.BigEndian.Uint64(r.data[r.pos:])
+		r.pos += 8
+		return math.Float64frombits(bits), nil
+	case tagString:
+		return r.string()
+	case tagOverflow:
+		id, err := r.string()
+		return overflowRef(id), err
+	case tagTime:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case tagBytes:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case tagList:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		list := make([]any, n)
+		for i := range list {
+			if list[i], err = r.value(); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case tagMap:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			k, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			if m[k], err = r.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case tagJSON:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		var v any
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown value tag %d", errCorruptNode, tag)
+	}
+}
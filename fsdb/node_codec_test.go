@@ -0,0 +1,258 @@
+package fsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNodeCodec_RoundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 30, 0, 42, time.FixedZone("X", 3600))
+	node := NewBTreeNode("n1", LeafNode, 8, "")
+	node.Parent, node.Next, node.Previous = "p", "n2", ""
+	node.Keys = [][]any{{1, "a"}, {int64(-7), "b"}}
+	node.Values = []any{
+		map[string]any{
+			"int":   42,
+			"int64": int64(1) << 40,
+			"float": 2.5,
+			"str":   "héllo",
+			"bool":  true,
+			"time":  ts,
+			"bytes": []byte{0, 1, 2},
+			"nil":   nil,
+			"list":  []any{1, "x", []any{false}},
+			"map":   map[string]any{"nested": 1.5},
+		},
+		struct{ A int }{A: 3},
+	}
+	data, err := encodeNode(node)
+	if err != nil {
+		t.Fatalf("encodeNode failed: %v", err)
+	}
+	if !isBinaryNode(data) {
+		t.Fatal("encoded node lacks the binary header")
+	}
+	got, err := decodeNode(data)
+	if err != nil {
+		t.Fatalf("decodeNode failed: %v", err)
+	}
+	if got.ID != "n1" || got.Type != LeafNode || got.PageSize != 8 || got.Parent != "p" || got.Next != "n2" {
+		t.Errorf("node header mismatch: %+v", got)
+	}
+	if !reflect.DeepEqual(got.Keys, node.Keys) {
+		t.Errorf("keys = %#v, want %#v", got.Keys, node.Keys)
+	}
+	row := got.Values[0].(map[string]any)
+	for k, want := range node.Values[0].(map[string]any) {
+		if k == "time" {
+			if tt, ok := row[k].(time.Time); !ok || !tt.Equal(ts) {
+				t.Errorf("time = %#v, want %v", row[k], ts)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(row[k], want) {
+			t.Errorf("%s = %#v, want %#v", k, row[k], want)
+		}
+	}
+	if !reflect.DeepEqual(got.Values[1], map[string]any{"A": float64(3)}) {
+		t.Errorf("unsupported types should round trip through JSON, got %#v", got.Values[1])
+	}
+
+	for cut := len(nodeFormatMagic) + 1; cut < len(data); cut += 7 {
+		if _, err := decodeNode(data[:cut]); err == nil {
+			t.Fatalf("expected truncated node (%d of %d bytes) to be rejected", cut, len(data))
+		}
+	}
+}
+
+func TestNodeCodec_IntegerWidths(t *testing.T) {
+	values := []any{
+		int(math.MinInt), int(math.MaxInt),
+		int8(math.MinInt8), int8(math.MaxInt8),
+		int16(math.MinInt16), int16(math.MaxInt16),
+		int32(math.MinInt32), int32(math.MaxInt32),
+		int64(math.MinInt64), int64(math.MaxInt64),
+		uint(math.MaxUint),
+		uint8(math.MaxUint8), uint16(math.MaxUint16), uint32(math.MaxUint32),
+		uint64(math.MaxUint64), uint64(1<<63 + 1),
+		float32(-1.5), float32(math.MaxFloat32),
+	}
+	for _, v := range values {
+		data, err := appendValue(nil, v)
+		if err != nil {
+			t.Fatalf("appendValue(%#v) failed: %v", v, err)
+		}
+		r := &valueReader{data: data}
+		got, err := r.value()
+		if err != nil || got != v {
+			t.Errorf("%T %v decoded as %#v, %v", v, v, got, err)
+		}
+	}
+
+	// A value too wide for its tag is rejected.
+	data := binary.AppendVarint([]byte{tagInt8}, 200)
+	if _, err := (&valueReader{data: data}).value(); err == nil {
+		t.Error("expected an out of range int8 to be rejected")
+	}
+	data = binary.AppendUvarint([]byte{tagUint16}, 1<<16)
+	if _, err := (&valueReader{data: data}).value(); err == nil {
+		t.Error("expected an out of range uint16 to be rejected")
+	}
+}
+
+func TestCollection_Uint64KeysAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	schema := CollectionSchema{
+		Name:    "counters",
+		Indexes: []IndexDefinition{{Name: "pk_id", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4}},
+	}
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %v", err)
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("counters")
+	ids := []uint64{1, 1<<63 + 1, math.MaxUint64}
+	for _, id := range ids {
+		if err := coll.Insert(map[string]any{"id": id, "small": uint8(id)}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	db.Close()
+
+	db, err = NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer db.Close()
+	coll, _ = db.GetCollection("counters")
+	for _, id := range ids {
+		rows, err := coll.Find([]any{id})
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("Find(%d) = %v, %v", id, rows, err)
+		}
+		if row := rows[0].(map[string]any); row["id"] != id || row["small"] != uint8(id) {
+			t.Errorf("Find(%d) = %#v", id, row)
+		}
+	}
+}
+
+func TestNodeCodec_OverflowRefs(t *testing.T) {
+	leaf := NewBTreeNode("n1", LeafNode, 8, "")
+	leaf.Keys = [][]any{{1}, {2}}
+	leaf.Values = []any{overflowRef("n9"), "n9"}
+	overflow := NewBTreeNode("n9", OverflowNode, 8, "")
+	overflow.Values = []any{map[string]any{"body": "large"}}
+	for _, format := range []NodeFormat{NodeFormatBinary, NodeFormatJSON} {
+		storage := &FileBTreeNodeStorage{IndexPath: "/idx", Provider: NewMemoryFileProvider(), Format: format}
+		if err := storage.Init(); err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range []*BTreeNode{leaf, overflow} {
+			node.IsDirty = true
+			if err := storage.SaveNode(node); err != nil {
+				t.Fatalf("%s: SaveNode failed: %v", format, err)
+			}
+		}
+		got, err := storage.LoadNode("n1")
+		if err != nil || !reflect.DeepEqual(got.Values, leaf.Values) {
+			t.Errorf("%s: leaf values = %#v, %v; want a reference and a string", format, got.Values, err)
+		}
+		if got, err := storage.LoadNode("n9"); err != nil || got.Type != OverflowNode {
+			t.Errorf("%s: overflow node = %+v, %v", format, got, err)
+		}
+	}
+}
+
+func TestNodeCodec_Counts(t *testing.T) {
+	node := NewBTreeNode("n1", InternalNode, 8, "")
+	node.Keys = [][]any{{10}}
+	node.Values = []any{"a", "b"}
+	node.Counts = []int{10, 300}
+	data, err := encodeNode(node)
+	if err != nil {
+		t.Fatalf("encodeNode failed: %v", err)
+	}
+	got, err := decodeNode(data)
+	if err != nil || !slices.Equal(got.Counts, node.Counts) {
+		t.Fatalf("counts = %v, %v; want %v", got.Counts, err, node.Counts)
+	}
+
+	// A version 1 node ends after its values.
+	node.Counts = nil
+	if data, err = encodeNode(node); err != nil {
+		t.Fatal(err)
+	}
+	data = data[:len(data)-1]
+	data[len(nodeFormatMagic)] = 1
+	if got, err = decodeNode(data); err != nil || got.Counts != nil || len(got.Values) != 2 {
+		t.Fatalf("version 1 node = %+v, %v", got, err)
+	}
+}
+
+func TestIndexManager_MigrateFormat(t *testing.T) {
+	dir := t.TempDir()
+	def := IndexDefinition{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4}
+	legacy, err := NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	legacy.Storage = &FileBTreeNodeStorage{IndexPath: dir, Format: NodeFormatJSON}
+	legacy.bTree = legacy.newBTree("")
+	for i := 0; i < 30; i++ {
+		if err := legacy.Insert([]any{i}, map[string]any{"id": i}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	countFiles := func(ext string) int {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+		return len(slices.DeleteFunc(matches, func(m string) bool { return filepath.Base(m) == indexMetaFile }))
+	}
+	jsonNodes := countFiles(jsonNodeExt)
+	if jsonNodes == 0 || countFiles(binaryNodeExt) != 0 {
+		t.Fatalf("expected a JSON index, found %d json and %d binary nodes", jsonNodes, countFiles(binaryNodeExt))
+	}
+
+	// Reopening with the default storage reads the JSON nodes.
+	im, err := NewIndexManager(dir, def)
+	if err != nil {
+		t.Fatalf("NewIndexManager failed: %v", err)
+	}
+	results, err := im.Search([]any{17})
+	if err != nil || len(results) != 1 {
+		t.Fatalf("Search on JSON index = %v, %v", results, err)
+	}
+	if id := results[0].(map[string]any)["id"]; id != float64(17) {
+		t.Errorf("JSON nodes decode numbers as float64, got %#v", id)
+	}
+
+	if err := im.MigrateFormat(); err != nil {
+		t.Fatalf("MigrateFormat failed: %v", err)
+	}
+	if countFiles(jsonNodeExt) != 0 || countFiles(binaryNodeExt) != jsonNodes {
+		t.Fatalf("after migration: %d json and %d binary nodes, want 0 and %d", countFiles(jsonNodeExt), countFiles(binaryNodeExt), jsonNodes)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, im.bTree.RootID()+binaryNodeExt))
+	if err != nil || !bytes.HasPrefix(data, []byte(nodeFormatMagic)) {
+		t.Fatalf("root node is not in the binary format: %v", err)
+	}
+	if err := im.Insert([]any{30}, map[string]any{"id": 30}); err != nil {
+		t.Fatalf("Insert after migration failed: %v", err)
+	}
+	all, err := im.Search(nil)
+	if err != nil || len(all) != 31 {
+		t.Fatalf("expected 31 rows after migration, got %d (%v)", len(all), err)
+	}
+	if id := all[30].(map[string]any)["id"]; id != 30 {
+		t.Errorf("binary nodes should keep int values, got %#v", id)
+	}
+}
@@ -0,0 +1,679 @@
+package fsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Node storage engines selectable per index with IndexDefinition.Storage.
+const (
+	StorageFiles      = "files"      // One file per node in the index directory (the default)
+	StoragePaged      = "paged"      // One paged data file per index
+	StorageCollection = "collection" // One paged data file shared by all indexes of the collection
+)
+
+const (
+	// DefaultPageBytes is the size of a page in a paged data file.
+	DefaultPageBytes = 4096
+	minPageBytes     = 256
+
+	indexPagesFile      = "nodes.pages"      // Data file of an index with StoragePaged
+	collectionPagesFile = "collection.pages" // Data file shared by the indexes with StorageCollection
+
+	pagedFileMagic    = "FSDBPAGE"
+	pagedFileVersion  = 2
+	fileHeaderBytes   = 32 // magic, version, pad, pageBytes:u32, pageCount:u64, freeHead:u64
+	pageHeaderBytes   = 20 // kind:u8, pad, length:u32, next:u64, checksum:u32
+	pageHeaderBytesV1 = 16 // Version 1 pages have no checksum
+
+	pageJournalSuffix = ".journal" // Appended to the data file name to name its journal
+	pageJournalMagic  = "FSDBJRNL"
+)
+
+// crcTable is the CRC-32 table of page checksums.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Page kinds.
+const (
+	pageFree     byte = 1 // On the free list; next is the next free page
+	pageNode     byte = 2 // First page of a node; next continues it
+	pageOverflow byte = 3 // Continuation of a node too large for one page
+)
+
+var errPagedFileClosed = errors.New("paged data file is closed")
+
+// PagedNodeStorage is a BTreeNodeStorage keeping every node in a single data
+// file of fixed-size pages. Page 0 holds the file header; a node is stored in
+// the page named by its numeric ID, continued in overflow pages when its
+// encoding does not fit. Freed pages go on a free list and are reused before
+// the file grows. One file may be shared by several indexes.
+//
+// Pages are overwritten in place, which a crash can interrupt halfway. Each
+// operation therefore first writes the pages it changes to a journal file next
+// to the data file and syncs it, and only then writes them in place; opening
+// the file writes the pages of a whole journaled operation again, and drops a
+// journal torn before the operation touched the data file. Each page also
+// carries a checksum of its header and payload, so that a page torn all the
+// same fails to load instead of decoding a mix of old and new data.
+type PagedNodeStorage struct {
+	mu         sync.Mutex
+	key        pagedFileKey
+	file       RandomAccessFile
+	journal    RandomAccessFile
+	syncWrites bool // Sync the journal before writing in place; false for DurabilityNone
+	unsynced   bool // The data file has writes not yet synced
+	pending    []pageWrite
+	version    byte // File format version; see pagedFileVersion
+	pageBytes  int
+	pageCount  uint64 // Number of pages including the header page
+	freeHead   uint64 // First page of the free list, 0 if empty
+	refs       int    // Number of open handles sharing this storage
+}
+
+// pageWrite is a write to the data file held back until its operation commits.
+type pageWrite struct {
+	offset int64
+	data   []byte
+}
+
+// pagedFileKey identifies an open data file.
+type pagedFileKey struct {
+	files IFileProvider
+	path  string
+}
+
+var (
+	pagedFilesMu sync.Mutex
+	pagedFiles   = map[pagedFileKey]*PagedNodeStorage{}
+)
+
+// OpenPagedNodeStorage opens or creates a paged data file on the local
+// filesystem. pageBytes applies to new files and defaults to DefaultPageBytes;
+// an existing file keeps its own. Opening the same path again returns the
+// already open storage, which is released once every opener has called Close.
+func OpenPagedNodeStorage(path string, pageBytes int) (*PagedNodeStorage, error) {
+	return openPagedNodeStorage(&FileProvider{}, filepath.Dir(path), filepath.Base(path), pageBytes)
+}
+
+// openPagedNodeStorage opens a paged data file through a file provider, which
+// must support random access.
+func openPagedNodeStorage(files IFileProvider, dir, name string, pageBytes int) (*PagedNodeStorage, error) {
+	ra, ok := files.(IRandomAccessFileProvider)
+	if !ok {
+		return nil, errors.New("paged storage requires a file provider implementing IRandomAccessFileProvider")
+	}
+	key := pagedFileKey{files: files, path: filepath.Join(dir, name)}
+	if _, isOS := files.(*FileProvider); isOS {
+		// Every FileProvider addresses the same filesystem.
+		key.files = nil
+	}
+	pagedFilesMu.Lock()
+	defer pagedFilesMu.Unlock()
+	if s, ok := pagedFiles[key]; ok {
+		s.refs++
+		return s, nil
+	}
+	if pageBytes <= 0 {
+		pageBytes = DefaultPageBytes
+	}
+	pageBytes = max(pageBytes, minPageBytes)
+	f, err := ra.OpenFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := ra.OpenFile(dir, name+pageJournalSuffix)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &PagedNodeStorage{key: key, file: f, journal: journal, syncWrites: true, version: pagedFileVersion, pageBytes: pageBytes, pageCount: 1, refs: 1}
+	if fp, ok := files.(*FileProvider); ok && fp.durability() == DurabilityNone {
+		s.syncWrites = false
+	}
+	if err := s.recoverJournal(); err == nil {
+		err = s.readHeader()
+	}
+	if err != nil {
+		f.Close()
+		journal.Close()
+		return nil, err
+	}
+	pagedFiles[key] = s
+	return s, nil
+}
+
+// Close releases this handle, closing the file when it was the last one.
+func (s *PagedNodeStorage) Close() error {
+	pagedFilesMu.Lock()
+	defer pagedFilesMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	delete(pagedFiles, s.key)
+	// Every write is in place once the data file is synced, so the journal is
+	// emptied rather than written again on the next open.
+	err := s.syncData()
+	if err == nil {
+		err = s.journal.Truncate(0)
+	}
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file, s.journal = nil, nil
+	return err
+}
+
+// Sync commits the data file to stable storage.
+func (s *PagedNodeStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.unsynced = false
+	return nil
+}
+
+// syncData syncs the data file if it has unsynced writes and writes are synced.
+func (s *PagedNodeStorage) syncData() error {
+	if !s.syncWrites || !s.unsynced {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.unsynced = false
+	return nil
+}
+
+// update runs fn, which reads pages and queues the writes of an operation, and
+// then commits the writes. Should fn fail, its writes are dropped and the free
+// list and page count are restored, leaving the data file as it was.
+func (s *PagedNodeStorage) update(fn func() error) error {
+	pageCount, freeHead := s.pageCount, s.freeHead
+	if err := fn(); err != nil {
+		s.pending = nil
+		s.pageCount, s.freeHead = pageCount, freeHead
+		return err
+	}
+	return s.commit()
+}
+
+// commit journals the queued writes and then makes them in place. The writes
+// of the previous commit are synced first, as the journal no longer holds them
+// once it is overwritten.
+func (s *PagedNodeStorage) commit() error {
+	writes := s.pending
+	s.pending = nil
+	if len(writes) == 0 {
+		return nil
+	}
+	if err := s.syncData(); err != nil {
+		return err
+	}
+	if _, err := s.journal.WriteAt(encodePageJournal(writes), 0); err != nil {
+		return err
+	}
+	if s.syncWrites {
+		if err := s.journal.Sync(); err != nil {
+			return err
+		}
+	}
+	s.unsynced = true
+	for _, w := range writes {
+		if _, err := s.file.WriteAt(w.data, w.offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodePageJournal encodes a batch of writes as the magic, the number of
+// writes, each write's offset, length and data, and a CRC-32C of all of it.
+func encodePageJournal(writes []pageWrite) []byte {
+	buf := []byte(pageJournalMagic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(writes)))
+	for _, w := range writes {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(w.offset))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(w.data)))
+		buf = append(buf, w.data...)
+	}
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// decodePageJournal decodes a batch of writes, returning false if the journal
+// is empty or was torn while being written.
+func decodePageJournal(data []byte) ([]pageWrite, bool) {
+	if len(data) < len(pageJournalMagic)+4 || string(data[:len(pageJournalMagic)]) != pageJournalMagic {
+		return nil, false
+	}
+	rest := data[len(pageJournalMagic)+4:]
+	writes := make([]pageWrite, 0, min(binary.BigEndian.Uint32(data[len(pageJournalMagic):]), 1024))
+	for range binary.BigEndian.Uint32(data[len(pageJournalMagic):]) {
+		if len(rest) < 12 {
+			return nil, false
+		}
+		offset, n := binary.BigEndian.Uint64(rest), binary.BigEndian.Uint32(rest[8:])
+		if uint64(len(rest)-12) < uint64(n) {
+			return nil, false
+		}
+		writes = append(writes, pageWrite{offset: int64(offset), data: rest[12 : 12+n]})
+		rest = rest[12+n:]
+	}
+	end := len(data) - len(rest)
+	if len(rest) < 4 || binary.BigEndian.Uint32(rest) != crc32.Checksum(data[:end], crcTable) {
+		return nil, false
+	}
+	return writes, true
+}
+
+// recoverJournal writes the pages of the operation left in the journal again,
+// finishing it if a crash interrupted its writes in place, and empties the
+// journal. A torn journal belongs to an operation that had not yet written in
+// place, and is dropped.
+func (s *PagedNodeStorage) recoverJournal() error {
+	size, err := s.journal.Size()
+	if err != nil || size == 0 {
+		return err
+	}
+	data := make([]byte, size)
+	if _, err := s.journal.ReadAt(data, 0); err != nil {
+		return err
+	}
+	if writes, ok := decodePageJournal(data); ok {
+		for _, w := range writes {
+			if _, err := s.file.WriteAt(w.data, w.offset); err != nil {
+				return err
+			}
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return s.journal.Truncate(0)
+}
+
+// PageBytes returns the page size of the data file.
+func (s *PagedNodeStorage) PageBytes() int {
+	return s.pageBytes
+}
+
+// readHeader loads the file header, writing a fresh one to an empty file.
+func (s *PagedNodeStorage) readHeader() error {
+	size, err := s.file.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return s.update(s.writeHeader)
+	}
+	buf := make([]byte, fileHeaderBytes)
+	if _, err := s.file.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:8], []byte(pagedFileMagic)) {
+		return fmt.Errorf("%s is not a paged data file", s.key.path)
+	}
+	if buf[8] < 1 || buf[8] > pagedFileVersion {
+		return fmt.Errorf("unsupported paged file version %d", buf[8])
+	}
+	s.version = buf[8]
+	s.pageBytes = int(binary.BigEndian.Uint32(buf[12:]))
+	s.pageCount = binary.BigEndian.Uint64(buf[16:])
+	s.freeHead = binary.BigEndian.Uint64(buf[24:])
+	if s.pageBytes < minPageBytes || s.pageCount == 0 {
+		return fmt.Errorf("corrupt header in paged data file %s", s.key.path)
+	}
+	return nil
+}
+
+// writeHeader queues a write of the file header.
+func (s *PagedNodeStorage) writeHeader() error {
+	buf := make([]byte, fileHeaderBytes)
+	copy(buf, pagedFileMagic)
+	buf[8] = s.version
+	binary.BigEndian.PutUint32(buf[12:], uint32(s.pageBytes))
+	binary.BigEndian.PutUint64(buf[16:], s.pageCount)
+	binary.BigEndian.PutUint64(buf[24:], s.freeHead)
+	s.pending = append(s.pending, pageWrite{offset: 0, data: buf})
+	return nil
+}
+
+// pageHeader is the header at the start of every data page.
+type pageHeader struct {
+	kind     byte
+	length   int    // Payload bytes used in this page
+	next     uint64 // Next page of the chain, 0 if none
+	checksum uint32 // CRC-32C of the header fields and the payload; version 2 files only
+}
+
+func (s *PagedNodeStorage) offset(page uint64) int64 {
+	return int64(page) * int64(s.pageBytes)
+}
+
+// headerBytes returns the size of the page header in the file's version.
+func (s *PagedNodeStorage) headerBytes() int {
+	if s.version < 2 {
+		return pageHeaderBytesV1
+	}
+	return pageHeaderBytes
+}
+
+// pageChecksum returns the checksum of a page: its header up to the checksum,
+// followed by its payload.
+func pageChecksum(header, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header[:pageHeaderBytesV1], crcTable), crcTable, payload)
+}
+
+func (s *PagedNodeStorage) readPageHeader(page uint64) (pageHeader, error) {
+	if page == 0 || page >= s.pageCount {
+		return pageHeader{}, fmt.Errorf("page %d out of range", page)
+	}
+	buf := make([]byte, s.headerBytes())
+	if _, err := s.file.ReadAt(buf, s.offset(page)); err != nil {
+		return pageHeader{}, err
+	}
+	h := pageHeader{
+		kind:   buf[0],
+		length: int(binary.BigEndian.Uint32(buf[4:])),
+		next:   binary.BigEndian.Uint64(buf[8:]),
+	}
+	if s.version >= 2 {
+		h.checksum = binary.BigEndian.Uint32(buf[16:])
+	}
+	if h.length > s.pageBytes-len(buf) {
+		return pageHeader{}, fmt.Errorf("page %d: %w", page, errCorruptNode)
+	}
+	return h, nil
+}
+
+// readPayload reads the payload of a page and checks it against the checksum
+// in its header.
+func (s *PagedNodeStorage) readPayload(page uint64, h pageHeader) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := s.file.ReadAt(payload, s.offset(page)+int64(s.headerBytes())); err != nil {
+		return nil, err
+	}
+	if s.version < 2 {
+		return payload, nil
+	}
+	header := make([]byte, pageHeaderBytesV1)
+	header[0] = h.kind
+	binary.BigEndian.PutUint32(header[4:], uint32(h.length))
+	binary.BigEndian.PutUint64(header[8:], h.next)
+	if pageChecksum(header, payload) != h.checksum {
+		return nil, fmt.Errorf("page %d fails its checksum, torn by an interrupted write: %w", page, errCorruptNode)
+	}
+	return payload, nil
+}
+
+// writePage queues a write of a page header followed by its payload.
+func (s *PagedNodeStorage) writePage(page uint64, h pageHeader, payload []byte) error {
+	n := s.headerBytes()
+	buf := make([]byte, n+len(payload))
+	buf[0] = h.kind
+	binary.BigEndian.PutUint32(buf[4:], uint32(h.length))
+	binary.BigEndian.PutUint64(buf[8:], h.next)
+	copy(buf[n:], payload)
+	if s.version >= 2 {
+		binary.BigEndian.PutUint32(buf[16:], pageChecksum(buf, payload))
+	}
+	s.pending = append(s.pending, pageWrite{offset: s.offset(page), data: buf})
+	return nil
+}
+
+// allocPage takes a page from the free list or appends one to the file.
+func (s *PagedNodeStorage) allocPage() (uint64, error) {
+	if s.freeHead != 0 {
+		page := s.freeHead
+		h, err := s.readPageHeader(page)
+		if err != nil {
+			return 0, err
+		}
+		if h.kind != pageFree {
+			return 0, fmt.Errorf("free list points at page %d in use", page)
+		}
+		s.freeHead = h.next
+		return page, nil
+	}
+	page := s.pageCount
+	s.pageCount++
+	// Extend the file to a whole page so that reads of the new page succeed.
+	if err := s.file.Truncate(s.offset(s.pageCount)); err != nil {
+		s.pageCount--
+		return 0, err
+	}
+	return page, nil
+}
+
+func (s *PagedNodeStorage) freePage(page uint64) error {
+	if err := s.writePage(page, pageHeader{kind: pageFree, next: s.freeHead}, nil); err != nil {
+		return err
+	}
+	s.freeHead = page
+	return nil
+}
+
+// chain returns the pages of the node starting at page.
+func (s *PagedNodeStorage) chain(page uint64) ([]uint64, []pageHeader, error) {
+	var pages []uint64
+	var headers []pageHeader
+	kind := pageNode
+	for page != 0 {
+		if uint64(len(pages)) >= s.pageCount {
+			return nil, nil, fmt.Errorf("page chain starting at %d loops", pages[0])
+		}
+		h, err := s.readPageHeader(page)
+		if err != nil {
+			return nil, nil, err
+		}
+		if h.kind != kind {
+			return nil, nil, fmt.Errorf("page %d has kind %d, want %d", page, h.kind, kind)
+		}
+		pages = append(pages, page)
+		headers = append(headers, h)
+		page, kind = h.next, pageOverflow
+	}
+	return pages, headers, nil
+}
+
+func parsePageID(nodeID string) (uint64, error) {
+	page, err := strconv.ParseUint(nodeID, 10, 64)
+	if err != nil || page == 0 {
+		return 0, fmt.Errorf("invalid page id %q", nodeID)
+	}
+	return page, nil
+}
+
+// AllocateNodeID reserves a page for a new node and returns its number.
+func (s *PagedNodeStorage) AllocateNodeID() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return "", errPagedFileClosed
+	}
+	var page uint64
+	err := s.update(func() error {
+		var err error
+		if page, err = s.allocPage(); err != nil {
+			return err
+		}
+		if err := s.writePage(page, pageHeader{kind: pageNode}, nil); err != nil {
+			return err
+		}
+		return s.writeHeader()
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(page, 10), nil
+}
+
+func (s *PagedNodeStorage) SaveNode(node *BTreeNode) error {
+	if !node.IsDirty {
+		return nil
+	}
+	page, err := parsePageID(node.ID)
+	if err != nil {
+		return err
+	}
+	data, err := encodeNode(node)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errPagedFileClosed
+	}
+	if err := s.update(func() error { return s.writeNode(page, data) }); err != nil {
+		return err
+	}
+	node.IsDirty = false
+	return nil
+}
+
+// writeNode queues the writes storing a node's encoding in the chain of pages
+// starting at page, growing or shrinking the chain to fit.
+func (s *PagedNodeStorage) writeNode(page uint64, data []byte) error {
+	pages, _, err := s.chain(page)
+	if err != nil {
+		return err
+	}
+	capacity := s.pageBytes - s.headerBytes()
+	need := max((len(data)+capacity-1)/capacity, 1)
+	allocated := false
+	for len(pages) < need {
+		p, err := s.allocPage()
+		if err != nil {
+			return err
+		}
+		pages = append(pages, p)
+		allocated = true
+	}
+	for _, p := range pages[need:] {
+		if err := s.freePage(p); err != nil {
+			return err
+		}
+	}
+	freed := len(pages) > need
+	pages = pages[:need]
+	for i, p := range pages {
+		chunk := data[min(i*capacity, len(data)):min((i+1)*capacity, len(data))]
+		h := pageHeader{kind: pageOverflow, length: len(chunk)}
+		if i == 0 {
+			h.kind = pageNode
+		}
+		if i+1 < len(pages) {
+			h.next = pages[i+1]
+		}
+		if err := s.writePage(p, h, chunk); err != nil {
+			return err
+		}
+	}
+	if allocated || freed {
+		return s.writeHeader()
+	}
+	return nil
+}
+
+func (s *PagedNodeStorage) LoadNode(nodeID string) (*BTreeNode, error) {
+	page, err := parsePageID(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil, errPagedFileClosed
+	}
+	pages, headers, err := s.chain(page)
+	if err != nil {
+		return nil, fmt.Errorf("load node %s: %w", nodeID, err)
+	}
+	var data []byte
+	for i, p := range pages {
+		chunk, err := s.readPayload(p, headers[i])
+		if err != nil {
+			return nil, fmt.Errorf("load node %s: %w", nodeID, err)
+		}
+		data = append(data, chunk...)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("load node %s: %w", nodeID, os.ErrNotExist)
+	}
+	node, err := decodeNode(data)
+	if err != nil {
+		return nil, fmt.Errorf("load node %s: %w", nodeID, err)
+	}
+	node.IsDirty = false
+	return node, nil
+}
+
+// DeleteNode returns the pages of a node to the free list. Deleting a page that
+// is already free is a no-op.
+func (s *PagedNodeStorage) DeleteNode(nodeID string) error {
+	page, err := parsePageID(nodeID)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errPagedFileClosed
+	}
+	if h, err := s.readPageHeader(page); err != nil || h.kind == pageFree {
+		return nil
+	}
+	return s.update(func() error {
+		pages, _, err := s.chain(page)
+		if err != nil {
+			return err
+		}
+		for _, p := range pages {
+			if err := s.freePage(p); err != nil {
+				return err
+			}
+		}
+		return s.writeHeader()
+	})
+}
+
+// NodeIDs returns the IDs of the nodes stored in the data file, i.e. the first
+// pages of all node chains. For a shared file these are the nodes of every index.
+func (s *PagedNodeStorage) NodeIDs() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil, errPagedFileClosed
+	}
+	var ids []string
+	for page := uint64(1); page < s.pageCount; page++ {
+		h, err := s.readPageHeader(page)
+		if err != nil {
+			return nil, err
+		}
+		if h.kind == pageNode {
+			ids = append(ids, strconv.FormatUint(page, 10))
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,335 @@
+package fsdb
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPagedNodeStorage_TreeWithOverflowAndReuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.pages")
+	storage, err := OpenPagedNodeStorage(path, minPageBytes)
+	if err != nil {
+		t.Fatalf("OpenPagedNodeStorage failed: %v", err)
+	}
+	bt := NewBTree(storage, "", 8, true)
+	rng := rand.New(rand.NewSource(3))
+	model := map[int]bool{}
+	for step := 0; step < 2000; step++ {
+		k := rng.Intn(400)
+		if rng.Intn(3) > 0 && !model[k] {
+			// Rows of up to 600 bytes need overflow pages.
+			row := map[string]any{"id": k, "pad": strings.Repeat("x", rng.Intn(600))}
+			if err := bt.Insert([]any{k}, row); err != nil {
+				t.Fatalf("Insert(%d) failed: %v", k, err)
+			}
+			model[k] = true
+		} else {
+			if err := bt.Delete([]any{k}); err != nil {
+				t.Fatalf("Delete(%d) failed: %v", k, err)
+			}
+			delete(model, k)
+		}
+	}
+	var want []int
+	for k := range model {
+		want = append(want, k)
+	}
+	sort.Ints(want)
+
+	rootID := bt.RootID()
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	storage, err = OpenPagedNodeStorage(path, 0)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer storage.Close()
+	if storage.PageBytes() != minPageBytes {
+		t.Fatalf("reopened file has %d byte pages, want %d", storage.PageBytes(), minPageBytes)
+	}
+	bt = NewBTree(storage, rootID, 8, true)
+	results, err := bt.Search(nil)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(results) != len(want) {
+		t.Fatalf("tree holds %d rows after reopen, want %d", len(results), len(want))
+	}
+	for i, r := range results {
+		if id := r.(map[string]any)["id"]; id != want[i] {
+			t.Fatalf("row %d has id %v, want %d", i, id, want[i])
+		}
+	}
+
+	// Freed pages are reused: deleting and reinserting everything must not grow the file.
+	info, _ := os.Stat(path)
+	for _, k := range want {
+		if err := bt.Delete([]any{k}); err != nil {
+			t.Fatalf("Delete(%d) failed: %v", k, err)
+		}
+	}
+	if bt.RootID() != "" {
+		t.Fatal("expected an empty tree")
+	}
+	for _, k := range want[:len(want)/2] {
+		if err := bt.Insert([]any{k}, map[string]any{"id": k}); err != nil {
+			t.Fatalf("Insert(%d) failed: %v", k, err)
+		}
+	}
+	if after, _ := os.Stat(path); after.Size() > info.Size() {
+		t.Errorf("file grew from %d to %d bytes despite free pages", info.Size(), after.Size())
+	}
+}
+
+func TestCollection_SharedPagedStorage(t *testing.T) {
+	dir := t.TempDir()
+	schema := CollectionSchema{
+		Name: "users",
+		Indexes: []IndexDefinition{
+			{Name: "pk_id", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4, Storage: StorageCollection},
+			{Name: "ix_name", Keys: []IndexField{{Name: "name"}}, PageSize: 4, Storage: StorageCollection},
+		},
+	}
+	db, err := NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %v", err)
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("users")
+	for i := 0; i < 100; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "name": string(rune('a' + i%26))}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	nodeFiles, _ := filepath.Glob(filepath.Join(dir, "users", "*", "*"+binaryNodeExt))
+	if len(nodeFiles) != 0 {
+		t.Fatalf("expected no per-node files, found %d", len(nodeFiles))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users", "collection.pages")); err != nil {
+		t.Fatalf("expected a shared data file: %v", err)
+	}
+
+	db, err = NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer db.Close()
+	coll, _ = db.GetCollection("users")
+	rows, err := coll.Find([]any{42})
+	if err != nil || len(rows) != 1 {
+		t.Fatalf("Find(42) = %v, %v", rows, err)
+	}
+	entries, err := coll.FindByIndex("ix_name", []any{"c"})
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("FindByIndex(c) = %d entries, %v; want 4", len(entries), err)
+	}
+}
+
+func TestPagedNodeStorage_TornPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.pages")
+	storage, err := OpenPagedNodeStorage(path, minPageBytes)
+	if err != nil {
+		t.Fatalf("OpenPagedNodeStorage failed: %v", err)
+	}
+	id, err := storage.AllocateNodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewBTreeNode(id, LeafNode, 8, "")
+	node.Keys = [][]any{{1}}
+	node.Values = []any{strings.Repeat("x", 600)}
+	node.IsDirty = true
+	if err := storage.SaveNode(node); err != nil {
+		t.Fatalf("SaveNode failed: %v", err)
+	}
+	storage.Close()
+
+	// Tear the first page of the node: the tail of its payload keeps older bytes.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := parsePageID(id)
+	if _, err := f.WriteAt(make([]byte, 32), int64(page+1)*minPageBytes-32); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	storage, err = OpenPagedNodeStorage(path, 0)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer storage.Close()
+	if _, err := storage.LoadNode(id); !errors.Is(err, errCorruptNode) {
+		t.Errorf("LoadNode of a torn page = %v, want a corrupt node error", err)
+	}
+}
+
+// tearingFileProvider opens files whose writes fail from the tearAt-th on, the
+// first of them after storing half its data, as a crash in the middle of that
+// write would.
+type tearingFileProvider struct {
+	*MemoryFileProvider
+	writes, tearAt int
+}
+
+func (p *tearingFileProvider) OpenFile(path, fileName string) (RandomAccessFile, error) {
+	f, err := p.MemoryFileProvider.OpenFile(path, fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &tearingFile{RandomAccessFile: f, p: p}, nil
+}
+
+type tearingFile struct {
+	RandomAccessFile
+	p *tearingFileProvider
+}
+
+func (f *tearingFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.p.tearAt == 0 {
+		return f.RandomAccessFile.WriteAt(b, off)
+	}
+	if f.p.writes++; f.p.writes < f.p.tearAt {
+		return f.RandomAccessFile.WriteAt(b, off)
+	}
+	if f.p.writes == f.p.tearAt {
+		f.RandomAccessFile.WriteAt(b[:len(b)/2], off)
+	}
+	return 0, errCrashed
+}
+
+func (f *tearingFile) Truncate(size int64) error {
+	if f.p.tearAt != 0 && f.p.writes >= f.p.tearAt {
+		return errCrashed
+	}
+	return f.RandomAccessFile.Truncate(size)
+}
+
+func TestPagedNodeStorage_InterruptedWrites(t *testing.T) {
+	saveLeaf := func(s *PagedNodeStorage, id, value string) error {
+		node := NewBTreeNode(id, LeafNode, 8, "")
+		node.Keys = [][]any{{id}}
+		node.Values = []any{value}
+		node.IsDirty = true
+		return s.SaveNode(node)
+	}
+	old, updated := strings.Repeat("a", 300), strings.Repeat("b", 700)
+	for n := 1; ; n++ {
+		files := NewMemoryFileProvider()
+		if err := files.CreateDirectory("/db"); err != nil {
+			t.Fatal(err)
+		}
+		fp := &tearingFileProvider{MemoryFileProvider: files}
+		storage, err := openPagedNodeStorage(fp, "/db", indexPagesFile, minPageBytes)
+		if err != nil {
+			t.Fatalf("openPagedNodeStorage failed: %v", err)
+		}
+		var ids []string
+		for i := 0; i < 3; i++ {
+			id, err := storage.AllocateNodeID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := saveLeaf(storage, id, old); err != nil {
+				t.Fatalf("SaveNode failed: %v", err)
+			}
+			ids = append(ids, id)
+		}
+
+		// Grow the second node into more pages, then delete the third.
+		fp.writes, fp.tearAt = 0, n
+		err = saveLeaf(storage, ids[1], updated)
+		if err == nil {
+			err = storage.DeleteNode(ids[2])
+		}
+		if err == nil {
+			break // every write of both operations has been torn once
+		}
+		if !errors.Is(err, errCrashed) {
+			t.Fatalf("write %d: %v", n, err)
+		}
+
+		// Reopen the files without closing the crashed storage.
+		storage, err = openPagedNodeStorage(files, "/db", indexPagesFile, 0)
+		if err != nil {
+			t.Fatalf("write %d: reopen failed: %v", n, err)
+		}
+		value := func(id string) (any, error) {
+			node, err := storage.LoadNode(id)
+			if err != nil {
+				return nil, err
+			}
+			return node.Values[0], nil
+		}
+		if v, err := value(ids[0]); err != nil || v != old {
+			t.Errorf("write %d: untouched node is %.10v, %v", n, v, err)
+		}
+		second, err := value(ids[1])
+		if err != nil || (second != old && second != updated) {
+			t.Errorf("write %d: updated node is %.10v, %v; want the old or the new value", n, second, err)
+		}
+		third, err := value(ids[2])
+		if (err == nil && third != old) || (err != nil && second != updated) {
+			t.Errorf("write %d: deleted node is %.10v, %v, with the updated node %.10v", n, third, err, second)
+		}
+		// The free list and page count are whole: new nodes get pages of their own.
+		id, err := storage.AllocateNodeID()
+		if err == nil {
+			err = saveLeaf(storage, id, old)
+		}
+		if err != nil || slices.Contains(ids, id) {
+			t.Errorf("write %d: new node %s: %v", n, id, err)
+		}
+		if v, err := value(ids[0]); err != nil || v != old {
+			t.Errorf("write %d: untouched node is %.10v, %v after a new node", n, v, err)
+		}
+		storage.Close()
+	}
+}
+
+func TestPagedNodeStorage_Version1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.pages")
+	storage, err := OpenPagedNodeStorage(path, minPageBytes)
+	if err != nil {
+		t.Fatalf("OpenPagedNodeStorage failed: %v", err)
+	}
+	// Write the file as version 1 did: page headers without checksums.
+	storage.version = 1
+	if err := storage.update(storage.writeHeader); err != nil {
+		t.Fatal(err)
+	}
+	bt := NewBTree(storage, "", 4, true)
+	for i := 0; i < 20; i++ {
+		if err := bt.Insert([]any{i}, strings.Repeat("y", 100)); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	rootID := bt.RootID()
+	storage.Close()
+
+	storage, err = OpenPagedNodeStorage(path, 0)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer storage.Close()
+	if storage.version != 1 {
+		t.Errorf("reopened file has version %d, want 1", storage.version)
+	}
+	bt = NewBTree(storage, rootID, 4, true)
+	if results, err := bt.Search(nil); err != nil || len(results) != 20 {
+		t.Errorf("Search = %d rows, %v; want 20", len(results), err)
+	}
+}
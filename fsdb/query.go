@@ -0,0 +1,338 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// QueryOp is the predicate or connective of a Query.
+type QueryOp string
+
+const (
+	QueryAll     QueryOp = ""        // Matches every row; the zero Query
+	QueryEq      QueryOp = "eq"      // Field equals Values[0]; a nil value matches null or missing fields
+	QueryNe      QueryOp = "ne"      // Negation of QueryEq
+	QueryGt      QueryOp = "gt"      // Field is greater than Values[0]
+	QueryGte     QueryOp = "gte"     // Field is greater than or equal to Values[0]
+	QueryLt      QueryOp = "lt"      // Field is less than Values[0]
+	QueryLte     QueryOp = "lte"     // Field is less than or equal to Values[0]
+	QueryIn      QueryOp = "in"      // Field equals one of Values
+	QueryBetween QueryOp = "between" // Field lies within [Values[0], Values[1]]
+	QueryExists  QueryOp = "exists"  // Field is present and not null
+	QueryAnd     QueryOp = "and"     // Every one of Queries matches
+	QueryOr      QueryOp = "or"      // At least one of Queries matches
+	QueryNot     QueryOp = "not"     // Queries[0] does not match
+)
+
+// Query filters the rows of a collection by predicates on their columns:
+//
+//	q := fsdb.And(fsdb.Eq("customer", "bob"), fsdb.Gte("total", 100))
+//	rows, err := coll.Query(q)
+//
+// Values compare like index keys (see keyOrder): numbers by value whatever their
+// Go type, strings bytewise, and values of different types by the rank of their
+// type, null < booleans < numbers < strings < times < byte slices. A null or
+// missing field matches no comparison, so Lt("total", 100) leaves out rows
+// without a total. A Query is plain data and can be encoded as JSON.
+type Query struct {
+	Op      QueryOp `json:"op,omitempty"`
+	Field   string  `json:"field,omitempty"`
+	Values  []any   `json:"values,omitempty"`
+	Queries []Query `json:"queries,omitempty"` // Operands of QueryAnd, QueryOr and QueryNot
+}
+
+// SortField is a field rows are ordered by. Nulls and missing fields sort below
+// every value, as in an index field with the default null placement.
+type SortField struct {
+	Field      string `json:"field"`
+	Descending bool   `json:"descending,omitempty"`
+}
+
+// QueryOptions orders, pages and projects the rows of a query.
+type QueryOptions struct {
+	OrderBy    []SortField // Fields rows are ordered by, most significant first; by default rows come in the order of the index read
+	Skip       int         // Number of matching rows skipped
+	Limit      int         // Maximum number of rows returned; 0 for no limit
+	Fields     []string    // Fields returned of every row; all of them when empty
+	SortMemory int         // Approximate bytes of rows sorted in memory before sorted runs spill to temporary files; DefaultBulkLoadMemory when 0
+	PageToken  string      // Resume after the last row of a page; see Collection.QueryPage
+}
+
+// validate checks the options.
+func (o QueryOptions) validate() error {
+	if o.Skip < 0 || o.Limit < 0 {
+		return fmt.Errorf("query: negative skip %d or limit %d", o.Skip, o.Limit)
+	}
+	for _, s := range o.OrderBy {
+		if s.Field == "" {
+			return errors.New("query: order by needs a field")
+		}
+	}
+	for _, f := range o.Fields {
+		if f == "" {
+			return errors.New("query: empty field name in projection")
+		}
+	}
+	return nil
+}
+
+// Eq matches rows whose field equals value. Eq(field, nil) matches rows where
+// the field is null or missing.
+func Eq(field string, value any) Query {
+	return Query{Op: QueryEq, Field: field, Values: []any{value}}
+}
+
+// Ne matches rows whose field does not equal value, including rows without it.
+func Ne(field string, value any) Query {
+	return Query{Op: QueryNe, Field: field, Values: []any{value}}
+}
+
+// Gt matches rows whose field is greater than value.
+func Gt(field string, value any) Query {
+	return Query{Op: QueryGt, Field: field, Values: []any{value}}
+}
+
+// Gte matches rows whose field is greater than or equal to value.
+func Gte(field string, value any) Query {
+	return Query{Op: QueryGte, Field: field, Values: []any{value}}
+}
+
+// Lt matches rows whose field is less than value.
+func Lt(field string, value any) Query {
+	return Query{Op: QueryLt, Field: field, Values: []any{value}}
+}
+
+// Lte matches rows whose field is less than or equal to value.
+func Lte(field string, value any) Query {
+	return Query{Op: QueryLte, Field: field, Values: []any{value}}
+}
+
+// In matches rows whose field equals one of values.
+func In(field string, values ...any) Query {
+	return Query{Op: QueryIn, Field: field, Values: values}
+}
+
+// Between matches rows whose field lies between lo and hi, both included.
+func Between(field string, lo, hi any) Query {
+	return Query{Op: QueryBetween, Field: field, Values: []any{lo, hi}}
+}
+
+// Exists matches rows in which the field is present and not null.
+func Exists(field string) Query {
+	return Query{Op: QueryExists, Field: field}
+}
+
+// And matches rows that match every one of queries; with none, every row.
+func And(queries ...Query) Query {
+	return Query{Op: QueryAnd, Queries: queries}
+}
+
+// Or matches rows that match at least one of queries; with none, no row.
+func Or(queries ...Query) Query {
+	return Query{Op: QueryOr, Queries: queries}
+}
+
+// Not matches rows that do not match q.
+func Not(q Query) Query {
+	return Query{Op: QueryNot, Queries: []Query{q}}
+}
+
+// validate checks the operands of every predicate of the query.
+func (q Query) validate() error {
+	want := -1 // Number of values the predicate takes; -1 for any
+	switch q.Op {
+	case QueryAll:
+		return nil
+	case QueryAnd, QueryOr, QueryNot:
+		if q.Op == QueryNot && len(q.Queries) != 1 {
+			return errors.New("query: not takes exactly one query")
+		}
+		for _, sub := range q.Queries {
+			if err := sub.validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case QueryEq, QueryNe, QueryGt, QueryGte, QueryLt, QueryLte:
+		want = 1
+	case QueryBetween:
+		want = 2
+	case QueryExists:
+		want = 0
+	case QueryIn:
+	default:
+		return fmt.Errorf("query: unknown operator %q", q.Op)
+	}
+	if q.Field == "" {
+		return fmt.Errorf("query: %s needs a field", q.Op)
+	}
+	if want >= 0 && len(q.Values) != want {
+		return fmt.Errorf("query: %s on %s takes %d values, got %d", q.Op, q.Field, want, len(q.Values))
+	}
+	return nil
+}
+
+// queryOperators are the symbols String writes for comparisons.
+var queryOperators = map[QueryOp]string{
+	QueryEq: "=", QueryNe: "!=", QueryGt: ">", QueryGte: ">=", QueryLt: "<", QueryLte: "<=",
+}
+
+// String formats the query as an expression, e.g.
+// (customer = "bob" AND total BETWEEN 10 AND 20).
+func (q Query) String() string {
+	switch q.Op {
+	case QueryAll:
+		return "TRUE"
+	case QueryAnd, QueryOr:
+		if len(q.Queries) == 0 && q.Op == QueryOr {
+			return "FALSE"
+		} else if len(q.Queries) == 0 {
+			return "TRUE"
+		}
+		parts := make([]string, len(q.Queries))
+		for i, sub := range q.Queries {
+			parts[i] = sub.String()
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(string(q.Op))+" ") + ")"
+	case QueryNot:
+		if len(q.Queries) != 1 {
+			break
+		}
+		return "NOT " + q.Queries[0].String()
+	case QueryExists:
+		return q.Field + " EXISTS"
+	case QueryIn:
+		parts := make([]string, len(q.Values))
+		for i, v := range q.Values {
+			parts[i] = formatValue(v)
+		}
+		return q.Field + " IN (" + strings.Join(parts, ", ") + ")"
+	case QueryBetween:
+		if len(q.Values) == 2 {
+			return fmt.Sprintf("%s BETWEEN %s AND %s", q.Field, formatValue(q.Values[0]), formatValue(q.Values[1]))
+		}
+	default:
+		if op, ok := queryOperators[q.Op]; ok && len(q.Values) == 1 {
+			return fmt.Sprintf("%s %s %s", q.Field, op, formatValue(q.Values[0]))
+		}
+	}
+	return fmt.Sprintf("%s(%s %v)", q.Op, q.Field, q.Values)
+}
+
+// formatValue formats a field value for String: strings quoted, nil as null.
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprint(v)
+}
+
+// matches reports whether a row satisfies the query.
+func (q Query) matches(row map[string]any) bool {
+	switch q.Op {
+	case QueryAll:
+		return true
+	case QueryAnd:
+		for _, sub := range q.Queries {
+			if !sub.matches(row) {
+				return false
+			}
+		}
+		return true
+	case QueryOr:
+		for _, sub := range q.Queries {
+			if sub.matches(row) {
+				return true
+			}
+		}
+		return false
+	case QueryNot:
+		return !q.Queries[0].matches(row)
+	}
+	v := row[q.Field]
+	switch q.Op {
+	case QueryEq:
+		return equalValues(v, q.Values[0])
+	case QueryNe:
+		return !equalValues(v, q.Values[0])
+	case QueryIn:
+		for _, want := range q.Values {
+			if equalValues(v, want) {
+				return true
+			}
+		}
+		return false
+	case QueryExists:
+		return v != nil
+	}
+	if v == nil {
+		return false
+	}
+	switch q.Op {
+	case QueryGt:
+		return compareValues(v, q.Values[0]) > 0
+	case QueryGte:
+		return compareValues(v, q.Values[0]) >= 0
+	case QueryLt:
+		return compareValues(v, q.Values[0]) < 0
+	case QueryLte:
+		return compareValues(v, q.Values[0]) <= 0
+	case QueryBetween:
+		return compareValues(v, q.Values[0]) >= 0 && compareValues(v, q.Values[1]) <= 0
+	}
+	return false
+}
+
+// conjuncts returns the queries that must all match for q to match, looking
+// through nested Ands.
+func (q Query) conjuncts() []Query {
+	switch q.Op {
+	case QueryAll:
+		return nil
+	case QueryAnd:
+		var all []Query
+		for _, sub := range q.Queries {
+			all = append(all, sub.conjuncts()...)
+		}
+		return all
+	}
+	return []Query{q}
+}
+
+// fields adds the names of the fields the query reads to set.
+func (q Query) fields(set map[string]bool) {
+	if q.Field != "" {
+		set[q.Field] = true
+	}
+	for _, sub := range q.Queries {
+		sub.fields(set)
+	}
+}
+
+// allOf combines queries that must all match into one query.
+func allOf(queries []Query) Query {
+	switch len(queries) {
+	case 0:
+		return Query{}
+	case 1:
+		return queries[0]
+	}
+	return And(queries...)
+}
+
+// compareValues compares two field values in index key order.
+func compareValues(a, b any) int {
+	return compareKeys([]any{a}, []any{b})
+}
+
+// equalValues reports whether two field values are equal; null equals only null.
+func equalValues(a, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return compareValues(a, b) == 0
+}
@@ -0,0 +1,152 @@
+package fsdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ScanDirection is the order in which a query reads the range of its index.
+type ScanDirection string
+
+const (
+	ScanForward ScanDirection = "forward" // From the first key of the range to the last
+	ScanReverse ScanDirection = "reverse" // From the last key of the range to the first
+)
+
+// SortMethod is how the rows of a query are put in order.
+type SortMethod string
+
+const (
+	SortIndexOrder SortMethod = "index order"    // Rows are returned in the order the index is read
+	SortInMemory   SortMethod = "in-memory sort" // Rows are sorted in memory after being read
+	SortExternal   SortMethod = "external sort"  // Rows are sorted in runs spilled to temporary files, then merged
+)
+
+// QueryExplain describes how a query ran: the access path the planner chose,
+// its estimate and what reading it actually took.
+type QueryExplain struct {
+	Index          string        // Index the rows were read through
+	Range          KeyRange      // Range of the index keys read, in index order
+	Direction      ScanDirection // Order in which the range was read
+	BookmarkLookup bool          // Entries of a non-clustered index were joined with their rows in Clustered
+	Covering       bool          // Entries of a non-clustered index held every field needed, so no row was looked up
+	Clustered      string        // Clustered index of the collection
+	SeekRows       int           // Index entries skipped by offset without being read
+	EstimatedRows  int           // Index entries expected to be read, counted when planning
+	ExaminedRows   int           // Index entries actually read
+	ReturnedRows   int           // Rows returned after skip and limit
+	Residual       Query         // Predicates the range does not capture, checked on every row read; the zero Query if none
+	Sort           SortMethod
+}
+
+// String formats the explanation as a few lines of text.
+func (e *QueryExplain) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "scan %s %s %s", e.Index, e.Direction, formatRange(e.Range))
+	if e.BookmarkLookup {
+		fmt.Fprintf(&b, ", bookmark lookup into %s", e.Clustered)
+	} else if e.Covering {
+		b.WriteString(", covering")
+	}
+	b.WriteString("\nrows: ")
+	if e.SeekRows > 0 {
+		fmt.Fprintf(&b, "skipped %d by offset, ", e.SeekRows)
+	}
+	fmt.Fprintf(&b, "estimated %d, examined %d, returned %d", e.EstimatedRows, e.ExaminedRows, e.ReturnedRows)
+	if e.Residual.Op == QueryAll {
+		b.WriteString("\nfilter: none")
+	} else {
+		fmt.Fprintf(&b, "\nfilter: %s", e.Residual)
+	}
+	fmt.Fprintf(&b, "\nsort: %s", e.Sort)
+	return b.String()
+}
+
+// formatRange formats the bounds of a key range, e.g.
+// from ("bob", 20) inclusive to ("bob") inclusive.
+func formatRange(r KeyRange) string {
+	bound := func(key []any, inclusive bool) string {
+		parts := make([]string, len(key))
+		for i, v := range key {
+			parts[i] = formatValue(v)
+		}
+		if inclusive {
+			return "(" + strings.Join(parts, ", ") + ") inclusive"
+		}
+		return "(" + strings.Join(parts, ", ") + ") exclusive"
+	}
+	if r.Lower == nil && r.Upper == nil {
+		return "over all keys"
+	}
+	lower, upper := "the first key", "the last key"
+	if r.Lower != nil {
+		lower = bound(r.Lower, r.LowerInclusive)
+	}
+	if r.Upper != nil {
+		upper = bound(r.Upper, r.UpperInclusive)
+	}
+	return "from " + lower + " to " + upper
+}
+
+// explain describes a plan after execute has run it.
+func (p *queryPlan) explain(s *Snapshot) *QueryExplain {
+	e := &QueryExplain{
+		Index:          p.index.index.indexDef.Name,
+		Range:          p.r,
+		Direction:      ScanForward,
+		BookmarkLookup: p.lookup(),
+		Covering:       p.covering,
+		Clustered:      s.clustered.index.indexDef.Name,
+		SeekRows:       p.seek,
+		EstimatedRows:  p.reads,
+		ExaminedRows:   p.examined,
+		ReturnedRows:   p.returned,
+		Residual:       p.residual,
+		Sort:           SortIndexOrder,
+	}
+	if p.reverse {
+		e.Direction = ScanReverse
+	}
+	if p.spilled {
+		e.Sort = SortExternal
+	} else if !p.sorted {
+		e.Sort = SortInMemory
+	}
+	return e
+}
+
+// Explain runs a query and describes how it ran.
+func (s *Snapshot) Explain(q Query) (*QueryExplain, error) {
+	return s.ExplainWithOptions(q, QueryOptions{})
+}
+
+// ExplainWithOptions runs a query with options and describes how it ran.
+func (s *Snapshot) ExplainWithOptions(q Query, opts QueryOptions) (*QueryExplain, error) {
+	p, err := s.plan(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.execute(p, opts, func(map[string]any) bool { return true }); err != nil {
+		return nil, err
+	}
+	return p.explain(s), nil
+}
+
+// Explain runs a query on a snapshot of the collection, discarding its rows, and
+// describes how it ran: the index and key range read, the planner's estimate
+// against the entries actually read, the filters checked on each row and how
+// the rows were ordered. The text form is QueryExplain.String.
+func (c *Collection) Explain(q Query) (*QueryExplain, error) {
+	return c.ExplainWithOptions(q, QueryOptions{})
+}
+
+// ExplainWithOptions runs a query with options on a snapshot of the collection
+// and describes how it ran, like Explain.
+func (c *Collection) ExplainWithOptions(q Query, opts QueryOptions) (*QueryExplain, error) {
+	snap, err := c.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	return snap.ExplainWithOptions(q, opts)
+}
@@ -0,0 +1,141 @@
+package fsdb
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+)
+
+// Queries are paged by key rather than by offset: the token a page ends with
+// records where the last row sits, and the next page is read from just past
+// it. Rows read in the order of an index are positioned by their entry key,
+// which ends with the row key and so is unique; the next page narrows the range
+// of the same index to the keys after it, so earlier rows are never read and
+// rows inserted or deleted meanwhile do not shift the pages. Rows sorted after
+// being read are positioned by their sort fields followed by the row key; the
+// next page sorts again and keeps the rows after that position.
+
+// pageTokenVersion is the version of the page token encoding.
+const pageTokenVersion = 1
+
+// pageToken is the decoded form of QueryOptions.PageToken.
+type pageToken struct {
+	index string // Index whose order the rows came in; empty when they were sorted after being read
+	key   []any  // Entry key in index, or sort fields and row key, of the last row returned
+}
+
+// QueryPage is a page of the rows of a query.
+type QueryPage struct {
+	Rows      []any
+	NextToken string // Pass as QueryOptions.PageToken to read the next page; empty on the last page
+}
+
+// queryFingerprint hashes the parts of a query that decide which rows come
+// after a page token and in which order.
+func queryFingerprint(q Query, opts QueryOptions) (uint64, error) {
+	data, err := json.Marshal(struct {
+		Query   Query       `json:"query"`
+		OrderBy []SortField `json:"order_by"`
+	}{q, opts.OrderBy})
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64(), nil
+}
+
+// encodePageToken encodes a page token as URL-safe base64 of its version, the
+// query fingerprint, the index name and the key in the typed value encoding of
+// the node format.
+func encodePageToken(t pageToken, fingerprint uint64) (string, error) {
+	buf := []byte{pageTokenVersion}
+	buf = binary.BigEndian.AppendUint64(buf, fingerprint)
+	buf, err := appendValue(buf, t.index)
+	if err == nil {
+		buf, err = appendValue(buf, t.key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// decodePageToken decodes a page token, checking that it was issued for a
+// query with the given fingerprint.
+func decodePageToken(token string, fingerprint uint64) (*pageToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) < 9 || data[0] != pageTokenVersion {
+		return nil, fmt.Errorf("query: malformed page token")
+	}
+	if binary.BigEndian.Uint64(data[1:9]) != fingerprint {
+		return nil, fmt.Errorf("query: page token was issued for a different query")
+	}
+	r := &valueReader{data: data[9:]}
+	index, err := r.value()
+	if err != nil {
+		return nil, fmt.Errorf("query: malformed page token")
+	}
+	key, err := r.value()
+	if err != nil {
+		return nil, fmt.Errorf("query: malformed page token")
+	}
+	t := &pageToken{}
+	var ok bool
+	if t.index, ok = index.(string); !ok {
+		return nil, fmt.Errorf("query: malformed page token")
+	}
+	if t.key, ok = key.([]any); !ok || len(t.key) == 0 {
+		return nil, fmt.Errorf("query: malformed page token")
+	}
+	return t, nil
+}
+
+// QueryPage returns a page of at most opts.Limit rows matching q, resuming
+// after opts.PageToken when set, and a token for the next page.
+func (s *Snapshot) QueryPage(q Query, opts QueryOptions) (*QueryPage, error) {
+	p, err := s.plan(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.paging = true
+	page := &QueryPage{Rows: []any{}}
+	err = s.execute(p, opts, func(row map[string]any) bool {
+		page.Rows = append(page.Rows, row)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.more {
+		t := pageToken{key: p.last}
+		if p.sorted {
+			t.index = p.index.index.indexDef.Name
+		}
+		if page.NextToken, err = encodePageToken(t, p.fingerprint); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// QueryPage returns a page of at most opts.Limit rows matching q on a snapshot
+// of the collection, and a token that resumes the query after its last row:
+//
+//	page, err := coll.QueryPage(q, fsdb.QueryOptions{Limit: 50})
+//	...
+//	next, err := coll.QueryPage(q, fsdb.QueryOptions{Limit: 50, PageToken: page.NextToken})
+//
+// A token is only valid for the query and order it was issued for. Each page
+// reads from its own snapshot, so rows changed between pages show on the pages
+// after their position.
+func (c *Collection) QueryPage(q Query, opts QueryOptions) (*QueryPage, error) {
+	snap, err := c.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	return snap.QueryPage(q, opts)
+}
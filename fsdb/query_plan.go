@@ -0,0 +1,578 @@
+package fsdb
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// A query is planned on one index of the collection. The planner turns the
+// predicates the query requires (the operands of its top-level Ands) into a
+// range of keys of each index: equalities on the leading key fields, then
+// comparisons or Exists on the next field. Every index is costed by counting
+// its entries within the range, which the subtree counts of the tree make a
+// descent per bound, and the cheapest is read. Entries of a non-clustered index
+// are joined with their rows through the row key that ends their keys (a
+// bookmark lookup), which is weighed as lookupCost entries read, unless the
+// entries hold every field the query needs (a covering index). Without a
+// usable range the clustered index is scanned. The predicates the range does
+// not capture are checked on each row read.
+//
+// An index whose order matches the requested one, read forward or in reverse,
+// returns the rows already sorted; without a residual filter it also skips
+// rows by offset instead of reading them and stops after the limit. Otherwise
+// the rows are sorted after being read, in memory or in sorted runs spilled to
+// temporary files, each row sorted weighed as sortCost entries read.
+
+const (
+	// lookupCost is the cost of joining an entry of a non-clustered index with
+	// its row, in entries read.
+	lookupCost = 3
+	// sortCost is the cost of sorting a row, in entries read.
+	sortCost = 2
+)
+
+// queryPlan is the access path chosen for a query.
+type queryPlan struct {
+	index    *indexSnapshot // Index the rows are read through
+	r        KeyRange       // Range of the index keys read
+	reverse  bool           // Read r from its last key to its first
+	residual Query          // Predicates checked on every row read
+	order    []SortField    // Order of the rows, without fields the query holds constant
+	sorted   bool           // Reading the index returns the rows in order
+	covering bool           // Entries of a non-clustered index hold every field the query needs
+	seek     int            // Entries of r skipped by offset without reading them
+	estimate int            // Number of index entries within r
+	reads    int            // Number of index entries expected to be read
+	cost     int            // reads, weighed by lookupCost for bookmark lookups, plus sortCost per row sorted
+	after    *pageToken     // Position the rows are read after, from QueryOptions.PageToken
+
+	fingerprint uint64 // Fingerprint of the query for page tokens
+	paging      bool   // Look for a row past the limit to tell whether another page follows
+
+	examined int   // Index entries read by run
+	returned int   // Rows passed on by execute
+	spilled  bool  // The sort spilled sorted runs to temporary files
+	last     []any // Position of the last row returned; see pageToken.key
+	more     bool  // Rows remain past the limit
+}
+
+// lookup reports whether the plan joins index entries with their rows.
+func (p *queryPlan) lookup() bool {
+	return !p.index.index.indexDef.IsClustered && !p.covering
+}
+
+// plan chooses the index and key range a query is read through.
+func (s *Snapshot) plan(q Query, opts QueryOptions) (*queryPlan, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fingerprint, err := queryFingerprint(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	var after *pageToken
+	if opts.PageToken != "" {
+		if after, err = decodePageToken(opts.PageToken, fingerprint); err != nil {
+			return nil, err
+		}
+	}
+	conjuncts := q.conjuncts()
+	if after != nil && after.index != "" {
+		// Resume in the order of the index the previous page was read from.
+		p, err := s.planResume(after, conjuncts, opts)
+		if p != nil {
+			p.fingerprint = fingerprint
+		}
+		return p, err
+	}
+	best, err := planIndex(s.clustered, conjuncts, opts, after)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.indexes)) {
+		is := s.indexes[name]
+		if len(is.index.rowKey) == 0 {
+			continue // Entries do not lead to their rows
+		}
+		p, err := planIndex(is, conjuncts, opts, after)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil && p.cost < best.cost {
+			best = p
+		}
+	}
+	best.fingerprint = fingerprint
+	return best, nil
+}
+
+// planResume plans reading the index named by a page token from the position it
+// records.
+func (s *Snapshot) planResume(after *pageToken, conjuncts []Query, opts QueryOptions) (*queryPlan, error) {
+	is := s.clustered
+	if is.index.indexDef.Name != after.index {
+		is = s.indexes[after.index]
+	}
+	if is == nil || (is != s.clustered && len(is.index.rowKey) == 0) {
+		return nil, fmt.Errorf("query: page token names unknown index %s", after.index)
+	}
+	if len(after.key) != len(is.index.indexDef.Keys)+len(is.index.rowKey) {
+		return nil, fmt.Errorf("query: page token does not hold a key of index %s", after.index)
+	}
+	p, err := planIndex(is, conjuncts, opts, after)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || !p.sorted {
+		return nil, fmt.Errorf("query: index %s no longer returns the rows of the page token in order", after.index)
+	}
+	return p, nil
+}
+
+// planIndex plans reading an index for the given conjuncts, resuming after a
+// page token when not nil. It returns nil for a sparse index that may lack rows
+// the query matches.
+func planIndex(is *indexSnapshot, conjuncts []Query, opts QueryOptions, after *pageToken) (*queryPlan, error) {
+	def := is.index.indexDef
+	if def.Sparse && !requiresKeyFields(def, conjuncts) {
+		return nil, nil
+	}
+	r, used := keyRange(def, def.keyOrder(), conjuncts)
+	var residual []Query
+	for i, c := range conjuncts {
+		if !used[i] {
+			residual = append(residual, c)
+		}
+	}
+	p := &queryPlan{index: is, r: r, residual: allOf(residual), after: after}
+	constant := constantFields(conjuncts)
+	for _, f := range opts.OrderBy {
+		if !constant[f.Field] {
+			p.order = append(p.order, f)
+		}
+	}
+	p.sorted, p.reverse = indexOrder(is.index, p.order, conjuncts)
+	switch {
+	case after != nil && after.index == "":
+		p.sorted, p.reverse = false, false // Sorted after being read on the previous page too
+	case after != nil && p.reverse:
+		p.r.Upper, p.r.UpperInclusive = after.key, false
+	case after != nil:
+		p.r.Lower, p.r.LowerInclusive = after.key, false
+	}
+	estimate, err := is.tree.CountRange(p.r)
+	if err != nil {
+		return nil, err
+	}
+	p.estimate, p.reads = estimate, estimate
+	p.covering = !def.IsClustered && covers(is.index, p.residual, opts)
+	if p.sorted && p.residual.Op == QueryAll {
+		p.seek = min(opts.Skip, estimate)
+		p.reads = estimate - p.seek
+		if opts.Limit > 0 {
+			p.reads = min(p.reads, opts.Limit)
+		}
+	}
+	p.cost = p.reads
+	if p.lookup() {
+		p.cost *= 1 + lookupCost
+	}
+	if !p.sorted {
+		p.cost += estimate * sortCost
+	}
+	return p, nil
+}
+
+// keyRange returns the range of keys of an index that holds every row matching
+// the conjuncts, and marks the conjuncts the range captures exactly.
+func keyRange(def IndexDefinition, order keyOrder, conjuncts []Query) (KeyRange, []bool) {
+	used := make([]bool, len(conjuncts))
+	var prefix []any
+	for i, field := range def.Keys {
+		if j := findEquality(conjuncts, used, field.Name); j >= 0 {
+			used[j] = true
+			prefix = append(prefix, conjuncts[j].Values[0])
+			continue
+		}
+		if r, ok := fieldRange(conjuncts, used, field.Name, order[i], prefix); ok {
+			return r, used
+		}
+		break
+	}
+	if len(prefix) == 0 {
+		return KeyRange{}, used
+	}
+	return ExactRange(prefix), used
+}
+
+// findEquality returns the position of an unused equality on a field, or -1.
+func findEquality(conjuncts []Query, used []bool, field string) int {
+	for j, c := range conjuncts {
+		if used[j] || c.Field != field {
+			continue
+		}
+		if c.Op == QueryEq || (c.Op == QueryIn && len(c.Values) == 1) {
+			return j
+		}
+	}
+	return -1
+}
+
+// fieldRange combines the comparisons and Exists on a key field into a range of
+// keys starting with prefix. Comparisons with null are left to the residual.
+func fieldRange(conjuncts []Query, used []bool, field string, f fieldOrder, prefix []any) (KeyRange, bool) {
+	var lo, hi any
+	var hasLo, hasHi, loInc, hiInc, found bool
+	raise := func(v any, inc bool) {
+		if c := compareValues(v, lo); !hasLo || c > 0 || (c == 0 && !inc) {
+			lo, loInc, hasLo = v, inc, true
+		}
+	}
+	lower := func(v any, inc bool) {
+		if c := compareValues(v, hi); !hasHi || c < 0 || (c == 0 && !inc) {
+			hi, hiInc, hasHi = v, inc, true
+		}
+	}
+	for j, c := range conjuncts {
+		if used[j] || c.Field != field || hasNull(c.Values) {
+			continue
+		}
+		switch c.Op {
+		case QueryGt, QueryGte:
+			raise(c.Values[0], c.Op == QueryGte)
+		case QueryLt, QueryLte:
+			lower(c.Values[0], c.Op == QueryLte)
+		case QueryBetween:
+			raise(c.Values[0], true)
+			lower(c.Values[1], true)
+		case QueryExists:
+		default:
+			continue
+		}
+		used[j] = true
+		found = true
+	}
+	if !found {
+		return KeyRange{}, false
+	}
+	bound := func(v any) []any {
+		return append(slices.Clone(prefix), v)
+	}
+	var r KeyRange
+	if hasLo {
+		r.Lower, r.LowerInclusive = bound(lo), loInc
+	}
+	if hasHi {
+		r.Upper, r.UpperInclusive = bound(hi), hiInc
+	}
+	if f.descending {
+		r.Lower, r.Upper = r.Upper, r.Lower
+		r.LowerInclusive, r.UpperInclusive = r.UpperInclusive, r.LowerInclusive
+	}
+	// Nulls match no comparison: cut them off the open side they sort on.
+	if f.nullsLast && r.Upper == nil {
+		r.Upper = bound(nil)
+	} else if !f.nullsLast && r.Lower == nil {
+		r.Lower = bound(nil)
+	}
+	if r.Lower == nil && len(prefix) > 0 {
+		r.Lower, r.LowerInclusive = prefix, true
+	}
+	if r.Upper == nil && len(prefix) > 0 {
+		r.Upper, r.UpperInclusive = prefix, true
+	}
+	return r, true
+}
+
+// requiresField reports whether the conjuncts only match rows in which a field
+// is present and not null.
+func requiresField(conjuncts []Query, field string) bool {
+	return slices.ContainsFunc(conjuncts, func(c Query) bool {
+		if c.Field != field || hasNull(c.Values) {
+			return false
+		}
+		switch c.Op {
+		case QueryEq, QueryGt, QueryGte, QueryLt, QueryLte, QueryBetween, QueryExists:
+			return true
+		case QueryIn:
+			return len(c.Values) > 0
+		}
+		return false
+	})
+}
+
+// requiresKeyFields reports whether the conjuncts only match rows in which every
+// key field of an index is present and not null, which a sparse index holds.
+func requiresKeyFields(def IndexDefinition, conjuncts []Query) bool {
+	for _, k := range def.Keys {
+		if !requiresField(conjuncts, k.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// constantFields returns the fields that have the same value in every row the
+// conjuncts match.
+func constantFields(conjuncts []Query) map[string]bool {
+	constant := map[string]bool{}
+	for _, c := range conjuncts {
+		if c.Op == QueryEq || (c.Op == QueryIn && len(c.Values) == 1) {
+			constant[c.Field] = true
+		}
+	}
+	return constant
+}
+
+// indexOrder reports whether reading an index returns its entries in the given
+// order of rows, and whether it must be read in reverse to do so. The fields
+// after the indexed ones are those of the row key, which make every key unique.
+func indexOrder(im *IndexManager, order []SortField, conjuncts []Query) (sorted, reverse bool) {
+	var fields []string
+	for _, k := range im.indexDef.Keys {
+		fields = append(fields, k.Name)
+	}
+	fields = append(fields, im.rowKey...)
+	orders := im.indexDef.keyOrder()
+	constant := constantFields(conjuncts)
+	i, dir := 0, 0
+	for _, s := range order {
+		for i < len(fields) && constant[fields[i]] {
+			i++
+		}
+		if i == len(fields) {
+			break // Keys are unique: later fields never break a tie
+		}
+		if fields[i] != s.Field {
+			return false, false
+		}
+		var f fieldOrder
+		if i < len(orders) {
+			f = orders[i]
+		}
+		// Nulls sort as the lowest value unless the query leaves them out.
+		if f.nullsLast != f.descending && !requiresField(conjuncts, s.Field) {
+			return false, false
+		}
+		d := 1
+		if f.descending != s.Descending {
+			d = -1
+		}
+		if dir != 0 && d != dir {
+			return false, false
+		}
+		dir = d
+		i++
+	}
+	return true, dir < 0
+}
+
+// covers reports whether the entries of a non-clustered index hold every field
+// a query returns, filters and orders by.
+func covers(im *IndexManager, residual Query, opts QueryOptions) bool {
+	if len(opts.Fields) == 0 {
+		return false
+	}
+	held := map[string]bool{}
+	for _, k := range im.indexDef.Keys {
+		held[k.Name] = true
+	}
+	for _, name := range im.indexDef.Includes {
+		held[name] = true
+	}
+	for _, name := range im.rowKey {
+		held[name] = true
+	}
+	needed := map[string]bool{}
+	residual.fields(needed)
+	for _, f := range opts.OrderBy {
+		needed[f.Field] = true
+	}
+	for _, name := range opts.Fields {
+		needed[name] = true
+	}
+	for name := range needed {
+		if !held[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasNull(values []any) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// run reads the rows a plan selects and passes those matching its residual
+// predicates to yield, until yield returns false.
+// The key passed along is the entry key of the row in the index.
+func (s *Snapshot) run(p *queryPlan, yield func(key []any, row map[string]any) bool) error {
+	cur := p.index.tree.Cursor(p.r)
+	if p.reverse {
+		cur = p.index.tree.ReverseCursor(p.r)
+	}
+	defer cur.Close()
+	if p.seek > 0 {
+		cur.SeekToOffset(p.seek)
+	}
+	keyLen := len(p.index.index.indexDef.Keys)
+	for cur.Next() {
+		p.examined++
+		row, ok := cur.Value().(map[string]any)
+		if p.lookup() {
+			var err error
+			if row, err = s.lookupRow(cur.Key()[keyLen:]); err != nil {
+				return fmt.Errorf("index %s: %w", p.index.index.indexDef.Name, err)
+			}
+		} else if !ok {
+			continue
+		}
+		if p.residual.matches(row) && !yield(cur.Key(), row) {
+			break
+		}
+	}
+	return cur.Err()
+}
+
+// execute runs a plan and passes the rows it returns to yield, ordered, paged
+// and projected as the options ask, until yield returns false.
+func (s *Snapshot) execute(p *queryPlan, opts QueryOptions, yield func(row map[string]any) bool) error {
+	skip := opts.Skip - p.seek
+	emit := func(key []any, row map[string]any) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		if opts.Limit > 0 && p.returned == opts.Limit {
+			p.more = true
+			return false
+		}
+		p.returned++
+		p.last = key
+		if !yield(project(row, opts.Fields)) {
+			return false
+		}
+		return opts.Limit == 0 || p.returned < opts.Limit || p.paging
+	}
+	if p.sorted {
+		return s.run(p, emit)
+	}
+
+	// Rows are sorted by the fields asked for, then by row key so that a page
+	// token positions them exactly.
+	rowKey := s.clustered.index.indexDef.Keys
+	order := make(keyOrder, len(p.order), len(p.order)+len(rowKey))
+	for i, f := range p.order {
+		order[i] = fieldOrder{descending: f.Descending, nullsLast: f.Descending}
+	}
+	order = append(order, make(keyOrder, len(rowKey))...)
+	sorter := newEntrySorter(order, s.clustered.index.files, BulkLoadOptions{MemoryBudget: opts.SortMemory})
+	defer sorter.Close()
+	var err error
+	if runErr := s.run(p, func(_ []any, row map[string]any) bool {
+		key := make([]any, 0, len(order))
+		for _, f := range p.order {
+			key = append(key, row[f.Field])
+		}
+		for _, k := range rowKey {
+			key = append(key, row[k.Name])
+		}
+		if p.after != nil && order.compare(key, p.after.key) <= 0 {
+			return true
+		}
+		err = sorter.Add(key, row)
+		return err == nil
+	}); runErr != nil {
+		return runErr
+	}
+	if err != nil {
+		return err
+	}
+	p.spilled = len(sorter.runs) > 0
+	for key, v := range sorter.All() {
+		row, _ := v.(map[string]any)
+		if !emit(key, row) {
+			break
+		}
+	}
+	return sorter.Err()
+}
+
+// project returns the given fields of a row, or the row itself without fields.
+func project(row map[string]any, fields []string) map[string]any {
+	if len(fields) == 0 {
+		return row
+	}
+	projected := make(map[string]any, len(fields))
+	for _, name := range fields {
+		if v, ok := row[name]; ok {
+			projected[name] = v
+		}
+	}
+	return projected
+}
+
+// lookupRow returns the row with the given clustered key.
+func (s *Snapshot) lookupRow(key []any) (map[string]any, error) {
+	rows, err := s.clustered.tree.Search(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("no row with key %#v", key)
+	}
+	row, ok := rows[0].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("row with key %#v is not a map", key)
+	}
+	return row, nil
+}
+
+// Query returns the rows matching q, in the order of the index the query is
+// planned on.
+func (s *Snapshot) Query(q Query) ([]any, error) {
+	return s.QueryWithOptions(q, QueryOptions{})
+}
+
+// QueryWithOptions returns the rows matching q, ordered, paged and projected as
+// opts asks.
+func (s *Snapshot) QueryWithOptions(q Query, opts QueryOptions) ([]any, error) {
+	p, err := s.plan(q, opts)
+	if err != nil {
+		return nil, err
+	}
+	rows := []any{}
+	err = s.execute(p, opts, func(row map[string]any) bool {
+		rows = append(rows, row)
+		return true
+	})
+	return rows, err
+}
+
+// Query returns the rows matching q. The query is planned on the clustered
+// index or a non-clustered one, whichever reads the fewest entries, and runs on
+// a snapshot of the collection.
+func (c *Collection) Query(q Query) ([]any, error) {
+	return c.QueryWithOptions(q, QueryOptions{})
+}
+
+// QueryWithOptions returns the rows matching q, ordered, paged and projected as
+// opts asks. The planner prefers an index that returns the rows in order over
+// sorting them, and an index holding every field returned over looking up rows.
+func (c *Collection) QueryWithOptions(q Query, opts QueryOptions) ([]any, error) {
+	snap, err := c.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	return snap.QueryWithOptions(q, opts)
+}
@@ -0,0 +1,329 @@
+package fsdb
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// newQueryCollection returns a collection of orders with a composite index
+// whose second field is descending and a sparse index.
+func newQueryCollection(t *testing.T) (*Collection, []map[string]any) {
+	t.Helper()
+	db, err := NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: NewMemoryFileProvider()})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema := CollectionSchema{
+		Name: "orders",
+		Indexes: []IndexDefinition{
+			{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_customer_total", Keys: []IndexField{{Name: "customer"}, {Name: "total", Descending: true}}, PageSize: 4},
+			{Name: "ix_status", Keys: []IndexField{{Name: "status"}}, PageSize: 4, Sparse: true},
+		},
+	}
+	if err := db.CreateCollection(schema); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("orders")
+	customers := []string{"alice", "bob", "carol", "dave", "erin"}
+	var rows []map[string]any
+	for i := 0; i < 200; i++ {
+		row := map[string]any{"id": i, "customer": customers[i%5]}
+		if i%7 != 0 {
+			row["total"] = (i * 37) % 50
+		}
+		if i%10 == 0 {
+			row["status"] = "open"
+		} else if i%10 == 1 {
+			row["status"] = nil
+		}
+		if err := coll.Insert(row); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	return coll, rows
+}
+
+func TestQuery_Plan(t *testing.T) {
+	coll, _ := newQueryCollection(t)
+	snap, err := coll.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	tests := []struct {
+		q     Query
+		index string
+		r     string
+	}{
+		{Query{}, "pk", "[] []"},
+		{Eq("id", 5), "pk", "[5] [5]"},
+		{Ne("id", 5), "pk", "[] []"},
+		{Eq("customer", "bob"), "ix_customer_total", "[bob] [bob]"},
+		{And(Eq("customer", "bob"), Gte("total", 40)), "ix_customer_total", "[bob] [bob 40]"},
+		{And(Eq("customer", "bob"), Between("total", 10, 20)), "ix_customer_total", "[bob 20] [bob 10]"},
+		{And(Eq("customer", "bob"), Eq("id", 5)), "pk", "[5] [5]"},
+		{Eq("status", "open"), "ix_status", "[open] [open]"},
+		{Eq("status", nil), "pk", "[] []"},
+		{Or(Eq("customer", "bob"), Eq("id", 5)), "pk", "[] []"},
+		{Gt("id", 190), "pk", "[190] []"},
+		{Lt("id", 10), "pk", "[<nil>] [10]"},
+	}
+	for _, tt := range tests {
+		p, err := snap.plan(tt.q, QueryOptions{})
+		if err != nil {
+			t.Fatalf("plan(%+v) failed: %v", tt.q, err)
+		}
+		if p.index.index.indexDef.Name != tt.index || fmt.Sprint(p.r.Lower, " ", p.r.Upper) != tt.r {
+			t.Errorf("plan(%+v) reads %s %v %v, want %s %s", tt.q, p.index.index.indexDef.Name, p.r.Lower, p.r.Upper, tt.index, tt.r)
+		}
+	}
+}
+
+// randomQuery returns a random predicate tree over the fields of the orders.
+func randomQuery(rng *rand.Rand, depth int) Query {
+	fields := []string{"id", "customer", "total", "status", "missing"}
+	values := func() any {
+		switch rng.Intn(6) {
+		case 0:
+			return nil
+		case 1:
+			return []string{"alice", "bob", "erin", "open", "zed"}[rng.Intn(5)]
+		case 2:
+			return float64(rng.Intn(60)) + 0.5
+		}
+		return rng.Intn(60)
+	}
+	if depth > 0 && rng.Intn(3) == 0 {
+		var subs []Query
+		for range rng.Intn(3) + 1 {
+			subs = append(subs, randomQuery(rng, depth-1))
+		}
+		switch rng.Intn(4) {
+		case 0:
+			return Or(subs...)
+		case 1:
+			return Not(subs[0])
+		}
+		return And(subs...)
+	}
+	f := fields[rng.Intn(len(fields))]
+	switch rng.Intn(10) {
+	case 0:
+		return Eq(f, values())
+	case 1:
+		return Ne(f, values())
+	case 2:
+		return Gt(f, values())
+	case 3:
+		return Gte(f, values())
+	case 4:
+		return Lt(f, values())
+	case 5:
+		return Lte(f, values())
+	case 6:
+		return In(f, values(), values())
+	case 7:
+		return Between(f, values(), values())
+	case 8:
+		return Exists(f)
+	}
+	return And(Eq("customer", values()), randomQuery(rng, 0))
+}
+
+func TestQuery_MatchesScan(t *testing.T) {
+	coll, rows := newQueryCollection(t)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		q := randomQuery(rng, 2)
+		var want []int
+		for _, row := range rows {
+			if q.matches(row) {
+				want = append(want, row["id"].(int))
+			}
+		}
+		got, err := coll.Query(q)
+		if err != nil {
+			t.Fatalf("Query(%+v) failed: %v", q, err)
+		}
+		var ids []int
+		for _, row := range got {
+			ids = append(ids, row.(map[string]any)["id"].(int))
+		}
+		sort.Ints(ids)
+		if !equalInts(ids, want) {
+			t.Fatalf("Query(%+v) returned ids %v, want %v", q, ids, want)
+		}
+	}
+}
+
+func TestQuery_PlanOrder(t *testing.T) {
+	coll, _ := newQueryCollection(t)
+	snap, err := coll.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	tests := []struct {
+		q        Query
+		opts     QueryOptions
+		index    string
+		sorted   bool
+		reverse  bool
+		covering bool
+	}{
+		{Query{}, QueryOptions{OrderBy: []SortField{{Field: "id", Descending: true}}, Limit: 5}, "pk", true, true, false},
+		{Query{}, QueryOptions{OrderBy: []SortField{{Field: "total"}}}, "pk", false, false, false},
+		{Eq("customer", "bob"), QueryOptions{OrderBy: []SortField{{Field: "total", Descending: true}}}, "ix_customer_total", true, false, false},
+		{Eq("customer", "bob"), QueryOptions{OrderBy: []SortField{{Field: "customer"}, {Field: "total"}, {Field: "id"}}}, "ix_customer_total", false, false, false},
+		{Eq("customer", "bob"), QueryOptions{OrderBy: []SortField{{Field: "total"}, {Field: "id", Descending: true}}}, "ix_customer_total", true, true, false},
+		{Query{}, QueryOptions{OrderBy: []SortField{{Field: "customer"}}, Fields: []string{"id", "total"}}, "ix_customer_total", true, false, true},
+		{Gt("total", 10), QueryOptions{Fields: []string{"customer"}}, "pk", true, false, false},
+	}
+	for _, tt := range tests {
+		p, err := snap.plan(tt.q, tt.opts)
+		if err != nil {
+			t.Fatalf("plan(%+v, %+v) failed: %v", tt.q, tt.opts, err)
+		}
+		if p.index.index.indexDef.Name != tt.index || p.sorted != tt.sorted || p.reverse != tt.reverse || p.covering != tt.covering {
+			t.Errorf("plan(%v, %+v) reads %s sorted %v reverse %v covering %v, want %s %v %v %v", tt.q, tt.opts,
+				p.index.index.indexDef.Name, p.sorted, p.reverse, p.covering, tt.index, tt.sorted, tt.reverse, tt.covering)
+		}
+	}
+}
+
+// randomOptions returns random query options ending the order with the row key,
+// so that the order of the rows is total.
+func randomOptions(rng *rand.Rand) QueryOptions {
+	var opts QueryOptions
+	for _, f := range []string{"customer", "total", "status"} {
+		if rng.Intn(3) == 0 {
+			opts.OrderBy = append(opts.OrderBy, SortField{Field: f, Descending: rng.Intn(2) == 0})
+		}
+	}
+	if len(opts.OrderBy) > 0 || rng.Intn(2) == 0 {
+		opts.OrderBy = append(opts.OrderBy, SortField{Field: "id", Descending: rng.Intn(2) == 0})
+	}
+	if rng.Intn(2) == 0 {
+		opts.Skip = rng.Intn(30)
+	}
+	if rng.Intn(2) == 0 {
+		opts.Limit = rng.Intn(20) + 1
+	}
+	if rng.Intn(2) == 0 {
+		opts.Fields = [][]string{{"id"}, {"customer", "total"}, {"status", "id"}}[rng.Intn(3)]
+	}
+	if rng.Intn(4) == 0 {
+		opts.SortMemory = 512
+	}
+	return opts
+}
+
+func TestQuery_OptionsMatchSort(t *testing.T) {
+	coll, rows := newQueryCollection(t)
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 300; i++ {
+		q, opts := randomQuery(rng, 1), randomOptions(rng)
+		var want []map[string]any
+		for _, row := range rows {
+			if q.matches(row) {
+				want = append(want, row)
+			}
+		}
+		if len(opts.OrderBy) > 0 {
+			slices.SortFunc(want, func(a, b map[string]any) int {
+				for _, f := range opts.OrderBy {
+					if c := compareValues(a[f.Field], b[f.Field]); c != 0 && f.Descending {
+						return -c
+					} else if c != 0 {
+						return c
+					}
+				}
+				return 0
+			})
+		}
+		want = want[min(opts.Skip, len(want)):]
+		if opts.Limit > 0 {
+			want = want[:min(opts.Limit, len(want))]
+		}
+		for j, row := range want {
+			want[j] = project(row, opts.Fields)
+		}
+		got, err := coll.QueryWithOptions(q, opts)
+		if err != nil {
+			t.Fatalf("Query(%v, %+v) failed: %v", q, opts, err)
+		}
+		if len(opts.OrderBy) == 0 {
+			continue // Rows come in the order of the index chosen
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Query(%v, %+v) returned %d rows, want %d", q, opts, len(got), len(want))
+		}
+		for j := range got {
+			if !reflect.DeepEqual(got[j], want[j]) {
+				t.Fatalf("Query(%v, %+v) row %d = %v, want %v", q, opts, j, got[j], want[j])
+			}
+		}
+	}
+}
+
+func TestQuery_String(t *testing.T) {
+	q := Or(And(Eq("customer", "bob"), Between("total", 10, 20.5)), Not(Exists("total")), In("id", 1, nil), And(), Query{})
+	want := `((customer = "bob" AND total BETWEEN 10 AND 20.5) OR NOT total EXISTS OR id IN (1, null) OR TRUE OR TRUE)`
+	if got := q.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestQuery_PagesMatchQuery(t *testing.T) {
+	coll, _ := newQueryCollection(t)
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 200; i++ {
+		q, opts := randomQuery(rng, 1), randomOptions(rng)
+		opts.Skip, opts.Limit, opts.Fields = 0, 0, nil
+		all, err := coll.QueryWithOptions(q, opts)
+		if err != nil {
+			t.Fatalf("Query(%v, %+v) failed: %v", q, opts, err)
+		}
+		opts.Limit = rng.Intn(15) + 1
+		var paged []any
+		for pages := 0; ; pages++ {
+			page, err := coll.QueryPage(q, opts)
+			if err != nil {
+				t.Fatalf("QueryPage(%v, %+v) failed: %v", q, opts, err)
+			}
+			if len(page.Rows) > opts.Limit || (page.NextToken != "" && len(page.Rows) < opts.Limit) {
+				t.Fatalf("QueryPage(%v, %+v) returned %d rows and token %q", q, opts, len(page.Rows), page.NextToken)
+			}
+			paged = append(paged, page.Rows...)
+			if page.NextToken == "" {
+				break
+			}
+			if pages > len(all) {
+				t.Fatalf("QueryPage(%v, %+v) does not end", q, opts)
+			}
+			opts.PageToken = page.NextToken
+		}
+		ids := func(rows []any) []int {
+			var ids []int
+			for _, row := range rows {
+				ids = append(ids, row.(map[string]any)["id"].(int))
+			}
+			return ids
+		}
+		want, got := ids(all), ids(paged)
+		if len(opts.OrderBy) == 0 {
+			sort.Ints(want) // Rows come in the order of the index each plan chose
+			sort.Ints(got)
+		}
+		if !equalInts(got, want) {
+			t.Fatalf("pages of %v, %+v returned ids %v, want %v", q, opts, got, want)
+		}
+	}
+}
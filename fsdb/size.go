@@ -0,0 +1,40 @@
+package fsdb
+
+import "time"
+
+// estimateSize returns a rough estimate of the in-memory size of a value in bytes.
+// It is used for memory budgets, not for exact accounting.
+func estimateSize(v any) int {
+	switch val := v.(type) {
+	case nil:
+		return 8
+	case string:
+		return 16 + len(val)
+	case []byte:
+		return 24 + len(val)
+	case int, int64, float64, bool, int32, float32, uint, uint64:
+		return 8
+	case time.Time:
+		return 24
+	case []any:
+		size := 24
+		for _, e := range val {
+			size += 16 + estimateSize(e)
+		}
+		return size
+	case [][]any:
+		size := 24
+		for _, e := range val {
+			size += estimateSize(e)
+		}
+		return size
+	case map[string]any:
+		size := 48
+		for k, e := range val {
+			size += 16 + len(k) + 16 + estimateSize(e)
+		}
+		return size
+	default:
+		return 16
+	}
+}
@@ -0,0 +1,298 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+var errTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a transaction: inserts, updates and deletes on any number of
+// collections are buffered until Commit applies them atomically, as a single
+// record of the write-ahead log. Reads through the transaction see its own
+// buffered writes. A Tx is not safe for concurrent use.
+type Tx struct {
+	db   *Database
+	ops  []walOp
+	view *txView
+	done bool
+}
+
+// Begin starts a transaction.
+func (db *Database) Begin() *Tx {
+	return &Tx{db: db, view: newTxView()}
+}
+
+// Insert buffers the insertion of a row into a collection.
+func (tx *Tx) Insert(collectionName string, row map[string]any) error {
+	return tx.buffer(walOp{Collection: collectionName, Kind: walInsert, Row: maps.Clone(row)})
+}
+
+// Update buffers the replacement of oldRow by newRow in a collection.
+func (tx *Tx) Update(collectionName string, oldRow, newRow map[string]any) error {
+	return tx.buffer(walOp{Collection: collectionName, Kind: walUpdate, Row: maps.Clone(newRow), OldRow: maps.Clone(oldRow)})
+}
+
+// Delete buffers the deletion of a row from a collection.
+func (tx *Tx) Delete(collectionName string, row map[string]any) error {
+	return tx.buffer(walOp{Collection: collectionName, Kind: walDelete, Row: maps.Clone(row)})
+}
+
+// buffer validates op against the rows as the transaction sees them and
+// queues it for Commit.
+func (tx *Tx) buffer(op walOp) error {
+	if tx.done {
+		return errTxDone
+	}
+	coll, err := tx.db.GetCollection(op.Collection)
+	if err != nil {
+		return err
+	}
+	if _, _, err := tx.view.apply(coll, op); err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Find returns the rows of a collection whose clustered key equals (or is
+// prefixed by) key, in key order, including the transaction's buffered writes.
+// A nil key returns every row.
+func (tx *Tx) Find(collectionName string, key []any) ([]any, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+	coll, err := tx.db.GetCollection(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := coll.Find(key)
+	if err != nil {
+		return nil, err
+	}
+	return tx.view.merge(coll, key, rows), nil
+}
+
+// Rollback discards the buffered operations.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	tx.ops, tx.view = nil, nil
+	return nil
+}
+
+// Commit applies the buffered operations atomically: every collection involved
+// is locked, the operations are validated again against the current rows and
+// logged as one record, then applied. Should applying fail midway, e.g. on an
+// I/O error, the database refuses further reads, writes and checkpoints, so
+// that the partly applied operations are never seen; Close keeps the record in
+// the log and the operations are completed when the database is next opened.
+// A database without a write-ahead log cannot guarantee this.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return tx.db.wal.checkpointIfFull()
+}
+
+func (tx *Tx) commit() error {
+	db := tx.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	colls := map[string]*Collection{}
+	for _, op := range tx.ops {
+		coll, ok := db.collections[op.Collection]
+		if !ok {
+			return fmt.Errorf("%w: %s", errCollectionNotExist, op.Collection)
+		}
+		colls[op.Collection] = coll
+	}
+	// Lock in name order so that concurrent commits cannot deadlock.
+	for _, name := range slices.Sorted(maps.Keys(colls)) {
+		colls[name].mu.Lock()
+		defer colls[name].mu.Unlock()
+	}
+
+	view := newTxView()
+	ops := make([]walOp, 0, len(tx.ops))
+	for _, op := range tx.ops {
+		resolved, changed, err := view.apply(colls[op.Collection], op)
+		if err != nil {
+			return err
+		}
+		if changed {
+			ops = append(ops, resolved)
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return db.wal.apply(ops, func() error {
+		for _, op := range ops {
+			coll := colls[op.Collection]
+			var err error
+			switch op.Kind {
+			case walInsert:
+				err = coll.insert(op.Row)
+			case walUpdate:
+				err = coll.update(op.OldRow, op.Row)
+			case walDelete:
+				err = coll.delete(op.Row)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to apply %s on collection %s: %w", op.Kind, op.Collection, err)
+			}
+		}
+		return nil
+	})
+}
+
+// txView overlays the writes of a transaction on the committed rows. Reads of
+// committed rows go to the clustered index directly, so they are safe while
+// the collection is locked.
+type txView struct {
+	writes map[string][]txWrite // Buffered rows of each collection, sorted by clustered key
+}
+
+// txWrite is the state of a row after the buffered operations; a nil row marks
+// a deleted one.
+type txWrite struct {
+	key []any
+	row map[string]any
+}
+
+func newTxView() *txView {
+	return &txView{writes: map[string][]txWrite{}}
+}
+
+func clusteredOrder(coll *Collection) keyOrder {
+	return coll.clusteredIndex.indexDef.keyOrder()
+}
+
+// search finds the buffered write of a collection with the given clustered key,
+// or the position to insert it at.
+func (v *txView) search(coll *Collection, key []any) (int, bool) {
+	order := clusteredOrder(coll)
+	return slices.BinarySearchFunc(v.writes[coll.Schema.Name], key, func(w txWrite, key []any) int {
+		return order.compare(w.key, key)
+	})
+}
+
+// lookup returns the row of a collection with the given clustered key.
+func (v *txView) lookup(coll *Collection, key []any) (map[string]any, error) {
+	if i, ok := v.search(coll, key); ok {
+		return v.writes[coll.Schema.Name][i].row, nil
+	}
+	rows, err := coll.clusteredIndex.Search(key)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	row, _ := rows[0].(map[string]any)
+	return row, nil
+}
+
+// set records the state of the row with the given clustered key.
+func (v *txView) set(coll *Collection, key []any, row map[string]any) {
+	name := coll.Schema.Name
+	i, ok := v.search(coll, key)
+	if ok {
+		v.writes[name][i].row = row
+		return
+	}
+	v.writes[name] = slices.Insert(v.writes[name], i, txWrite{key: key, row: row})
+}
+
+// apply validates op as Collection.Insert, Update and Delete would and records
+// its effect. It returns op with the deleted and replaced rows read from the
+// view, so that every index entry of those rows is removed when it is applied,
+// and whether op changes anything: deleting a missing row does not.
+func (v *txView) apply(coll *Collection, op walOp) (walOp, bool, error) {
+	if coll.clusteredIndex == nil {
+		return op, false, errInvalidCollection
+	}
+	def := coll.clusteredIndex.indexDef
+	key := extractIndexKey(op.Row, def)
+	if op.Kind != walDelete {
+		if err := coll.clusteredIndex.checkKey(key); err != nil {
+			return op, false, err
+		}
+	}
+	current, err := v.lookup(coll, key)
+	if err != nil {
+		return op, false, err
+	}
+	switch op.Kind {
+	case walInsert:
+		if current != nil {
+			return op, false, fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
+		}
+		v.set(coll, key, op.Row)
+	case walUpdate:
+		oldKey := extractIndexKey(op.OldRow, def)
+		old := current
+		if compareKeys(oldKey, key) != 0 {
+			if current != nil {
+				return op, false, fmt.Errorf("duplicate key not allowed in clustered index: %#v", key)
+			}
+			if old, err = v.lookup(coll, oldKey); err != nil {
+				return op, false, err
+			}
+		}
+		if old == nil {
+			return op, false, fmt.Errorf("key not found: %#v", oldKey)
+		}
+		op.OldRow = old
+		v.set(coll, oldKey, nil)
+		v.set(coll, key, op.Row)
+	case walDelete:
+		if current == nil {
+			return op, false, nil
+		}
+		op.Row = current
+		v.set(coll, key, nil)
+	}
+	return op, true, nil
+}
+
+// merge applies the view to rows read from a collection for key.
+func (v *txView) merge(coll *Collection, key []any, rows []any) []any {
+	writes := v.writes[coll.Schema.Name]
+	if len(writes) == 0 {
+		return rows
+	}
+	def := coll.clusteredIndex.indexDef
+	order := clusteredOrder(coll)
+	r := KeyRange{}
+	if key != nil {
+		r = ExactRange(key)
+	}
+	merged := make([]any, 0, len(rows))
+	for _, value := range rows {
+		row, _ := value.(map[string]any)
+		rowKey := extractIndexKey(row, def)
+		if _, ok := v.search(coll, rowKey); !ok {
+			merged = append(merged, value)
+		}
+	}
+	for _, w := range writes {
+		if w.row != nil && r.aboveLower(order, w.key) && r.belowUpper(order, w.key) {
+			merged = append(merged, w.row)
+		}
+	}
+	slices.SortStableFunc(merged, func(a, b any) int {
+		return order.compare(extractIndexKey(a.(map[string]any), def), extractIndexKey(b.(map[string]any), def))
+	})
+	return merged
+}
@@ -0,0 +1,215 @@
+package fsdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func openShop(t *testing.T, dir string, fp IFileProvider) *Database {
+	t.Helper()
+	db, err := NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: fp})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	schemas := []CollectionSchema{
+		{Name: "stock", Indexes: []IndexDefinition{{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "sku"}}, PageSize: 4}}},
+		{Name: "orders", Indexes: []IndexDefinition{
+			{Name: "pk", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_sku", Keys: []IndexField{{Name: "sku"}}, PageSize: 4},
+		}},
+	}
+	for _, schema := range schemas {
+		if err := db.EnsureCreatedCollection(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// placeOrder inserts an order and takes its quantity off the stock.
+func placeOrder(tx *Tx, id int, sku string, qty int) error {
+	rows, err := tx.Find("stock", []any{sku})
+	if err != nil {
+		return err
+	}
+	if len(rows) != 1 {
+		return errors.New("unknown sku")
+	}
+	item := rows[0].(map[string]any)
+	left := item["qty"].(int) - qty
+	if left < 0 {
+		return errors.New("out of stock")
+	}
+	if err := tx.Update("stock", item, map[string]any{"sku": sku, "qty": left}); err != nil {
+		return err
+	}
+	return tx.Insert("orders", map[string]any{"id": id, "sku": sku, "qty": qty})
+}
+
+func TestTx_CommitAndRollback(t *testing.T) {
+	db := openShop(t, "/shop", NewMemoryFileProvider())
+	defer db.Close()
+	stock, _ := db.GetCollection("stock")
+	orders, _ := db.GetCollection("orders")
+	if err := stock.Insert(map[string]any{"sku": "apple", "qty": 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	for id := 1; id <= 2; id++ {
+		if err := placeOrder(tx, id, "apple", 2); err != nil {
+			t.Fatalf("order %d: %v", id, err)
+		}
+	}
+	if err := placeOrder(tx, 3, "apple", 2); err == nil {
+		t.Fatal("expected the transaction to see its own stock updates")
+	}
+	if rows, _ := tx.Find("orders", nil); len(rows) != 2 {
+		t.Errorf("transaction sees %d orders, want 2", len(rows))
+	}
+	if rows, _ := orders.Find(nil); len(rows) != 0 {
+		t.Errorf("uncommitted orders are visible: %v", rows)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if rows, _ := stock.Find([]any{"apple"}); len(rows) != 1 || rows[0].(map[string]any)["qty"] != 1 {
+		t.Errorf("stock after commit: %v", rows)
+	}
+	if rows, _ := orders.FindByIndex("ix_sku", []any{"apple"}); len(rows) != 2 {
+		t.Errorf("expected both orders in the secondary index, got %v", rows)
+	}
+	if err := tx.Insert("orders", map[string]any{"id": 9}); !errors.Is(err, errTxDone) {
+		t.Errorf("expected errTxDone after Commit, got %v", err)
+	}
+
+	tx = db.Begin()
+	if err := placeOrder(tx, 3, "apple", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete("orders", map[string]any{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ := tx.Find("orders", nil); len(rows) != 2 || rows[0].(map[string]any)["id"] != 2 || rows[1].(map[string]any)["id"] != 3 {
+		t.Errorf("transaction sees orders %v, want 2 and 3", rows)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := orders.Count(); count != 2 {
+		t.Errorf("rolled back changes were applied: %d orders", count)
+	}
+	if err := tx.Commit(); !errors.Is(err, errTxDone) {
+		t.Errorf("expected errTxDone after Rollback, got %v", err)
+	}
+}
+
+func TestTx_CommitRevalidates(t *testing.T) {
+	db := openShop(t, "/shop", NewMemoryFileProvider())
+	defer db.Close()
+	orders, _ := db.GetCollection("orders")
+
+	tx := db.Begin()
+	if err := tx.Insert("orders", map[string]any{"id": 1, "sku": "pear"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Insert("orders", map[string]any{"id": 2, "sku": "pear"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.Insert(map[string]any{"id": 2, "sku": "plum"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("expected the conflicting insert to fail the commit")
+	}
+	if rows, _ := orders.Find(nil); len(rows) != 1 || rows[0].(map[string]any)["sku"] != "plum" {
+		t.Errorf("a failed commit applied changes: %v", rows)
+	}
+}
+
+func TestTx_CrashDuringCommit(t *testing.T) {
+	for n := 1; ; n++ {
+		dir := filepath.Join(t.TempDir(), "shop")
+		fp := &FileProvider{}
+		db := openShop(t, dir, fp)
+		stock, _ := db.GetCollection("stock")
+		if err := stock.Insert(map[string]any{"sku": "apple", "qty": 5}); err != nil {
+			t.Fatal(err)
+		}
+		tx := db.Begin()
+		if err := placeOrder(tx, 1, "apple", 3); err != nil {
+			t.Fatal(err)
+		}
+		fp.failStep = crashAt(n, stepWritten)
+		err := tx.Commit()
+		if err == nil {
+			db.Close()
+			break
+		}
+		if !errors.Is(err, errCrashed) {
+			t.Fatalf("Commit failed: %v", err)
+		}
+
+		db = openShop(t, dir, &FileProvider{})
+		stock, _ = db.GetCollection("stock")
+		orders, _ := db.GetCollection("orders")
+		rows, _ := stock.Find([]any{"apple"})
+		if len(rows) != 1 || rows[0].(map[string]any)["qty"] != 2 {
+			t.Errorf("write %d: stock after recovery is %v", n, rows)
+		}
+		if rows, _ := orders.FindByIndex("ix_sku", []any{"apple"}); len(rows) != 1 {
+			t.Errorf("write %d: orders after recovery are %v", n, rows)
+		}
+		db.Close()
+	}
+}
+
+func TestTx_FailedCommitIsCompleted(t *testing.T) {
+	errDiskFull := errors.New("disk full")
+	for n := 1; ; n++ {
+		dir := filepath.Join(t.TempDir(), "shop")
+		fp := &FileProvider{}
+		db := openShop(t, dir, fp)
+		stock, _ := db.GetCollection("stock")
+		orders, _ := db.GetCollection("orders")
+		if err := stock.Insert(map[string]any{"sku": "apple", "qty": 5}); err != nil {
+			t.Fatal(err)
+		}
+		tx := db.Begin()
+		if err := placeOrder(tx, 1, "apple", 3); err != nil {
+			t.Fatal(err)
+		}
+		fp.failStep = failAt(n, stepWritten, errDiskFull)
+		err := tx.Commit()
+		if err == nil {
+			db.Close()
+			break
+		}
+		if !errors.Is(err, errDiskFull) {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		fp.failStep = nil
+		if _, err := stock.Find([]any{"apple"}); !errors.Is(err, errWALFailed) {
+			t.Errorf("write %d: reading the stock after the failed commit = %v", n, err)
+		}
+		if _, err := orders.FindByIndex("ix_sku", []any{"apple"}); !errors.Is(err, errWALFailed) {
+			t.Errorf("write %d: reading the orders after the failed commit = %v", n, err)
+		}
+		if err := db.Close(); !errors.Is(err, errWALFailed) {
+			t.Errorf("write %d: Close after the failed commit = %v", n, err)
+		}
+
+		db = openShop(t, dir, &FileProvider{})
+		stock, _ = db.GetCollection("stock")
+		orders, _ = db.GetCollection("orders")
+		rows, _ := stock.Find([]any{"apple"})
+		if len(rows) != 1 || rows[0].(map[string]any)["qty"] != 2 {
+			t.Errorf("write %d: stock after reopening is %v", n, rows)
+		}
+		if rows, _ := orders.FindByIndex("ix_sku", []any{"apple"}); len(rows) != 1 {
+			t.Errorf("write %d: orders after reopening are %v", n, rows)
+		}
+		db.Close()
+	}
+}
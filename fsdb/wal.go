@@ -0,0 +1,329 @@
+package fsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+const (
+	walFileName  = "wal.log"
+	walMagic     = "FSDBWAL1"
+	walRecHeader = 8 // length:u32, crc32:u32
+
+	// DefaultWALCheckpointBytes is the log size that triggers a checkpoint.
+	DefaultWALCheckpointBytes = 4 << 20
+)
+
+// WALOptions configures the write-ahead log of a database.
+type WALOptions struct {
+	Disabled        bool  // Apply mutations without logging them first
+	CheckpointBytes int64 // Log size that triggers a checkpoint; DefaultWALCheckpointBytes when zero
+}
+
+// Logical operations recorded in the write-ahead log.
+const (
+	walInsert   = "insert"
+	walUpdate   = "update"
+	walDelete   = "delete"
+	walBulkLoad = "bulk_load"
+)
+
+// walOp is a logical mutation of a collection. Row is the inserted, updated or
+// deleted row; OldRow is the row replaced by an update.
+type walOp struct {
+	Collection string
+	Kind       string
+	Row        map[string]any
+	OldRow     map[string]any
+}
+
+// walRecord is a group of operations logged and applied together.
+type walRecord struct {
+	LSN int64
+	Ops []walOp
+}
+
+// errWALFailed is returned by a database that logged operations it then failed
+// to apply.
+var errWALFailed = errors.New("logged operations failed to apply; reopen the database to redo them")
+
+// writeAheadLog records the logical operations of a database before they are
+// applied to the index files. Each record holds operations applied together;
+// its checksum detects a record torn by a crash. After a crash, the operations
+// logged since the last checkpoint are replayed; a checkpoint makes all applied
+// operations durable in the index files and empties the log.
+//
+// Operations that fail to apply after being logged may have changed some
+// indexes and not others. The log then stops the database as a crash would:
+// it refuses further operations and checkpoints, so the record stays in the
+// log, and the database is repaired by replaying it when next opened.
+type writeAheadLog struct {
+	mu       sync.RWMutex // Shared by operations between logging and applying, exclusive for checkpoints
+	fileMu   sync.Mutex   // Serializes appends
+	file     RandomAccessFile
+	size     int64
+	nextLSN  int64
+	sync     bool        // fsync every record
+	limit    int64       // Size that triggers a checkpoint
+	recovery []walRecord // Records found when the log was opened
+	failed   error       // Set once logged operations fail to apply; guarded by fileMu
+
+	// requestCheckpoint checkpoints the database owning the log.
+	requestCheckpoint func() error
+}
+
+// openWAL opens the write-ahead log in dir, reading the records left by the
+// previous run. A torn record at the end of the log is dropped.
+func openWAL(files IFileProvider, dir string, opts WALOptions) (*writeAheadLog, error) {
+	ra, ok := files.(IRandomAccessFileProvider)
+	if !ok {
+		return nil, errors.New("the write-ahead log requires a file provider implementing IRandomAccessFileProvider")
+	}
+	f, err := ra.OpenFile(dir, walFileName)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{file: f, nextLSN: 1, limit: opts.CheckpointBytes, sync: true}
+	if w.limit <= 0 {
+		w.limit = DefaultWALCheckpointBytes
+	}
+	if fp, ok := files.(*FileProvider); ok && fp.durability() == DurabilityNone {
+		w.sync = false
+	}
+	if err := w.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read the write-ahead log: %w", err)
+	}
+	return w, nil
+}
+
+// load reads the records of the log and positions it after the last whole one.
+func (w *writeAheadLog) load() error {
+	size, err := w.file.Size()
+	if err != nil {
+		return err
+	}
+	if size < int64(len(walMagic)) {
+		return w.reset()
+	}
+	magic := make([]byte, len(walMagic))
+	if _, err := w.file.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	if string(magic) != walMagic {
+		return errors.New("not a write-ahead log")
+	}
+	pos := int64(len(walMagic))
+	header := make([]byte, walRecHeader)
+	for pos+walRecHeader <= size {
+		if _, err := w.file.ReadAt(header, pos); err != nil {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(header))
+		if pos+walRecHeader+n > size {
+			break
+		}
+		payload := make([]byte, n)
+		if _, err := w.file.ReadAt(payload, pos+walRecHeader); err != nil && err != io.EOF {
+			return err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			break
+		}
+		w.recovery = append(w.recovery, rec)
+		w.nextLSN = rec.LSN + 1
+		pos += walRecHeader + n
+	}
+	if pos < size {
+		if err := w.file.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	w.size = pos
+	return nil
+}
+
+// reset empties the log, leaving only its header.
+func (w *writeAheadLog) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.WriteAt([]byte(walMagic), 0); err != nil {
+		return err
+	}
+	w.size = int64(len(walMagic))
+	if w.sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// append writes a record holding ops to the end of the log.
+func (w *writeAheadLog) append(ops []walOp) error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	payload, err := encodeWALRecord(walRecord{LSN: w.nextLSN, Ops: ops})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, walRecHeader, walRecHeader+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+	if _, err := w.file.WriteAt(buf, w.size); err != nil {
+		return err
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	w.size += int64(len(buf))
+	w.nextLSN++
+	return nil
+}
+
+// apply logs ops and then runs fn to apply them. Checkpoints wait for fn to
+// return. Should fn fail, the log is marked failed; see writeAheadLog. A nil
+// log just runs fn.
+func (w *writeAheadLog) apply(ops []walOp, fn func() error) error {
+	if w == nil {
+		return fn()
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if err := w.failure(); err != nil {
+		return err
+	}
+	if err := w.append(ops); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		w.fileMu.Lock()
+		if w.failed == nil {
+			w.failed = err
+		}
+		w.fileMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// failure returns errWALFailed, wrapping the cause, once logged operations
+// have failed to apply. A nil log never fails.
+func (w *writeAheadLog) failure() error {
+	if w == nil {
+		return nil
+	}
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	if w.failed == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", errWALFailed, w.failed)
+}
+
+// checkpointIfFull checkpoints the database once the log has outgrown its
+// limit. Callers must not hold locks a checkpoint takes.
+func (w *writeAheadLog) checkpointIfFull() error {
+	if w == nil {
+		return nil
+	}
+	w.fileMu.Lock()
+	full := w.size >= w.limit
+	w.fileMu.Unlock()
+	if !full {
+		return nil
+	}
+	return w.checkpointDatabase()
+}
+
+// checkpointDatabase checkpoints the database owning the log.
+func (w *writeAheadLog) checkpointDatabase() error {
+	if w == nil || w.requestCheckpoint == nil {
+		return nil
+	}
+	return w.requestCheckpoint()
+}
+
+// checkpoint waits for the operations being applied, runs flush to make every
+// applied operation durable in the index files and empties the log. A failed
+// log is kept for the next open to replay, without running flush. A nil log
+// just runs flush.
+func (w *writeAheadLog) checkpoint(flush func() error) error {
+	if w == nil {
+		return flush()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.failure(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	w.recovery = nil
+	return w.reset()
+}
+
+// Close closes the log file.
+func (w *writeAheadLog) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+func encodeWALRecord(rec walRecord) ([]byte, error) {
+	ops := make([]any, len(rec.Ops))
+	for i, op := range rec.Ops {
+		m := map[string]any{"collection": op.Collection, "kind": op.Kind}
+		if op.Row != nil {
+			m["row"] = op.Row
+		}
+		if op.OldRow != nil {
+			m["old_row"] = op.OldRow
+		}
+		ops[i] = m
+	}
+	return appendValue(nil, []any{rec.LSN, ops})
+}
+
+func decodeWALRecord(data []byte) (walRecord, error) {
+	r := &valueReader{data: data}
+	v, err := r.value()
+	if err != nil {
+		return walRecord{}, err
+	}
+	fields, ok := v.([]any)
+	if !ok || len(fields) != 2 {
+		return walRecord{}, errors.New("malformed write-ahead log record")
+	}
+	lsn, ok1 := fields[0].(int64)
+	list, ok2 := fields[1].([]any)
+	if !ok1 || !ok2 {
+		return walRecord{}, errors.New("malformed write-ahead log record")
+	}
+	rec := walRecord{LSN: lsn, Ops: make([]walOp, len(list))}
+	for i, item := range list {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return walRecord{}, errors.New("malformed write-ahead log operation")
+		}
+		rec.Ops[i].Collection, _ = m["collection"].(string)
+		rec.Ops[i].Kind, _ = m["kind"].(string)
+		rec.Ops[i].Row, _ = m["row"].(map[string]any)
+		rec.Ops[i].OldRow, _ = m["old_row"].(map[string]any)
+	}
+	return rec, nil
+}
@@ -0,0 +1,392 @@
+package fsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dannyswat/fsdb/datatype"
+)
+
+func walTestSchema() CollectionSchema {
+	return CollectionSchema{
+		Name:           "notes",
+		EnableFullText: true,
+		Columns: []ColumnDefinition{
+			{FieldName: "id", DataType: datatype.Integer},
+			{FieldName: "title", DataType: datatype.String, FullText: true},
+		},
+		Indexes: []IndexDefinition{
+			{Name: "pk_id", IsClustered: true, Keys: []IndexField{{Name: "id"}}, PageSize: 4},
+			{Name: "ix_title", Keys: []IndexField{{Name: "title"}}, PageSize: 4},
+		},
+	}
+}
+
+func TestWAL_RecoverInterruptedMutations(t *testing.T) {
+	mutations := map[string]func(*Collection) error{
+		"insert": func(c *Collection) error {
+			return c.Insert(map[string]any{"id": 100, "title": "zebra crossing"})
+		},
+		"update": func(c *Collection) error {
+			return c.Update(map[string]any{"id": 3, "title": "note 3"}, map[string]any{"id": 100, "title": "zebra crossing"})
+		},
+		"delete": func(c *Collection) error {
+			return c.Delete(map[string]any{"id": 3, "title": "note 3"})
+		},
+	}
+	for kind, mutate := range mutations {
+		for n := 1; ; n++ {
+			dir := filepath.Join(t.TempDir(), "db")
+			fp := &FileProvider{}
+			db, err := NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: fp})
+			if err != nil {
+				t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+			}
+			if err := db.CreateCollection(walTestSchema()); err != nil {
+				t.Fatalf("CreateCollection failed: %v", err)
+			}
+			coll, _ := db.GetCollection("notes")
+			for i := 0; i < 10; i++ {
+				if err := coll.Insert(map[string]any{"id": i, "title": fmt.Sprintf("note %d", i)}); err != nil {
+					t.Fatalf("Insert failed: %v", err)
+				}
+			}
+			fp.failStep = crashAt(n, stepWritten)
+			err = mutate(coll)
+			if err == nil {
+				db.Close()
+				break // every write of the mutation has been interrupted once
+			}
+			if !errors.Is(err, errCrashed) {
+				t.Fatalf("%s: %v", kind, err)
+			}
+
+			// Restart without closing the crashed database.
+			db, err = NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: &FileProvider{}})
+			if err != nil {
+				t.Fatalf("%s, write %d: recovery failed: %v", kind, n, err)
+			}
+			reports, err := db.Verify(VerifyOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range reports {
+				if !r.OK() {
+					t.Errorf("%s, write %d: %s has issues after recovery: %v", kind, n, r.Index, r.Issues)
+				}
+			}
+			coll, _ = db.GetCollection("notes")
+			wantCount, wantNew := int64(10), kind != "delete"
+			switch kind {
+			case "insert":
+				wantCount = 11
+			case "delete":
+				wantCount = 9
+			}
+			if count, err := coll.Count(); err != nil || count != wantCount {
+				t.Errorf("%s, write %d: %d rows after recovery, want %d (%v)", kind, n, count, wantCount, err)
+			}
+			rows, _ := coll.FindByIndex("ix_title", []any{"zebra crossing"})
+			docs, _ := coll.SearchFullText("zebra")
+			if got := len(rows) == 1 && slices.Contains(docs, DocumentID("100")); got != wantNew {
+				t.Errorf("%s, write %d: new row indexed = %v (rows %v, docs %v)", kind, n, got, rows, docs)
+			}
+			if rows, _ := coll.Find([]any{3}); (len(rows) == 1) != (kind == "insert") {
+				t.Errorf("%s, write %d: row 3 is %v", kind, n, rows)
+			}
+			if docs, _ := coll.SearchFullText("note 3"); slices.Contains(docs, DocumentID("3")) != (kind == "insert") {
+				t.Errorf("%s, write %d: row 3 full-text entry is %v", kind, n, docs)
+			}
+			db.Close()
+		}
+	}
+}
+
+// failAt returns a fault that fails the n-th file write at step with err, as an
+// I/O error would, leaving the process running.
+func failAt(n int, step writeStep, err error) func(writeStep, string) error {
+	count := 0
+	return func(s writeStep, _ string) error {
+		if s == step {
+			if count++; count == n {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestWAL_FailedApplyIsRedone(t *testing.T) {
+	errDiskFull := errors.New("disk full")
+	for _, writeBack := range []bool{false, true} {
+		for n := 1; ; n++ {
+			dir := filepath.Join(t.TempDir(), "db")
+			fp := &FileProvider{}
+			cache := NodeCacheOptions{MaxEntries: 8, WriteBack: writeBack}
+			db, err := NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: fp, NodeCache: &cache})
+			if err != nil {
+				t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+			}
+			if err := db.CreateCollection(walTestSchema()); err != nil {
+				t.Fatalf("CreateCollection failed: %v", err)
+			}
+			coll, _ := db.GetCollection("notes")
+			for i := 0; i < 10; i++ {
+				if err := coll.Insert(map[string]any{"id": i, "title": fmt.Sprintf("note %d", i)}); err != nil {
+					t.Fatalf("Insert failed: %v", err)
+				}
+			}
+			fp.failStep = failAt(n, stepWritten, errDiskFull)
+			err = coll.Update(map[string]any{"id": 3, "title": "note 3"}, map[string]any{"id": 100, "title": "zebra crossing"})
+			if err == nil {
+				db.Close()
+				break // every write of the update has failed once
+			}
+			if !errors.Is(err, errDiskFull) {
+				t.Fatalf("write %d: %v", n, err)
+			}
+			fp.failStep = nil
+			if db.wal.failure() == nil {
+				// A dirty node evicted while validating the update failed to
+				// write, so the update was rejected before being logged.
+				db.Close()
+				continue
+			}
+
+			// The half-applied update is neither read, built upon nor checkpointed.
+			if err := coll.Insert(map[string]any{"id": 50, "title": "later"}); !errors.Is(err, errWALFailed) {
+				t.Errorf("write %d: Insert after the failure = %v", n, err)
+			}
+			if _, err := coll.Find([]any{100}); !errors.Is(err, errWALFailed) {
+				t.Errorf("write %d: Find after the failure = %v", n, err)
+			}
+			if _, err := coll.Count(); !errors.Is(err, errWALFailed) {
+				t.Errorf("write %d: Count after the failure = %v", n, err)
+			}
+			if err := db.Flush(); !errors.Is(err, errWALFailed) {
+				t.Errorf("write %d: Flush after the failure = %v", n, err)
+			}
+			if err := db.Close(); !errors.Is(err, errWALFailed) {
+				t.Errorf("write %d: Close after the failure = %v", n, err)
+			}
+
+			db, err = NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: &FileProvider{}})
+			if err != nil {
+				t.Fatalf("write %d: reopen failed: %v", n, err)
+			}
+			reports, err := db.Verify(VerifyOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range reports {
+				if !r.OK() {
+					t.Errorf("write %d: %s has issues after reopening: %v", n, r.Index, r.Issues)
+				}
+			}
+			coll, _ = db.GetCollection("notes")
+			if count, err := coll.Count(); err != nil || count != 10 {
+				t.Errorf("write %d: %d rows after reopening, want 10 (%v)", n, count, err)
+			}
+			if count, err := coll.CountByIndexRange("ix_title", KeyRange{}); err != nil || count != 10 {
+				t.Errorf("write %d: %d title entries after reopening, want 10 (%v)", n, count, err)
+			}
+			rows, _ := coll.FindByIndex("ix_title", []any{"zebra crossing"})
+			old, _ := coll.FindByIndex("ix_title", []any{"note 3"})
+			if moved, _ := coll.Find([]any{100}); len(rows) != 1 || len(old) != 0 || len(moved) != 1 {
+				t.Errorf("write %d: update not redone: new title %v, old title %v, row %v", n, rows, old, moved)
+			}
+			if err := db.Close(); err != nil {
+				t.Errorf("write %d: Close failed: %v", n, err)
+			}
+		}
+	}
+}
+
+func TestWAL_CheckpointedRowsSurviveSplitCrash(t *testing.T) {
+	// The rows are checkpointed by Close, so only the index files hold them.
+	base := filepath.Join(t.TempDir(), "base")
+	db, err := NewDatabaseWithOptions(base, DatabaseOptions{FileProvider: &FileProvider{Durability: DurabilityNone}})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	if err := db.CreateCollection(walTestSchema()); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("notes")
+	for i := 0; i < 16; i += 2 {
+		if err := coll.Insert(map[string]any{"id": i, "title": fmt.Sprintf("note %d", i)}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for n := 1; ; n++ {
+		dir := filepath.Join(t.TempDir(), "db")
+		if err := os.CopyFS(dir, os.DirFS(base)); err != nil {
+			t.Fatal(err)
+		}
+		fp := &FileProvider{Durability: DurabilityNone}
+		db, err := NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: fp})
+		if err != nil {
+			t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+		}
+		crash := crashAt(n, stepWritten)
+		fp.failStep = func(step writeStep, tmpPath string) error {
+			if !strings.Contains(tmpPath, "pk_id") {
+				return nil
+			}
+			return crash(step, tmpPath)
+		}
+		coll, _ := db.GetCollection("notes")
+		crashed := false
+		for i := 1; i < 16 && !crashed; i += 2 {
+			err := coll.Insert(map[string]any{"id": i, "title": fmt.Sprintf("note %d", i)})
+			if err != nil && !errors.Is(err, errCrashed) {
+				t.Fatalf("write %d: Insert(%d) failed: %v", n, i, err)
+			}
+			crashed = err != nil
+		}
+		if !crashed {
+			db.Close()
+			break // every write to the clustered index has been interrupted once
+		}
+
+		// Restart without closing the crashed database.
+		db, err = NewDatabaseWithOptions(dir, DatabaseOptions{FileProvider: &FileProvider{Durability: DurabilityNone}})
+		if err != nil {
+			t.Fatalf("write %d: recovery failed: %v", n, err)
+		}
+		coll, _ = db.GetCollection("notes")
+		for i := 0; i < 16; i += 2 {
+			if rows, err := coll.Find([]any{i}); err != nil || len(rows) != 1 {
+				t.Errorf("write %d: checkpointed row %d lost after recovery: %v, %v", n, i, rows, err)
+			}
+		}
+		reports, err := db.Verify(VerifyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range reports {
+			if !r.OK() {
+				t.Errorf("write %d: %s has issues after recovery: %v", n, r.Index, r.Issues)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestWAL_RejectedOperationsAreNotLogged(t *testing.T) {
+	files := NewMemoryFileProvider()
+	db, err := NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: files})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	if err := db.CreateCollection(walTestSchema()); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("notes")
+	if err := coll.Insert(map[string]any{"id": 1, "title": "one"}); err != nil {
+		t.Fatal(err)
+	}
+	size := db.wal.size
+	if err := coll.Insert(map[string]any{"id": 1, "title": "again"}); err == nil {
+		t.Error("expected a duplicate key error")
+	}
+	if err := coll.Update(map[string]any{"id": 2}, map[string]any{"id": 2, "title": "two"}); err == nil {
+		t.Error("expected updating a missing row to fail")
+	}
+	if db.wal.size != size {
+		t.Errorf("rejected operations grew the log from %d to %d bytes", size, db.wal.size)
+	}
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	files := NewMemoryFileProvider()
+	db, err := NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: files, WAL: &WALOptions{CheckpointBytes: 1024}})
+	if err != nil {
+		t.Fatalf("NewDatabaseWithOptions failed: %v", err)
+	}
+	if err := db.CreateCollection(walTestSchema()); err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	coll, _ := db.GetCollection("notes")
+	for i := 0; i < 200; i++ {
+		if err := coll.Insert(map[string]any{"id": i, "title": fmt.Sprintf("note %d", i)}); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if db.wal.size >= 1024 {
+			t.Fatalf("log reached %d bytes without a checkpoint", db.wal.size)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	data, err := files.ReadFile("/db", walFileName)
+	if err != nil || string(data) != walMagic {
+		t.Errorf("expected an empty log after Flush, got %d bytes, %v", len(data), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabaseWithOptions("/db", DatabaseOptions{FileProvider: files, WAL: &WALOptions{Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	coll, _ = db.GetCollection("notes")
+	if count, _ := coll.Count(); count != 200 {
+		t.Errorf("expected 200 rows, got %d", count)
+	}
+	if err := coll.Insert(map[string]any{"id": 200, "title": "unlogged"}); err != nil {
+		t.Fatalf("Insert without a log failed: %v", err)
+	}
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	files := NewMemoryFileProvider()
+	if err := files.CreateDirectory("/db"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openWAL(files, "/db", WALOptions{})
+	if err != nil {
+		t.Fatalf("openWAL failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.append([]walOp{{Collection: "c", Kind: walInsert, Row: map[string]any{"id": i}}}); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+	whole := w.size
+	if err := w.append([]walOp{{Collection: "c", Kind: walDelete, Row: map[string]any{"id": 0}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.file.Truncate(w.size - 3); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w, err = openWAL(files, "/db", WALOptions{})
+	if err != nil {
+		t.Fatalf("reopening the log failed: %v", err)
+	}
+	defer w.Close()
+	if len(w.recovery) != 3 || w.size != whole || w.nextLSN != 4 {
+		t.Fatalf("recovered %d records, size %d, next LSN %d; want 3, %d, 4", len(w.recovery), w.size, w.nextLSN, whole)
+	}
+	for i, rec := range w.recovery {
+		if op := rec.Ops[0]; rec.LSN != int64(i+1) || op.Kind != walInsert || op.Row["id"] != i {
+			t.Errorf("record %d = %+v", i, rec)
+		}
+	}
+	if size, _ := w.file.Size(); size != whole {
+		t.Errorf("torn record left in the file: %d bytes, want %d", size, whole)
+	}
+}